@@ -4,11 +4,22 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/url"
+	"path"
+	"regexp"
 	"sort"
+	"strings"
+	"time"
 
+	"filippo.io/age"
+	"filippo.io/age/agessh"
 	sdk "github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
 const (
@@ -16,12 +27,138 @@ const (
 	fnConfigVersion    = "v1alpha1"
 	fnConfigAPIVersion = fnConfigGroup + "/" + fnConfigVersion
 	fnConfigKind       = "UpdateKSopsSecrets"
+
+	listAPIVersion = "v1"
+	listKind       = "List"
+
+	internalAnnotationPrefix = "internal.config.kubernetes.io/"
+
+	// OutputPatternName is replaced with the normalized secret name
+	OutputPatternName = "{name}"
+	// OutputPatternKey is replaced with the normalized secret key
+	OutputPatternKey = "{key}"
+
+	// SopsConfigRecipientsMerge adds the .sops.yaml recipients to the configured ones
+	SopsConfigRecipientsMerge = "merge"
+	// SopsConfigRecipientsOverride replaces the configured recipients with the
+	// .sops.yaml ones when a creation rule matches
+	SopsConfigRecipientsOverride = "override"
+
+	// SecretPrecedenceOrder reads the ambiguous keys from the first secret in
+	// the reference list order with a warning
+	SecretPrecedenceOrder = "order"
+	// SecretPrecedenceError fails the ambiguous keys
+	SecretPrecedenceError = "error"
+	// SecretPrecedenceExplicit requires every item to pin its source secret
+	SecretPrecedenceExplicit = "explicit"
 )
 
 type UpdateKSopsSecretSpec struct {
-	Type       string   `json:"type,omitempty" yaml:"type,omitempty"`
-	References []string `json:"references" yaml:"references"`
-	Items      []string `json:"items" yaml:"items"`
+	Type       string                      `json:"type,omitempty" yaml:"type,omitempty"`
+	References []string                    `json:"references" yaml:"references"`
+	Items      []UpdateKSopsSecretItem     `json:"items" yaml:"items"`
+	Selectors  []UpdateKSopsSecretSelector `json:"selectors,omitempty" yaml:"selectors,omitempty"`
+	Precedence string                      `json:"precedence,omitempty" yaml:"precedence,omitempty"`
+}
+
+// UpdateKSopsSecretItem is the secret item, it could be written as the key
+// only or as a mapping with the source and the sops options overrides
+type UpdateKSopsSecretItem struct {
+	Key  string                       `json:"key" yaml:"key"`
+	From *UpdateKSopsSecretItemSource `json:"from,omitempty" yaml:"from,omitempty"`
+	Sops *UpdateKSopsSopsOptions      `json:"sops,omitempty" yaml:"sops,omitempty"`
+}
+
+// UpdateKSopsSecretItemSource is where the item value is read from, the
+// secret pins the reference or the provider command is run instead, and the
+// key renames the source key, they default to any references and the item key
+type UpdateKSopsSecretItemSource struct {
+	Secret   string `json:"secret,omitempty" yaml:"secret,omitempty"`
+	Provider string `json:"provider,omitempty" yaml:"provider,omitempty"`
+	Key      string `json:"key,omitempty" yaml:"key,omitempty"`
+}
+
+// UpdateKSopsSecretSelector selects the items by the keys of the referenced
+// secret, all the keys or the keys matched by the include globs or regex,
+// except the ones matched by the exclude globs or regex
+type UpdateKSopsSecretSelector struct {
+	Secret       string   `json:"secret" yaml:"secret"`
+	All          bool     `json:"all,omitempty" yaml:"all,omitempty"`
+	Include      []string `json:"include,omitempty" yaml:"include,omitempty"`
+	IncludeRegex string   `json:"includeRegex,omitempty" yaml:"includeRegex,omitempty"`
+	Exclude      []string `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+	ExcludeRegex string   `json:"excludeRegex,omitempty" yaml:"excludeRegex,omitempty"`
+}
+
+// Match reports whether the key is selected
+func (s UpdateKSopsSecretSelector) Match(key string) bool {
+	if matchKey(key, s.Exclude, s.ExcludeRegex) {
+		return false
+	}
+
+	return s.All || matchKey(key, s.Include, s.IncludeRegex)
+}
+
+func matchKey(key string, globs []string, regex string) bool {
+	for _, glob := range globs {
+		if matched, _ := path.Match(glob, key); matched {
+			return true
+		}
+	}
+
+	if regex == "" {
+		return false
+	}
+
+	matched, _ := regexp.MatchString(regex, key)
+	return matched
+}
+
+func (s UpdateKSopsSecretSelector) validate() error {
+	if s.Secret == "" {
+		return fmt.Errorf("secret must not be empty")
+	}
+
+	include := len(s.Include) > 0 || s.IncludeRegex != ""
+	if s.All == include {
+		return fmt.Errorf("either all or the include patterns must be set")
+	}
+
+	for _, glob := range append(append([]string{}, s.Include...), s.Exclude...) {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("glob '%s' is invalid: %w", glob, err)
+		}
+	}
+
+	for _, regex := range []string{s.IncludeRegex, s.ExcludeRegex} {
+		if _, err := regexp.Compile(regex); err != nil {
+			return fmt.Errorf("regex '%s' is invalid: %w", regex, err)
+		}
+	}
+
+	return nil
+}
+
+func (i *UpdateKSopsSecretItem) UnmarshalJSON(data []byte) error {
+	var key string
+	if err := json.Unmarshal(data, &key); err == nil {
+		*i = UpdateKSopsSecretItem{Key: key}
+		return nil
+	}
+
+	type item UpdateKSopsSecretItem
+	return json.Unmarshal(data, (*item)(i))
+}
+
+// UpdateKSopsSopsOptions configures the SOPS encryption the same way as the
+// .sops.yaml creation rules, only one of encryptedRegex, unencryptedSuffix
+// and encryptedCommentRegex could be set
+type UpdateKSopsSopsOptions struct {
+	EncryptedRegex        string `json:"encryptedRegex,omitempty" yaml:"encryptedRegex,omitempty"`
+	UnencryptedSuffix     string `json:"unencryptedSuffix,omitempty" yaml:"unencryptedSuffix,omitempty"`
+	EncryptedCommentRegex string `json:"encryptedCommentRegex,omitempty" yaml:"encryptedCommentRegex,omitempty"`
+	MACOnlyEncrypted      *bool  `json:"macOnlyEncrypted,omitempty" yaml:"macOnlyEncrypted,omitempty"`
+	ShamirThreshold       int    `json:"shamirThreshold,omitempty" yaml:"shamirThreshold,omitempty"`
 }
 
 type UpdateKSopsGPGPublicKeyReference struct {
@@ -33,19 +170,534 @@ type UpdateKSopsRecipient struct {
 	Type      string `json:"type" yaml:"type"`
 	Recipient string `json:"recipient" yaml:"recipient"`
 
+	// Name and Team reference the member or the team recipients of the
+	// RecipientDirectory, they are resolved when the function runs
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	Team string `json:"team,omitempty" yaml:"team,omitempty"`
+
 	PublicKeySecretReference UpdateKSopsGPGPublicKeyReference `json:"publicKeySecretReference,omitempty" yaml:"publicKeySecretReference,omitempty"`
+
+	// PublicKeyConfigMapReference passes the public key data with a ConfigMap
+	// reference, the public keys are not secret
+	PublicKeyConfigMapReference UpdateKSopsGPGPublicKeyReference `json:"publicKeyConfigMapReference,omitempty" yaml:"publicKeyConfigMapReference,omitempty"`
+
+	// PublicKeyFile is the public key file path relative to the package
+	// directory of the UpdateKSopsSecrets
+	PublicKeyFile string `json:"publicKeyFile,omitempty" yaml:"publicKeyFile,omitempty"`
+
+	// Keyserver is the lookup of the PGP public key without the public key
+	// source, it overrides the keyserver of the UpdateKSopsSecrets
+	Keyserver UpdateKSopsKeyserver `json:"keyserver,omitempty" yaml:"keyserver,omitempty"`
+
+	// KeyGroup is the index of the SOPS key group of the recipient, it is
+	// set from the recipientGroups
+	KeyGroup int `json:"-" yaml:"-"`
+}
+
+// RecipientTypes are the supported recipient types
+var RecipientTypes = []string{"age", "pgp", "ssh", "vault", "awskms", "gcpkms", "azurekv"}
+
+// KeyServiceRecipientTypes are the cloud KMS recipient types, their data keys
+// are encrypted by the SOPS keyservices holding the KMS credentials
+var KeyServiceRecipientTypes = []string{"awskms", "gcpkms", "azurekv"}
+
+const (
+	// VaultAddressEnv is the Vault address of the vault recipients, the
+	// address and the token are never read from the configuration
+	VaultAddressEnv = "VAULT_ADDR"
+	// VaultTokenEnv is the Vault token of the transit encryption
+	VaultTokenEnv = "VAULT_TOKEN"
+	// VaultNamespaceEnv is the optional Vault Enterprise namespace
+	VaultNamespaceEnv = "VAULT_NAMESPACE"
+)
+
+var (
+	pgpFingerprintRegexp   = regexp.MustCompile(`^[0-9A-Fa-f]{40}$`)
+	awsKMSARNRegexp        = regexp.MustCompile(`^arn:aws[\w-]*:kms:[^:]+:\d{12}:(key|alias)/.+$`)
+	awsIAMRoleARNRegexp    = regexp.MustCompile(`^arn:aws[\w-]*:iam::\d{12}:role/.+$`)
+	gcpKMSResourceRegexp   = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+	azureKeyVaultURLRegexp = regexp.MustCompile(`^(https://[^/]+)/keys/([^/]+)/([^/]+)$`)
+)
+
+// IsPGPFingerprint reports whether the recipient is the full 40 hex PGP
+// fingerprint, the short and long key ids are not pinned to a key
+func IsPGPFingerprint(recipient string) bool {
+	return pgpFingerprintRegexp.MatchString(recipient)
+}
+
+// ParseVaultTransitKey splits the vault recipient, the transit key path
+// <engine path>/keys/<key name>, into the engine path and the key name
+func ParseVaultTransitKey(recipient string) (enginePath, keyName string, err error) {
+	i := strings.LastIndex(recipient, "/keys/")
+	if i <= 0 || strings.HasPrefix(recipient, "/") ||
+		strings.Contains(recipient[i+len("/keys/"):], "/") || i+len("/keys/") == len(recipient) {
+		return "", "", fmt.Errorf("vault recipient '%s' must be the transit key path <engine path>/keys/<key name>", recipient)
+	}
+
+	return recipient[:i], recipient[i+len("/keys/"):], nil
+}
+
+// ParseAWSKMSKey splits the awskms recipient, the key ARN with the optional
+// +<role ARN> to assume as SOPS does
+func ParseAWSKMSKey(recipient string) (arn, role string, err error) {
+	arn, role, _ = strings.Cut(recipient, "+")
+	if !awsKMSARNRegexp.MatchString(arn) {
+		return "", "", fmt.Errorf("awskms recipient '%s' must be the KMS key ARN", recipient)
+	}
+
+	if role != "" && !awsIAMRoleARNRegexp.MatchString(role) {
+		return "", "", fmt.Errorf("awskms recipient '%s' role must be the IAM role ARN", recipient)
+	}
+
+	return arn, role, nil
+}
+
+// ParseGCPKMSKey validates the gcpkms recipient, the crypto key resource ID
+func ParseGCPKMSKey(recipient string) (resourceID string, err error) {
+	if !gcpKMSResourceRegexp.MatchString(recipient) {
+		return "", fmt.Errorf("gcpkms recipient '%s' must be the resource ID projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key>", recipient)
+	}
+
+	return recipient, nil
+}
+
+// ParseAzureKeyVaultKey splits the azurekv recipient, the key URL
+// https://<vault>/keys/<name>/<version>, into its vault URL, name and version
+func ParseAzureKeyVaultKey(recipient string) (vaultURL, name, version string, err error) {
+	matches := azureKeyVaultURLRegexp.FindStringSubmatch(recipient)
+	if matches == nil {
+		return "", "", "", fmt.Errorf("azurekv recipient '%s' must be the key URL https://<vault>/keys/<name>/<version>", recipient)
+	}
+
+	return matches[1], matches[2], matches[3], nil
+}
+
+// IsKeyServiceRecipient reports whether the recipient is encrypted by the
+// SOPS keyservices
+func (r UpdateKSopsRecipient) IsKeyServiceRecipient() bool {
+	return sliceContainsString(KeyServiceRecipientTypes, r.Type)
+}
+
+// VaultTransitURI returns the SOPS transit key URI of the vault recipient
+func VaultTransitURI(address, recipient string) string {
+	return strings.TrimSuffix(address, "/") + "/v1/" + recipient
+}
+
+// ParseVaultTransitURI splits the SOPS transit key URI into the Vault address
+// and the vault recipient, the reverse of the VaultTransitURI
+func ParseVaultTransitURI(uri string) (address, recipient string, err error) {
+	i := strings.Index(uri, "/v1/")
+	if i > 0 {
+		address, recipient = uri[:i], uri[i+len("/v1/"):]
+		if _, _, err := ParseVaultTransitKey(recipient); err == nil {
+			return address, recipient, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("vault transit URI '%s' must be <address>/v1/<engine path>/keys/<key name>", uri)
+}
+
+// HasPublicKeySource reports whether the public key data of the recipient
+// is passed by any of the references or the file
+func (r UpdateKSopsRecipient) HasPublicKeySource() bool {
+	return r.PublicKeySecretReference.Name != "" ||
+		r.PublicKeyConfigMapReference.Name != "" || r.PublicKeyFile != ""
+}
+
+// validate returns the error with the relative path of the invalid field
+func (r UpdateKSopsRecipient) validate() (field string, err error) {
+	sources := 0
+	for _, source := range []string{r.PublicKeySecretReference.Name,
+		r.PublicKeyConfigMapReference.Name, r.PublicKeyFile} {
+		if source != "" {
+			sources++
+		}
+	}
+
+	if sources > 1 {
+		return "", fmt.Errorf("only one of publicKeySecretReference, publicKeyConfigMapReference and publicKeyFile could be set")
+	}
+
+	if sources > 0 && (r.Type == "vault" || r.IsKeyServiceRecipient()) {
+		return "", fmt.Errorf("the public key source could not be set for the %s recipient", r.Type)
+	}
+
+	if r.PublicKeyFile != "" && !isPackagePath(r.PublicKeyFile) {
+		return ".publicKeyFile", fmt.Errorf("publicKeyFile '%s' must be a path in the package", r.PublicKeyFile)
+	}
+
+	if !r.Keyserver.IsEmpty() {
+		if r.Type != "pgp" {
+			return ".keyserver", fmt.Errorf("keyserver could only be set for the pgp recipient")
+		}
+
+		if sources > 0 {
+			return ".keyserver", fmt.Errorf("keyserver could not be set together with the public key source")
+		}
+
+		if err := r.Keyserver.validate(); err != nil {
+			return ".keyserver", err
+		}
+	}
+
+	// The age and ssh recipients are read from the file if not listed
+	if r.Recipient == "" && ((r.Type != "age" && r.Type != "ssh") || sources == 0) {
+		return ".recipient", fmt.Errorf("recipient must not be empty")
+	}
+
+	return "", nil
+}
+
+// validateKey parses the recipient by its type
+func (r UpdateKSopsRecipient) validateKey() error {
+	switch r.Type {
+	case "age":
+		if r.Recipient == "" {
+			return nil
+		}
+
+		if strings.HasPrefix(r.Recipient, "ssh-") {
+			return fmt.Errorf("age recipient must be a bech32 age public key, the ssh public keys are the ssh type recipients")
+		}
+
+		if _, err := age.ParseX25519Recipient(r.Recipient); err != nil {
+			return fmt.Errorf("age recipient must be a bech32 age public key, %w", err)
+		}
+	case "vault":
+		if _, _, err := ParseVaultTransitKey(r.Recipient); err != nil {
+			return err
+		}
+	case "awskms":
+		if _, _, err := ParseAWSKMSKey(r.Recipient); err != nil {
+			return err
+		}
+	case "gcpkms":
+		if _, err := ParseGCPKMSKey(r.Recipient); err != nil {
+			return err
+		}
+	case "azurekv":
+		if _, _, _, err := ParseAzureKeyVaultKey(r.Recipient); err != nil {
+			return err
+		}
+	case "ssh":
+		if r.Recipient == "" {
+			return nil
+		}
+
+		if _, err := agessh.ParseRecipient(r.Recipient); err != nil {
+			return fmt.Errorf("ssh recipient must be a ssh-ed25519 or ssh-rsa public key, %w", err)
+		}
+	case "pgp":
+		if !IsPGPFingerprint(r.Recipient) {
+			return fmt.Errorf("pgp recipient '%s' must be the full 40 hex fingerprint", r.Recipient)
+		}
+	}
+
+	return nil
+}
+
+// UpdateKSopsKeyserver fetches the PGP public key of the fingerprint from the
+// HKP/HKPS keyserver URL or the Web Key Directory of the email, the WKD is
+// looked up first, the key is rejected if it does not match the fingerprint
+type UpdateKSopsKeyserver struct {
+	URL string `json:"url,omitempty" yaml:"url,omitempty"`
+	WKD string `json:"wkd,omitempty" yaml:"wkd,omitempty"`
+}
+
+func (k UpdateKSopsKeyserver) IsEmpty() bool {
+	return k.URL == "" && k.WKD == ""
+}
+
+func (k UpdateKSopsKeyserver) validate() error {
+	if k.URL != "" {
+		u, err := url.Parse(k.URL)
+		if err != nil {
+			return fmt.Errorf("url '%s' is invalid: %w", k.URL, err)
+		}
+
+		switch u.Scheme {
+		case "hkp", "hkps", "http", "https":
+		default:
+			return fmt.Errorf("url '%s' scheme must be one of hkp, hkps, http and https", k.URL)
+		}
+
+		if u.Host == "" {
+			return fmt.Errorf("url '%s' has no host", k.URL)
+		}
+	}
+
+	if k.WKD != "" {
+		local, domain, found := strings.Cut(k.WKD, "@")
+		if !found || local == "" || domain == "" || strings.Contains(domain, "@") {
+			return fmt.Errorf("wkd '%s' must be an email address", k.WKD)
+		}
+	}
+
+	return nil
+}
+
+// UpdateKSopsProvider is the command that prints the secret value of the key
+// given as its last argument to the stdout, eg. pass show or op read
+type UpdateKSopsProvider struct {
+	Name    string   `json:"name" yaml:"name"`
+	Command string   `json:"command" yaml:"command"`
+	Args    []string `json:"args,omitempty" yaml:"args,omitempty"`
+	Timeout string   `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// DefaultProviderTimeout is the timeout of the provider command if unset
+const DefaultProviderTimeout = 30 * time.Second
+
+// GetTimeout returns the timeout of the provider command
+func (p UpdateKSopsProvider) GetTimeout() time.Duration {
+	if timeout, err := time.ParseDuration(p.Timeout); err == nil && timeout > 0 {
+		return timeout
+	}
+
+	return DefaultProviderTimeout
+}
+
+func (p UpdateKSopsProvider) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("name must not be empty")
+	}
+
+	if p.Command == "" {
+		return fmt.Errorf("'%s' command must not be empty", p.Name)
+	}
+
+	if p.Timeout != "" {
+		if timeout, err := time.ParseDuration(p.Timeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("'%s' timeout '%s' must be a positive duration", p.Name, p.Timeout)
+		}
+	}
+
+	return nil
+}
+
+// UpdateKSopsRecipientGroup is the SOPS key group, the data key is split
+// into a share per group and the sops shamirThreshold of them decrypt it
+type UpdateKSopsRecipientGroup struct {
+	Name       string                 `json:"name,omitempty" yaml:"name,omitempty"`
+	Recipients []UpdateKSopsRecipient `json:"recipients" yaml:"recipients"`
+}
+
+// UpdateKSopsOutput configures the generated files layout, all paths are
+// relative to the package directory of the UpdateKSopsSecrets
+type UpdateKSopsOutput struct {
+	BaseSecretsFile        string `json:"baseSecretsFile,omitempty" yaml:"baseSecretsFile,omitempty"`
+	KustomizationFile      string `json:"kustomizationFile,omitempty" yaml:"kustomizationFile,omitempty"`
+	GeneratedDir           string `json:"generatedDir,omitempty" yaml:"generatedDir,omitempty"`
+	EncryptedFilePattern   string `json:"encryptedFilePattern,omitempty" yaml:"encryptedFilePattern,omitempty"`
+	FingerprintFilePattern string `json:"fingerprintFilePattern,omitempty" yaml:"fingerprintFilePattern,omitempty"`
+
+	// KeepOrphans keeps the encrypted files of the removed items with warnings,
+	// they are pruned by default
+	KeepOrphans bool `json:"keepOrphans,omitempty" yaml:"keepOrphans,omitempty"`
+}
+
+// UpdateKSopsSopsConfig configures the .sops.yaml creation rules lookup, the
+// nearest .sops.yaml resource in the package is used unless the ConfigMap or
+// Secret holding the content is referenced
+type UpdateKSopsSopsConfig struct {
+	Name       string `json:"name,omitempty" yaml:"name,omitempty"`
+	Key        string `json:"key,omitempty" yaml:"key,omitempty"`
+	Recipients string `json:"recipients,omitempty" yaml:"recipients,omitempty"`
+
+	// Generate maintains the creation rules of the encrypted files in the
+	// .sops.yaml for editing them with sops by hand
+	Generate bool `json:"generate,omitempty" yaml:"generate,omitempty"`
 }
 
 type UpdateKSopsSecrets struct {
 	ObjectMeta metav1.ObjectMeta
 	Secret     UpdateKSopsSecretSpec  `json:"secret" yaml:"secret"`
 	Recipients []UpdateKSopsRecipient `json:"recipients" yaml:"recipients"`
+	Output     UpdateKSopsOutput      `json:"output,omitempty" yaml:"output,omitempty"`
+	Sops       UpdateKSopsSopsOptions `json:"sops,omitempty" yaml:"sops,omitempty"`
+	SopsConfig UpdateKSopsSopsConfig  `json:"sopsConfig,omitempty" yaml:"sopsConfig,omitempty"`
+
+	// RecipientGroups are the SOPS key groups, they could not be set together
+	// with the recipients
+	RecipientGroups []UpdateKSopsRecipientGroup `json:"recipientGroups,omitempty" yaml:"recipientGroups,omitempty"`
+
+	// Keyserver is the default lookup of the PGP public keys without the
+	// public key source, the gpg default keyserver is used if unset
+	Keyserver UpdateKSopsKeyserver `json:"keyserver,omitempty" yaml:"keyserver,omitempty"`
+
+	// Keyservices are the SOPS keyservice endpoints, tcp://<host>:<port> or
+	// unix://<path>, of the cloud KMS recipients, they are tried in order
+	Keyservices []string `json:"keyservices,omitempty" yaml:"keyservices,omitempty"`
+
+	// Providers are the commands that print the secret values of the items,
+	// the values are never read from the unencrypted files
+	Providers []UpdateKSopsProvider `json:"providers,omitempty" yaml:"providers,omitempty"`
+
+	// Path is the package file path of the resource, the generated files are
+	// placed relative to its directory
+	Path string `json:"-" yaml:"-"`
+
+	// directory resolves the recipients referenced by name or team
+	directory *RecipientDirectory
+
+	// selected are the items resolved from the selectors
+	selected []UpdateKSopsSecretItem
 }
 
 func validGVK(ko *sdk.KubeObject, apiVersion, kind string) bool {
 	return ko.GetAPIVersion() == apiVersion && ko.GetKind() == kind
 }
 
+// IsUpdateKSopsSecrets reports whether the resource is an UpdateKSopsSecrets
+func IsUpdateKSopsSecrets(ko *sdk.KubeObject) bool {
+	return validGVK(ko, fnConfigAPIVersion, fnConfigKind)
+}
+
+// LoadUpdateKSopsSecrets collects all the UpdateKSopsSecrets, the
+// functionConfig could be a single resource or a List of them, and any other
+// UpdateKSopsSecrets found in the resources are also included
+func LoadUpdateKSopsSecrets(functionConfig *sdk.KubeObject, items sdk.KubeObjects) ([]*UpdateKSopsSecrets, error) {
+	var fnConfigs sdk.KubeObjects
+
+	switch {
+	case validGVK(functionConfig, listAPIVersion, listKind):
+		listItems, _, err := functionConfig.NestedSlice("items")
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the functionConfig %s items:\n%w",
+				listKind, err)
+		}
+
+		for _, item := range listItems {
+			ko, err := sdk.ParseKubeObject([]byte(item.String()))
+			if err != nil {
+				return nil, fmt.Errorf("unable to read the functionConfig %s item:\n%w",
+					listKind, err)
+			}
+
+			if !IsUpdateKSopsSecrets(ko) {
+				return nil, fmt.Errorf("the functionConfig %s items must be a %s",
+					listKind, fnConfigKind)
+			}
+
+			fnConfigs = append(fnConfigs, ko)
+		}
+	default:
+		fnConfigs = append(fnConfigs, functionConfig)
+	}
+
+	var configs []*UpdateKSopsSecrets
+
+	for _, ko := range fnConfigs {
+		uks := &UpdateKSopsSecrets{}
+		if err := uks.Config(ko); err != nil {
+			return nil, err
+		}
+
+		configs = append(configs, uks)
+	}
+
+	// The functionConfig is usually a resource in the package as well
+	fnConfigsCount := len(configs)
+
+	for _, ko := range items.Where(IsUpdateKSopsSecrets) {
+		if uks := findConfig(configs[:fnConfigsCount], ko.GetName(), filePath(ko)); uks != nil {
+			if uks.Path == "" {
+				uks.Path = filePath(ko)
+			}
+			continue
+		}
+
+		uks := &UpdateKSopsSecrets{}
+		if err := uks.Config(ko); err != nil {
+			return nil, err
+		}
+
+		// The provider commands are run by the function, they are never taken
+		// from the package resources that anyone could change
+		if len(uks.Providers) > 0 {
+			return nil, fmt.Errorf("invalid %s '%s' providers: the providers could only be set by the functionConfig",
+				fnConfigKind, uks.GetName())
+		}
+
+		configs = append(configs, uks)
+	}
+
+	if err := validateConfigs(configs); err != nil {
+		return nil, err
+	}
+
+	directory, err := LoadRecipientDirectory(items)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, uks := range configs {
+		uks.directory = directory
+		if results := uks.validateReferences(); len(results) > 0 {
+			return nil, results
+		}
+	}
+
+	return configs, nil
+}
+
+// findConfig finds the config by name, the config without a path is matched
+// by name only as the functionConfig might not be annotated with its path
+func findConfig(configs []*UpdateKSopsSecrets, name, path string) *UpdateKSopsSecrets {
+	for _, uks := range configs {
+		if uks.GetName() == name && (uks.Path == "" || uks.Path == path) {
+			return uks
+		}
+	}
+
+	return nil
+}
+
+func validateConfigs(configs []*UpdateKSopsSecrets) error {
+	names := map[string]bool{}
+	outputs := map[string]UpdateKSopsOutput{}
+
+	for _, uks := range configs {
+		id := path.Join(uks.GetDir(), uks.GetName())
+		if names[id] {
+			return fmt.Errorf("the %s name '%s' is duplicated", fnConfigKind,
+				uks.GetName())
+		}
+
+		names[id] = true
+
+		// The generated files in the same directory are shared
+		if output, found := outputs[uks.GetDir()]; found && output != uks.Output {
+			return fmt.Errorf("the %s '%s' output must be the same as others in the directory '%s'",
+				fnConfigKind, uks.GetName(), uks.GetDir())
+		}
+
+		outputs[uks.GetDir()] = uks.Output
+	}
+
+	return nil
+}
+
+func filePath(ko *sdk.KubeObject) string {
+	if p := ko.GetAnnotation(kioutil.PathAnnotation); p != "" {
+		return p
+	}
+
+	return ko.GetAnnotation(kioutil.LegacyPathAnnotation)
+}
+
+// isFileAnnotation reports whether the annotation is maintained by the kpt/kyaml
+// for tracking the resource file, it must not be passed to the generated secret
+func isFileAnnotation(key string) bool {
+	switch key {
+	case kioutil.LegacyPathAnnotation, kioutil.LegacyIndexAnnotation,
+		kioutil.LegacyIdAnnotation:
+		return true
+	}
+
+	return strings.HasPrefix(key, internalAnnotationPrefix)
+}
+
 func (uks *UpdateKSopsSecrets) Config(functionConfig *sdk.KubeObject) error {
 	switch {
 	case validGVK(functionConfig, fnConfigAPIVersion, fnConfigKind):
@@ -57,9 +709,56 @@ func (uks *UpdateKSopsSecrets) Config(functionConfig *sdk.KubeObject) error {
 		return fmt.Errorf("the functionConfig must be a %s", fnConfigKind)
 	}
 
+	if err := uks.Output.validate(); err != nil {
+		return fmt.Errorf("invalid %s output: %w", fnConfigKind, err)
+	}
+
+	if err := uks.validateRecipientGroups(); err != nil {
+		return fmt.Errorf("invalid %s recipientGroups: %w", fnConfigKind, err)
+	}
+
+	if uks.Keyserver.WKD != "" {
+		return fmt.Errorf("invalid %s keyserver: wkd must be set per recipient", fnConfigKind)
+	}
+
+	if err := uks.Keyserver.validate(); err != nil {
+		return fmt.Errorf("invalid %s keyserver: %w", fnConfigKind, err)
+	}
+
+	if err := uks.validateKeyservices(); err != nil {
+		return fmt.Errorf("invalid %s keyservices: %w", fnConfigKind, err)
+	}
+
+	if results := uks.validateRecipients(functionConfig); len(results) > 0 {
+		return results
+	}
+
+	if err := uks.validateSopsOptions(); err != nil {
+		return fmt.Errorf("invalid %s sops options: %w", fnConfigKind, err)
+	}
+
+	if err := uks.validateProviders(); err != nil {
+		return fmt.Errorf("invalid %s providers: %w", fnConfigKind, err)
+	}
+
+	if err := uks.validateSecretItems(); err != nil {
+		return fmt.Errorf("invalid %s secret items: %w", fnConfigKind, err)
+	}
+
+	if err := uks.SopsConfig.validate(); err != nil {
+		return fmt.Errorf("invalid %s sopsConfig: %w", fnConfigKind, err)
+	}
+
 	uks.ObjectMeta.Name = functionConfig.GetName()
+	uks.Path = filePath(functionConfig)
+
+	annotations := map[string]string{}
+	for key, value := range functionConfig.GetAnnotations() {
+		if !isFileAnnotation(key) {
+			annotations[key] = value
+		}
+	}
 
-	annotations := functionConfig.GetAnnotations()
 	if len(annotations) > 0 {
 		uks.ObjectMeta.Annotations = annotations
 	}
@@ -84,15 +783,705 @@ func (uks *UpdateKSopsSecrets) GetLabels() map[string]string {
 	return uks.ObjectMeta.GetLabels()
 }
 
-func (uks *UpdateKSopsSecrets) GetType() string {
+// GetDir returns the package directory of the resource
+func (uks *UpdateKSopsSecrets) GetDir() string {
+	return path.Dir(uks.Path)
+}
+
+func (uks *UpdateKSopsSecrets) GetType() string {
 	return uks.Secret.Type
 }
 
+// GetSecretPrecedence returns the policy of the keys found in more than one
+// of the references, the reference list order by default
+func (uks *UpdateKSopsSecrets) GetSecretPrecedence() string {
+	if uks.Secret.Precedence == "" {
+		return SecretPrecedenceOrder
+	}
+
+	return uks.Secret.Precedence
+}
+
 func (uks *UpdateKSopsSecrets) GetSecretItems() []string {
-	keys := make([]string, len(uks.Secret.Items))
+	items := uks.secretItems()
+	keys := make([]string, len(items))
 
-	copy(keys, uks.Secret.Items)
+	for i, item := range items {
+		keys[i] = item.Key
+	}
 	sort.Strings(keys)
 
 	return keys
 }
+
+// SetSelectedItems sets the items resolved from the selectors, the listed
+// items take precedence over the selected ones of the same key
+func (uks *UpdateKSopsSecrets) SetSelectedItems(items []UpdateKSopsSecretItem) {
+	uks.selected = items
+}
+
+// secretItems returns the listed items followed by the selected ones
+func (uks *UpdateKSopsSecrets) secretItems() []UpdateKSopsSecretItem {
+	items := append([]UpdateKSopsSecretItem{}, uks.Secret.Items...)
+	for _, selected := range uks.selected {
+		if uks.findSecretItem(selected.Key) == nil {
+			items = append(items, selected)
+		}
+	}
+
+	return items
+}
+
+func (uks *UpdateKSopsSecrets) findSecretItem(key string) *UpdateKSopsSecretItem {
+	for i := range uks.Secret.Items {
+		if uks.Secret.Items[i].Key == key {
+			return &uks.Secret.Items[i]
+		}
+	}
+
+	return nil
+}
+
+// GetSecretItemSource returns the reference name and the key that the item
+// value is read from, the name is empty if any of the references could
+// provide the key
+func (uks *UpdateKSopsSecrets) GetSecretItemSource(key string) (name, sourceKey string) {
+	for _, item := range uks.secretItems() {
+		if item.Key != key || item.From == nil {
+			continue
+		}
+
+		if item.From.Key != "" {
+			return item.From.Secret, item.From.Key
+		}
+
+		return item.From.Secret, key
+	}
+
+	return "", key
+}
+
+// GetSecretItemProvider returns the provider name of the item, empty if the
+// item is read from the references
+func (uks *UpdateKSopsSecrets) GetSecretItemProvider(key string) string {
+	for _, item := range uks.secretItems() {
+		if item.Key == key && item.From != nil {
+			return item.From.Provider
+		}
+	}
+
+	return ""
+}
+
+// GetSecretItemReferences returns the secrets pinned by the item sources
+// and the selectors
+func (uks *UpdateKSopsSecrets) GetSecretItemReferences() (names []string) {
+	for _, item := range uks.Secret.Items {
+		if item.From != nil && item.From.Secret != "" && !sliceContainsString(names, item.From.Secret) {
+			names = append(names, item.From.Secret)
+		}
+	}
+
+	for _, selector := range uks.Secret.Selectors {
+		if !sliceContainsString(names, selector.Secret) {
+			names = append(names, selector.Secret)
+		}
+	}
+
+	return names
+}
+
+// GetSopsOptions returns the sops options of the item, the item overrides
+// are merged over the options of the config
+func (uks *UpdateKSopsSecrets) GetSopsOptions(key string) UpdateKSopsSopsOptions {
+	for _, item := range uks.secretItems() {
+		if item.Key == key {
+			return uks.Sops.merge(item.Sops)
+		}
+	}
+
+	return uks.Sops
+}
+
+// GetRecipients returns the recipients of all the key groups, the references
+// are resolved by the RecipientDirectory, once per key group
+func (uks *UpdateKSopsSecrets) GetRecipients() []UpdateKSopsRecipient {
+	var recipients []UpdateKSopsRecipient
+	for _, field := range uks.recipientFields() {
+		resolved := []UpdateKSopsRecipient{field.recipient}
+		if field.recipient.IsReference() {
+			var err error
+			if resolved, err = uks.directory.Resolve(field.recipient); err != nil {
+				// The references are validated when the configs are loaded
+				continue
+			}
+		}
+
+		for _, r := range resolved {
+			// The recipients read from the public key source are not listed
+			if r.Recipient == "" || !ContainsRecipient(recipients, r) {
+				recipients = append(recipients, r)
+			}
+		}
+	}
+
+	return recipients
+}
+
+// ContainsRecipient reports whether the recipient of the same key group is
+// listed
+func ContainsRecipient(recipients []UpdateKSopsRecipient, r UpdateKSopsRecipient) bool {
+	for _, recipient := range recipients {
+		if recipient.Type == r.Type && recipient.Recipient == r.Recipient &&
+			recipient.KeyGroup == r.KeyGroup {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateReferences resolves the referenced recipients, the unknown names
+// and teams are the results of their fields
+func (uks *UpdateKSopsSecrets) validateReferences() (results framework.Results) {
+	for _, field := range uks.recipientFields() {
+		r := field.recipient
+		if !r.IsReference() {
+			continue
+		}
+
+		path := field.path + "." + r.referenceKind()
+		resolved, err := uks.directory.Resolve(r)
+		if err != nil {
+			results = append(results, fieldResult(fnConfigKind, uks.GetName(), uks.Path, path, err.Error()))
+			continue
+		}
+
+		for _, member := range resolved {
+			if member.IsKeyServiceRecipient() && len(uks.Keyservices) == 0 {
+				results = append(results, fieldResult(fnConfigKind, uks.GetName(), uks.Path, path,
+					fmt.Sprintf("the %s recipient of the %s '%s' requires the keyservices",
+						member.Type, r.referenceKind(), r.Name+r.Team)))
+				break
+			}
+		}
+	}
+
+	return results
+}
+
+// recipientField is the recipient with its field path in the configuration
+type recipientField struct {
+	path      string
+	recipient UpdateKSopsRecipient
+}
+
+func (uks *UpdateKSopsSecrets) recipientFields() (fields []recipientField) {
+	for i, r := range uks.Recipients {
+		fields = append(fields, recipientField{path: fmt.Sprintf("recipients[%d]", i), recipient: r})
+	}
+
+	for i, group := range uks.RecipientGroups {
+		for j, r := range group.Recipients {
+			r.KeyGroup = i
+			fields = append(fields, recipientField{
+				path:      fmt.Sprintf("recipientGroups[%d].recipients[%d]", i, j),
+				recipient: r,
+			})
+		}
+	}
+
+	return fields
+}
+
+// validateRecipients parses every recipient by its type and flags the
+// duplicates of the same key group, each problem is a result of its field
+func (uks *UpdateKSopsSecrets) validateRecipients(functionConfig *sdk.KubeObject) (results framework.Results) {
+	addResult := func(field, message string) {
+		results = append(results, fieldResult(fnConfigKind, functionConfig.GetName(),
+			filePath(functionConfig), field, message))
+	}
+
+	seen := map[string]string{}
+	for _, field := range uks.recipientFields() {
+		r := field.recipient
+		if r.IsReference() {
+			if invalid, err := r.validateReference(); err != nil {
+				addResult(field.path+invalid, err.Error())
+				continue
+			}
+
+			id := fmt.Sprintf("%d/%s/%s", r.KeyGroup, r.referenceKind(), r.Name+r.Team)
+			if first, found := seen[id]; found {
+				addResult(field.path+"."+r.referenceKind(), fmt.Sprintf("duplicate reference of %s", first))
+				continue
+			}
+
+			seen[id] = field.path + "." + r.referenceKind()
+			continue
+		}
+
+		if !sliceContainsString(RecipientTypes, r.Type) {
+			addResult(field.path+".type", fmt.Sprintf("unsupported recipient type '%s', must be one of %s",
+				r.Type, strings.Join(RecipientTypes, ", ")))
+			continue
+		}
+
+		if invalid, err := r.validate(); err != nil {
+			addResult(field.path+invalid, err.Error())
+			continue
+		}
+
+		if err := r.validateKey(); err != nil {
+			addResult(field.path+".recipient", err.Error())
+			continue
+		}
+
+		if r.IsKeyServiceRecipient() && len(uks.Keyservices) == 0 {
+			addResult(field.path+".type", fmt.Sprintf("the %s recipient requires the keyservices", r.Type))
+			continue
+		}
+
+		if r.Recipient == "" {
+			continue
+		}
+
+		id := fmt.Sprintf("%d/%s/%s", r.KeyGroup, r.Type, strings.ToLower(r.Recipient))
+		if first, found := seen[id]; found {
+			addResult(field.path+".recipient", fmt.Sprintf("duplicate recipient of %s", first))
+			continue
+		}
+
+		seen[id] = field.path + ".recipient"
+	}
+
+	return results
+}
+
+// fieldResult is the error result of the field of the resource kind
+func fieldResult(kind, name, file, field, message string) *framework.Result {
+	result := &framework.Result{
+		Message:  message,
+		Severity: framework.Error,
+		ResourceRef: &yaml.ResourceIdentifier{
+			TypeMeta: yaml.TypeMeta{APIVersion: fnConfigAPIVersion, Kind: kind},
+			NameMeta: yaml.NameMeta{Name: name},
+		},
+		Field: &framework.Field{Path: field},
+	}
+
+	if file != "" {
+		result.File = &framework.File{Path: file}
+	}
+
+	return result
+}
+
+func (uks *UpdateKSopsSecrets) validateKeyservices() error {
+	for _, keyservice := range uks.Keyservices {
+		if _, _, err := ParseKeyservice(keyservice); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ParseKeyservice returns the network and the address of the SOPS keyservice
+// endpoint, the same schemes as the sops --keyservice
+func ParseKeyservice(keyservice string) (network, address string, err error) {
+	u, err := url.Parse(keyservice)
+	if err != nil {
+		return "", "", fmt.Errorf("'%s' is invalid: %w", keyservice, err)
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		address = u.Host
+	case "unix":
+		address = u.Path
+	default:
+		return "", "", fmt.Errorf("'%s' scheme must be one of tcp and unix", keyservice)
+	}
+
+	if address == "" {
+		return "", "", fmt.Errorf("'%s' has no address", keyservice)
+	}
+
+	return u.Scheme, address, nil
+}
+
+func sliceContainsString(s []string, value string) bool {
+	for _, v := range s {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetKeyserver returns the keyserver of the recipient, the url defaults to
+// the keyserver of the UpdateKSopsSecrets
+func (uks *UpdateKSopsSecrets) GetKeyserver(r UpdateKSopsRecipient) UpdateKSopsKeyserver {
+	keyserver := r.Keyserver
+	if keyserver.URL == "" {
+		keyserver.URL = uks.Keyserver.URL
+	}
+
+	return keyserver
+}
+
+// KeyGroups groups the recipients by their key group index in order
+func KeyGroups(recipients ...UpdateKSopsRecipient) [][]UpdateKSopsRecipient {
+	var groups [][]UpdateKSopsRecipient
+	for _, r := range recipients {
+		for len(groups) <= r.KeyGroup {
+			groups = append(groups, nil)
+		}
+
+		groups[r.KeyGroup] = append(groups[r.KeyGroup], r)
+	}
+
+	// The groups left empty by the merged .sops.yaml recipients are dropped
+	var keyGroups [][]UpdateKSopsRecipient
+	for _, group := range groups {
+		if len(group) > 0 {
+			keyGroups = append(keyGroups, group)
+		}
+	}
+
+	return keyGroups
+}
+
+func (uks *UpdateKSopsSecrets) validateRecipientGroups() error {
+	if len(uks.RecipientGroups) == 0 {
+		return nil
+	}
+
+	if len(uks.Recipients) > 0 {
+		return fmt.Errorf("recipients and recipientGroups could not be set together")
+	}
+
+	for i, group := range uks.RecipientGroups {
+		if len(group.Recipients) == 0 {
+			return fmt.Errorf("group %d '%s' has no recipients", i, group.Name)
+		}
+	}
+
+	return nil
+}
+
+func (uks *UpdateKSopsSecrets) validateSopsOptions() error {
+	if err := uks.Sops.validate(); err != nil {
+		return err
+	}
+
+	for _, item := range uks.Secret.Items {
+		if item.Sops == nil {
+			continue
+		}
+
+		if err := uks.Sops.merge(item.Sops).validate(); err != nil {
+			return fmt.Errorf("secret item '%s': %w", item.Key, err)
+		}
+	}
+
+	return nil
+}
+
+// validateSecretItems ensures the target keys are unique and the sources
+// set the secret or the key, as well as the precedence requires
+func (uks *UpdateKSopsSecrets) validateSecretItems() error {
+	switch uks.Secret.Precedence {
+	case "", SecretPrecedenceOrder, SecretPrecedenceError, SecretPrecedenceExplicit:
+	default:
+		return fmt.Errorf("precedence '%s' must be one of %s, %s and %s", uks.Secret.Precedence,
+			SecretPrecedenceOrder, SecretPrecedenceError, SecretPrecedenceExplicit)
+	}
+
+	keys := map[string]bool{}
+	for _, item := range uks.Secret.Items {
+		if item.Key == "" {
+			return fmt.Errorf("secret item key must not be empty")
+		}
+
+		if keys[item.Key] {
+			return fmt.Errorf("duplicate secret item key '%s'", item.Key)
+		}
+
+		keys[item.Key] = true
+
+		if err := uks.validateSecretItemSource(item.From); err != nil {
+			return fmt.Errorf("secret item '%s': %w", item.Key, err)
+		}
+	}
+
+	for i, selector := range uks.Secret.Selectors {
+		if err := selector.validate(); err != nil {
+			return fmt.Errorf("secret selector %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (uks *UpdateKSopsSecrets) validateSecretItemSource(from *UpdateKSopsSecretItemSource) error {
+	if from == nil {
+		if uks.Secret.Precedence == SecretPrecedenceExplicit {
+			return fmt.Errorf("from.secret or from.provider must be set with the %s precedence",
+				SecretPrecedenceExplicit)
+		}
+
+		return nil
+	}
+
+	switch {
+	case from.Secret != "" && from.Provider != "":
+		return fmt.Errorf("only one of from.secret and from.provider could be set")
+	case from.Provider != "":
+		if uks.findProvider(from.Provider) == nil {
+			return fmt.Errorf("unknown provider '%s'", from.Provider)
+		}
+	case from.Secret == "" && from.Key == "":
+		return fmt.Errorf("from must set the secret, the provider or the key")
+	case from.Secret == "" && uks.Secret.Precedence == SecretPrecedenceExplicit:
+		return fmt.Errorf("from.secret or from.provider must be set with the %s precedence",
+			SecretPrecedenceExplicit)
+	}
+
+	return nil
+}
+
+func (uks *UpdateKSopsSecrets) findProvider(name string) *UpdateKSopsProvider {
+	for i := range uks.Providers {
+		if uks.Providers[i].Name == name {
+			return &uks.Providers[i]
+		}
+	}
+
+	return nil
+}
+
+func (uks *UpdateKSopsSecrets) validateProviders() error {
+	names := map[string]bool{}
+	for _, provider := range uks.Providers {
+		if err := provider.validate(); err != nil {
+			return err
+		}
+
+		if names[provider.Name] {
+			return fmt.Errorf("duplicate provider '%s'", provider.Name)
+		}
+
+		names[provider.Name] = true
+	}
+
+	return nil
+}
+
+// IsMACOnlyEncrypted reports whether only the encrypted values are
+// authenticated by the MAC
+func (o UpdateKSopsSopsOptions) IsMACOnlyEncrypted() bool {
+	return o.MACOnlyEncrypted != nil && *o.MACOnlyEncrypted
+}
+
+// hasEncryptionRule reports whether any of the mutually exclusive rules
+// selecting the encrypted values is set
+func (o UpdateKSopsSopsOptions) hasEncryptionRule() bool {
+	return o.EncryptedRegex != "" || o.UnencryptedSuffix != "" ||
+		o.EncryptedCommentRegex != ""
+}
+
+// UnencryptedRegex returns the SOPS unencrypted regex of the unencryptedSuffix,
+// the Secret apiVersion, kind, metadata and type are left unencrypted along
+// with the keys of the suffix, it is empty if the suffix is unset
+func (o UpdateKSopsSopsOptions) UnencryptedRegex() string {
+	if o.UnencryptedSuffix == "" {
+		return ""
+	}
+
+	return `^(apiVersion|kind|metadata|type)$|` + regexp.QuoteMeta(o.UnencryptedSuffix) + `$`
+}
+
+// merge overrides the options, the encryption rules are replaced as a whole
+// as they could not be combined
+func (o UpdateKSopsSopsOptions) merge(override *UpdateKSopsSopsOptions) UpdateKSopsSopsOptions {
+	if override == nil {
+		return o
+	}
+
+	merged := o
+	if override.hasEncryptionRule() {
+		merged.EncryptedRegex = override.EncryptedRegex
+		merged.UnencryptedSuffix = override.UnencryptedSuffix
+		merged.EncryptedCommentRegex = override.EncryptedCommentRegex
+	}
+
+	if override.MACOnlyEncrypted != nil {
+		merged.MACOnlyEncrypted = override.MACOnlyEncrypted
+	}
+
+	if override.ShamirThreshold != 0 {
+		merged.ShamirThreshold = override.ShamirThreshold
+	}
+
+	return merged
+}
+
+// secretIdentityKeys are the keys of the encrypted Secret identity fields,
+// they are read by kustomize and KSOPS so they must never be encrypted
+var secretIdentityKeys = []string{
+	"apiVersion", "kind", "metadata", "name", "annotations",
+	"kustomize.config.k8s.io/behavior", "type",
+}
+
+func (o UpdateKSopsSopsOptions) validate() error {
+	rules := 0
+	for _, rule := range []string{o.EncryptedRegex, o.UnencryptedSuffix, o.EncryptedCommentRegex} {
+		if rule != "" {
+			rules++
+		}
+	}
+
+	if rules > 1 {
+		return fmt.Errorf("only one of encryptedRegex, unencryptedSuffix and encryptedCommentRegex could be set")
+	}
+
+	for _, r := range []struct {
+		field string
+		value string
+	}{
+		{"encryptedRegex", o.EncryptedRegex},
+		{"encryptedCommentRegex", o.EncryptedCommentRegex},
+	} {
+		if _, err := regexp.Compile(r.value); err != nil {
+			return fmt.Errorf("%s '%s' is invalid: %w", r.field, r.value, err)
+		}
+	}
+
+	// The values are encrypted unless a key of their path has the suffix or
+	// is a Secret identity field, the secret data must stay encrypted
+	for _, key := range []string{"data", "stringData"} {
+		if o.UnencryptedSuffix != "" && strings.HasSuffix(key, o.UnencryptedSuffix) {
+			return fmt.Errorf("unencryptedSuffix '%s' must not be the suffix of the '%s' key",
+				o.UnencryptedSuffix, key)
+		}
+	}
+
+	if o.EncryptedRegex != "" {
+		encryptedCheck := regexp.MustCompile(o.EncryptedRegex)
+		for _, key := range secretIdentityKeys {
+			if encryptedCheck.MatchString(key) {
+				return fmt.Errorf("encryptedRegex '%s' must not match the Secret identity field '%s'",
+					o.EncryptedRegex, key)
+			}
+		}
+	}
+
+	if o.ShamirThreshold < 0 {
+		return fmt.Errorf("shamirThreshold %d must not be negative", o.ShamirThreshold)
+	}
+
+	return nil
+}
+
+// ValidateKeyGroups ensures the shamirThreshold suits the number of the key
+// groups, they are known once the .sops.yaml creation rule recipients are
+// merged into the configured ones
+func (o UpdateKSopsSopsOptions) ValidateKeyGroups(keyGroups int) error {
+	if o.ShamirThreshold > keyGroups {
+		return fmt.Errorf("shamirThreshold %d must not be greater than the number of key groups",
+			o.ShamirThreshold)
+	}
+
+	// The data key is split into the shares of at least 2 required, the
+	// single key group holds the data key as is
+	if keyGroups > 1 && o.ShamirThreshold == 1 {
+		return fmt.Errorf("shamirThreshold must be at least 2 for %d key groups", keyGroups)
+	}
+
+	return nil
+}
+
+func (o *UpdateKSopsOutput) validate() error {
+	paths := []struct {
+		field string
+		value string
+		dir   bool
+	}{
+		{"baseSecretsFile", o.BaseSecretsFile, false},
+		{"kustomizationFile", o.KustomizationFile, false},
+		{"generatedDir", o.GeneratedDir, true},
+		{"encryptedFilePattern", o.EncryptedFilePattern, false},
+		{"fingerprintFilePattern", o.FingerprintFilePattern, false},
+	}
+
+	for _, p := range paths {
+		if p.value == "" {
+			continue
+		}
+
+		if !isPackagePath(p.value) {
+			return fmt.Errorf("%s '%s' must be a path in the package", p.field, p.value)
+		}
+
+		if !p.dir && !isYAMLFile(path.Clean(p.value)) {
+			return fmt.Errorf("%s '%s' must be a YAML file", p.field, p.value)
+		}
+	}
+
+	// The kustomize looks up the kustomization at the directory root only
+	if strings.Contains(o.KustomizationFile, "/") {
+		return fmt.Errorf("kustomizationFile '%s' must be a file name", o.KustomizationFile)
+	}
+
+	for _, pattern := range []string{o.EncryptedFilePattern, o.FingerprintFilePattern} {
+		if pattern != "" && !strings.Contains(pattern, OutputPatternKey) {
+			return fmt.Errorf("file pattern '%s' must contain %s", pattern,
+				OutputPatternKey)
+		}
+	}
+
+	if o.EncryptedFilePattern != "" &&
+		o.EncryptedFilePattern == o.FingerprintFilePattern {
+		return fmt.Errorf("encryptedFilePattern and fingerprintFilePattern must be different")
+	}
+
+	return nil
+}
+
+func (c *UpdateKSopsSopsConfig) validate() error {
+	if (c.Name == "") != (c.Key == "") {
+		return fmt.Errorf("name and key must be set together")
+	}
+
+	if c.Generate && c.Name != "" {
+		return fmt.Errorf("generate is not supported with the referenced '%s'", c.Name)
+	}
+
+	switch c.Recipients {
+	case "", SopsConfigRecipientsMerge, SopsConfigRecipientsOverride:
+	default:
+		return fmt.Errorf("recipients '%s' must be %s or %s", c.Recipients,
+			SopsConfigRecipientsMerge, SopsConfigRecipientsOverride)
+	}
+
+	return nil
+}
+
+// IsOverride reports whether the .sops.yaml recipients replace the configured ones
+func (c *UpdateKSopsSopsConfig) IsOverride() bool {
+	return c.Recipients == SopsConfigRecipientsOverride
+}
+
+// isPackagePath reports whether the relative path stays in the package
+func isPackagePath(p string) bool {
+	cleaned := path.Clean(p)
+	return !path.IsAbs(cleaned) && cleaned != "." && cleaned != ".." &&
+		!strings.HasPrefix(cleaned, "../")
+}
+
+func isYAMLFile(file string) bool {
+	return strings.HasSuffix(file, ".yaml") || strings.HasSuffix(file, ".yml")
+}
@@ -4,12 +4,14 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
 
 	sdk "github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
 )
 
 func TestConfig(t *testing.T) {
@@ -44,7 +46,7 @@ recipients:
 				},
 				Secret: UpdateKSopsSecretSpec{
 					References: []string{"unencrypted-secrets"},
-					Items:      []string{"test", "test2"},
+					Items:      []UpdateKSopsSecretItem{{Key: "test"}, {Key: "test2"}},
 				},
 				Recipients: []UpdateKSopsRecipient{
 					{
@@ -90,7 +92,7 @@ recipients:
 				},
 				Secret: UpdateKSopsSecretSpec{
 					References: []string{"unencrypted-secrets"},
-					Items:      []string{"test", "test2"},
+					Items:      []UpdateKSopsSecretItem{{Key: "test"}, {Key: "test2"}},
 				},
 				Recipients: []UpdateKSopsRecipient{
 					{
@@ -136,7 +138,7 @@ recipients:
 				},
 				Secret: UpdateKSopsSecretSpec{
 					References: []string{"unencrypted-secrets"},
-					Items:      []string{"test", "test2"},
+					Items:      []UpdateKSopsSecretItem{{Key: "test"}, {Key: "test2"}},
 				},
 				Recipients: []UpdateKSopsRecipient{
 					{
@@ -189,7 +191,7 @@ recipients:
 				},
 				Secret: UpdateKSopsSecretSpec{
 					References: []string{"unencrypted-secrets"},
-					Items:      []string{"test", "test2"},
+					Items:      []UpdateKSopsSecretItem{{Key: "test"}, {Key: "test2"}},
 				},
 				Recipients: []UpdateKSopsRecipient{
 					{
@@ -230,7 +232,7 @@ recipients:
 				},
 				Secret: UpdateKSopsSecretSpec{
 					References: []string{"unencrypted-secrets", "unencrypted-secrets-config-txt"},
-					Items:      []string{"test", "test2", "config.txt"},
+					Items:      []UpdateKSopsSecretItem{{Key: "test"}, {Key: "test2"}, {Key: "config.txt"}},
 				},
 				Recipients: []UpdateKSopsRecipient{
 					{
@@ -270,7 +272,7 @@ recipients:
 				Secret: UpdateKSopsSecretSpec{
 					Type:       "kubernetes.io/dockerconfigjson",
 					References: []string{"unencrypted-secrets"},
-					Items:      []string{".dockerconfigjson"},
+					Items:      []UpdateKSopsSecretItem{{Key: ".dockerconfigjson"}},
 				},
 				Recipients: []UpdateKSopsRecipient{
 					{
@@ -313,7 +315,7 @@ recipients:
 				Secret: UpdateKSopsSecretSpec{
 					Type:       "kubernetes.io/dockerconfigjson",
 					References: []string{"unencrypted-secrets"},
-					Items:      []string{".dockerconfigjson"},
+					Items:      []UpdateKSopsSecretItem{{Key: ".dockerconfigjson"}},
 				},
 				Recipients: []UpdateKSopsRecipient{
 					{
@@ -369,3 +371,1455 @@ data:
 		})
 	}
 }
+
+func TestLoadUpdateKSopsSecrets(t *testing.T) {
+	items, err := sdk.ParseKubeObjects([]byte(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test-db
+  annotations:
+    config.kubernetes.io/path: update-ksops-secrets-db.yaml
+    internal.config.kubernetes.io/path: update-ksops-secrets-db.yaml
+    test: test
+secret:
+  references:
+  - unencrypted-secrets
+  items:
+  - password
+recipients:
+- type: age
+  recipient: age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa
+---
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test-registry
+  annotations:
+    config.kubernetes.io/path: update-ksops-secrets-registry.yaml
+    internal.config.kubernetes.io/path: update-ksops-secrets-registry.yaml
+secret:
+  type: kubernetes.io/dockerconfigjson
+  references:
+  - unencrypted-secrets
+  items:
+  - .dockerconfigjson
+recipients:
+- type: age
+  recipient: age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: unencrypted-secrets
+stringData:
+  password: password
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+
+	testCases := []struct {
+		TestName       string
+		FunctionConfig string
+		ExpectedNames  []string
+		ExpectedError  error
+	}{
+		{
+			TestName: "functionConfig is also a resource",
+			FunctionConfig: `
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test-db
+secret:
+  references:
+  - unencrypted-secrets
+  items:
+  - password
+`,
+			ExpectedNames: []string{"test-db", "test-registry"},
+		},
+		{
+			TestName: "functionConfig is not a resource",
+			FunctionConfig: `
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test-app
+secret:
+  references:
+  - unencrypted-secrets
+  items:
+  - token
+`,
+			ExpectedNames: []string{"test-app", "test-db", "test-registry"},
+		},
+		{
+			TestName: "functionConfig list",
+			FunctionConfig: `
+apiVersion: v1
+kind: List
+items:
+- apiVersion: fn.kpt.dev/v1alpha1
+  kind: UpdateKSopsSecrets
+  metadata:
+    name: test-app
+  secret:
+    references:
+    - unencrypted-secrets
+    items:
+    - token
+- apiVersion: fn.kpt.dev/v1alpha1
+  kind: UpdateKSopsSecrets
+  metadata:
+    name: test-tls
+  secret:
+    type: kubernetes.io/tls
+    references:
+    - unencrypted-secrets
+    items:
+    - tls.crt
+    - tls.key
+`,
+			ExpectedNames: []string{"test-app", "test-tls", "test-db", "test-registry"},
+		},
+		{
+			TestName: "functionConfig list with invalid kind",
+			FunctionConfig: `
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: test-invalid
+`,
+			ExpectedError: fmt.Errorf("the functionConfig %s items must be a %s", listKind, fnConfigKind),
+		},
+		{
+			TestName: "functionConfig list with duplicated names",
+			FunctionConfig: `
+apiVersion: v1
+kind: List
+items:
+- apiVersion: fn.kpt.dev/v1alpha1
+  kind: UpdateKSopsSecrets
+  metadata:
+    name: test-app
+- apiVersion: fn.kpt.dev/v1alpha1
+  kind: UpdateKSopsSecrets
+  metadata:
+    name: test-app
+`,
+			ExpectedError: fmt.Errorf("the %s name 'test-app' is duplicated", fnConfigKind),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.TestName, func(t *testing.T) {
+			koConfig, err := sdk.ParseKubeObject([]byte(tc.FunctionConfig))
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			configs, err := LoadUpdateKSopsSecrets(koConfig, items)
+			if tc.ExpectedError != nil {
+				if err == nil || err.Error() != tc.ExpectedError.Error() {
+					t.Fatalf("Expected error %v, got %v", tc.ExpectedError, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			var names []string
+			for _, uks := range configs {
+				names = append(names, uks.GetName())
+			}
+
+			if !reflect.DeepEqual(names, tc.ExpectedNames) {
+				t.Errorf("Expected %#v, got %#v", tc.ExpectedNames, names)
+			}
+		})
+	}
+
+	t.Run("functionConfig path from the resource", func(t *testing.T) {
+		koConfig, err := sdk.ParseKubeObject([]byte(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test-registry
+`))
+		if err != nil {
+			t.Fatalf("Unexpected error, %v", err)
+		}
+
+		configs, err := LoadUpdateKSopsSecrets(koConfig, items)
+		if err != nil {
+			t.Fatalf("Unexpected error, %v", err)
+		}
+
+		expected := "update-ksops-secrets-registry.yaml"
+		if configs[0].Path != expected {
+			t.Errorf("Expected %s, got %s", expected, configs[0].Path)
+		}
+	})
+
+	t.Run("same names in different directories", func(t *testing.T) {
+		nested, err := sdk.ParseKubeObjects([]byte(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test-app
+  annotations:
+    internal.config.kubernetes.io/path: envs/prod/update-ksops-secrets.yaml
+---
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test-app
+  annotations:
+    internal.config.kubernetes.io/path: envs/staging/update-ksops-secrets.yaml
+`))
+		if err != nil {
+			t.Fatalf("Unexpected error, %v", err)
+		}
+
+		configs, err := LoadUpdateKSopsSecrets(nested[0], nested)
+		if err != nil {
+			t.Fatalf("Unexpected error, %v", err)
+		}
+
+		var dirs []string
+		for _, uks := range configs {
+			dirs = append(dirs, uks.GetDir())
+		}
+
+		expected := []string{"envs/prod", "envs/staging"}
+		if !reflect.DeepEqual(dirs, expected) {
+			t.Errorf("Expected %#v, got %#v", expected, dirs)
+		}
+	})
+
+	t.Run("providers of the package resource", func(t *testing.T) {
+		providers, err := sdk.ParseKubeObjects([]byte(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test-app
+  annotations:
+    internal.config.kubernetes.io/path: update-ksops-secrets-app.yaml
+secret:
+  items:
+  - key: token
+    from:
+      provider: pass
+recipients:
+- type: age
+  recipient: age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa
+providers:
+- name: pass
+  command: pass
+`))
+		if err != nil {
+			t.Fatalf("Unexpected error, %v", err)
+		}
+
+		// The same resource is accepted as the functionConfig
+		if _, err := LoadUpdateKSopsSecrets(providers[0], providers); err != nil {
+			t.Fatalf("Unexpected error, %v", err)
+		}
+
+		expected := fmt.Sprintf("invalid %s 'test-app' providers: the providers could only be set by the functionConfig", fnConfigKind)
+		if _, err := LoadUpdateKSopsSecrets(items[0], append(items, providers...)); err == nil || err.Error() != expected {
+			t.Errorf("Expected error %s, got %v", expected, err)
+		}
+	})
+
+	t.Run("file annotations are not passed to the secret", func(t *testing.T) {
+		uks := UpdateKSopsSecrets{}
+		if err := uks.Config(items[0]); err != nil {
+			t.Fatalf("Unexpected error, %v", err)
+		}
+
+		expected := map[string]string{"test": "test"}
+		if !reflect.DeepEqual(uks.GetAnnotations(), expected) {
+			t.Errorf("Expected %#v, got %#v", expected, uks.GetAnnotations())
+		}
+	})
+}
+
+func TestConfigOutput(t *testing.T) {
+	testCases := []struct {
+		TestName       string
+		Output         string
+		ExpectedOutput UpdateKSopsOutput
+		ExpectedError  error
+	}{
+		{
+			TestName: "custom layout",
+			Output: `
+  baseSecretsFile: secrets/base.yaml
+  generatedDir: secrets
+  encryptedFilePattern: secrets/{key}.enc.yaml
+  fingerprintFilePattern: .sops/{key}.fp.yaml
+`,
+			ExpectedOutput: UpdateKSopsOutput{
+				BaseSecretsFile:        "secrets/base.yaml",
+				GeneratedDir:           "secrets",
+				EncryptedFilePattern:   "secrets/{key}.enc.yaml",
+				FingerprintFilePattern: ".sops/{key}.fp.yaml",
+			},
+		},
+		{
+			TestName: "outside the package",
+			Output: `
+  generatedDir: ../secrets
+`,
+			ExpectedError: fmt.Errorf("invalid %s output: generatedDir '../secrets' must be a path in the package", fnConfigKind),
+		},
+		{
+			TestName: "not a YAML file",
+			Output: `
+  baseSecretsFile: secrets.txt
+`,
+			ExpectedError: fmt.Errorf("invalid %s output: baseSecretsFile 'secrets.txt' must be a YAML file", fnConfigKind),
+		},
+		{
+			TestName: "kustomization in a sub directory",
+			Output: `
+  kustomizationFile: secrets/kustomization.yaml
+`,
+			ExpectedError: fmt.Errorf("invalid %s output: kustomizationFile 'secrets/kustomization.yaml' must be a file name", fnConfigKind),
+		},
+		{
+			TestName: "pattern without key",
+			Output: `
+  encryptedFilePattern: secrets/{name}.enc.yaml
+`,
+			ExpectedError: fmt.Errorf("invalid %s output: file pattern 'secrets/{name}.enc.yaml' must contain {key}", fnConfigKind),
+		},
+		{
+			TestName: "same patterns",
+			Output: `
+  encryptedFilePattern: secrets/{key}.yaml
+  fingerprintFilePattern: secrets/{key}.yaml
+`,
+			ExpectedError: fmt.Errorf("invalid %s output: encryptedFilePattern and fingerprintFilePattern must be different", fnConfigKind),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.TestName, func(t *testing.T) {
+			koConfig, err := sdk.ParseKubeObject([]byte(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test-output
+output:` + tc.Output))
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			uks := UpdateKSopsSecrets{}
+			err = uks.Config(koConfig)
+			if tc.ExpectedError != nil {
+				if err == nil || err.Error() != tc.ExpectedError.Error() {
+					t.Fatalf("Expected error %v, got %v", tc.ExpectedError, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			if !reflect.DeepEqual(uks.Output, tc.ExpectedOutput) {
+				t.Errorf("Expected\n%#v,\ngot \n%#v", tc.ExpectedOutput, uks.Output)
+			}
+		})
+	}
+}
+
+func TestConfigSopsOptions(t *testing.T) {
+	macOnlyEncrypted := true
+
+	testCases := []struct {
+		TestName        string
+		Config          string
+		ExpectedOptions map[string]UpdateKSopsSopsOptions
+		ExpectedError   error
+	}{
+		{
+			TestName: "options with item overrides",
+			Config: `
+sops:
+  encryptedRegex: ^data$
+  macOnlyEncrypted: true
+secret:
+  items:
+    - test
+    - key: config.txt
+      sops:
+        encryptedCommentRegex: sops:enc
+`,
+			ExpectedOptions: map[string]UpdateKSopsSopsOptions{
+				"test": {
+					EncryptedRegex:   "^data$",
+					MACOnlyEncrypted: &macOnlyEncrypted,
+				},
+				"config.txt": {
+					EncryptedCommentRegex: "sops:enc",
+					MACOnlyEncrypted:      &macOnlyEncrypted,
+				},
+			},
+		},
+		{
+			TestName: "conflicting rules",
+			Config: `
+sops:
+  encryptedRegex: ^data$
+  unencryptedSuffix: _unencrypted
+`,
+			ExpectedError: fmt.Errorf("invalid %s sops options: only one of encryptedRegex, unencryptedSuffix and encryptedCommentRegex could be set", fnConfigKind),
+		},
+		{
+			TestName: "invalid regex",
+			Config: `
+secret:
+  items:
+    - key: test
+      sops:
+        encryptedCommentRegex: "("
+`,
+			ExpectedError: fmt.Errorf("invalid %s sops options: secret item 'test': encryptedCommentRegex '(' is invalid: error parsing regexp: missing closing ): `(`", fnConfigKind),
+		},
+		{
+			TestName: "negative shamir threshold",
+			Config: `
+sops:
+  shamirThreshold: -1
+`,
+			ExpectedError: fmt.Errorf("invalid %s sops options: shamirThreshold -1 must not be negative", fnConfigKind),
+		},
+		{
+			TestName: "empty item key",
+			Config: `
+secret:
+  items:
+    - sops:
+        encryptedRegex: ^data$
+`,
+			ExpectedError: fmt.Errorf("invalid %s secret items: secret item key must not be empty", fnConfigKind),
+		},
+		{
+			TestName: "unencrypted suffix",
+			Config: `
+secret:
+  items:
+    - key: test
+      sops:
+        unencryptedSuffix: _unencrypted
+`,
+			ExpectedOptions: map[string]UpdateKSopsSopsOptions{
+				"test": {UnencryptedSuffix: "_unencrypted"},
+			},
+		},
+		{
+			TestName: "unencrypted suffix of data",
+			Config: `
+sops:
+  unencryptedSuffix: Data
+`,
+			ExpectedError: fmt.Errorf("invalid %s sops options: unencryptedSuffix 'Data' must not be the suffix of the 'stringData' key", fnConfigKind),
+		},
+		{
+			TestName: "encrypted regex of identity fields",
+			Config: `
+sops:
+  encryptedRegex: ^(data|metadata)$
+`,
+			ExpectedError: fmt.Errorf("invalid %s sops options: encryptedRegex '^(data|metadata)$' must not match the Secret identity field 'metadata'", fnConfigKind),
+		},
+		{
+			TestName: "encrypted regex of annotations",
+			Config: `
+sops:
+  encryptedRegex: behavior
+`,
+			ExpectedError: fmt.Errorf("invalid %s sops options: encryptedRegex 'behavior' must not match the Secret identity field 'kustomize.config.k8s.io/behavior'", fnConfigKind),
+		},
+		{
+			TestName: "sops config reference without key",
+			Config: `
+sopsConfig:
+  name: sops-config
+`,
+			ExpectedError: fmt.Errorf("invalid %s sopsConfig: name and key must be set together", fnConfigKind),
+		},
+		{
+			TestName: "sops config unknown recipients mode",
+			Config: `
+sopsConfig:
+  recipients: replace
+`,
+			ExpectedError: fmt.Errorf("invalid %s sopsConfig: recipients 'replace' must be merge or override", fnConfigKind),
+		},
+		{
+			TestName: "sops config generate with reference",
+			Config: `
+sopsConfig:
+  name: sops-config
+  key: .sops.yaml
+  generate: true
+`,
+			ExpectedError: fmt.Errorf("invalid %s sopsConfig: generate is not supported with the referenced 'sops-config'", fnConfigKind),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.TestName, func(t *testing.T) {
+			koConfig, err := sdk.ParseKubeObject([]byte(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test-sops
+` + tc.Config))
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			uks := UpdateKSopsSecrets{}
+			err = uks.Config(koConfig)
+			if tc.ExpectedError != nil {
+				if err == nil || err.Error() != tc.ExpectedError.Error() {
+					t.Fatalf("Expected error %v, got %v", tc.ExpectedError, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			for key, expected := range tc.ExpectedOptions {
+				if actual := uks.GetSopsOptions(key); !reflect.DeepEqual(actual, expected) {
+					t.Errorf("Expected %s\n%#v,\ngot \n%#v", key, expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigSecretItems(t *testing.T) {
+	testCases := []struct {
+		TestName        string
+		Config          string
+		ExpectedSources map[string][2]string
+		ExpectedRefs    []string
+		ExpectedError   error
+	}{
+		{
+			TestName: "item sources",
+			Config: `
+secret:
+  references:
+    - app
+  items:
+    - url
+    - key: DATABASE_URL
+      from:
+        secret: legacy-db
+        key: url
+    - key: APP_URL
+      from:
+        key: url
+    - key: LEGACY_TOKEN
+      from:
+        secret: legacy-db
+`,
+			ExpectedSources: map[string][2]string{
+				"url":          {"", "url"},
+				"DATABASE_URL": {"legacy-db", "url"},
+				"APP_URL":      {"", "url"},
+				"LEGACY_TOKEN": {"legacy-db", "LEGACY_TOKEN"},
+			},
+			ExpectedRefs: []string{"legacy-db"},
+		},
+		{
+			TestName: "duplicate item keys",
+			Config: `
+secret:
+  items:
+    - DATABASE_URL
+    - key: DATABASE_URL
+      from:
+        secret: legacy-db
+`,
+			ExpectedError: fmt.Errorf("invalid %s secret items: duplicate secret item key 'DATABASE_URL'", fnConfigKind),
+		},
+		{
+			TestName: "empty item source",
+			Config: `
+secret:
+  items:
+    - key: DATABASE_URL
+      from: {}
+`,
+			ExpectedError: fmt.Errorf("invalid %s secret items: secret item 'DATABASE_URL': from must set the secret, the provider or the key", fnConfigKind),
+		},
+		{
+			TestName: "explicit precedence",
+			Config: `
+secret:
+  precedence: explicit
+  items:
+    - key: DATABASE_URL
+      from:
+        secret: legacy-db
+        key: url
+`,
+			ExpectedSources: map[string][2]string{
+				"DATABASE_URL": {"legacy-db", "url"},
+			},
+			ExpectedRefs: []string{"legacy-db"},
+		},
+		{
+			TestName: "explicit precedence without source secret",
+			Config: `
+secret:
+  precedence: explicit
+  items:
+    - key: DATABASE_URL
+      from:
+        key: url
+`,
+			ExpectedError: fmt.Errorf("invalid %s secret items: secret item 'DATABASE_URL': from.secret or from.provider must be set with the explicit precedence", fnConfigKind),
+		},
+		{
+			TestName: "providers",
+			Config: `
+providers:
+  - name: pass
+    command: pass
+    args:
+      - show
+    timeout: 10s
+secret:
+  precedence: explicit
+  items:
+    - key: DB_PASSWORD
+      from:
+        provider: pass
+        key: app/db-password
+`,
+			ExpectedSources: map[string][2]string{
+				"DB_PASSWORD": {"", "app/db-password"},
+			},
+		},
+		{
+			TestName: "unknown provider",
+			Config: `
+secret:
+  items:
+    - key: DB_PASSWORD
+      from:
+        provider: pass
+`,
+			ExpectedError: fmt.Errorf("invalid %s secret items: secret item 'DB_PASSWORD': unknown provider 'pass'", fnConfigKind),
+		},
+		{
+			TestName: "provider with secret",
+			Config: `
+providers:
+  - name: pass
+    command: pass
+secret:
+  items:
+    - key: DB_PASSWORD
+      from:
+        provider: pass
+        secret: app
+`,
+			ExpectedError: fmt.Errorf("invalid %s secret items: secret item 'DB_PASSWORD': only one of from.secret and from.provider could be set", fnConfigKind),
+		},
+		{
+			TestName: "provider without command",
+			Config: `
+providers:
+  - name: pass
+`,
+			ExpectedError: fmt.Errorf("invalid %s providers: 'pass' command must not be empty", fnConfigKind),
+		},
+		{
+			TestName: "provider invalid timeout",
+			Config: `
+providers:
+  - name: pass
+    command: pass
+    timeout: "10"
+`,
+			ExpectedError: fmt.Errorf("invalid %s providers: 'pass' timeout '10' must be a positive duration", fnConfigKind),
+		},
+		{
+			TestName: "duplicate providers",
+			Config: `
+providers:
+  - name: pass
+    command: pass
+  - name: pass
+    command: gopass
+`,
+			ExpectedError: fmt.Errorf("invalid %s providers: duplicate provider 'pass'", fnConfigKind),
+		},
+		{
+			TestName: "selectors",
+			Config: `
+secret:
+  items:
+    - DATABASE_URL
+  selectors:
+    - secret: app-env
+      all: true
+      exclude:
+        - DEBUG*
+    - secret: shared-env
+      includeRegex: ^SMTP_
+`,
+			ExpectedSources: map[string][2]string{
+				"DATABASE_URL": {"", "DATABASE_URL"},
+			},
+			ExpectedRefs: []string{"app-env", "shared-env"},
+		},
+		{
+			TestName: "selector without secret",
+			Config: `
+secret:
+  selectors:
+    - all: true
+`,
+			ExpectedError: fmt.Errorf("invalid %s secret items: secret selector 0: secret must not be empty", fnConfigKind),
+		},
+		{
+			TestName: "selector with all and include",
+			Config: `
+secret:
+  selectors:
+    - secret: app-env
+      all: true
+      include:
+        - DB_*
+`,
+			ExpectedError: fmt.Errorf("invalid %s secret items: secret selector 0: either all or the include patterns must be set", fnConfigKind),
+		},
+		{
+			TestName: "selector invalid glob",
+			Config: `
+secret:
+  selectors:
+    - secret: app-env
+      include:
+        - "DB_["
+`,
+			ExpectedError: fmt.Errorf("invalid %s secret items: secret selector 0: glob 'DB_[' is invalid: syntax error in pattern", fnConfigKind),
+		},
+		{
+			TestName: "selector invalid regex",
+			Config: `
+secret:
+  selectors:
+    - secret: app-env
+      all: true
+      excludeRegex: "("
+`,
+			ExpectedError: fmt.Errorf("invalid %s secret items: secret selector 0: regex '(' is invalid: error parsing regexp: missing closing ): `(`", fnConfigKind),
+		},
+		{
+			TestName: "unknown precedence",
+			Config: `
+secret:
+  precedence: first
+`,
+			ExpectedError: fmt.Errorf("invalid %s secret items: precedence 'first' must be one of order, error and explicit", fnConfigKind),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.TestName, func(t *testing.T) {
+			koConfig, err := sdk.ParseKubeObject([]byte(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test-items
+` + tc.Config))
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			uks := UpdateKSopsSecrets{}
+			err = uks.Config(koConfig)
+			if tc.ExpectedError != nil {
+				if err == nil || err.Error() != tc.ExpectedError.Error() {
+					t.Fatalf("Expected error %v, got %v", tc.ExpectedError, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			for key, expected := range tc.ExpectedSources {
+				name, sourceKey := uks.GetSecretItemSource(key)
+				if name != expected[0] || sourceKey != expected[1] {
+					t.Errorf("Expected %s source %v, got %s %s", key, expected, name, sourceKey)
+				}
+			}
+
+			if refs := uks.GetSecretItemReferences(); !reflect.DeepEqual(refs, tc.ExpectedRefs) {
+				t.Errorf("Expected references %v, got %v", tc.ExpectedRefs, refs)
+			}
+		})
+	}
+}
+
+func TestConfigRecipientGroups(t *testing.T) {
+	groups := `
+recipientGroups:
+  - name: ops
+    recipients:
+      - type: age
+        recipient: age1g505zftp900843tue0l5exwp6kdlu3xhv673wywgrvsp95xpmcgs2s7c2a
+  - name: security
+    recipients:
+      - type: age
+        recipient: age1vtgw4yfk7zsmfz2jthkkptwcmscnv5xu2lcw47r4v8a8vaxpuv5s5k7a33
+      - type: pgp
+        recipient: 380024A2AC1D3EBC9402BEE66E38309B4DA30118
+  - name: break-glass
+    recipients:
+      - type: age
+        recipient: age19vsg5chvk0phc5hxs79cp5shegmewa6p4em0htej4lchmv7t895q6gjqns
+`
+
+	testCases := []struct {
+		TestName               string
+		Config                 string
+		ExpectedRecipients     []UpdateKSopsRecipient
+		ExpectedError          error
+		ExpectedKeyGroupsError error
+	}{
+		{
+			TestName: "key groups with threshold",
+			Config: groups + `
+sops:
+  shamirThreshold: 2
+`,
+			ExpectedRecipients: []UpdateKSopsRecipient{
+				{Type: "age", Recipient: "age1g505zftp900843tue0l5exwp6kdlu3xhv673wywgrvsp95xpmcgs2s7c2a"},
+				{Type: "age", Recipient: "age1vtgw4yfk7zsmfz2jthkkptwcmscnv5xu2lcw47r4v8a8vaxpuv5s5k7a33", KeyGroup: 1},
+				{Type: "pgp", Recipient: "380024A2AC1D3EBC9402BEE66E38309B4DA30118", KeyGroup: 1},
+				{Type: "age", Recipient: "age19vsg5chvk0phc5hxs79cp5shegmewa6p4em0htej4lchmv7t895q6gjqns", KeyGroup: 2},
+			},
+		},
+		{
+			TestName: "recipients only",
+			Config: `
+recipients:
+  - type: age
+    recipient: age1g505zftp900843tue0l5exwp6kdlu3xhv673wywgrvsp95xpmcgs2s7c2a
+`,
+			ExpectedRecipients: []UpdateKSopsRecipient{
+				{Type: "age", Recipient: "age1g505zftp900843tue0l5exwp6kdlu3xhv673wywgrvsp95xpmcgs2s7c2a"},
+			},
+		},
+		{
+			TestName: "recipients and key groups",
+			Config: groups + `
+recipients:
+  - type: age
+    recipient: age1g505zftp900843tue0l5exwp6kdlu3xhv673wywgrvsp95xpmcgs2s7c2a
+`,
+			ExpectedError: fmt.Errorf("invalid %s recipientGroups: recipients and recipientGroups could not be set together", fnConfigKind),
+		},
+		{
+			TestName: "empty key group",
+			Config: `
+recipientGroups:
+  - name: ops
+`,
+			ExpectedError: fmt.Errorf("invalid %s recipientGroups: group 0 'ops' has no recipients", fnConfigKind),
+		},
+		{
+			TestName: "threshold over key groups",
+			Config: groups + `
+sops:
+  shamirThreshold: 4
+`,
+			ExpectedKeyGroupsError: fmt.Errorf("shamirThreshold 4 must not be greater than the number of key groups"),
+		},
+		{
+			TestName: "threshold of one key group",
+			Config: groups + `
+sops:
+  shamirThreshold: 1
+`,
+			ExpectedKeyGroupsError: fmt.Errorf("shamirThreshold must be at least 2 for 3 key groups"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.TestName, func(t *testing.T) {
+			koConfig, err := sdk.ParseKubeObject([]byte(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test-recipient-groups
+` + tc.Config))
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			uks := UpdateKSopsSecrets{}
+			err = uks.Config(koConfig)
+			if tc.ExpectedError != nil {
+				if err == nil || err.Error() != tc.ExpectedError.Error() {
+					t.Fatalf("Expected error %v, got %v", tc.ExpectedError, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			recipients := uks.GetRecipients()
+			keyGroups := KeyGroups(recipients...)
+			err = uks.Sops.ValidateKeyGroups(len(keyGroups))
+			if tc.ExpectedKeyGroupsError != nil {
+				if err == nil || err.Error() != tc.ExpectedKeyGroupsError.Error() {
+					t.Fatalf("Expected key groups error %v, got %v", tc.ExpectedKeyGroupsError, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected key groups error, %v", err)
+			}
+
+			if !reflect.DeepEqual(recipients, tc.ExpectedRecipients) {
+				t.Errorf("Expected\n%#v,\ngot \n%#v", tc.ExpectedRecipients, recipients)
+			}
+
+			if expected := len(uks.RecipientGroups); expected > 0 && len(keyGroups) != expected {
+				t.Errorf("Expected %d key groups, got %d", expected, len(keyGroups))
+			}
+		})
+	}
+}
+
+func TestConfigRecipientPublicKeySources(t *testing.T) {
+	testCases := []struct {
+		TestName      string
+		Config        string
+		ExpectedError error
+	}{
+		{
+			TestName: "public key file",
+			Config: `
+recipients:
+  - type: pgp
+    recipient: 380024A2AC1D3EBC9402BEE66E38309B4DA30118
+    publicKeyFile: keys/380024A2AC1D3EBC9402BEE66E38309B4DA30118.asc
+`,
+		},
+		{
+			TestName: "age recipients file",
+			Config: `
+recipients:
+  - type: age
+    publicKeyConfigMapReference:
+      name: public-keys
+      key: age.txt
+`,
+		},
+		{
+			TestName: "multiple public key sources",
+			Config: `
+recipients:
+  - type: pgp
+    recipient: 380024A2AC1D3EBC9402BEE66E38309B4DA30118
+    publicKeyFile: keys/380024A2AC1D3EBC9402BEE66E38309B4DA30118.asc
+    publicKeyConfigMapReference:
+      name: public-keys
+      key: pgp.asc
+`,
+			ExpectedError: fmt.Errorf("[error] %s/%s/test-recipients recipients[0]: only one of publicKeySecretReference, publicKeyConfigMapReference and publicKeyFile could be set", fnConfigAPIVersion, fnConfigKind),
+		},
+		{
+			TestName: "public key file outside the package",
+			Config: `
+recipients:
+  - type: pgp
+    recipient: 380024A2AC1D3EBC9402BEE66E38309B4DA30118
+    publicKeyFile: ../keys/380024A2AC1D3EBC9402BEE66E38309B4DA30118.asc
+`,
+			ExpectedError: fmt.Errorf("[error] %s/%s/test-recipients recipients[0].publicKeyFile: publicKeyFile '../keys/380024A2AC1D3EBC9402BEE66E38309B4DA30118.asc' must be a path in the package", fnConfigAPIVersion, fnConfigKind),
+		},
+		{
+			TestName: "pgp recipient without fingerprint",
+			Config: `
+recipients:
+  - type: pgp
+    publicKeyFile: keys/380024A2AC1D3EBC9402BEE66E38309B4DA30118.asc
+`,
+			ExpectedError: fmt.Errorf("[error] %s/%s/test-recipients recipients[0].recipient: recipient must not be empty", fnConfigAPIVersion, fnConfigKind),
+		},
+		{
+			TestName: "pgp recipient short key id",
+			Config: `
+recipients:
+  - type: pgp
+    recipient: 4DA30118
+`,
+			ExpectedError: fmt.Errorf("[error] %s/%s/test-recipients recipients[0].recipient: pgp recipient '4DA30118' must be the full 40 hex fingerprint", fnConfigAPIVersion, fnConfigKind),
+		},
+		{
+			TestName: "pgp recipient long key id",
+			Config: `
+recipients:
+  - type: pgp
+    recipient: 6E38309B4DA30118
+`,
+			ExpectedError: fmt.Errorf("[error] %s/%s/test-recipients recipients[0].recipient: pgp recipient '6E38309B4DA30118' must be the full 40 hex fingerprint", fnConfigAPIVersion, fnConfigKind),
+		},
+		{
+			TestName: "pgp recipient group email",
+			Config: `
+recipientGroups:
+  - recipients:
+      - type: pgp
+        recipient: ops@example.com
+`,
+			ExpectedError: fmt.Errorf("[error] %s/%s/test-recipients recipientGroups[0].recipients[0].recipient: pgp recipient 'ops@example.com' must be the full 40 hex fingerprint", fnConfigAPIVersion, fnConfigKind),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.TestName, func(t *testing.T) {
+			koConfig, err := sdk.ParseKubeObject([]byte(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test-recipients
+` + tc.Config))
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			uks := UpdateKSopsSecrets{}
+			err = uks.Config(koConfig)
+			if tc.ExpectedError != nil {
+				if err == nil || err.Error() != tc.ExpectedError.Error() {
+					t.Fatalf("Expected error %v, got %v", tc.ExpectedError, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+		})
+	}
+}
+
+func TestConfigKeyserver(t *testing.T) {
+	testCases := []struct {
+		TestName          string
+		Config            string
+		ExpectedKeyserver UpdateKSopsKeyserver
+		ExpectedError     error
+	}{
+		{
+			TestName: "default keyserver",
+			Config: `
+keyserver:
+  url: hkps://keys.example.com
+recipients:
+  - type: pgp
+    recipient: 380024A2AC1D3EBC9402BEE66E38309B4DA30118
+`,
+			ExpectedKeyserver: UpdateKSopsKeyserver{URL: "hkps://keys.example.com"},
+		},
+		{
+			TestName: "recipient wkd with default keyserver",
+			Config: `
+keyserver:
+  url: hkps://keys.example.com
+recipients:
+  - type: pgp
+    recipient: 380024A2AC1D3EBC9402BEE66E38309B4DA30118
+    keyserver:
+      wkd: alice@example.com
+`,
+			ExpectedKeyserver: UpdateKSopsKeyserver{URL: "hkps://keys.example.com", WKD: "alice@example.com"},
+		},
+		{
+			TestName: "recipient keyserver overrides",
+			Config: `
+keyserver:
+  url: hkps://keys.example.com
+recipients:
+  - type: pgp
+    recipient: 380024A2AC1D3EBC9402BEE66E38309B4DA30118
+    keyserver:
+      url: hkp://keys.internal:11371
+`,
+			ExpectedKeyserver: UpdateKSopsKeyserver{URL: "hkp://keys.internal:11371"},
+		},
+		{
+			TestName: "invalid keyserver scheme",
+			Config: `
+keyserver:
+  url: ldap://keys.example.com
+recipients:
+  - type: pgp
+    recipient: 380024A2AC1D3EBC9402BEE66E38309B4DA30118
+`,
+			ExpectedError: fmt.Errorf("invalid %s keyserver: url 'ldap://keys.example.com' scheme must be one of hkp, hkps, http and https", fnConfigKind),
+		},
+		{
+			TestName: "default keyserver wkd",
+			Config: `
+keyserver:
+  wkd: alice@example.com
+recipients:
+  - type: pgp
+    recipient: 380024A2AC1D3EBC9402BEE66E38309B4DA30118
+`,
+			ExpectedError: fmt.Errorf("invalid %s keyserver: wkd must be set per recipient", fnConfigKind),
+		},
+		{
+			TestName: "invalid wkd email",
+			Config: `
+recipients:
+  - type: pgp
+    recipient: 380024A2AC1D3EBC9402BEE66E38309B4DA30118
+    keyserver:
+      wkd: example.com
+`,
+			ExpectedError: fmt.Errorf("[error] %s/%s/test-keyserver recipients[0].keyserver: wkd 'example.com' must be an email address", fnConfigAPIVersion, fnConfigKind),
+		},
+		{
+			TestName: "keyserver of age recipient",
+			Config: `
+recipients:
+  - type: age
+    recipient: age1q4fnulh3w7u93uxngxxg9ndrjjke0fg3rya9zlns2yw3dekk5uxsqzqs24
+    keyserver:
+      url: hkps://keys.example.com
+`,
+			ExpectedError: fmt.Errorf("[error] %s/%s/test-keyserver recipients[0].keyserver: keyserver could only be set for the pgp recipient", fnConfigAPIVersion, fnConfigKind),
+		},
+		{
+			TestName: "keyserver with public key source",
+			Config: `
+recipients:
+  - type: pgp
+    recipient: 380024A2AC1D3EBC9402BEE66E38309B4DA30118
+    publicKeyFile: keys/380024A2AC1D3EBC9402BEE66E38309B4DA30118.asc
+    keyserver:
+      url: hkps://keys.example.com
+`,
+			ExpectedError: fmt.Errorf("[error] %s/%s/test-keyserver recipients[0].keyserver: keyserver could not be set together with the public key source", fnConfigAPIVersion, fnConfigKind),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.TestName, func(t *testing.T) {
+			koConfig, err := sdk.ParseKubeObject([]byte(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test-keyserver
+` + tc.Config))
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			uks := UpdateKSopsSecrets{}
+			err = uks.Config(koConfig)
+			if tc.ExpectedError != nil {
+				if err == nil || err.Error() != tc.ExpectedError.Error() {
+					t.Fatalf("Expected error %v, got %v", tc.ExpectedError, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			keyserver := uks.GetKeyserver(uks.GetRecipients()[0])
+			if !reflect.DeepEqual(keyserver, tc.ExpectedKeyserver) {
+				t.Errorf("Expected keyserver %v, got %v", tc.ExpectedKeyserver, keyserver)
+			}
+		})
+	}
+}
+
+func TestConfigRecipientValidation(t *testing.T) {
+	testCases := []struct {
+		TestName       string
+		Config         string
+		ExpectedFields map[string]string
+	}{
+		{
+			TestName: "valid recipients",
+			Config: `
+recipients:
+  - type: age
+    recipient: age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa
+  - type: pgp
+    recipient: 380024A2AC1D3EBC9402BEE66E38309B4DA30118
+  - type: ssh
+    recipient: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILqk4EhAuCsl8EwxgLLug+O0Eo6GdZnpSCJfU76iFNND ops@example.com
+  - type: ssh
+    recipient: ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQClRdlLUBR2DApovXEeeeNldOgES33YajjFnuIZNSkD1WClFgUuyiPRgwMisEXrL39SY4Z0PbwaRJrLOb+1XEoH24hZ1vRLD69UruhSJB3B1bP3gyqNwCiE5+/zrRO7uWgmDUBOizMNEvUAdgCV8I+OjGJaFR5RstEaegyV0c3LxS1xorLM18jjB/QTyAfjcyAeNye+3eO91ODLrSsqmQyEmEKb/4kLTNS9L/Uq1aWZFOUeduXOchEh/+IrKk6YGF8C+JQkwdF/ffWrGkWjS9B/Jb6II6Hz1lufo2fqkChzH5FfeoPFQtrps4RxSUizIi2jKHqMY9rNUH8mrAs07kXx
+  - type: ssh
+    publicKeyFile: keys/ops.keys
+  - type: vault
+    recipient: transit/keys/sops
+  - type: vault
+    recipient: secrets/team/transit/keys/app
+`,
+		},
+		{
+			TestName: "cloud KMS recipients",
+			Config: `
+keyservices:
+  - tcp://keyservice.example.com:5000
+recipients:
+  - type: awskms
+    recipient: arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab
+  - type: awskms
+    recipient: arn:aws:kms:us-east-1:123456789012:alias/sops+arn:aws:iam::123456789012:role/sops
+  - type: gcpkms
+    recipient: projects/test/locations/global/keyRings/sops/cryptoKeys/sops
+  - type: azurekv
+    recipient: https://sops.vault.azure.net/keys/sops/0123456789abcdef
+`,
+		},
+		{
+			TestName: "invalid cloud KMS recipients",
+			Config: `
+keyservices:
+  - unix:///run/sops/keyservice.sock
+recipients:
+  - type: awskms
+    recipient: arn:aws:iam::123456789012:role/sops
+  - type: awskms
+    recipient: arn:aws:kms:us-east-1:123456789012:key/sops+admin
+  - type: gcpkms
+    recipient: projects/test/cryptoKeys/sops
+  - type: azurekv
+    recipient: https://sops.vault.azure.net/keys/sops
+`,
+			ExpectedFields: map[string]string{
+				"recipients[0].recipient": "awskms recipient 'arn:aws:iam::123456789012:role/sops' must be the KMS key ARN",
+				"recipients[1].recipient": "awskms recipient 'arn:aws:kms:us-east-1:123456789012:key/sops+admin' role must be the IAM role ARN",
+				"recipients[2].recipient": "gcpkms recipient 'projects/test/cryptoKeys/sops' must be the resource ID projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key>",
+				"recipients[3].recipient": "azurekv recipient 'https://sops.vault.azure.net/keys/sops' must be the key URL https://<vault>/keys/<name>/<version>",
+			},
+		},
+		{
+			TestName: "cloud KMS recipients without keyservices",
+			Config: `
+recipients:
+  - type: gcpkms
+    recipient: projects/test/locations/global/keyRings/sops/cryptoKeys/sops
+`,
+			ExpectedFields: map[string]string{
+				"recipients[0].type": "the gcpkms recipient requires the keyservices",
+			},
+		},
+		{
+			TestName: "invalid vault recipients",
+			Config: `
+recipients:
+  - type: vault
+    recipient: transit/sops
+  - type: vault
+    recipient: transit/keys/
+  - type: vault
+    recipient: transit/keys/sops
+    publicKeyFile: keys/sops.asc
+`,
+			ExpectedFields: map[string]string{
+				"recipients[0].recipient": "vault recipient 'transit/sops' must be the transit key path <engine path>/keys/<key name>",
+				"recipients[1].recipient": "vault recipient 'transit/keys/' must be the transit key path <engine path>/keys/<key name>",
+				"recipients[2]":           "the public key source could not be set for the vault recipient",
+			},
+		},
+		{
+			TestName: "invalid ssh recipients",
+			Config: `
+recipients:
+  - type: age
+    recipient: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILqk4EhAuCsl8EwxgLLug+O0Eo6GdZnpSCJfU76iFNND
+  - type: ssh
+    recipient: ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBA+Eydr5SlN7iaq/vbHi6eTkJBFjYp2xNxpLoSAVsE7Tqhyhx0swN04eqIAsHmfLeL6YiS8WgpozBLNQTTx0+HA=
+`,
+			ExpectedFields: map[string]string{
+				"recipients[0].recipient": "age recipient must be a bech32 age public key, the ssh public keys are the ssh type recipients",
+				"recipients[1].recipient": "ssh recipient must be a ssh-ed25519 or ssh-rsa public key, unknown SSH recipient type: \"ecdsa-sha2-nistp256\"",
+			},
+		},
+		{
+			TestName: "all problems reported",
+			Config: `
+recipients:
+  - type: age
+    recipient: age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaac
+  - type: gpg
+    recipient: 380024A2AC1D3EBC9402BEE66E38309B4DA30118
+  - type: pgp
+    recipient: 380024A2AC1D3EBC9402BEE66E38309B4DA30118
+  - type: pgp
+    recipient: 380024a2ac1d3ebc9402bee66e38309b4da30118
+`,
+			ExpectedFields: map[string]string{
+				"recipients[0].recipient": `age recipient must be a bech32 age public key, malformed recipient "age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaac": invalid checksum`,
+				"recipients[1].type":      "unsupported recipient type 'gpg', must be one of age, pgp, ssh, vault, awskms, gcpkms, azurekv",
+				"recipients[3].recipient": "duplicate recipient of recipients[2].recipient",
+			},
+		},
+		{
+			TestName: "duplicates of the same key group",
+			Config: `
+recipientGroups:
+  - recipients:
+      - type: age
+        recipient: age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa
+  - recipients:
+      - type: age
+        recipient: age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa
+      - type: age
+        recipient: age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa
+`,
+			ExpectedFields: map[string]string{
+				"recipientGroups[1].recipients[1].recipient": "duplicate recipient of recipientGroups[1].recipients[0].recipient",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.TestName, func(t *testing.T) {
+			koConfig, err := sdk.ParseKubeObject([]byte(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test-recipients
+  annotations:
+    config.kubernetes.io/path: update-ksops-secrets.yaml
+` + tc.Config))
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			uks := UpdateKSopsSecrets{}
+			err = uks.Config(koConfig)
+			if len(tc.ExpectedFields) == 0 {
+				if err != nil {
+					t.Fatalf("Unexpected error, %v", err)
+				}
+				return
+			}
+
+			var results framework.Results
+			if !errors.As(err, &results) {
+				t.Fatalf("Expected results, got %v", err)
+			}
+
+			fields := map[string]string{}
+			for _, result := range results {
+				if result.Severity != framework.Error || result.ResourceRef.Name != "test-recipients" ||
+					result.File.Path != "update-ksops-secrets.yaml" {
+					t.Errorf("Unexpected result %v", result)
+				}
+				fields[result.Field.Path] = result.Message
+			}
+
+			if !reflect.DeepEqual(fields, tc.ExpectedFields) {
+				t.Errorf("Expected fields %v, got %v", tc.ExpectedFields, fields)
+			}
+		})
+	}
+}
+
+func TestConfigKeyservices(t *testing.T) {
+	testCases := []struct {
+		TestName      string
+		Keyservices   string
+		ExpectedError error
+	}{
+		{
+			TestName: "tcp and unix keyservices",
+			Keyservices: `
+  - tcp://localhost:5000
+  - unix:///run/sops/keyservice.sock
+`,
+		},
+		{
+			TestName: "invalid keyservice scheme",
+			Keyservices: `
+  - https://keyservice.example.com
+`,
+			ExpectedError: fmt.Errorf("invalid %s keyservices: 'https://keyservice.example.com' scheme must be one of tcp and unix", fnConfigKind),
+		},
+		{
+			TestName: "keyservice without address",
+			Keyservices: `
+  - tcp://
+`,
+			ExpectedError: fmt.Errorf("invalid %s keyservices: 'tcp://' has no address", fnConfigKind),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.TestName, func(t *testing.T) {
+			koConfig, err := sdk.ParseKubeObject([]byte(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test-keyservices
+recipients:
+  - type: awskms
+    recipient: arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab
+keyservices:` + tc.Keyservices))
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			uks := UpdateKSopsSecrets{}
+			err = uks.Config(koConfig)
+			if tc.ExpectedError != nil {
+				if err == nil || err.Error() != tc.ExpectedError.Error() {
+					t.Fatalf("Expected error %v, got %v", tc.ExpectedError, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			if len(uks.Keyservices) != 2 {
+				t.Errorf("Expected 2 keyservices, got %v", uks.Keyservices)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	sdk "github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+)
+
+const recipientDirectoryKind = "RecipientDirectory"
+
+// RecipientDirectory maps the names of the people, the teams and the CI to
+// their recipients, the UpdateKSopsSecrets recipients reference them by name
+// or team, all the directories of the packages are merged
+type RecipientDirectory struct {
+	Members []RecipientDirectoryMember `json:"members" yaml:"members"`
+	Teams   []RecipientDirectoryTeam   `json:"teams,omitempty" yaml:"teams,omitempty"`
+
+	// members and teams index the merged directories by name
+	members map[string][]UpdateKSopsRecipient
+	teams   map[string][]string
+}
+
+// RecipientDirectoryMember is the person or the CI with its recipients
+type RecipientDirectoryMember struct {
+	Name       string                 `json:"name" yaml:"name"`
+	Recipients []UpdateKSopsRecipient `json:"recipients" yaml:"recipients"`
+}
+
+// RecipientDirectoryTeam lists the member names of the team
+type RecipientDirectoryTeam struct {
+	Name    string   `json:"name" yaml:"name"`
+	Members []string `json:"members" yaml:"members"`
+}
+
+// IsRecipientDirectory reports whether the resource is a RecipientDirectory
+func IsRecipientDirectory(ko *sdk.KubeObject) bool {
+	return validGVK(ko, fnConfigAPIVersion, recipientDirectoryKind)
+}
+
+// LoadRecipientDirectory merges all the RecipientDirectory resources, nil is
+// returned if there is none, every problem is a result of its field
+func LoadRecipientDirectory(items sdk.KubeObjects) (*RecipientDirectory, error) {
+	type resource struct {
+		name, file string
+		directory  RecipientDirectory
+	}
+
+	var resources []resource
+	for _, ko := range items.Where(IsRecipientDirectory) {
+		r := resource{name: ko.GetName(), file: filePath(ko)}
+		if err := ko.As(&r.directory); err != nil {
+			return nil, fmt.Errorf("unable to convert the %s '%s':\n%w",
+				recipientDirectoryKind, ko.GetName(), err)
+		}
+
+		resources = append(resources, r)
+	}
+
+	if len(resources) == 0 {
+		return nil, nil
+	}
+
+	merged := &RecipientDirectory{
+		members: map[string][]UpdateKSopsRecipient{},
+		teams:   map[string][]string{},
+	}
+
+	var results framework.Results
+	addResult := func(r resource, field, message string) {
+		results = append(results, fieldResult(recipientDirectoryKind, r.name, r.file, field, message))
+	}
+
+	// The members are merged ahead of the teams of any directory
+	for _, r := range resources {
+		for i, member := range r.directory.Members {
+			path := fmt.Sprintf("members[%d]", i)
+			if member.Name == "" {
+				addResult(r, path+".name", "name must not be empty")
+				continue
+			}
+
+			if _, found := merged.members[member.Name]; found {
+				addResult(r, path+".name", fmt.Sprintf("duplicate member '%s'", member.Name))
+				continue
+			}
+
+			if len(member.Recipients) == 0 {
+				addResult(r, path+".recipients", "recipients must not be empty")
+				continue
+			}
+
+			for j, recipient := range member.Recipients {
+				if field, err := recipient.validateMember(); err != nil {
+					addResult(r, fmt.Sprintf("%s.recipients[%d]%s", path, j, field), err.Error())
+				}
+			}
+
+			merged.members[member.Name] = member.Recipients
+		}
+	}
+
+	for _, r := range resources {
+		for i, team := range r.directory.Teams {
+			path := fmt.Sprintf("teams[%d]", i)
+			if team.Name == "" {
+				addResult(r, path+".name", "name must not be empty")
+				continue
+			}
+
+			if _, found := merged.teams[team.Name]; found {
+				addResult(r, path+".name", fmt.Sprintf("duplicate team '%s'", team.Name))
+				continue
+			}
+
+			if len(team.Members) == 0 {
+				addResult(r, path+".members", "members must not be empty")
+				continue
+			}
+
+			for j, name := range team.Members {
+				if _, found := merged.members[name]; !found {
+					addResult(r, fmt.Sprintf("%s.members[%d]", path, j), fmt.Sprintf("unknown member '%s'", name))
+				}
+			}
+
+			merged.teams[team.Name] = team.Members
+		}
+	}
+
+	if len(results) > 0 {
+		return nil, results
+	}
+
+	return merged, nil
+}
+
+// Resolve returns the recipients of the referenced member or team members in
+// the key group of the reference
+func (d *RecipientDirectory) Resolve(r UpdateKSopsRecipient) ([]UpdateKSopsRecipient, error) {
+	if d == nil {
+		return nil, fmt.Errorf("unknown %s '%s', no %s found", r.referenceKind(), r.Name+r.Team,
+			recipientDirectoryKind)
+	}
+
+	names := []string{r.Name}
+	if r.Team != "" {
+		var found bool
+		if names, found = d.teams[r.Team]; !found {
+			return nil, fmt.Errorf("unknown team '%s' in the %s", r.Team, recipientDirectoryKind)
+		}
+	}
+
+	var resolved []UpdateKSopsRecipient
+	for _, name := range names {
+		recipients, found := d.members[name]
+		if !found {
+			return nil, fmt.Errorf("unknown name '%s' in the %s", name, recipientDirectoryKind)
+		}
+
+		for _, recipient := range recipients {
+			recipient.KeyGroup = r.KeyGroup
+			resolved = append(resolved, recipient)
+		}
+	}
+
+	return resolved, nil
+}
+
+// IsReference reports whether the recipient references the RecipientDirectory
+// member or team
+func (r UpdateKSopsRecipient) IsReference() bool {
+	return r.Name != "" || r.Team != ""
+}
+
+func (r UpdateKSopsRecipient) referenceKind() string {
+	if r.Team != "" {
+		return "team"
+	}
+
+	return "name"
+}
+
+// validateReference returns the error with the relative path of the invalid
+// field, the reference could not be set together with the recipient fields
+func (r UpdateKSopsRecipient) validateReference() (field string, err error) {
+	if r.Name != "" && r.Team != "" {
+		return "", fmt.Errorf("only one of name and team could be set")
+	}
+
+	if r.Type != "" || r.Recipient != "" || r.HasPublicKeySource() || !r.Keyserver.IsEmpty() {
+		return "", fmt.Errorf("the %s reference could not be set together with the type, recipient, public key source and keyserver",
+			r.referenceKind())
+	}
+
+	return "", nil
+}
+
+// validateMember validates the recipient of the RecipientDirectory member,
+// the public keys are listed inline as the directory is shared by packages
+func (r UpdateKSopsRecipient) validateMember() (field string, err error) {
+	if r.IsReference() {
+		return "", fmt.Errorf("the member recipient could not reference the name or team")
+	}
+
+	if !sliceContainsString(RecipientTypes, r.Type) {
+		return ".type", fmt.Errorf("unsupported recipient type '%s', must be one of %s",
+			r.Type, strings.Join(RecipientTypes, ", "))
+	}
+
+	if r.HasPublicKeySource() {
+		return "", fmt.Errorf("the public key source could not be set for the member recipient")
+	}
+
+	if field, err := r.validate(); err != nil {
+		return field, err
+	}
+
+	if err := r.validateKey(); err != nil {
+		return ".recipient", err
+	}
+
+	return "", nil
+}
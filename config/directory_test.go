@@ -0,0 +1,286 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	sdk "github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+)
+
+const (
+	testDirectoryAliceAge = "age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa"
+	testDirectoryBobPGP   = "380024A2AC1D3EBC9402BEE66E38309B4DA30118"
+	testDirectoryCIAge    = "age1q4fnulh3w7u93uxngxxg9ndrjjke0fg3rya9zlns2yw3dekk5uxsqzqs24"
+)
+
+const testRecipientDirectory = `
+apiVersion: fn.kpt.dev/v1alpha1
+kind: RecipientDirectory
+metadata:
+  name: engineering
+  annotations:
+    config.kubernetes.io/local-config: "true"
+    internal.config.kubernetes.io/path: recipients.yaml
+members:
+  - name: alice
+    recipients:
+      - type: age
+        recipient: ` + testDirectoryAliceAge + `
+  - name: bob
+    recipients:
+      - type: pgp
+        recipient: ` + testDirectoryBobPGP + `
+teams:
+  - name: platform
+    members:
+      - alice
+      - bob
+---
+apiVersion: fn.kpt.dev/v1alpha1
+kind: RecipientDirectory
+metadata:
+  name: ci
+  annotations:
+    internal.config.kubernetes.io/path: ci/recipients.yaml
+members:
+  - name: ci
+    recipients:
+      - type: age
+        recipient: ` + testDirectoryCIAge + `
+teams:
+  - name: deploy
+    members:
+      - alice
+      - ci
+`
+
+func TestLoadRecipientDirectory(t *testing.T) {
+	testCases := []struct {
+		TestName       string
+		Directory      string
+		ExpectedFields map[string]string
+	}{
+		{
+			TestName:  "merged directories",
+			Directory: testRecipientDirectory,
+		},
+		{
+			TestName: "invalid directory",
+			Directory: `
+apiVersion: fn.kpt.dev/v1alpha1
+kind: RecipientDirectory
+metadata:
+  name: engineering
+members:
+  - name: alice
+    recipients:
+      - type: age
+        recipient: age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaac
+  - name: alice
+    recipients:
+      - type: age
+        recipient: ` + testDirectoryAliceAge + `
+  - name: bob
+    recipients:
+      - type: pgp
+        recipient: ` + testDirectoryBobPGP + `
+        publicKeyFile: keys/bob.asc
+  - name: carol
+    recipients: []
+  - name: ci
+    recipients:
+      - team: platform
+teams:
+  - name: platform
+    members:
+      - alice
+      - dave
+`,
+			ExpectedFields: map[string]string{
+				"members[0].recipients[0].recipient": `age recipient must be a bech32 age public key, malformed recipient "age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaac": invalid checksum`,
+				"members[1].name":                    "duplicate member 'alice'",
+				"members[2].recipients[0]":           "the public key source could not be set for the member recipient",
+				"members[3].recipients":              "recipients must not be empty",
+				"members[4].recipients[0]":           "the member recipient could not reference the name or team",
+				"teams[0].members[1]":                "unknown member 'dave'",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.TestName, func(t *testing.T) {
+			items, err := sdk.ParseKubeObjects([]byte(tc.Directory))
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			directory, err := LoadRecipientDirectory(items)
+			if len(tc.ExpectedFields) == 0 {
+				if err != nil || directory == nil {
+					t.Fatalf("Unexpected error, %v", err)
+				}
+				return
+			}
+
+			var results framework.Results
+			if !errors.As(err, &results) {
+				t.Fatalf("Expected results, got %v", err)
+			}
+
+			fields := map[string]string{}
+			for _, result := range results {
+				if result.ResourceRef.Kind != recipientDirectoryKind || result.ResourceRef.Name != "engineering" {
+					t.Errorf("Unexpected result %v", result)
+				}
+				fields[result.Field.Path] = result.Message
+			}
+
+			if !reflect.DeepEqual(fields, tc.ExpectedFields) {
+				t.Errorf("Expected fields %v, got %v", tc.ExpectedFields, fields)
+			}
+		})
+	}
+}
+
+func TestRecipientDirectoryReferences(t *testing.T) {
+	testCases := []struct {
+		TestName           string
+		Config             string
+		Directory          string
+		ExpectedRecipients []UpdateKSopsRecipient
+		ExpectedFields     map[string]string
+	}{
+		{
+			TestName: "name and team references",
+			Config: `
+recipients:
+  - team: platform
+  - name: ci
+  - name: alice
+`,
+			Directory: testRecipientDirectory,
+			ExpectedRecipients: []UpdateKSopsRecipient{
+				{Type: "age", Recipient: testDirectoryAliceAge},
+				{Type: "pgp", Recipient: testDirectoryBobPGP},
+				{Type: "age", Recipient: testDirectoryCIAge},
+			},
+		},
+		{
+			TestName: "references of the key groups",
+			Config: `
+recipientGroups:
+  - recipients:
+      - team: deploy
+  - recipients:
+      - name: alice
+      - name: bob
+`,
+			Directory: testRecipientDirectory,
+			ExpectedRecipients: []UpdateKSopsRecipient{
+				{Type: "age", Recipient: testDirectoryAliceAge},
+				{Type: "age", Recipient: testDirectoryCIAge},
+				{Type: "age", Recipient: testDirectoryAliceAge, KeyGroup: 1},
+				{Type: "pgp", Recipient: testDirectoryBobPGP, KeyGroup: 1},
+			},
+		},
+		{
+			TestName: "unknown references",
+			Config: `
+recipients:
+  - name: carol
+  - team: security
+  - team: platform
+`,
+			Directory: testRecipientDirectory,
+			ExpectedFields: map[string]string{
+				"recipients[0].name": "unknown name 'carol' in the RecipientDirectory",
+				"recipients[1].team": "unknown team 'security' in the RecipientDirectory",
+			},
+		},
+		{
+			TestName: "no directory",
+			Config: `
+recipients:
+  - name: alice
+`,
+			ExpectedFields: map[string]string{
+				"recipients[0].name": "unknown name 'alice', no RecipientDirectory found",
+			},
+		},
+		{
+			TestName: "invalid references",
+			Config: `
+recipients:
+  - name: alice
+    team: platform
+  - name: bob
+    type: pgp
+    recipient: ` + testDirectoryBobPGP + `
+  - team: platform
+  - team: platform
+`,
+			Directory: testRecipientDirectory,
+			ExpectedFields: map[string]string{
+				"recipients[0]":      "only one of name and team could be set",
+				"recipients[1]":      "the name reference could not be set together with the type, recipient, public key source and keyserver",
+				"recipients[3].team": "duplicate reference of recipients[2].team",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.TestName, func(t *testing.T) {
+			koConfig, err := sdk.ParseKubeObject([]byte(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test-references
+  annotations:
+    config.kubernetes.io/path: update-ksops-secrets.yaml
+` + tc.Config))
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			items, err := sdk.ParseKubeObjects([]byte(tc.Directory))
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			configs, err := LoadUpdateKSopsSecrets(koConfig, items)
+			if len(tc.ExpectedFields) == 0 {
+				if err != nil {
+					t.Fatalf("Unexpected error, %v", err)
+				}
+
+				recipients := configs[0].GetRecipients()
+				if !reflect.DeepEqual(recipients, tc.ExpectedRecipients) {
+					t.Errorf("Expected recipients %v, got %v", tc.ExpectedRecipients, recipients)
+				}
+				return
+			}
+
+			var results framework.Results
+			if !errors.As(err, &results) {
+				t.Fatalf("Expected results, got %v", err)
+			}
+
+			fields := map[string]string{}
+			for _, result := range results {
+				if result.ResourceRef.Name != "test-references" || result.File.Path != "update-ksops-secrets.yaml" {
+					t.Errorf("Unexpected result %v", result)
+				}
+				fields[result.Field.Path] = result.Message
+			}
+
+			if !reflect.DeepEqual(fields, tc.ExpectedFields) {
+				t.Errorf("Expected fields %v, got %v", tc.ExpectedFields, fields)
+			}
+		})
+	}
+}
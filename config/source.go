@@ -0,0 +1,108 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	sdk "github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+)
+
+const secretSourceKind = "SecretSource"
+
+// SecretSource reads the secret values from the dotenv and plain files of
+// the package the same way as the kustomize secretGenerator envs and files,
+// it is referenced by its name as a Secret
+type SecretSource struct {
+	Envs  []string `json:"envs,omitempty" yaml:"envs,omitempty"`
+	Files []string `json:"files,omitempty" yaml:"files,omitempty"`
+}
+
+// IsSecretSource reports whether the resource is a SecretSource
+func IsSecretSource(ko *sdk.KubeObject) bool {
+	return validGVK(ko, fnConfigAPIVersion, secretSourceKind)
+}
+
+// LoadSecretSource converts the SecretSource, every problem is a result of
+// its field
+func LoadSecretSource(ko *sdk.KubeObject) (*SecretSource, error) {
+	source := &SecretSource{}
+	if err := ko.As(source); err != nil {
+		return nil, fmt.Errorf("unable to convert the %s '%s':\n%w",
+			secretSourceKind, ko.GetName(), err)
+	}
+
+	var results framework.Results
+	addResult := func(field, message string) {
+		results = append(results, fieldResult(secretSourceKind, ko.GetName(), filePath(ko), field, message))
+	}
+
+	if len(source.Envs) == 0 && len(source.Files) == 0 {
+		addResult("", "envs or files must be set")
+	}
+
+	// The files are relative to the SecretSource directory, they must be in
+	// the package
+	dir := path.Dir(filePath(ko))
+	isSourcePath := func(file string) bool {
+		return !path.IsAbs(file) && isPackagePath(path.Join(dir, file))
+	}
+
+	for i, env := range source.Envs {
+		field := fmt.Sprintf("envs[%d]", i)
+
+		switch {
+		case env == "":
+			addResult(field, "file must not be empty")
+		case !isSourcePath(env):
+			addResult(field, fmt.Sprintf("file '%s' must be a path in the package", env))
+		}
+	}
+
+	keys := map[string]bool{}
+	for i, file := range source.Files {
+		key, filename := ParseSecretSourceFile(file)
+		field := fmt.Sprintf("files[%d]", i)
+
+		switch {
+		case filename == "":
+			addResult(field, "file must not be empty")
+		case !isSourcePath(filename):
+			addResult(field, fmt.Sprintf("file '%s' must be a path in the package", filename))
+		case !IsSecretSourceKey(key):
+			addResult(field, fmt.Sprintf("key '%s' is invalid: %s", key,
+				strings.Join(validation.IsConfigMapKey(key), ", ")))
+		case keys[key]:
+			addResult(field, fmt.Sprintf("duplicate key '%s'", key))
+		}
+
+		keys[key] = true
+	}
+
+	if len(results) > 0 {
+		return nil, results
+	}
+
+	return source, nil
+}
+
+// ParseSecretSourceFile returns the key and the filename of the files entry,
+// it is written as the filename or as key=filename, the key is the base name
+// of the file if not set
+func ParseSecretSourceFile(file string) (key, filename string) {
+	if key, filename, found := strings.Cut(file, "="); found {
+		return key, filename
+	}
+
+	return path.Base(file), file
+}
+
+// IsSecretSourceKey reports whether the key is valid for the Secret data
+func IsSecretSourceKey(key string) bool {
+	return len(validation.IsConfigMapKey(key)) == 0
+}
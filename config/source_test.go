@@ -0,0 +1,126 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	sdk "github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+)
+
+func TestLoadSecretSource(t *testing.T) {
+	testCases := []struct {
+		TestName       string
+		Source         string
+		ExpectedFields map[string]string
+	}{
+		{
+			TestName: "envs and files",
+			Source: `
+envs:
+  - .env
+files:
+  - config.txt
+  - tls.crt=certs/server.crt
+`,
+		},
+		{
+			TestName: "no envs and files",
+			Source:   `{}`,
+			ExpectedFields: map[string]string{
+				"": "envs or files must be set",
+			},
+		},
+		{
+			TestName: "invalid files",
+			Source: `
+envs:
+  - ""
+files:
+  - config.txt
+  - certs/config.txt
+  - tls crt=certs/server.crt
+  - tls.key=
+`,
+			ExpectedFields: map[string]string{
+				"envs[0]":  "file must not be empty",
+				"files[1]": "duplicate key 'config.txt'",
+				"files[2]": "key 'tls crt' is invalid: a valid config key must consist of alphanumeric characters, '-', '_' or '.' (e.g. 'key.name',  or 'KEY_NAME',  or 'key-name', regex used for validation is '[-._a-zA-Z0-9]+')",
+				"files[3]": "file must not be empty",
+			},
+		},
+		{
+			TestName: "files outside the package",
+			Source: `
+envs:
+  - ../.env
+files:
+  - /etc/passwd
+  - key=../certs/server.key
+`,
+			ExpectedFields: map[string]string{
+				"envs[0]":  "file '../.env' must be a path in the package",
+				"files[0]": "file '/etc/passwd' must be a path in the package",
+				"files[1]": "file '../certs/server.key' must be a path in the package",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.TestName, func(t *testing.T) {
+			ko, err := sdk.ParseKubeObject([]byte(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: SecretSource
+metadata:
+  name: app-env
+  annotations:
+    internal.config.kubernetes.io/path: sources.yaml
+`))
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			source, err := sdk.ParseKubeObject([]byte(tc.Source))
+			if err != nil {
+				t.Fatalf("Unexpected error, %v", err)
+			}
+
+			for _, field := range []string{"envs", "files"} {
+				if values, found, _ := source.NestedStringSlice(field); found {
+					if err := ko.SetNestedStringSlice(values, field); err != nil {
+						t.Fatalf("Unexpected error, %v", err)
+					}
+				}
+			}
+
+			loaded, err := LoadSecretSource(ko)
+			if len(tc.ExpectedFields) == 0 {
+				if err != nil || loaded == nil {
+					t.Fatalf("Unexpected error, %v", err)
+				}
+				return
+			}
+
+			var results framework.Results
+			if !errors.As(err, &results) {
+				t.Fatalf("Expected results, got %v", err)
+			}
+
+			fields := map[string]string{}
+			for _, result := range results {
+				if result.ResourceRef.Kind != secretSourceKind || result.File.Path != "sources.yaml" {
+					t.Errorf("Unexpected result %v", result)
+				}
+				fields[result.Field.Path] = result.Message
+			}
+
+			if !reflect.DeepEqual(fields, tc.ExpectedFields) {
+				t.Errorf("Expected fields %v, got %v", tc.ExpectedFields, fields)
+			}
+		})
+	}
+}
@@ -5,19 +5,51 @@ package exec
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
-	"strings"
 )
 
 type GPGKeysInterface interface {
 	ReceiveKeys(fingerprints ...string) (output string, err error)
-	ImportKey(data string) (output string, err error)
+	ExportKey(fingerprint string) (armored string, err error)
+
+	// Home returns the isolated GnuPG home directory of the keys
+	Home() string
+	// Close removes the GnuPG home directory with its keyring
+	Close() error
+}
+
+type gpg struct {
+	home string
+}
+
+// NewGPGKeys creates the keys of a temporary GnuPG home directory, the
+// keyring of the user is never read or written, it must be closed after use
+func NewGPGKeys() (GPGKeysInterface, error) {
+	home, err := os.MkdirTemp("", "update-ksops-secrets-gnupg-")
+	if err != nil {
+		return nil, fmt.Errorf("the GPG home directory error: %w", err)
+	}
+
+	return &gpg{home: home}, nil
 }
 
-type gpg struct{}
+func (g *gpg) Home() string {
+	return g.home
+}
+
+func (g *gpg) Close() error {
+	// The agent is started on demand by the key operations of the home
+	_ = exec.Command("gpgconf", "--homedir", g.home, "--kill", "all").Run()
+
+	return os.RemoveAll(g.home)
+}
 
-func NewGPGKeys() GPGKeysInterface {
-	return &gpg{}
+func (g *gpg) command(args ...string) *exec.Cmd {
+	cmd := exec.Command("gpg", append([]string{"--homedir", g.home, "--batch"}, args...)...)
+	cmd.Env = append(os.Environ(), "GNUPGHOME="+g.home)
+
+	return cmd
 }
 
 func (g *gpg) ReceiveKeys(fingerprints ...string) (output string, err error) {
@@ -28,7 +60,7 @@ func (g *gpg) ReceiveKeys(fingerprints ...string) (output string, err error) {
 		fingerprints...,
 	)
 
-	cmd := exec.Command("gpg", cmdOpts...)
+	cmd := g.command(cmdOpts...)
 	out, err := cmd.CombinedOutput()
 
 	if err != nil {
@@ -38,18 +70,23 @@ func (g *gpg) ReceiveKeys(fingerprints ...string) (output string, err error) {
 	return string(out), nil
 }
 
-func (g *gpg) ImportKey(data string) (output string, err error) {
+func (g *gpg) ExportKey(fingerprint string) (armored string, err error) {
 	cmdOpts := []string{
-		"--import",
+		"--export",
+		"--armor",
+		fingerprint,
 	}
 
-	cmd := exec.Command("gpg", cmdOpts...)
-	cmd.Stdin = strings.NewReader(data)
-	out, err := cmd.CombinedOutput()
+	cmd := g.command(cmdOpts...)
+	out, err := cmd.Output()
 
 	if err != nil {
 		return "", fmt.Errorf("the GPG Error: %s", out)
 	}
 
+	if len(out) == 0 {
+		return "", fmt.Errorf("the GPG public key %s not found", fingerprint)
+	}
+
 	return string(out), nil
 }
@@ -0,0 +1,43 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package exec
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGPGKeysHome(t *testing.T) {
+	gpg, err := NewGPGKeys()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	other, err := NewGPGKeys()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer other.Close()
+
+	if gpg.Home() == other.Home() {
+		t.Errorf("Expect isolated home directories, got %s", gpg.Home())
+	}
+
+	info, err := os.Stat(gpg.Home())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if mode := info.Mode().Perm(); mode != 0o700 {
+		t.Errorf("Expect home directory mode 0700, got %o", mode)
+	}
+
+	if err := gpg.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(gpg.Home()); !os.IsNotExist(err) {
+		t.Errorf("Expect home directory removed, got %v", err)
+	}
+}
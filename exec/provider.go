@@ -0,0 +1,109 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package exec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+)
+
+const (
+	// providerWaitDelay bounds the wait for the output of the processes left
+	// by the provider command after it is killed on the timeout
+	providerWaitDelay = time.Second
+
+	// maxProviderStderrSize is the size of the stderr kept in the errors
+	maxProviderStderrSize = 512
+
+	redacted = "[REDACTED]"
+)
+
+// sensitiveEnvNames are the parts of the environment variable names of
+// which values are redacted from the stderr, eg. BW_SESSION or OP_SESSION_*
+var sensitiveEnvNames = []string{"TOKEN", "SESSION", "PASSWORD", "PASSPHRASE", "SECRET"}
+
+type ValueProviderInterface interface {
+	Get(key string) (value string, err error)
+}
+
+type commandProvider struct {
+	provider config.UpdateKSopsProvider
+}
+
+// NewCommandProvider runs the provider command with the key as its last
+// argument, the value is the stdout without the trailing newline
+func NewCommandProvider(provider config.UpdateKSopsProvider) ValueProviderInterface {
+	return &commandProvider{provider: provider}
+}
+
+func (p *commandProvider) Get(key string) (value string, err error) {
+	timeout := p.provider.GetTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var execErr, execOut bytes.Buffer
+
+	args := append(append([]string{}, p.provider.Args...), key)
+	cmd := exec.CommandContext(ctx, p.provider.Command, args...)
+	cmd.Stdout = &execOut
+	cmd.Stderr = &execErr
+	cmd.WaitDelay = providerWaitDelay
+
+	if e := cmd.Run(); e != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("the provider '%s' timed out after %s", p.provider.Name, timeout)
+		}
+
+		return "", fmt.Errorf("the provider '%s' error: %v%s", p.provider.Name, e,
+			redactStderr(execErr.String(), execOut.String()))
+	}
+
+	value = strings.TrimSuffix(execOut.String(), "\n")
+	return strings.TrimSuffix(value, "\r"), nil
+}
+
+// redactStderr returns the stderr for the error message, the lines of the
+// stdout and the values of the sensitive environment variables are redacted
+// as the provider could print them on failures, and it is truncated
+func redactStderr(stderr, stdout string) string {
+	stderr = strings.TrimSpace(stderr)
+	if stderr == "" {
+		return ""
+	}
+
+	var secrets []string
+	for _, line := range strings.Split(stdout, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			secrets = append(secrets, line)
+		}
+	}
+
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		for _, sensitive := range sensitiveEnvNames {
+			if strings.Contains(strings.ToUpper(name), sensitive) && len(value) >= 4 {
+				secrets = append(secrets, value)
+				break
+			}
+		}
+	}
+
+	for _, secret := range secrets {
+		stderr = strings.ReplaceAll(stderr, secret, redacted)
+	}
+
+	if len(stderr) > maxProviderStderrSize {
+		stderr = stderr[:maxProviderStderrSize] + "..."
+	}
+
+	return "\n" + stderr
+}
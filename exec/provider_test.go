@@ -0,0 +1,130 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package exec
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+)
+
+const (
+	fakeProviderEnv   = "EXEC_FAKE_PROVIDER"
+	fakeProviderToken = "fake-provider-session-token"
+)
+
+// TestFakeProvider is the fake provider command run by the test binary
+// itself, it is skipped unless run as the provider
+func TestFakeProvider(t *testing.T) {
+	if os.Getenv(fakeProviderEnv) != "1" {
+		t.Skip("run as the fake provider only")
+	}
+
+	args := flag.Args()
+	switch args[len(args)-1] {
+	case "db-password":
+		fmt.Println("s3cr3t")
+	case "multiline":
+		fmt.Print("line1\nline2\r\n")
+	case "leaky":
+		fmt.Println("leaked-value")
+		fmt.Fprintf(os.Stderr, "error: leaked-value with session %s\n", os.Getenv("FAKE_PROVIDER_SESSION"))
+		os.Exit(1)
+	case "slow":
+		time.Sleep(10 * time.Second)
+	default:
+		fmt.Fprintln(os.Stderr, "item not found")
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
+func fakeProvider(t *testing.T, timeout string) ValueProviderInterface {
+	t.Helper()
+	t.Setenv(fakeProviderEnv, "1")
+	t.Setenv("FAKE_PROVIDER_SESSION", fakeProviderToken)
+
+	return NewCommandProvider(config.UpdateKSopsProvider{
+		Name:    "fake",
+		Command: os.Args[0],
+		Args:    []string{"-test.run=^TestFakeProvider$", "--"},
+		Timeout: timeout,
+	})
+}
+
+func TestCommandProvider(t *testing.T) {
+	testCases := []struct {
+		Name          string
+		Key           string
+		Timeout       string
+		ExpectedValue string
+		ExpectedError string
+	}{
+		{
+			Name:          "value",
+			Key:           "db-password",
+			ExpectedValue: "s3cr3t",
+		},
+		{
+			Name:          "multiline value",
+			Key:           "multiline",
+			ExpectedValue: "line1\nline2",
+		},
+		{
+			Name:          "not found",
+			Key:           "unknown",
+			ExpectedError: "the provider 'fake' error: exit status 1\nitem not found",
+		},
+		{
+			Name:          "redacted stderr",
+			Key:           "leaky",
+			ExpectedError: "the provider 'fake' error: exit status 1\nerror: [REDACTED] with session [REDACTED]",
+		},
+		{
+			Name:          "timeout",
+			Key:           "slow",
+			Timeout:       "100ms",
+			ExpectedError: "the provider 'fake' timed out after 100ms",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			value, err := fakeProvider(t, tc.Timeout).Get(tc.Key)
+			if tc.ExpectedError != "" {
+				if err == nil || err.Error() != tc.ExpectedError {
+					t.Fatalf("Expect error %q, got %v", tc.ExpectedError, err)
+				}
+
+				for _, secret := range []string{"leaked-value", fakeProviderToken} {
+					if strings.Contains(err.Error(), secret) {
+						t.Errorf("Expect %s redacted, got %v", secret, err)
+					}
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if value != tc.ExpectedValue {
+				t.Errorf("Expect %q, got %q", tc.ExpectedValue, value)
+			}
+		})
+	}
+}
+
+func TestRedactStderrTruncated(t *testing.T) {
+	stderr := redactStderr(strings.Repeat("e", maxProviderStderrSize*2), "")
+	if len(stderr) != maxProviderStderrSize+len("\n...") {
+		t.Errorf("Expect the stderr truncated, got %d bytes", len(stderr))
+	}
+}
@@ -27,14 +27,72 @@ We use ` + "`" + `UpdateKSopsSecrets` + "`" + ` custom resource to configure the
     type: string
     references:
       - string
+    precedence: string
     items:
       - string
+      - key: string
+        from:
+          secret: string
+          provider: string
+          key: string
+        sops:
+          encryptedRegex: string
+          unencryptedSuffix: string
+          encryptedCommentRegex: string
+          macOnlyEncrypted: bool
+          shamirThreshold: int
+    selectors:
+      - secret: string
+        all: bool
+        include:
+          - string
+        includeRegex: string
+        exclude:
+          - string
+        excludeRegex: string
   recipients:
     - type: string
       recipient: string
       publicKeySecretReference:
         name: string
         key: string
+      publicKeyConfigMapReference:
+        name: string
+        key: string
+      publicKeyFile: string
+    - name: string
+    - team: string
+  recipientGroups:
+    - name: string
+      recipients:
+        - type: string
+          recipient: string
+  output:
+    baseSecretsFile: string
+    kustomizationFile: string
+    generatedDir: string
+    encryptedFilePattern: string
+    fingerprintFilePattern: string
+    keepOrphans: bool
+  sops:
+    encryptedRegex: string
+    unencryptedSuffix: string
+    encryptedCommentRegex: string
+    macOnlyEncrypted: bool
+    shamirThreshold: int
+  sopsConfig:
+    name: string
+    key: string
+    recipients: string
+    generate: bool
+  keyservices:
+    - string
+  providers:
+    - name: string
+      command: string
+      args:
+        - string
+      timeout: string
 
 apiVersion:
 
@@ -64,31 +122,291 @@ secret:
 | --------------------------: | ------------------------------------------------------------------------------------------------------------------- | --------------------------------------------------------------- |
 |                      ` + "`" + `type` + "`" + ` | Type of the generated ` + "`" + `Secret` + "`" + ` resource <br/>-` + "`" + `Opaque` + "`" + ` (default)<br/>-` + "`" + `kubernetes.io/dockerconfigjson` + "`" + `<br/>-` + "`" + `...` + "`" + `   | ` + "`" + `kubernetes.io/dockerconfigjson` + "`" + `                                |
 |                ` + "`" + `references` + "`" + ` | The list of unencrypted secret resources that the ` + "`" + `update-ksops-secrets` + "`" + ` will look up and generates encrypted files | - ` + "`" + `unencrypted-secrets` + "`" + `<br/> - ` + "`" + `unencrypted-secrets-config-txt` + "`" + ` |
-|                     ` + "`" + `items` + "`" + ` | The list of secret keys for data look up in the referenced secret resources                                         |
+|                     ` + "`" + `items` + "`" + ` | The list of secret keys for data look up in the referenced secret resources, an item could be a mapping of the ` + "`" + `key` + "`" + `, its [` + "`" + `from` + "`" + `](#from) source and its [` + "`" + `sops` + "`" + `](#sops) options overrides | - ` + "`" + `test` + "`" + `<br/> - ` + "`" + `key: config.txt` + "`" + `<br/>&nbsp;&nbsp;` + "`" + `sops:` + "`" + `<br/>&nbsp;&nbsp;&nbsp;&nbsp;` + "`" + `macOnlyEncrypted: true` + "`" + ` |
+|   [` + "`" + `selectors` + "`" + `](#selectors) | The items selected by the keys of the referenced secrets, in addition to the ` + "`" + `items` + "`" + ` | |
+|                ` + "`" + `precedence` + "`" + ` | The policy of the keys found in more than one of the references <br/>-` + "`" + `order` + "`" + ` (default), the first in the ` + "`" + `references` + "`" + ` order with a warning<br/>-` + "`" + `error` + "`" + `, fail the key<br/>-` + "`" + `explicit` + "`" + `, every item must set its ` + "`" + `from.secret` + "`" + ` or ` + "`" + `from.provider` + "`" + ` | ` + "`" + `error` + "`" + ` |
 | [` + "`" + `recipients` + "`" + `](#recipients) | The list of recipients who could decrypt the generated encrypted files                                              |
+| [` + "`" + `recipientGroups` + "`" + `](#recipientgroups) | The SOPS key groups of the recipients, could not be set together with ` + "`" + `recipients` + "`" + `                        |
+|         [` + "`" + `output` + "`" + `](#output) | The generated files layout                                                                                          |
+|             [` + "`" + `sops` + "`" + `](#sops) | The SOPS encryption options                                                                                         |
+| [` + "`" + `sopsConfig` + "`" + `](#sopsconfig) | The ` + "`" + `.sops.yaml` + "`" + ` creation rules lookup for the recipients                                                           |
+| [` + "`" + `keyserver` + "`" + `](#keyserver) | The default keyserver ` + "`" + `url` + "`" + ` of the PGP/GPG recipients without a public key source                                 |
+
+from:
+
+The item value is read from the key of the same name in the first of the ` + "`" + `references` + "`" + ` that has it by default, the ` + "`" + `from` + "`" + ` maps the item to another source key, or pins it to a specific secret which is looked up even if it is not listed in the ` + "`" + `references` + "`" + `.
+
+|      Field | Description                                                                      | Example     |
+| ---------: | -------------------------------------------------------------------------------- | ----------- |
+|   ` + "`" + `secret` + "`" + ` | The secret that the value is read from, any references if unset                   | ` + "`" + `legacy-db` + "`" + ` |
+| ` + "`" + `provider` + "`" + ` | The [` + "`" + `providers` + "`" + `](#providers) command that the value is read from instead         | ` + "`" + `pass` + "`" + `      |
+|      ` + "`" + `key` + "`" + ` | The source key in the secret or the key passed to the provider, the item ` + "`" + `key` + "`" + ` if unset | ` + "`" + `url` + "`" + `  |
+
+  secret:
+    references:
+      - unencrypted-secrets
+    items:
+      - key: DATABASE_URL
+        from:
+          secret: legacy-db
+          key: url
+
+The key of an item without the ` + "`" + `from.secret` + "`" + ` is looked up in the ` + "`" + `references` + "`" + ` order, the ` + "`" + `stringData` + "`" + ` of a secret takes precedence over its ` + "`" + `data` + "`" + `. The key found in more than one of the references is reported with the conflicting secrets as the ` + "`" + `precedence` + "`" + ` policy configured.
+
+selectors:
+
+A selector adds the keys of a secret as the items pinned to it, instead of listing every key of the secret with dozens of keys such as a migrated ` + "`" + `.env` + "`" + `. The listed ` + "`" + `items` + "`" + ` take precedence over the selected ones of the same key, and a key selected from more than one secret is taken from the first selector with a warning.
+
+|          Field | Description                                                              | Example         |
+| -------------: | ------------------------------------------------------------------------ | --------------- |
+|       ` + "`" + `secret` + "`" + ` | The secret that the keys are selected from, looked up as a reference     | ` + "`" + `app-env` + "`" + `       |
+|          ` + "`" + `all` + "`" + ` | Select all the keys, could not be set together with the include patterns | ` + "`" + `true` + "`" + `          |
+|      ` + "`" + `include` + "`" + ` | The glob patterns of the selected keys                                   | - ` + "`" + `DB_*` + "`" + `        |
+| ` + "`" + `includeRegex` + "`" + ` | The regex of the selected keys                                           | ` + "`" + `_(TOKEN\|KEY)$` + "`" + ` |
+|      ` + "`" + `exclude` + "`" + ` | The glob patterns of the keys not selected                               | - ` + "`" + `DEBUG*` + "`" + `      |
+| ` + "`" + `excludeRegex` + "`" + ` | The regex of the keys not selected                                       | ` + "`" + `^LOCAL_` + "`" + `       |
+
+  secret:
+    selectors:
+      - secret: app-env
+        all: true
+        exclude:
+          - DEBUG*
+      - secret: shared-env
+        includeRegex: _(TOKEN|KEY)$
+
+The unencrypted secrets are usually not committed, if the secret of a selector is absent, the keys of the already encrypted files are matched instead, so they are neither pruned nor removed from the KSOPS generator.
+
+SecretSource:
+
+The values could be read from the dotenv and plain files of the package without wrapping them into a ` + "`" + `Secret` + "`" + ` first, the same way as the kustomize ` + "`" + `secretGenerator` + "`" + ` ` + "`" + `envs` + "`" + ` and ` + "`" + `files` + "`" + `. The ` + "`" + `SecretSource` + "`" + ` resource is referenced by its name as a ` + "`" + `Secret` + "`" + `, by the ` + "`" + `references` + "`" + `, the items ` + "`" + `from.secret` + "`" + ` or the ` + "`" + `selectors` + "`" + `.
+
+  # sources.yaml
+  apiVersion: fn.kpt.dev/v1alpha1
+  kind: SecretSource
+  metadata:
+    name: app-env
+    annotations:
+      config.kubernetes.io/local-config: "true"
+  envs:
+    - .env
+  files:
+    - config.txt
+    - tls.crt=certs/server.crt
+
+The files are relative to the directory of the ` + "`" + `SecretSource` + "`" + ` resource and must be in the package. The ` + "`" + `envs` + "`" + ` are the ` + "`" + `KEY=VALUE` + "`" + ` lines as is, without the quotes removal or the variables expansion, the comment lines preceding a key are kept for the ` + "`" + `encryptedCommentRegex` + "`" + `. The ` + "`" + `files` + "`" + ` are keyed by the base name of the file or the ` + "`" + `key=` + "`" + ` prefix, their content is read as the base64 ` + "`" + `data` + "`" + `. The files are read once per run from the package in the same way as the ` + "`" + `publicKeyFile` + "`" + `, the kpt function input has no non-KRM files, so the unencrypted files must be available to the function in the package directory, eg. with ` + "`" + `kpt fn eval --exec` + "`" + ` or a mounted package, and ignored by the ` + "`" + `.gitignore` + "`" + `. The ` + "`" + `SecretSource` + "`" + ` fails with an error if the resources are not found at their package paths.
 
 recipients:
 
 |                                                   Field | Description                                                                                     | Example                                                                                                         |
 | ------------------------------------------------------: | ----------------------------------------------------------------------------------------------- | --------------------------------------------------------------------------------------------------------------- |
-|                                                  ` + "`" + `type` + "`" + ` | The type of the recipient that supported by SOPS, eg. ` + "`" + `age` + "`" + `, ` + "`" + `pgp` + "`" + `                              | ` + "`" + `age` + "`" + `                                                                                                           |
-|                                             ` + "`" + `recipient` + "`" + ` | The recipient id<br/>-` + "`" + `age` + "`" + `: public key<br/>-` + "`" + `pgp` + "`" + `: fingerprint id                              | ` + "`" + `age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa` + "`" + `<br/>` + "`" + `F532DA10E563EE84440977A19D0470BDA6CDC457` + "`" + ` |
+|                                                  ` + "`" + `type` + "`" + ` | The type of the recipient that supported by SOPS, ` + "`" + `age` + "`" + `, ` + "`" + `pgp` + "`" + `, ` + "`" + `ssh` + "`" + `, ` + "`" + `vault` + "`" + `, ` + "`" + `awskms` + "`" + `, ` + "`" + `gcpkms` + "`" + ` or ` + "`" + `azurekv` + "`" + ` | ` + "`" + `age` + "`" + `                                                                                                           |
+|                                             ` + "`" + `recipient` + "`" + ` | The recipient id<br/>-` + "`" + `age` + "`" + `: public key<br/>-` + "`" + `pgp` + "`" + `: full 40 hex fingerprint<br/>-` + "`" + `ssh` + "`" + `: ` + "`" + `ssh-ed25519` + "`" + ` or ` + "`" + `ssh-rsa` + "`" + ` public key<br/>-` + "`" + `vault` + "`" + `: transit key path ` + "`" + `<engine path>/keys/<key name>` + "`" + `<br/>-` + "`" + `awskms` + "`" + `: key ARN, optionally ` + "`" + `+<role ARN>` + "`" + `<br/>-` + "`" + `gcpkms` + "`" + `: key resource ID<br/>-` + "`" + `azurekv` + "`" + `: key URL ` + "`" + `https://<vault>/keys/<name>/<version>` + "`" + ` | ` + "`" + `age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa` + "`" + `<br/>` + "`" + `F532DA10E563EE84440977A19D0470BDA6CDC457` + "`" + ` |
 | [` + "`" + `publicKeySecretReference` + "`" + `](#publickeysecretreference) | Pass the PGP/GPG public key data with a secret reference, ignored for all other types but ` + "`" + `pgp` + "`" + ` |                                                                                                                 |
+| ` + "`" + `publicKeyConfigMapReference` + "`" + ` | Pass the public key data with a ` + "`" + `ConfigMap` + "`" + ` reference of the same ` + "`" + `name` + "`" + ` and ` + "`" + `key` + "`" + ` fields, the ` + "`" + `data` + "`" + ` or ` + "`" + `binaryData` + "`" + ` | ` + "`" + `name: public-keys` + "`" + `<br/>` + "`" + `key: ops.asc` + "`" + ` |
+| ` + "`" + `publicKeyFile` + "`" + ` | Pass the public key data with a file relative to the ` + "`" + `UpdateKSopsSecrets` + "`" + ` directory | ` + "`" + `keys/ops.asc` + "`" + ` |
+| [` + "`" + `keyserver` + "`" + `](#keyserver) | Fetch the PGP/GPG public key from the keyserver ` + "`" + `url` + "`" + ` or the ` + "`" + `wkd` + "`" + ` email, overrides the default ` + "`" + `keyserver` + "`" + ` | ` + "`" + `wkd: ops@example.com` + "`" + ` |
+| [` + "`" + `name` + "`" + `](#recipientdirectory) | Reference the recipients of the ` + "`" + `RecipientDirectory` + "`" + ` member, instead of the other fields | ` + "`" + `alice` + "`" + ` |
+| [` + "`" + `team` + "`" + `](#recipientdirectory) | Reference the recipients of the ` + "`" + `RecipientDirectory` + "`" + ` team members, instead of the other fields | ` + "`" + `platform` + "`" + ` |
+
+The recipients are validated when the configuration is loaded, the ` + "`" + `age` + "`" + ` public keys must be bech32 encoded, the ` + "`" + `pgp` + "`" + ` ones the full 40 hex fingerprints, the ` + "`" + `ssh` + "`" + ` ones the ` + "`" + `ssh-ed25519` + "`" + ` or ` + "`" + `ssh-rsa` + "`" + ` public keys, the ` + "`" + `vault` + "`" + ` ones the transit key paths, the cloud KMS ones their key identifiers and the [` + "`" + `keyservices` + "`" + `](#keyservices), other types are rejected, and a recipient listed twice in the same group is a duplicate. Every problem is reported as an error result of its field path, eg. ` + "`" + `recipientGroups[1].recipients[0].recipient` + "`" + `.
 
 publicKeySecretReference:
 
+The public key data, ASCII-armored or binary, is parsed in-process, neither the ` + "`" + `gpg` + "`" + ` nor the network is required. The data must hold the key of the recipient fingerprint, either the primary key or a subkey.
+
 |  Field | Description                                                | Example                                        |
 | -----: | ---------------------------------------------------------- | ---------------------------------------------- |
 | ` + "`" + `name` + "`" + ` | The secret name contains PGP/GPG public keys data          | ` + "`" + `gpg-publickeys` + "`" + `                               |
 |  ` + "`" + `key` + "`" + ` | The secret key contains a specific PGP/GPG public key data | ` + "`" + `380024A2AC1D3EBC9402BEE66E38309B4DA30118.gpg` + "`" + ` |
 
+Only one of the public key sources could be set. For the ` + "`" + `age` + "`" + ` recipients, the source is an age recipients file of one public key per line, all of them are the recipients if the ` + "`" + `recipient` + "`" + ` is not set, otherwise it must be listed. The same applies to the ` + "`" + `ssh` + "`" + ` recipients with an authorized keys file, eg. the ` + "`" + `https://github.com/<user>.keys` + "`" + ` content, the key comments are left out.
+
+The ` + "`" + `ssh` + "`" + ` recipients are encrypted as the age recipients of SOPS, they are decrypted with the SSH private key the same as ` + "`" + `sops` + "`" + ` does with ` + "`" + `SOPS_AGE_SSH_PRIVATE_KEY_FILE` + "`" + ` or ` + "`" + `~/.ssh/id_ed25519` + "`" + ` and ` + "`" + `~/.ssh/id_rsa` + "`" + `.
+
+The ` + "`" + `vault` + "`" + ` recipients are encrypted by the HashiCorp Vault transit engine, eg. ` + "`" + `transit/keys/sops` + "`" + `. The Vault address and token are read from the ` + "`" + `VAULT_ADDR` + "`" + ` and ` + "`" + `VAULT_TOKEN` + "`" + ` environment variables, and the optional ` + "`" + `VAULT_NAMESPACE` + "`" + `, they are never read from the configuration, so they are passed to the function with the ` + "`" + `kpt fn eval --env` + "`" + ` or ` + "`" + `--exec` + "`" + `. The public key sources could not be set for them.
+
+Every PGP/GPG key, imported, fetched or received, must match the full recipient fingerprint, primary key or subkey, be neither expired nor revoked and have an encryption-capable key, otherwise the recipient is rejected with an error.
+
+The PGP/GPG recipients without any public key source are looked up in the ASCII-armored ` + "`" + `keys/*.asc` + "`" + ` files of the ` + "`" + `UpdateKSopsSecrets` + "`" + ` directory before the key server, so the public keys could be committed next to the configuration. The kpt function input has no non-KRM files, so the ` + "`" + `keys/*.asc` + "`" + ` and the ` + "`" + `publicKeyFile` + "`" + ` files are read from the package directory only if the function runs in it, eg. with ` + "`" + `kpt fn eval --exec` + "`" + ` or a mounted package, the resources files must be found at their package paths. An unreadable ` + "`" + `publicKeyFile` + "`" + ` fails with an error, it is never replaced by the key server, while the keys unreadable from the ` + "`" + `keys/*.asc` + "`" + ` are looked up on the key server with a warning.
+
+keyserver:
+
+The PGP/GPG public keys without any public key source nor ` + "`" + `keys/*.asc` + "`" + ` file are fetched in-process from the configured keyserver instead of the ` + "`" + `gpg` + "`" + ` default one. The Web Key Directory of the ` + "`" + `wkd` + "`" + ` email is looked up first, then the keyserver ` + "`" + `url` + "`" + `. The fetched key is pinned to the recipient fingerprint, a mismatched key is rejected with an error.
+
+| Field | Description                                                                      | Example                    |
+| ----: | -------------------------------------------------------------------------------- | -------------------------- |
+| ` + "`" + `url` + "`" + ` | The HKP/HKPS keyserver URL, the ` + "`" + `hkp` + "`" + ` default port is ` + "`" + `11371` + "`" + `                     | ` + "`" + `hkps://keys.example.com` + "`" + `  |
+| ` + "`" + `wkd` + "`" + ` | The email of the recipient in the Web Key Directory, only set per recipient       | ` + "`" + `ops@example.com` + "`" + `          |
+
+  keyserver:
+    url: hkps://keys.internal.example.com
+  recipients:
+    - type: pgp
+      recipient: 380024A2AC1D3EBC9402BEE66E38309B4DA30118
+      keyserver:
+        wkd: ops@example.com
+
+The network is required to fetch the keys, see the [Note](#gpg-receive-keys-requires-network-to-work-properly).
+
+keyservices:
+
+The data keys of the cloud KMS recipients, ` + "`" + `awskms` + "`" + `, ` + "`" + `gcpkms` + "`" + ` and ` + "`" + `azurekv` + "`" + `, are encrypted by the SOPS keyservices, eg. ` + "`" + `sops keyservice` + "`" + ` run by the team holding the KMS credentials, so the cloud credentials are never required by the function. The keyservices are tried in order until one succeeds, the same as the ` + "`" + `sops --keyservice` + "`" + `.
+
+  keyservices:
+    - tcp://keyservice.internal.example.com:5000
+    - unix:///run/sops/keyservice.sock
+  recipients:
+    - type: awskms
+      recipient: arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab
+    - type: gcpkms
+      recipient: projects/my-project/locations/global/keyRings/sops/cryptoKeys/sops
+    - type: azurekv
+      recipient: https://sops.vault.azure.net/keys/sops/0123456789abcdef
+
+The endpoints are the ` + "`" + `tcp://<host>:<port>` + "`" + ` or ` + "`" + `unix://<path>` + "`" + ` of the plaintext gRPC, the same as the ` + "`" + `sops keyservice` + "`" + ` listens on.
+
+providers:
+
+The values could be read from the password managers, eg. ` + "`" + `pass` + "`" + `, the 1Password CLI or the Bitwarden CLI, without keeping them on disk as the unencrypted secrets. The provider command is run with the ` + "`" + `args` + "`" + ` and the item key as its last argument, and the value is its stdout without the trailing newline.
+
+  providers:
+    - name: pass
+      command: pass
+      args:
+        - show
+    - name: op
+      command: op
+      args:
+        - read
+      timeout: 1m
+  secret:
+    items:
+      - key: DB_PASSWORD
+        from:
+          provider: pass
+          key: app/db-password
+      - key: API_TOKEN
+        from:
+          provider: op
+          key: op://app/api/token
+
+|     Field | Description                                         | Example |
+| --------: | --------------------------------------------------- | ------- |
+|    ` + "`" + `name` + "`" + ` | The provider name referenced by the items ` + "`" + `from` + "`" + `    | ` + "`" + `pass` + "`" + `  |
+| ` + "`" + `command` + "`" + ` | The provider command                                | ` + "`" + `pass` + "`" + `  |
+|    ` + "`" + `args` + "`" + ` | The arguments of the command preceding the key      | - ` + "`" + `show` + "`" + ` |
+| ` + "`" + `timeout` + "`" + ` | The timeout of the command, default ` + "`" + `30s` + "`" + `           | ` + "`" + `1m` + "`" + `    |
+
+The command runs without a shell, a failure or the timeout is an error of the item, and its stderr is redacted from the printed stdout lines and the values of the environment variables named as a token, session, password, passphrase or secret. The commands and their sessions must be available to the function, so the providers are used with the ` + "`" + `kpt fn eval --exec` + "`" + `. The ` + "`" + `providers` + "`" + ` are only accepted from the functionConfig, the other ` + "`" + `UpdateKSopsSecrets` + "`" + ` resources of the package with the ` + "`" + `providers` + "`" + ` fail with an error, so the commands are never taken from the package content alone.
+
+RecipientDirectory:
+
+The recipients of the people, the teams and the CI could be maintained once in the ` + "`" + `RecipientDirectory` + "`" + ` resources shared by the packages, the ` + "`" + `recipients` + "`" + ` and ` + "`" + `recipientGroups` + "`" + ` reference them by ` + "`" + `name` + "`" + ` or ` + "`" + `team` + "`" + `.
+
+  # recipients.yaml
+  apiVersion: fn.kpt.dev/v1alpha1
+  kind: RecipientDirectory
+  metadata:
+    name: engineering
+    annotations:
+      config.kubernetes.io/local-config: "true"
+  members:
+    - name: alice
+      recipients:
+        - type: age
+          recipient: age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa
+    - name: ci
+      recipients:
+        - type: pgp
+          recipient: 380024A2AC1D3EBC9402BEE66E38309B4DA30118
+  teams:
+    - name: platform
+      members:
+        - alice
+        - ci
+
+  # update-ksops-secrets.yaml
+  recipients:
+    - team: platform
+    - name: bob
+
+All the ` + "`" + `RecipientDirectory` + "`" + ` resources of the function input are merged, the member and team names must be unique. The member recipients are listed inline, the public key sources could not be set for them. The references are resolved when the function runs, an unknown name or team is an error, and a recipient of several references is used once per key group. The resolved recipients are part of the fingerprint, so the secrets are encrypted again when the team members are changed.
+
+recipientGroups:
+
+Each group is a SOPS key group, the data key is split with the Shamir's secret sharing into a share per group and any [` + "`" + `sops.shamirThreshold` + "`" + `](#sops) of the groups are required to decrypt, all of them by default. A single recipient of each required group decrypts its share.
+
+|        Field | Description                                              | Example    |
+| -----------: | -------------------------------------------------------- | ---------- |
+|       ` + "`" + `name` + "`" + ` | The group name for the readers                           | ` + "`" + `security` + "`" + ` |
+| ` + "`" + `recipients` + "`" + ` | The [` + "`" + `recipients` + "`" + `](#recipients) of the group             |            |
+
+  recipientGroups:
+    - name: ops
+      recipients:
+        - type: age
+          recipient: age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa
+    - name: security
+      recipients:
+        - type: pgp
+          recipient: 380024A2AC1D3EBC9402BEE66E38309B4DA30118
+    - name: break-glass
+      recipients:
+        - type: age
+          recipient: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+  sops:
+    shamirThreshold: 2
+
+output:
+
+All paths are relative to the ` + "`" + `UpdateKSopsSecrets` + "`" + ` file directory, the ` + "`" + `{name}` + "`" + ` and ` + "`" + `{key}` + "`" + ` placeholders in the patterns are replaced with the normalized secret name and key.
+
+|                    Field | Description                                                               | Example                  |
+| -----------------------: | ------------------------------------------------------------------------- | ------------------------ |
+|        ` + "`" + `baseSecretsFile` + "`" + ` | The base ` + "`" + `Secret` + "`" + ` file, default ` + "`" + `secrets.yaml` + "`" + `                            | ` + "`" + `secrets/base.yaml` + "`" + `      |
+|      ` + "`" + `kustomizationFile` + "`" + ` | The kustomization file name, default ` + "`" + `kustomization.yaml` + "`" + `                 | ` + "`" + `kustomization.yml` + "`" + `      |
+|           ` + "`" + `generatedDir` + "`" + ` | The KSOPS generator and encrypted files directory, default ` + "`" + `generated` + "`" + `    | ` + "`" + `secrets` + "`" + `                |
+|   ` + "`" + `encryptedFilePattern` + "`" + ` | The encrypted files pattern, default ` + "`" + `<generatedDir>/secrets.{key}.enc.yaml` + "`" + ` | ` + "`" + `secrets/{key}.enc.yaml` + "`" + ` |
+| ` + "`" + `fingerprintFilePattern` + "`" + ` | The fingerprint files pattern, default ` + "`" + `<generatedDir>/secrets.{key}.fp.yaml` + "`" + ` | ` + "`" + `.sops/{key}.fp.yaml` + "`" + `    |
+|            ` + "`" + `keepOrphans` + "`" + ` | Keep the encrypted files of the removed items with warnings, default ` + "`" + `false` + "`" + ` | ` + "`" + `true` + "`" + `                   |
+
+sops:
+
+The options are the same as the ` + "`" + `.sops.yaml` + "`" + ` creation rules, only one of ` + "`" + `encryptedRegex` + "`" + `, ` + "`" + `unencryptedSuffix` + "`" + ` and ` + "`" + `encryptedCommentRegex` + "`" + ` could be set. The Secret ` + "`" + `apiVersion` + "`" + `, ` + "`" + `kind` + "`" + `, ` + "`" + `metadata` + "`" + ` and ` + "`" + `type` + "`" + ` are never encrypted, the ` + "`" + `encryptedRegex` + "`" + ` must not match their keys, and the ` + "`" + `unencryptedSuffix` + "`" + ` is written as the ` + "`" + `unencrypted_regex` + "`" + ` of the suffix and these keys, it must not be the suffix of the ` + "`" + `data` + "`" + ` or ` + "`" + `stringData` + "`" + ` key. The item overrides replace the encryption rule of the configuration as a whole. The generated values must be encrypted by the rule, the encrypted comment is taken from the referenced secret item. The item comments are written to the encrypted files, encrypted under the encrypted paths in the same way as ` + "`" + `sops` + "`" + `, only the lines matching the ` + "`" + `encryptedCommentRegex` + "`" + ` itself are left as is.
+
+|                   Field | Description                                                                  | Example         |
+| ----------------------: | ---------------------------------------------------------------------------- | --------------- |
+|        ` + "`" + `encryptedRegex` + "`" + ` | Encrypt the values of the matched keys, default ` + "`" + `^(data\|stringData)$` + "`" + `       | ` + "`" + `^data$` + "`" + `        |
+|     ` + "`" + `unencryptedSuffix` + "`" + ` | Leave the values of the keys with the suffix unencrypted                      | ` + "`" + `_unencrypted` + "`" + `  |
+| ` + "`" + `encryptedCommentRegex` + "`" + ` | Encrypt the values preceded by the matched comment                            | ` + "`" + `sops:enc` + "`" + `      |
+|      ` + "`" + `macOnlyEncrypted` + "`" + ` | Compute the MAC over the encrypted values only, default ` + "`" + `false` + "`" + `               | ` + "`" + `true` + "`" + `          |
+|       ` + "`" + `shamirThreshold` + "`" + ` | The number of [key groups](#recipientgroups) required to decrypt, at least ` + "`" + `2` + "`" + ` of multiple groups, default all | ` + "`" + `2` + "`" + `             |
+
+sopsConfig:
+
+The recipients of each encrypted file are also resolved by the first ` + "`" + `.sops.yaml` + "`" + ` creation rule whose ` + "`" + `path_regex` + "`" + ` matches the file path relative to the ` + "`" + `.sops.yaml` + "`" + ` directory, the same as SOPS does. The nearest ` + "`" + `.sops.yaml` + "`" + ` resource in the ` + "`" + `UpdateKSopsSecrets` + "`" + ` directory or its parents is used, unless a ` + "`" + `ConfigMap` + "`" + ` or ` + "`" + `Secret` + "`" + ` holding the content is referenced. The ` + "`" + `age` + "`" + `, ` + "`" + `pgp` + "`" + `, ` + "`" + `kms` + "`" + `, ` + "`" + `gcp_kms` + "`" + `, ` + "`" + `azure_keyvault` + "`" + ` and ` + "`" + `hc_vault_transit_uri` + "`" + ` keys of the rule, or the same keys and the ` + "`" + `hc_vault` + "`" + ` of its key groups, are the ` + "`" + `age` + "`" + `, ` + "`" + `pgp` + "`" + `, ` + "`" + `awskms` + "`" + `, ` + "`" + `gcpkms` + "`" + `, ` + "`" + `azurekv` + "`" + ` and ` + "`" + `vault` + "`" + ` recipients. The ` + "`" + `hc_vault_transit_uri` + "`" + ` must be of the ` + "`" + `VAULT_ADDR` + "`" + ` address, and the ` + "`" + `kms` + "`" + ` keys with the ` + "`" + `context` + "`" + ` or the ` + "`" + `aws_profile` + "`" + ` are ignored with warnings. The key groups are merged with the configured ones in order. The rule ` + "`" + `shamir_threshold` + "`" + ` applies unless [` + "`" + `sops.shamirThreshold` + "`" + `](#sops) is set, the threshold is validated against the merged key groups. The configured recipients are used as is if no rule matches.
+
+|        Field | Description                                                                                      | Example       |
+| -----------: | ------------------------------------------------------------------------------------------------ | ------------- |
+|       ` + "`" + `name` + "`" + ` | The ` + "`" + `ConfigMap` + "`" + ` or ` + "`" + `Secret` + "`" + ` name holding the ` + "`" + `.sops.yaml` + "`" + ` content                                | ` + "`" + `sops-config` + "`" + ` |
+|        ` + "`" + `key` + "`" + ` | The data key of the ` + "`" + `.sops.yaml` + "`" + ` content                                                         | ` + "`" + `.sops.yaml` + "`" + `  |
+| ` + "`" + `recipients` + "`" + ` | ` + "`" + `merge` + "`" + ` adds the rule recipients to the configured ones (default), ` + "`" + `override` + "`" + ` replaces them       | ` + "`" + `override` + "`" + `    |
+|   ` + "`" + `generate` + "`" + ` | Maintain the creation rules of the encrypted files in the nearest ` + "`" + `.sops.yaml` + "`" + `, default ` + "`" + `false` + "`" + `  | ` + "`" + `true` + "`" + `        |
+
+With ` + "`" + `generate` + "`" + `, a creation rule per encrypted file is written ahead of the other rules of the nearest ` + "`" + `.sops.yaml` + "`" + `, or a new ` + "`" + `.sops.yaml` + "`" + ` in the package directory, so that ` + "`" + `sops` + "`" + ` edits the files with the same recipients and options. The generated rules are marked by the ` + "`" + `# update-ksops-secrets: <dir>/<name>` + "`" + ` comment and replaced on every run, the marked rules of the removed configs or the configs without ` + "`" + `generate` + "`" + ` are removed, the other rules are kept as is. The ` + "`" + `vault` + "`" + ` recipients are written as the ` + "`" + `hc_vault_transit_uri` + "`" + ` of the ` + "`" + `VAULT_ADDR` + "`" + `, the cloud KMS ones as the ` + "`" + `kms` + "`" + `, ` + "`" + `gcp_kms` + "`" + ` and ` + "`" + `azure_keyvault` + "`" + `, the keyservices are passed to ` + "`" + `sops` + "`" + ` by its ` + "`" + `--keyservice` + "`" + ` option. It can not be combined with a referenced ` + "`" + `name` + "`" + `.
+
 ` + "`" + `update-ksops-secrets` + "`" + ` function performs the following steps when invoked:
 
 1. Pass unencrypted secrets manifests referred by the configuration to the mutators pipeline.
 2. Generate the encrypted secrets from the listed items in the configuration using SOPS,
+   - The encryption is built in, the ` + "`" + `sops` + "`" + ` binary is not required, the encrypted files are decryptable by the upstream SOPS and KSOPS.
    - Unavailable secrets would be skipped.
    - Existing encrypted files of unavailable secrets will be processed with untouch.
-3. Generate or update the kustomization and KSOPS secrets resources.
+   - Encrypted and fingerprint files of the items removed from the configuration are pruned, unless ` + "`" + `output.keepOrphans` + "`" + ` is set.
+   - The ` + "`" + `.sops.yaml` + "`" + ` creation rules of the encrypted files are updated, if ` + "`" + `sopsConfig.generate` + "`" + ` is set.
+3. Generate or update the kustomization and KSOPS secrets resources,
+   - An existing kustomization is kept as is, only the base secrets ` + "`" + `resources` + "`" + ` and the KSOPS ` + "`" + `generators` + "`" + ` entries are added when missing.
 `
 var KptUpdateKsopsSecretsExamples = `
 Generate kustomization manifests with encrypted files:
@@ -142,7 +460,7 @@ Declare the new desired values for setters in the functionConfig file.
     name: update-ksops-secrets
   pipeline:
     mutators:
-      - image: ghcr.io/neutronth/kpt-update-ksops-secrets:0.4
+      - image: ghcr.io/neutronth/kpt-update-ksops-secrets:0.13
         configPath: update-ksops-secrets.yaml
 
 Invoke the function:
@@ -152,7 +470,7 @@ Invoke the function:
 Alternatively, invoke function directly without the ` + "`" + `Kptfile` + "`" + `
 
   $ kpt fn eval \
-      --image=ghcr.io/neutronth/kpt-update-ksops-secrets:0.4 \
+      --image=ghcr.io/neutronth/kpt-update-ksops-secrets:0.13 \
       --fn-config=update-ksops-secrets.yaml
 
 If you encountered the error with the PGP/GPG recipients encryption, see the [Note](#gpg-receive-keys-requires-network-to-work-properly) to understand the limitation and working solution.
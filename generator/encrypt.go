@@ -11,11 +11,14 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/neutronth/kpt-update-ksops-secrets/config"
 	"github.com/neutronth/kpt-update-ksops-secrets/exec"
+	"github.com/neutronth/kpt-update-ksops-secrets/sops"
 	"golang.org/x/crypto/argon2"
 	"sigs.k8s.io/kustomize/kyaml/fn/framework"
 	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
@@ -30,14 +33,66 @@ func (g *KSopsGenerator) GenerateSecretEncryptedFiles(nodes []*yaml.RNode,
 	uksConfig *config.UpdateKSopsSecrets,
 	secretRef SecretReference,
 ) (newNodes []*yaml.RNode, results framework.Results) {
-	preloadResults := preloadGPGKeys(secretRef, uksConfig.Recipients...)
+	keys := g.newPublicKeyReader(nodes, secretRef)
+	keyRecipients, keyOptions, results := g.resolveKeyRecipients(nodes, uksConfig, keys)
+	if results.ExitCode() == 1 {
+		return nil, results
+	}
+
+	var allRecipients []config.UpdateKSopsRecipient
+	for _, key := range uksConfig.GetSecretItems() {
+		for _, r := range keyRecipients[key] {
+			// The keys are loaded once whatever their key groups
+			r.KeyGroup = 0
+			if r.Type == "pgp" && !r.HasPublicKeySource() {
+				r.Keyserver = uksConfig.GetKeyserver(r)
+			}
+			if !config.ContainsRecipient(allRecipients, r) {
+				allRecipients = append(allRecipients, r)
+			}
+		}
+	}
+
+	gpg := g.GPG
+	if gpg == nil {
+		var err error
+		if gpg, err = exec.NewGPGKeys(); err != nil {
+			results = append(results, &framework.Result{
+				Message:  err.Error(),
+				Severity: framework.Error,
+			})
+			return nil, results
+		}
+		defer gpg.Close()
+	}
+
+	fetcher := g.KeyFetcher
+	if fetcher == nil {
+		fetcher = sops.NewPGPKeyFetcher(nil)
+	}
+
+	// The referenced and the fetched public keys are imported in-process, the
+	// others are received into and exported from the isolated gpg keyring
+	keyRing := sops.NewPGPKeyRing(gpg.ExportKey)
+	preloadResults := preloadGPGKeys(keys, keyRing, fetcher, gpg, allRecipients...)
 	results = append(results, preloadResults...)
 	if preloadResults.ExitCode() == 1 {
 		return nil, results
 	}
 
 	for _, key := range uksConfig.GetSecretItems() {
-		value, b64encoded, err := secretRef.Get(key)
+		name, sourceKey := uksConfig.GetSecretItemSource(key)
+		provider := uksConfig.GetSecretItemProvider(key)
+		if name == "" && provider == "" {
+			if result := ambiguousSecretResult(secretRef, uksConfig, key, sourceKey); result != nil {
+				results = append(results, result)
+				if result.Severity == framework.Error {
+					continue
+				}
+			}
+		}
+
+		value, b64encoded, err := getSecretItemValue(secretRef, provider, name, sourceKey)
 		shouldSkip := false
 		if err == nil && strings.HasPrefix(value, "ENC[AES256_GCM,data:") && strings.HasSuffix(value, ",type:str]") {
 			shouldSkip = true
@@ -45,7 +100,7 @@ func (g *KSopsGenerator) GenerateSecretEncryptedFiles(nodes []*yaml.RNode,
 
 		if err != nil && errors.Unwrap(err) == ErrSecretNotFound || shouldSkip {
 			results = append(results, &framework.Result{
-				Message:  fmt.Sprintf("Secret '%s' not found in the secrets references, encryption skipped", key),
+				Message:  fmt.Sprintf("Secret '%s' not found in the secrets references%s, encryption skipped", key, describeSecretItemSource(key, name, sourceKey)),
 				Severity: framework.Warning,
 			})
 			continue
@@ -58,8 +113,11 @@ func (g *KSopsGenerator) GenerateSecretEncryptedFiles(nodes []*yaml.RNode,
 			continue
 		}
 
-		encryptedFP := secretRef.GetEncryptedFP(uksConfig.GetName(), key)
-		found, encryptedOnceErr := secretFingerprintTryOpen(encryptedFP, uksConfig.GetName(), uksConfig.GetType(), key, value, b64encoded, uksConfig.Recipients...)
+		fpFilename := g.path(g.encryptedFilename(uksConfig.GetName(), key, "fp"))
+		encryptedFP := secretRef.GetEncryptedFP(fpFilename, uksConfig.GetName(), key)
+		sopsOptions := keyOptions[key]
+		recipients := keyRecipients[key]
+		found, encryptedOnceErr := secretFingerprintTryOpen(encryptedFP, uksConfig.GetName(), uksConfig.GetType(), key, value, b64encoded, sopsOptions, recipients...)
 		if found {
 			results = append(results, &framework.Result{
 				Message:  fmt.Sprintf("Secret '%s' has been encrypted and not changed, encryption skipped", key),
@@ -75,23 +133,33 @@ func (g *KSopsGenerator) GenerateSecretEncryptedFiles(nodes []*yaml.RNode,
 			})
 		}
 
+		// The provided values have no comments
+		var comment string
+		if provider == "" {
+			comment = secretRef.GetComment(name, sourceKey)
+		}
+
 		encNode, err := NewSecretEncryptedFileNode(
 			uksConfig.GetName(),
 			uksConfig.GetType(),
 			key,
 			value,
+			comment,
 			b64encoded,
-			uksConfig.Recipients...,
+			keyRing.PublicKey,
+			uksConfig.Keyservices,
+			sopsOptions,
+			recipients...,
 		)
 		if err != nil {
 			results = append(results, &framework.Result{
 				Message:  err.Error(),
 				Severity: framework.Error,
 			})
+			continue
 		}
 
-		filename := fmt.Sprintf("%s.%s.enc.yaml", ResultFileEncryptedBase,
-			normalizedKeyName(key))
+		filename := g.path(g.encryptedFilename(uksConfig.GetName(), key, "enc"))
 		setFilename([]*yaml.RNode{encNode}, filename)
 		newNodes = append(newNodes, encNode)
 		results = append(results, &framework.Result{
@@ -106,22 +174,22 @@ func (g *KSopsGenerator) GenerateSecretEncryptedFiles(nodes []*yaml.RNode,
 			key,
 			value,
 			b64encoded,
-			uksConfig.Recipients...,
+			sopsOptions,
+			recipients...,
 		)
 		if err != nil {
 			results = append(results, &framework.Result{
 				Message:  err.Error(),
 				Severity: framework.Error,
 			})
+			continue
 		}
 
-		filename = fmt.Sprintf("%s.%s.fp.yaml", ResultFileEncryptedBase,
-			normalizedKeyName(key))
-		setFilename([]*yaml.RNode{fpNode}, filename)
+		setFilename([]*yaml.RNode{fpNode}, fpFilename)
 		newNodes = append(newNodes, fpNode)
 		results = append(results, &framework.Result{
 			Message: fmt.Sprintf("SecretFingerprint key '%s' => %s updated",
-				key, filename),
+				key, fpFilename),
 			Severity: framework.Info,
 		})
 	}
@@ -129,8 +197,143 @@ func (g *KSopsGenerator) GenerateSecretEncryptedFiles(nodes []*yaml.RNode,
 	return newNodes, results
 }
 
-func NewSecretEncryptedFileNode(secretName, secretType, key, value string,
+// MigrateSecretEncryptedFiles moves the encrypted and fingerprint files of the
+// secret items named by the other file names scheme, the qualified names
+// follow the number of the secrets of the package directory, so the files
+// are kept as they are instead of the encryption of the unencrypted values
+func (g *KSopsGenerator) MigrateSecretEncryptedFiles(nodes []*yaml.RNode,
+	uksConfig *config.UpdateKSopsSecrets,
+) (results framework.Results) {
+	other := *g
+	other.QualifiedFilenames = !g.QualifiedFilenames
+
+	for _, key := range uksConfig.GetSecretItems() {
+		for _, suffix := range []string{"enc", "fp"} {
+			target := g.path(g.encryptedFilename(uksConfig.GetName(), key, suffix))
+			source := other.path(other.encryptedFilename(uksConfig.GetName(), key, suffix))
+			if target == source || findSecretFileNode(nodes, uksConfig.GetName(), target) != nil {
+				continue
+			}
+
+			node := findSecretFileNode(nodes, uksConfig.GetName(), source)
+			if node == nil {
+				continue
+			}
+
+			annotations := node.GetAnnotations()
+			annotations[kioutil.PathAnnotation] = target
+			if _, found := annotations[kioutil.LegacyPathAnnotation]; found {
+				annotations[kioutil.LegacyPathAnnotation] = target
+			}
+
+			if err := node.SetAnnotations(annotations); err != nil {
+				results = append(results, &framework.Result{
+					Message: fmt.Sprintf("Secret '%s' file %s move error, %s",
+						uksConfig.GetName(), source, err.Error()),
+					Severity: framework.Error,
+				})
+				return results
+			}
+
+			results = append(results, &framework.Result{
+				Message: fmt.Sprintf("Secret '%s' file %s moved to %s",
+					uksConfig.GetName(), source, target),
+				Severity: framework.Info,
+			})
+		}
+	}
+
+	return results
+}
+
+// findSecretFileNode returns the encrypted or fingerprint file of the secret
+func findSecretFileNode(nodes []*yaml.RNode, name, filePath string) *yaml.RNode {
+	for _, node := range nodes {
+		if node.GetName() != name {
+			continue
+		}
+
+		if nodePath, _, err := kioutil.GetFileAnnotations(node); err == nil && nodePath == filePath {
+			return node
+		}
+	}
+
+	return nil
+}
+
+// PruneSecretEncryptedFiles finds the encrypted and fingerprint files of the
+// secret that no longer have a matching item, the orphan paths are returned
+// for pruning unless the output keeps them. The files of the items are never
+// orphans whatever their file names scheme, even if the items are skipped
+func (g *KSopsGenerator) PruneSecretEncryptedFiles(nodes []*yaml.RNode,
+	uksConfig *config.UpdateKSopsSecrets,
+) (orphanPaths []string, results framework.Results) {
+	managedFilesCheck, err := regexp.Compile(
+		encryptedFilesPattern(uksConfig.GetDir(), uksConfig.Output))
+	if err != nil {
+		results = append(results, &framework.Result{
+			Message:  fmt.Sprintf("Encrypted files pattern error, %s", err.Error()),
+			Severity: framework.Error,
+		})
+		return nil, results
+	}
+
+	other := *g
+	other.QualifiedFilenames = !g.QualifiedFilenames
+
+	var expectedPaths []string
+	for _, key := range uksConfig.GetSecretItems() {
+		for _, gen := range []*KSopsGenerator{g, &other} {
+			expectedPaths = append(expectedPaths,
+				gen.path(gen.encryptedFilename(uksConfig.GetName(), key, "enc")),
+				gen.path(gen.encryptedFilename(uksConfig.GetName(), key, "fp")),
+			)
+		}
+	}
+
+	for _, node := range nodes {
+		if node.GetName() != uksConfig.GetName() {
+			continue
+		}
+
+		nodePath, _, err := kioutil.GetFileAnnotations(node)
+		if err != nil || !managedFilesCheck.MatchString(nodePath) {
+			continue
+		}
+
+		if sliceContainsString(expectedPaths, nodePath) ||
+			sliceContainsString(orphanPaths, nodePath) {
+			continue
+		}
+
+		if uksConfig.Output.KeepOrphans {
+			results = append(results, &framework.Result{
+				Message: fmt.Sprintf("Secret '%s' file %s has no matching item, kept",
+					uksConfig.GetName(), nodePath),
+				Severity: framework.Warning,
+			})
+			continue
+		}
+
+		orphanPaths = append(orphanPaths, nodePath)
+		results = append(results, &framework.Result{
+			Message: fmt.Sprintf("Secret '%s' file %s has no matching item, pruned",
+				uksConfig.GetName(), nodePath),
+			Severity: framework.Info,
+		})
+	}
+
+	return orphanPaths, results
+}
+
+// NewSecretEncryptedFileNode encrypts the secret item, the comment is kept
+// on the item key for the sops encrypted comment regex and encrypted with
+// the value, the cloud KMS recipients are encrypted by the keyservices
+func NewSecretEncryptedFileNode(secretName, secretType, key, value, comment string,
 	b64encoded bool,
+	pgpPublicKey sops.PGPPublicKeyFunc,
+	keyservices []string,
+	options config.UpdateKSopsSopsOptions,
 	recipients ...config.UpdateKSopsRecipient,
 ) (*yaml.RNode, error) {
 	n := yaml.MustParse(`
@@ -169,25 +372,49 @@ data:
 	}
 	n.SetDataMap(data)
 
-	encryptor := exec.NewSopsEncryption()
-	output, err := encryptor.Encrypt(n.MustString(), recipients...)
+	if comment != "" {
+		if f := n.Field("data").Value.Field(key); f != nil {
+			f.Key.YNode().HeadComment = comment
+		}
+	}
+
+	encryptor := sops.NewSopsEncryption(pgpPublicKey, keyservices...)
+	output, err := encryptor.Encrypt(n.MustString(), options, recipients...)
 	if err != nil {
 		return nil, err
 	}
 
-	enc := yaml.MustParse(output)
-
-	// The Sops render the encrypted YAML as a wide sequences indentation
-	if _, err := enc.Pipe(yaml.SetAnnotation(kioutil.SeqIndentAnnotation,
-		string(yaml.WideSequenceStyle))); err != nil {
+	enc, err := yaml.Parse(output)
+	if err != nil {
 		return nil, err
 	}
 
+	// The secret value must never be left in plaintext by the sops options
+	for k, v := range enc.GetDataMap() {
+		if v != "" && !strings.HasPrefix(v, "ENC[AES256_GCM,data:") {
+			return nil, fmt.Errorf("the Secret '%s' key '%s' is not encrypted by the sops options",
+				secretName, k)
+		}
+	}
+
+	// The identity fields are read by kustomize and KSOPS as is
+	for _, field := range [][]string{
+		{"apiVersion"}, {"kind"}, {"metadata", "name"},
+		{"metadata", "annotations", "kustomize.config.k8s.io/behavior"}, {"type"},
+	} {
+		v, err := enc.Pipe(yaml.Lookup(field...))
+		if err == nil && v != nil && strings.HasPrefix(v.YNode().Value, "ENC[AES256_GCM,data:") {
+			return nil, fmt.Errorf("the Secret '%s' field '%s' must not be encrypted by the sops options",
+				secretName, strings.Join(field, "."))
+		}
+	}
+
 	return enc, nil
 }
 
 func NewSecretFingerprintFileNode(secretName, secretType, key, value string,
 	b64encoded bool,
+	options config.UpdateKSopsSopsOptions,
 	recipients ...config.UpdateKSopsRecipient,
 ) (*yaml.RNode, error) {
 	n := yaml.MustParse(`
@@ -218,7 +445,7 @@ data:
 	}
 
 	// Add the encrypted fingerprint to support the encrypt once consideration
-	fingerprintCiphertext, err := secretFingerprintSeal(secretName, secretType, key, dataValue, true, recipients...)
+	fingerprintCiphertext, err := secretFingerprintSeal(secretName, secretType, key, dataValue, true, options, recipients...)
 	if err != nil {
 		return nil, err
 	}
@@ -228,19 +455,12 @@ data:
 	}
 	n.SetDataMap(data)
 
-	// The Sops render the encrypted YAML as a wide sequences indentation
-	if _, err := n.Pipe(yaml.SetAnnotation(kioutil.SeqIndentAnnotation,
-		string(yaml.WideSequenceStyle))); err != nil {
-		return nil, err
-	}
-
 	return n, nil
 }
 
 func selectGPGRecipientsWithPublicKey(gpgRecipients []config.UpdateKSopsRecipient) (selected []config.UpdateKSopsRecipient) {
 	for _, gr := range gpgRecipients {
-		sr := gr.PublicKeySecretReference
-		if sr.Name != "" && sr.Key != "" {
+		if gr.HasPublicKeySource() {
 			selected = append(selected, gr)
 		}
 	}
@@ -250,8 +470,7 @@ func selectGPGRecipientsWithPublicKey(gpgRecipients []config.UpdateKSopsRecipien
 
 func selectGPGRecipientsWithoutPublicKey(gpgRecipients []config.UpdateKSopsRecipient) (selected []config.UpdateKSopsRecipient) {
 	for _, gr := range gpgRecipients {
-		sr := gr.PublicKeySecretReference
-		if sr.Name == "" || sr.Key == "" {
+		if !gr.HasPublicKeySource() {
 			selected = append(selected, gr)
 		}
 	}
@@ -269,6 +488,58 @@ func getGPGRecipients(recipients ...config.UpdateKSopsRecipient) (gpgRecipients
 	return
 }
 
+// getSecretItemValue reads the item value from the provider, the pinned
+// reference, or the first of the references if both are empty
+func getSecretItemValue(secretRef SecretReference, provider, name, key string) (value string, b64encoded bool, err error) {
+	switch {
+	case provider != "":
+		return secretRef.GetFromProvider(provider, key)
+	case name == "":
+		return secretRef.Get(key)
+	}
+
+	return secretRef.GetExact(name, key)
+}
+
+// ambiguousSecretResult reports the key found in more than one of the
+// references, nil if the key is not ambiguous
+func ambiguousSecretResult(secretRef SecretReference, uksConfig *config.UpdateKSopsSecrets,
+	key, sourceKey string) *framework.Result {
+
+	sources := secretRef.GetSources(sourceKey)
+	if len(sources) < 2 {
+		return nil
+	}
+
+	message := fmt.Sprintf("Secret '%s' is ambiguous%s, found in the secrets references '%s'",
+		key, describeSecretItemSource(key, "", sourceKey), strings.Join(sources, "', '"))
+
+	if uksConfig.GetSecretPrecedence() == config.SecretPrecedenceError {
+		return &framework.Result{
+			Message:  message + ", pin the source with the item from.secret",
+			Severity: framework.Error,
+		}
+	}
+
+	return &framework.Result{
+		Message:  fmt.Sprintf("%s, the value of '%s' is used", message, sources[0]),
+		Severity: framework.Warning,
+	}
+}
+
+// describeSecretItemSource describes the item source for the messages, it is
+// empty if the item is read from the key of the same name in any references
+func describeSecretItemSource(key, name, sourceKey string) string {
+	switch {
+	case name != "":
+		return fmt.Sprintf(" from '%s/%s'", name, sourceKey)
+	case sourceKey != key:
+		return fmt.Sprintf(" from '%s'", sourceKey)
+	}
+
+	return ""
+}
+
 func getGPGPublicKeysData(secretRef SecretReference, name, key string) (data string, err error) {
 	value, b64encoded, err := secretRef.GetExact(name, key)
 
@@ -290,28 +561,54 @@ func getGPGPublicKeysData(secretRef SecretReference, name, key string) (data str
 	return data, nil
 }
 
-func importGPGKeys(secretRef SecretReference, recipients ...config.UpdateKSopsRecipient) (results []*framework.Result) {
-	gpg := exec.NewGPGKeys()
+// importGPGKeys parses the public keys data of the recipients into the key
+// ring, the data must hold the key of the recipient fingerprint, the keys
+// without the public key source are looked up in the keys directory
+func importGPGKeys(keys *publicKeyReader, keyRing *sops.PGPKeyRing,
+	recipients ...config.UpdateKSopsRecipient,
+) (results []*framework.Result, imported []string) {
+	for _, gr := range getGPGRecipients(recipients...) {
+		if !gr.HasPublicKeySource() {
+			file, err := keys.importFromKeysDir(keyRing, gr.Recipient)
+			if err != nil {
+				// The key server is still the source of the keys, it is
+				// reported as the committed keys could be left out
+				results = append(results, &framework.Result{
+					Message: fmt.Sprintf("PGP/GPG public key %s is looked up on the key server, %s",
+						gr.Recipient, err.Error()),
+					Severity: framework.Warning,
+				})
+			}
+
+			if file != "" {
+				imported = append(imported, gr.Recipient)
+				results = append(results, &framework.Result{
+					Message:  fmt.Sprintf("PGP/GPG public key %s imported from %s", gr.Recipient, file),
+					Severity: framework.Info,
+				})
+			}
+			continue
+		}
 
-	for _, gr := range selectGPGRecipientsWithPublicKey(getGPGRecipients(recipients...)) {
-		sr := gr.PublicKeySecretReference
-		data, err := getGPGPublicKeysData(secretRef, sr.Name, sr.Key)
+		// The configured public key source is never replaced by the key server
+		data, source, err := keys.read(gr)
 		if err != nil {
 			results = append(results, &framework.Result{
-				Message:  err.Error(),
-				Severity: framework.Warning,
+				Message:  fmt.Sprintf("PGP/GPG public key %s read error, %s", gr.Recipient, err.Error()),
+				Severity: framework.Error,
 			})
 			continue
 		}
 
-		if _, err = gpg.ImportKey(data); err != nil {
+		if err := keyRing.Import(gr.Recipient, data); err != nil {
 			results = append(results, &framework.Result{
-				Message:  err.Error(),
-				Severity: framework.Warning,
+				Message:  fmt.Sprintf("%s, %s", err.Error(), source),
+				Severity: framework.Error,
 			})
 			continue
 		}
 
+		imported = append(imported, gr.Recipient)
 		results = append(results, &framework.Result{
 			Message:  fmt.Sprintf("PGP/GPG public key %s imported", gr.Recipient),
 			Severity: framework.Info,
@@ -321,9 +618,67 @@ func importGPGKeys(secretRef SecretReference, recipients ...config.UpdateKSopsRe
 	return
 }
 
-func receiveGPGKeys(recipients ...config.UpdateKSopsRecipient) (results []*framework.Result) {
-	gpg := exec.NewGPGKeys()
+// fetchGPGKeys fetches the keys of the recipients with the keyserver from the
+// WKD first then the keyserver URL, the fetched key must match the fingerprint
+func fetchGPGKeys(fetcher *sops.PGPKeyFetcher, keyRing *sops.PGPKeyRing, imported []string,
+	recipients ...config.UpdateKSopsRecipient,
+) (results []*framework.Result) {
 	for _, gr := range selectGPGRecipientsWithoutPublicKey(getGPGRecipients(recipients...)) {
+		if gr.Keyserver.IsEmpty() || sliceContainsString(imported, gr.Recipient) {
+			continue
+		}
+
+		var errs []string
+		for _, lookup := range []struct {
+			source string
+			fetch  func(string, string) (string, error)
+		}{
+			{source: gr.Keyserver.WKD, fetch: fetcher.FetchWKD},
+			{source: gr.Keyserver.URL, fetch: fetcher.FetchHKP},
+		} {
+			if lookup.source == "" {
+				continue
+			}
+
+			data, err := lookup.fetch(lookup.source, gr.Recipient)
+			if err == nil {
+				err = keyRing.Import(gr.Recipient, data)
+			}
+
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+
+			results = append(results, &framework.Result{
+				Message:  fmt.Sprintf("PGP/GPG public key %s fetched from %s", gr.Recipient, lookup.source),
+				Severity: framework.Info,
+			})
+			errs = nil
+			break
+		}
+
+		if len(errs) > 0 {
+			results = append(results, &framework.Result{
+				Message:  strings.Join(errs, "; "),
+				Severity: framework.Error,
+			})
+		}
+	}
+
+	return
+}
+
+// receiveGPGKeys receives the keys not imported nor fetched with the gpg
+// default keyserver
+func receiveGPGKeys(gpg exec.GPGKeysInterface, imported []string,
+	recipients ...config.UpdateKSopsRecipient,
+) (results []*framework.Result) {
+	for _, gr := range selectGPGRecipientsWithoutPublicKey(getGPGRecipients(recipients...)) {
+		if !gr.Keyserver.IsEmpty() || sliceContainsString(imported, gr.Recipient) {
+			continue
+		}
+
 		if _, err := gpg.ReceiveKeys(gr.Recipient); err != nil {
 			results = append(results, &framework.Result{
 				Message:  err.Error(),
@@ -342,11 +697,52 @@ func receiveGPGKeys(recipients ...config.UpdateKSopsRecipient) (results []*frame
 	return
 }
 
-func preloadGPGKeys(secretRef SecretReference, recipients ...config.UpdateKSopsRecipient) framework.Results {
-	importResults := importGPGKeys(secretRef, recipients...)
-	receiveKeysResults := receiveGPGKeys(recipients...)
+func preloadGPGKeys(keys *publicKeyReader, keyRing *sops.PGPKeyRing,
+	fetcher *sops.PGPKeyFetcher, gpg exec.GPGKeysInterface,
+	recipients ...config.UpdateKSopsRecipient,
+) framework.Results {
+	importResults, imported := importGPGKeys(keys, keyRing, recipients...)
+	fetchResults := fetchGPGKeys(fetcher, keyRing, imported, recipients...)
+	receiveKeysResults := receiveGPGKeys(gpg, imported, recipients...)
+
+	results := framework.Results(append(importResults, fetchResults...))
+	results = append(results, receiveKeysResults...)
+	if results.ExitCode() == 1 {
+		return results
+	}
 
-	return append(importResults, receiveKeysResults...)
+	return append(results, verifyGPGKeys(keyRing, time.Now(), recipients...)...)
+}
+
+func verifyGPGKey(keyRing *sops.PGPKeyRing, fingerprint string, now time.Time) error {
+	data, err := keyRing.PublicKey(fingerprint)
+	if err != nil {
+		return err
+	}
+
+	return sops.ValidatePGPKey(fingerprint, data, now)
+}
+
+// verifyGPGKeys confirms the imported, fetched or received key of each
+// recipient is pinned to its full fingerprint and could encrypt
+func verifyGPGKeys(keyRing *sops.PGPKeyRing, now time.Time,
+	recipients ...config.UpdateKSopsRecipient,
+) (results []*framework.Result) {
+	for _, gr := range getGPGRecipients(recipients...) {
+		err := fmt.Errorf("must be the full 40 hex fingerprint")
+		if config.IsPGPFingerprint(gr.Recipient) {
+			err = verifyGPGKey(keyRing, gr.Recipient, now)
+		}
+
+		if err != nil {
+			results = append(results, &framework.Result{
+				Message:  fmt.Sprintf("the PGP/GPG recipient %s is rejected: %s", gr.Recipient, err.Error()),
+				Severity: framework.Error,
+			})
+		}
+	}
+
+	return
 }
 
 func encodeValue(value string) (enc string) {
@@ -374,6 +770,7 @@ func secretFingerprintObfuscatedValue(value string, salt []byte) []byte {
 
 func secretFingerprintCryptoKey(secretName, secretType, key, value string, b64encoded bool,
 	salt []byte,
+	options config.UpdateKSopsSopsOptions,
 	recipients ...config.UpdateKSopsRecipient,
 ) []byte {
 	var buffer bytes.Buffer
@@ -391,12 +788,32 @@ func secretFingerprintCryptoKey(secretName, secretType, key, value string, b64en
 	for _, recipient := range recipients {
 		buffer.Write(secretFingerprintObfuscatedValue(recipient.Type, salt))
 		buffer.Write(secretFingerprintObfuscatedValue(recipient.Recipient, salt))
+
+		// The first key group is left out to keep the existing fingerprints valid
+		if recipient.KeyGroup > 0 {
+			buffer.Write(secretFingerprintObfuscatedValue(strconv.Itoa(recipient.KeyGroup), salt))
+		}
+	}
+
+	// The default options are left out to keep the existing fingerprints valid
+	if options != (config.UpdateKSopsSopsOptions{}) {
+		buffer.Write(secretFingerprintObfuscatedValue(sopsOptionsFingerprint(options), salt))
 	}
 
 	return secretFingerprintIDKey(buffer.Bytes(), salt)
 }
 
+// sopsOptionsFingerprint serializes the sops options, the encrypted files are
+// regenerated when the options are changed
+func sopsOptionsFingerprint(options config.UpdateKSopsSopsOptions) string {
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%t\x00%d",
+		options.EncryptedRegex, options.UnencryptedSuffix,
+		options.EncryptedCommentRegex, options.IsMACOnlyEncrypted(),
+		options.ShamirThreshold)
+}
+
 func secretFingerprintSeal(secretName, secretType, key, value string, b64encoded bool,
+	options config.UpdateKSopsSopsOptions,
 	recipients ...config.UpdateKSopsRecipient,
 ) (string, error) {
 	nonce := make([]byte, gcmStandardNonceSize)
@@ -405,7 +822,7 @@ func secretFingerprintSeal(secretName, secretType, key, value string, b64encoded
 		return "", fmt.Errorf("Random nonce error: %w", err)
 	}
 
-	secretKey := secretFingerprintCryptoKey(secretName, secretType, key, value, b64encoded, nonce, recipients...)
+	secretKey := secretFingerprintCryptoKey(secretName, secretType, key, value, b64encoded, nonce, options, recipients...)
 
 	block, err := aes.NewCipher(secretKey)
 	if err != nil {
@@ -425,6 +842,7 @@ func secretFingerprintSeal(secretName, secretType, key, value string, b64encoded
 }
 
 func secretFingerprintTryOpen(b64Ciphertext, secretName, secretType, key, value string, b64encoded bool,
+	options config.UpdateKSopsSopsOptions,
 	recipients ...config.UpdateKSopsRecipient,
 ) (found bool, err error) {
 	if b64Ciphertext == "" {
@@ -438,7 +856,7 @@ func secretFingerprintTryOpen(b64Ciphertext, secretName, secretType, key, value
 
 	nonce, ciphertext := ciphertext[:gcmStandardNonceSize], ciphertext[gcmStandardNonceSize:]
 
-	secretKey := secretFingerprintCryptoKey(secretName, secretType, key, value, b64encoded, nonce, recipients...)
+	secretKey := secretFingerprintCryptoKey(secretName, secretType, key, value, b64encoded, nonce, options, recipients...)
 
 	block, err := aes.NewCipher(secretKey)
 	if err != nil {
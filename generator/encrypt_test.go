@@ -6,12 +6,20 @@ package generator
 import (
 	"encoding/base64"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/neutronth/kpt-update-ksops-secrets/config"
+	"github.com/neutronth/kpt-update-ksops-secrets/exec"
+	"github.com/neutronth/kpt-update-ksops-secrets/sops"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
@@ -22,7 +30,7 @@ func uksConfigEncryptedSimple() *config.UpdateKSopsSecrets {
 		},
 		Secret: config.UpdateKSopsSecretSpec{
 			References: []string{"unencrypted-secrets"},
-			Items:      []string{"test", "test2", "UPPER_CASE"},
+			Items:      []config.UpdateKSopsSecretItem{{Key: "test"}, {Key: "test2"}, {Key: "UPPER_CASE"}},
 		},
 		Recipients: []config.UpdateKSopsRecipient{
 			{
@@ -48,12 +56,34 @@ func uksConfigEncryptedSimple() *config.UpdateKSopsSecrets {
 type mockSecretReference struct{}
 
 func (sr *mockSecretReference) GetExact(name, key string) (value string, b64encoded bool, err error) {
+	// The PGP public keys are the example ones
+	if strings.HasSuffix(key, ".gpg") {
+		data, err := os.ReadFile(path.Join("../example", key))
+		return encodeValue(string(data)), true, err
+	}
+
 	value = "T0s="
 	b64encoded = true
 	err = nil
 	return
 }
 
+func testPGPKeyRing(t *testing.T, recipients ...config.UpdateKSopsRecipient) *sops.PGPKeyRing {
+	gpg, err := exec.NewGPGKeys()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { gpg.Close() })
+
+	keyRing := sops.NewPGPKeyRing(gpg.ExportKey)
+	keys := &publicKeyReader{secretRef: &mockSecretReference{}}
+	if results := preloadGPGKeys(keys, keyRing, sops.NewPGPKeyFetcher(nil), gpg, recipients...); results.ExitCode() != 0 {
+		t.Fatalf("Unexpected preload results: %s", results.Error())
+	}
+
+	return keyRing
+}
+
 func (sr *mockSecretReference) Get(key string) (value string, b64encoded bool, err error) {
 	switch key {
 	case "test":
@@ -74,7 +104,27 @@ func (sr *mockSecretReference) Get(key string) (value string, b64encoded bool, e
 	return
 }
 
-func (sr *mockSecretReference) GetEncryptedFP(name, key string) string {
+func (sr *mockSecretReference) GetComment(name, key string) string {
+	return ""
+}
+
+func (sr *mockSecretReference) GetFromProvider(provider, key string) (value string, b64encoded bool, err error) {
+	return "", false, fmt.Errorf("unknown provider '%s'", provider)
+}
+
+func (sr *mockSecretReference) GetSources(key string) []string {
+	return nil
+}
+
+func (sr *mockSecretReference) GetKeys(name string) (keys []string, found bool) {
+	return nil, false
+}
+
+func (sr *mockSecretReference) GetEncryptedKeys(name string) []string {
+	return nil
+}
+
+func (sr *mockSecretReference) GetEncryptedFP(filename, name, key string) string {
 	return ""
 }
 
@@ -184,10 +234,12 @@ func TestGenerateSecretEncryptedFiles(t *testing.T) {
 			},
 		}
 
+		keyRing := testPGPKeyRing(t, recipients...)
+
 		for _, tc := range testCases {
 			t.Run(tc.Name, func(t *testing.T) {
 				output, err := NewSecretEncryptedFileNode(tc.SecretName, tc.SecretType,
-					tc.Key, tc.Value, tc.B64Encoded, recipients...)
+					tc.Key, tc.Value, "", tc.B64Encoded, keyRing.PublicKey, nil, config.UpdateKSopsSopsOptions{}, recipients...)
 				if err != nil {
 					t.Fatalf("Unexpected error: %v", err)
 				}
@@ -244,6 +296,80 @@ func TestGenerateSecretEncryptedFiles(t *testing.T) {
 	})
 }
 
+func TestSecretEncryptedFileNodeSopsOptions(t *testing.T) {
+	recipients := []config.UpdateKSopsRecipient{
+		{
+			Type:      "age",
+			Recipient: "age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa",
+		},
+	}
+
+	testCases := []struct {
+		Name          string
+		Key           string
+		Comment       string
+		Options       config.UpdateKSopsSopsOptions
+		ExpectedError error
+	}{
+		{
+			Name:    "encrypted regex",
+			Key:     "test",
+			Options: config.UpdateKSopsSopsOptions{EncryptedRegex: "^test$"},
+		},
+		{
+			Name:    "encrypted comment",
+			Key:     "test",
+			Comment: "# sops:enc",
+			Options: config.UpdateKSopsSopsOptions{EncryptedCommentRegex: "sops:enc"},
+		},
+		{
+			Name:          "unmatched comment",
+			Key:           "test",
+			Options:       config.UpdateKSopsSopsOptions{EncryptedCommentRegex: "sops:enc"},
+			ExpectedError: fmt.Errorf("the Secret 'test' key 'test' is not encrypted by the sops options"),
+		},
+		{
+			Name:    "unencrypted suffix",
+			Key:     "test",
+			Options: config.UpdateKSopsSopsOptions{UnencryptedSuffix: "_unencrypted"},
+		},
+		{
+			Name:          "unencrypted suffix key",
+			Key:           "test_unencrypted",
+			Options:       config.UpdateKSopsSopsOptions{UnencryptedSuffix: "_unencrypted"},
+			ExpectedError: fmt.Errorf("the Secret 'test' key 'test_unencrypted' is not encrypted by the sops options"),
+		},
+		{
+			Name:          "encrypted identity field",
+			Key:           "test",
+			Options:       config.UpdateKSopsSopsOptions{EncryptedRegex: "^(data|metadata)$"},
+			ExpectedError: fmt.Errorf("the Secret 'test' field 'metadata.name' must not be encrypted by the sops options"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			output, err := NewSecretEncryptedFileNode("test", "Opaque", tc.Key, "test",
+				tc.Comment, false, nil, nil, tc.Options, recipients...)
+			if tc.ExpectedError != nil {
+				if err == nil || err.Error() != tc.ExpectedError.Error() {
+					t.Fatalf("Expected error %v, got %v", tc.ExpectedError, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			value := output.GetDataMap()[tc.Key]
+			if !strings.HasPrefix(value, "ENC[AES256_GCM,data:") {
+				t.Errorf("Expect encrypted data, got %s=%v", tc.Key, value)
+			}
+		})
+	}
+}
+
 func TestSecretFingerprint(t *testing.T) {
 	t.Run("fingerprint seal and try open", func(t *testing.T) {
 		recipients := []config.UpdateKSopsRecipient{
@@ -265,7 +391,7 @@ func TestSecretFingerprint(t *testing.T) {
 			},
 		}
 
-		fp, err := secretFingerprintSeal("secret-name", "Opaque", "test", "secret", false, recipients...)
+		fp, err := secretFingerprintSeal("secret-name", "Opaque", "test", "secret", false, config.UpdateKSopsSopsOptions{}, recipients...)
 		if err != nil {
 			t.Errorf("Expect no errors got %v", err)
 		}
@@ -274,7 +400,7 @@ func TestSecretFingerprint(t *testing.T) {
 			t.Errorf("Expect non-empty sealed fingerprint, got %s", fp)
 		}
 
-		found, err := secretFingerprintTryOpen(fp, "secret-name", "Opaque", "test", "secret", false, recipients...)
+		found, err := secretFingerprintTryOpen(fp, "secret-name", "Opaque", "test", "secret", false, config.UpdateKSopsSopsOptions{}, recipients...)
 		if !found {
 			t.Errorf("Expect secret found but got not found")
 		}
@@ -283,7 +409,7 @@ func TestSecretFingerprint(t *testing.T) {
 			t.Errorf("Expect no errors got %v", err)
 		}
 
-		found, err = secretFingerprintTryOpen(fp, "secret-name", "Opaque", "test", "c2VjcmV0", true, recipients...)
+		found, err = secretFingerprintTryOpen(fp, "secret-name", "Opaque", "test", "c2VjcmV0", true, config.UpdateKSopsSopsOptions{}, recipients...)
 		if !found {
 			t.Errorf("Expect secret found but got not found")
 		}
@@ -292,7 +418,7 @@ func TestSecretFingerprint(t *testing.T) {
 			t.Errorf("Expect no errors got %v", err)
 		}
 
-		found, err = secretFingerprintTryOpen(fp, "secret-name", "Opaque", "test", "invalidsecret", false, recipients...)
+		found, err = secretFingerprintTryOpen(fp, "secret-name", "Opaque", "test", "invalidsecret", false, config.UpdateKSopsSopsOptions{}, recipients...)
 		if found {
 			t.Errorf("Expect secret not found but got found")
 		}
@@ -301,7 +427,7 @@ func TestSecretFingerprint(t *testing.T) {
 			t.Errorf("Expect no errors got %v", err)
 		}
 
-		fp, err = secretFingerprintSeal("secret-name", "Opaque", "test", "", false, recipients...)
+		fp, err = secretFingerprintSeal("secret-name", "Opaque", "test", "", false, config.UpdateKSopsSopsOptions{}, recipients...)
 		if err != nil {
 			t.Errorf("Expect no errors got %v", err)
 		}
@@ -310,6 +436,49 @@ func TestSecretFingerprint(t *testing.T) {
 			t.Errorf("Expect non-empty sealed fingerprint, got %s", fp)
 		}
 	})
+
+	t.Run("fingerprint key groups changed", func(t *testing.T) {
+		recipients := []config.UpdateKSopsRecipient{
+			{Type: "age", Recipient: "age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa"},
+			{Type: "age", Recipient: "age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"},
+		}
+
+		fp, err := secretFingerprintSeal("secret-name", "Opaque", "test", "secret", false, config.UpdateKSopsSopsOptions{}, recipients...)
+		if err != nil {
+			t.Fatalf("Expect no errors got %v", err)
+		}
+
+		grouped := append([]config.UpdateKSopsRecipient{}, recipients...)
+		grouped[1].KeyGroup = 1
+
+		found, err := secretFingerprintTryOpen(fp, "secret-name", "Opaque", "test", "secret", false,
+			config.UpdateKSopsSopsOptions{ShamirThreshold: 2}, grouped...)
+		if found || err != nil {
+			t.Errorf("Expect secret not found with the key groups, got %v, %v", found, err)
+		}
+	})
+
+	t.Run("fingerprint ssh recipient added", func(t *testing.T) {
+		recipients := []config.UpdateKSopsRecipient{
+			{Type: "age", Recipient: "age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa"},
+		}
+
+		fp, err := secretFingerprintSeal("secret-name", "Opaque", "test", "secret", false, config.UpdateKSopsSopsOptions{}, recipients...)
+		if err != nil {
+			t.Fatalf("Expect no errors got %v", err)
+		}
+
+		withSSH := append(recipients, config.UpdateKSopsRecipient{
+			Type:      "ssh",
+			Recipient: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILqk4EhAuCsl8EwxgLLug+O0Eo6GdZnpSCJfU76iFNND",
+		})
+
+		found, err := secretFingerprintTryOpen(fp, "secret-name", "Opaque", "test", "secret", false,
+			config.UpdateKSopsSopsOptions{}, withSSH...)
+		if found || err != nil {
+			t.Errorf("Expect secret not found with the ssh recipient, got %v, %v", found, err)
+		}
+	})
 }
 
 func TestGenerateSecretFingerprintFiles(t *testing.T) {
@@ -333,7 +502,7 @@ func TestGenerateSecretFingerprintFiles(t *testing.T) {
 			},
 		}
 
-		output, err := NewSecretFingerprintFileNode("test", "Opaque", "test", "secret", false, recipients...)
+		output, err := NewSecretFingerprintFileNode("test", "Opaque", "test", "secret", false, config.UpdateKSopsSopsOptions{}, recipients...)
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
 		}
@@ -398,3 +567,259 @@ func assertRecipients(output *yaml.RNode, recipients []config.UpdateKSopsRecipie
 
 	return nil
 }
+
+func TestPruneSecretEncryptedFiles(t *testing.T) {
+	var nodes []*yaml.RNode
+
+	resources := []string{`
+apiVersion: v1
+kind: Secret
+metadata:
+  name: test
+  annotations:
+    config.kubernetes.io/path: generated/secrets.test.enc.yaml
+`, `
+apiVersion: config.kubernetes.io/v1alpha1
+kind: SecretFingerprint
+metadata:
+  name: test
+  annotations:
+    config.kubernetes.io/path: generated/secrets.test.fp.yaml
+`, `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: test
+  annotations:
+    config.kubernetes.io/path: generated/secrets.removed.enc.yaml
+`, `
+apiVersion: config.kubernetes.io/v1alpha1
+kind: SecretFingerprint
+metadata:
+  name: test
+  annotations:
+    config.kubernetes.io/path: generated/secrets.removed.fp.yaml
+`, `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: other
+  annotations:
+    config.kubernetes.io/path: generated/secrets.other.enc.yaml
+`, `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: test
+  annotations:
+    config.kubernetes.io/path: envs/prod/generated/secrets.removed.enc.yaml
+`}
+
+	for _, resource := range resources {
+		nodes = append(nodes, yaml.MustParse(resource))
+	}
+
+	uksConfig := uksConfigEncryptedSimple()
+	gen := KSopsGenerator{}
+
+	t.Run("prune", func(t *testing.T) {
+		expected := []string{
+			"generated/secrets.removed.enc.yaml",
+			"generated/secrets.removed.fp.yaml",
+		}
+
+		orphanPaths, results := gen.PruneSecretEncryptedFiles(nodes, uksConfig)
+		if results.ExitCode() != 0 {
+			t.Fatalf("unexpected error:\n %s", results.Error())
+		}
+
+		if !reflect.DeepEqual(expected, orphanPaths) {
+			t.Errorf("Expect %#v, got %#v", expected, orphanPaths)
+		}
+
+		if len(results) != len(expected) {
+			t.Errorf("Expect %d results, got %d", len(expected), len(results))
+		}
+	})
+
+	t.Run("qualified filenames", func(t *testing.T) {
+		gen := KSopsGenerator{QualifiedFilenames: true}
+		expected := []string{
+			"generated/secrets.removed.enc.yaml",
+			"generated/secrets.removed.fp.yaml",
+		}
+
+		orphanPaths, results := gen.PruneSecretEncryptedFiles(nodes, uksConfig)
+		if results.ExitCode() != 0 {
+			t.Fatalf("unexpected error:\n %s", results.Error())
+		}
+
+		if !reflect.DeepEqual(expected, orphanPaths) {
+			t.Errorf("Expect %#v, got %#v", expected, orphanPaths)
+		}
+	})
+
+	t.Run("keep orphans", func(t *testing.T) {
+		uksConfig.Output.KeepOrphans = true
+
+		orphanPaths, results := gen.PruneSecretEncryptedFiles(nodes, uksConfig)
+		if len(orphanPaths) != 0 {
+			t.Errorf("Expect no orphans pruned, got %#v", orphanPaths)
+		}
+
+		for _, result := range results {
+			if result.Severity != framework.Warning {
+				t.Errorf("Expect warning, got %s", result.Severity)
+			}
+		}
+	})
+}
+
+func TestFetchGPGKeys(t *testing.T) {
+	publicKey, err := os.ReadFile("../example/" + testPGPFingerprint + ".gpg")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The mismatched keyserver serves the key whatever the search
+		if r.URL.Query().Get("search") != "0x"+testPGPFingerprint &&
+			!strings.HasPrefix(r.URL.Path, "/mismatched/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		_, _ = w.Write(publicKey)
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		Name              string
+		Recipient         config.UpdateKSopsRecipient
+		Imported          []string
+		ExpectedExitCode  int
+		ExpectedImported  bool
+		ExpectedNoResults bool
+	}{
+		{
+			Name: "fetched from keyserver",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:      "pgp",
+				Recipient: testPGPFingerprint,
+				Keyserver: config.UpdateKSopsKeyserver{URL: server.URL},
+			},
+			ExpectedImported: true,
+		},
+		{
+			Name: "keyserver after the WKD lookup error",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:      "pgp",
+				Recipient: testPGPFingerprint,
+				Keyserver: config.UpdateKSopsKeyserver{URL: server.URL, WKD: "test@invalid"},
+			},
+			ExpectedImported: true,
+		},
+		{
+			Name: "mismatched key",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:      "pgp",
+				Recipient: "F532DA10E563EE84440977A19D0470BDA6CDC457",
+				Keyserver: config.UpdateKSopsKeyserver{URL: server.URL + "/mismatched"},
+			},
+			ExpectedExitCode: 1,
+		},
+		{
+			Name: "already imported",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:      "pgp",
+				Recipient: testPGPFingerprint,
+				Keyserver: config.UpdateKSopsKeyserver{URL: server.URL},
+			},
+			Imported:          []string{testPGPFingerprint},
+			ExpectedNoResults: true,
+		},
+		{
+			Name: "gpg default keyserver",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:      "pgp",
+				Recipient: testPGPFingerprint,
+			},
+			ExpectedNoResults: true,
+		},
+	}
+
+	fetcher := sops.NewPGPKeyFetcher(server.Client())
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			keyRing := sops.NewPGPKeyRing(nil)
+			results := framework.Results(fetchGPGKeys(fetcher, keyRing, tc.Imported, tc.Recipient))
+
+			if tc.ExpectedNoResults && len(results) > 0 {
+				t.Errorf("Expected no results, got %s", results.Error())
+			}
+
+			if results.ExitCode() != tc.ExpectedExitCode {
+				t.Errorf("Expected exit code %d, got %d: %s", tc.ExpectedExitCode, results.ExitCode(), results.Error())
+			}
+
+			_, err := keyRing.PublicKey(tc.Recipient.Recipient)
+			if tc.ExpectedImported != (err == nil) {
+				t.Errorf("Expected imported %v, got %v", tc.ExpectedImported, err)
+			}
+		})
+	}
+}
+
+func TestVerifyGPGKeys(t *testing.T) {
+	publicKey, err := os.ReadFile("../example/" + testPGPFingerprint + ".gpg")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	keyRing := sops.NewPGPKeyRing(func(fingerprint string) (string, error) {
+		return "", fmt.Errorf("the GPG public key %s not found", fingerprint)
+	})
+	if err := keyRing.Import(testPGPFingerprint, string(publicKey)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	testCases := []struct {
+		Name            string
+		Recipient       string
+		ExpectedMessage string
+	}{
+		{
+			Name:      "pinned key",
+			Recipient: testPGPFingerprint,
+		},
+		{
+			Name:            "long key id",
+			Recipient:       "6E38309B4DA30118",
+			ExpectedMessage: "the PGP/GPG recipient 6E38309B4DA30118 is rejected: must be the full 40 hex fingerprint",
+		},
+		{
+			Name:            "key not found",
+			Recipient:       "F532DA10E563EE84440977A19D0470BDA6CDC457",
+			ExpectedMessage: "the PGP/GPG recipient F532DA10E563EE84440977A19D0470BDA6CDC457 is rejected: the GPG public key F532DA10E563EE84440977A19D0470BDA6CDC457 not found",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			results := framework.Results(verifyGPGKeys(keyRing, time.Now(),
+				config.UpdateKSopsRecipient{Type: "pgp", Recipient: tc.Recipient}))
+
+			if tc.ExpectedMessage == "" {
+				if len(results) > 0 {
+					t.Errorf("Unexpected results: %s", results.Error())
+				}
+				return
+			}
+
+			if len(results) != 1 || results[0].Severity != framework.Error ||
+				results[0].Message != tc.ExpectedMessage {
+				t.Errorf("Expected error %s, got %v", tc.ExpectedMessage, results)
+			}
+		})
+	}
+}
@@ -5,19 +5,202 @@ package generator
 
 import (
 	"fmt"
+	"io/fs"
+	"path"
 	"strings"
 
 	"github.com/neutronth/kpt-update-ksops-secrets/config"
+	"github.com/neutronth/kpt-update-ksops-secrets/exec"
+	"github.com/neutronth/kpt-update-ksops-secrets/sops"
 	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
 const ResultFileBaseSecrets = "secrets.yaml"
 const ResultFileKustomization = "kustomization.yaml"
 const ResultFileKSopsGenerator = "generated/ksops-generator.yaml"
+const ResultDirGenerated = "generated"
+const ResultFileEncryptedPattern = "secrets." + config.OutputPatternKey + ".enc.yaml"
+const ResultFileFingerprintPattern = "secrets." + config.OutputPatternKey + ".fp.yaml"
+const ResultFileQualifiedEncryptedPattern = "secrets." + config.OutputPatternName + "." + config.OutputPatternKey + ".enc.yaml"
+const ResultFileQualifiedFingerprintPattern = "secrets." + config.OutputPatternName + "." + config.OutputPatternKey + ".fp.yaml"
+
+// ResultFileEncryptedBase is the base of the default encrypted file names
+//
+// Deprecated: the encrypted file names follow the output patterns, use
+// ResultFileEncryptedPattern instead
 const ResultFileEncryptedBase = "generated/secrets"
 
-type KSopsGenerator struct{}
+// kustomizationFileNames are the file names recognized by the kustomize
+var kustomizationFileNames = []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}
+
+type KSopsGenerator struct {
+	// Dir is the package directory where the files are generated into
+	Dir string
+
+	// QualifiedFilenames includes the secret name in the encrypted file names,
+	// required when multiple secrets are generated into the same package
+	QualifiedFilenames bool
+
+	// Output is the generated files layout, the defaults apply if unset
+	Output config.UpdateKSopsOutput
+
+	// FS holds the package files, the public key and the SecretSource files
+	// are read from it
+	FS fs.FS
+
+	// GPG is the isolated keyring of the run, a temporary one is used per
+	// encryption if unset
+	GPG exec.GPGKeysInterface
+
+	// KeyFetcher fetches the PGP public keys of the configured keyservers, a
+	// fetcher of the default HTTP client is used if unset
+	KeyFetcher *sops.PGPKeyFetcher
+}
+
+// packageFS returns the package files only if they hold the files of the
+// resources at their package paths, the function could run elsewhere than
+// the package directory, eg. in a container without the mounted package
+func (g *KSopsGenerator) packageFS(nodes []*yaml.RNode) fs.FS {
+	if g.FS == nil {
+		return nil
+	}
+
+	for _, node := range nodes {
+		nodePath, _, err := kioutil.GetFileAnnotations(node)
+		if err != nil || nodePath == "" {
+			continue
+		}
+
+		if info, err := fs.Stat(g.FS, nodePath); err == nil && info.Mode().IsRegular() {
+			return g.FS
+		}
+	}
+
+	return nil
+}
+
+// path returns the package file path of the generated file
+func (g *KSopsGenerator) path(filename string) string {
+	return path.Join(g.Dir, filename)
+}
+
+func (g *KSopsGenerator) baseSecretsFile() string {
+	return outputOrDefault(g.Output.BaseSecretsFile, ResultFileBaseSecrets)
+}
+
+func (g *KSopsGenerator) kustomizationFile() string {
+	return outputOrDefault(g.Output.KustomizationFile, ResultFileKustomization)
+}
+
+// kustomizationPath returns the package file path of the existing
+// kustomization, or the configured one if none exists
+func (g *KSopsGenerator) kustomizationPath(nodes []*yaml.RNode) string {
+	if node := g.findKustomization(nodes); node != nil {
+		if nodePath, _, err := kioutil.GetFileAnnotations(node); err == nil {
+			return nodePath
+		}
+	}
+
+	return g.path(g.kustomizationFile())
+}
+
+func (g *KSopsGenerator) findKustomization(nodes []*yaml.RNode) *yaml.RNode {
+	for _, node := range nodes {
+		if node.GetKind() != "Kustomization" {
+			continue
+		}
+
+		nodePath, _, err := kioutil.GetFileAnnotations(node)
+		if err != nil {
+			continue
+		}
+
+		if g.Output.KustomizationFile != "" {
+			if nodePath == g.path(g.kustomizationFile()) {
+				return node
+			}
+			continue
+		}
+
+		if path.Dir(nodePath) == path.Clean(g.Dir) &&
+			sliceContainsString(kustomizationFileNames, path.Base(nodePath)) {
+			return node
+		}
+	}
+
+	return nil
+}
+
+func (g *KSopsGenerator) ksopsGeneratorFile() string {
+	return path.Join(generatedDir(g.Output), path.Base(ResultFileKSopsGenerator))
+}
+
+func (g *KSopsGenerator) encryptedFilename(secretName, key, suffix string) string {
+	pattern := encryptedFilePattern(g.Output, g.QualifiedFilenames)
+	if suffix == "fp" {
+		pattern = fingerprintFilePattern(g.Output, g.QualifiedFilenames)
+	}
+
+	filename := strings.ReplaceAll(pattern, config.OutputPatternName, normalizedKeyName(secretName))
+	filename = strings.ReplaceAll(filename, config.OutputPatternKey, normalizedKeyName(key))
+
+	return path.Clean(filename)
+}
+
+// validateOutput ensures the encrypted files of the secrets sharing the
+// package directory never collide
+func (g *KSopsGenerator) validateOutput() error {
+	if !g.QualifiedFilenames {
+		return nil
+	}
+
+	for _, pattern := range []string{g.Output.EncryptedFilePattern, g.Output.FingerprintFilePattern} {
+		if pattern != "" && !strings.Contains(pattern, config.OutputPatternName) {
+			return fmt.Errorf("file pattern '%s' must contain %s, the directory '%s' has multiple secrets",
+				pattern, config.OutputPatternName, g.Dir)
+		}
+	}
+
+	return nil
+}
+
+func outputOrDefault(value, defaultValue string) string {
+	if value != "" {
+		return path.Clean(value)
+	}
+
+	return defaultValue
+}
+
+func generatedDir(output config.UpdateKSopsOutput) string {
+	return outputOrDefault(output.GeneratedDir, ResultDirGenerated)
+}
+
+func encryptedFilePattern(output config.UpdateKSopsOutput, qualified bool) string {
+	if output.EncryptedFilePattern != "" {
+		return output.EncryptedFilePattern
+	}
+
+	if qualified {
+		return path.Join(generatedDir(output), ResultFileQualifiedEncryptedPattern)
+	}
+
+	return path.Join(generatedDir(output), ResultFileEncryptedPattern)
+}
+
+func fingerprintFilePattern(output config.UpdateKSopsOutput, qualified bool) string {
+	if output.FingerprintFilePattern != "" {
+		return output.FingerprintFilePattern
+	}
+
+	if qualified {
+		return path.Join(generatedDir(output), ResultFileQualifiedFingerprintPattern)
+	}
+
+	return path.Join(generatedDir(output), ResultFileFingerprintPattern)
+}
 
 func (g *KSopsGenerator) GenerateBaseSecrets(nodes []*yaml.RNode,
 	uksConfig *config.UpdateKSopsSecrets,
@@ -48,7 +231,26 @@ func (g *KSopsGenerator) GenerateBaseSecrets(nodes []*yaml.RNode,
 }
 
 func (g *KSopsGenerator) GenerateKustomization(nodes []*yaml.RNode) (newNodes []*yaml.RNode, results framework.Results) {
-	node, err := NewKustomizationNode()
+	if existing := g.findKustomization(nodes); existing != nil {
+		node := existing.Copy()
+		if err := UpdateKustomizationNode(node, g.baseSecretsFile(), g.ksopsGeneratorFile()); err != nil {
+			results = append(results, &framework.Result{
+				Message:  fmt.Sprintf("Kustomization update error, %s", err.Error()),
+				Severity: framework.Error,
+			})
+			return nil, results
+		}
+
+		newNodes = append(newNodes, node)
+		results = append(results, &framework.Result{
+			Message:  "Kustomization updated",
+			Severity: framework.Info,
+		})
+
+		return newNodes, results
+	}
+
+	node, err := NewKustomizationNode(g.baseSecretsFile(), g.ksopsGeneratorFile())
 	if err != nil {
 		results = append(results, &framework.Result{
 			Message:  fmt.Sprintf("Kustomization generation error, %s", err.Error()),
@@ -68,7 +270,8 @@ func (g *KSopsGenerator) GenerateKustomization(nodes []*yaml.RNode) (newNodes []
 
 func (g *KSopsGenerator) GenerateKSopsGenerator(nodes []*yaml.RNode, uksConfig *config.UpdateKSopsSecrets) (newNodes []*yaml.RNode, results framework.Results) {
 	for _, key := range uksConfig.GetSecretItems() {
-		node, err := NewKSopsGeneratorNode(uksConfig.GetName(), key)
+		node, err := NewKSopsGeneratorNode(uksConfig.GetName(), key,
+			g.encryptedFilename(uksConfig.GetName(), key, "enc"))
 		if err != nil {
 			results = append(results, &framework.Result{
 				Message:  fmt.Sprintf("KSOPS Generator manifest generation error, %s", err.Error()),
@@ -127,20 +330,62 @@ data: {}
 	return n, nil
 }
 
-func NewKustomizationNode() (*yaml.RNode, error) {
+func NewKustomizationNode(baseSecretsFile, ksopsGeneratorFile string) (*yaml.RNode, error) {
 	n := yaml.MustParse(`
 apiVersion: kustomize.config.k8s.io/v1beta1
 kind: Kustomization
 resources:
-- secrets.yaml
 generators:
-- generated/ksops-generator.yaml
 `)
 
+	resources := yaml.NewListRNode(baseSecretsFile)
+	if _, err := n.Pipe(yaml.Lookup("resources"), yaml.Set(resources)); err != nil {
+		return nil, err
+	}
+
+	generators := yaml.NewListRNode(ksopsGeneratorFile)
+	if _, err := n.Pipe(yaml.Lookup("generators"), yaml.Set(generators)); err != nil {
+		return nil, err
+	}
+
 	return n, nil
 }
 
-func NewKSopsGeneratorNode(secretName, key string) (*yaml.RNode, error) {
+// UpdateKustomizationNode upserts the base secrets and the KSOPS generator
+// entries into the existing kustomization, all other fields are left as is
+func UpdateKustomizationNode(n *yaml.RNode, baseSecretsFile, ksopsGeneratorFile string) error {
+	if err := upsertListEntry(n, "resources", baseSecretsFile); err != nil {
+		return err
+	}
+
+	return upsertListEntry(n, "generators", ksopsGeneratorFile)
+}
+
+func upsertListEntry(n *yaml.RNode, field, value string) error {
+	list, err := n.Pipe(yaml.Lookup(field))
+	if err != nil {
+		return err
+	}
+
+	if yaml.IsMissingOrNull(list) {
+		return n.PipeE(yaml.SetField(field, yaml.NewListRNode(value)))
+	}
+
+	elements, err := list.Elements()
+	if err != nil {
+		return fmt.Errorf("%s field: %w", field, err)
+	}
+
+	for _, element := range elements {
+		if path.Clean(yaml.GetValue(element)) == path.Clean(value) {
+			return nil
+		}
+	}
+
+	return list.PipeE(yaml.Append(yaml.NewScalarRNode(value).YNode()))
+}
+
+func NewKSopsGeneratorNode(secretName, key, encryptedFile string) (*yaml.RNode, error) {
 	n := yaml.MustParse(`
 apiVersion: viaduct.ai/v1
 kind: ksops
@@ -151,7 +396,7 @@ files:
 		return nil, err
 	}
 
-	files := yaml.NewListRNode(fmt.Sprintf("generated/secrets.%s.enc.yaml", normalizedKey))
+	files := yaml.NewListRNode(encryptedFile)
 	if _, err := n.Pipe(yaml.Lookup("files"), yaml.Set(files)); err != nil {
 		return nil, err
 	}
@@ -19,7 +19,7 @@ func uksConfigSimple() *config.UpdateKSopsSecrets {
 		},
 		Secret: config.UpdateKSopsSecretSpec{
 			References: []string{"unencrypted-secrets"},
-			Items:      []string{"test", "test2", "UPPER_CASE", ".dockerconfigjson", "middle..double..dot"},
+			Items:      []config.UpdateKSopsSecretItem{{Key: "test"}, {Key: "test2"}, {Key: "UPPER_CASE"}, {Key: ".dockerconfigjson"}, {Key: "middle..double..dot"}},
 		},
 	}
 }
@@ -35,7 +35,7 @@ func uksConfigAnnotations() *config.UpdateKSopsSecrets {
 		},
 		Secret: config.UpdateKSopsSecretSpec{
 			References: []string{"unencrypted-secrets"},
-			Items:      []string{"test", "test2"},
+			Items:      []config.UpdateKSopsSecretItem{{Key: "test"}, {Key: "test2"}},
 		},
 	}
 }
@@ -51,7 +51,7 @@ func uksConfigLabels() *config.UpdateKSopsSecrets {
 		},
 		Secret: config.UpdateKSopsSecretSpec{
 			References: []string{"unencrypted-secrets"},
-			Items:      []string{"test", "test2"},
+			Items:      []config.UpdateKSopsSecretItem{{Key: "test"}, {Key: "test2"}},
 		},
 	}
 }
@@ -71,7 +71,7 @@ func uksConfigAnnotationsLabels() *config.UpdateKSopsSecrets {
 		},
 		Secret: config.UpdateKSopsSecretSpec{
 			References: []string{"unencrypted-secrets"},
-			Items:      []string{"test", "test2"},
+			Items:      []config.UpdateKSopsSecretItem{{Key: "test"}, {Key: "test2"}},
 		},
 	}
 }
@@ -92,7 +92,7 @@ func uksConfigOtherSecretType() *config.UpdateKSopsSecrets {
 		Secret: config.UpdateKSopsSecretSpec{
 			Type:       "kubernetes.io/dockerconfigjson",
 			References: []string{"unencrypted-secrets"},
-			Items:      []string{".dockerconfigjson"},
+			Items:      []config.UpdateKSopsSecretItem{{Key: ".dockerconfigjson"}},
 		},
 	}
 }
@@ -285,3 +285,203 @@ metadata:
 		}
 	}
 }
+
+func TestGenerateKSopsGeneratorQualifiedFilenames(t *testing.T) {
+	uksConfig := uksConfigOtherSecretType()
+	uksConfig.ObjectMeta.Name = "test.registry"
+	expected := `apiVersion: viaduct.ai/v1
+files:
+- generated/secrets.test-registry.dockerconfigjson.enc.yaml
+kind: ksops
+metadata:
+  name: ksops-generator-test.registry-dockerconfigjson
+`
+
+	gen := KSopsGenerator{QualifiedFilenames: true}
+	outputs, results := gen.GenerateKSopsGenerator([]*yaml.RNode{}, uksConfig)
+	if results.ExitCode() != 0 {
+		t.Fatalf("unexpected error:\n %s", results.Error())
+	}
+	if len(outputs) != 1 {
+		t.Fatalf("expect to generate 1 rnode, got %d", len(outputs))
+	}
+
+	a, _ := outputs[0].MarshalJSON()
+	actual, _ := yaml2.JSONToYAML(a)
+	if string(actual) != expected {
+		t.Fatalf("\n[expect]\n%v\n[got]\n%v", expected, string(actual))
+	}
+}
+
+func TestGenerateOutputLayout(t *testing.T) {
+	gen := KSopsGenerator{
+		Dir: "envs/prod",
+		Output: config.UpdateKSopsOutput{
+			BaseSecretsFile:        "secrets/base.yaml",
+			GeneratedDir:           "secrets",
+			FingerprintFilePattern: ".sops/{name}-{key}.fp.yaml",
+		},
+	}
+
+	t.Run("kustomization", func(t *testing.T) {
+		expected := `apiVersion: kustomize.config.k8s.io/v1beta1
+generators:
+- secrets/ksops-generator.yaml
+kind: Kustomization
+resources:
+- secrets/base.yaml
+`
+
+		outputs, results := gen.GenerateKustomization([]*yaml.RNode{})
+		if results.ExitCode() != 0 {
+			t.Fatalf("unexpected error:\n %s", results.Error())
+		}
+
+		a, _ := outputs[0].MarshalJSON()
+		actual, _ := yaml2.JSONToYAML(a)
+		if string(actual) != expected {
+			t.Fatalf("\n[expect]\n%v\n[got]\n%v", expected, string(actual))
+		}
+	})
+
+	t.Run("file paths", func(t *testing.T) {
+		testCases := []struct {
+			Actual   string
+			Expected string
+		}{
+			{gen.path(gen.baseSecretsFile()), "envs/prod/secrets/base.yaml"},
+			{gen.path(gen.kustomizationFile()), "envs/prod/kustomization.yaml"},
+			{gen.path(gen.ksopsGeneratorFile()), "envs/prod/secrets/ksops-generator.yaml"},
+			{gen.encryptedFilename("test", "UPPER_CASE", "enc"), "secrets/secrets.upper_case.enc.yaml"},
+			{gen.encryptedFilename("test", "UPPER_CASE", "fp"), ".sops/test-upper_case.fp.yaml"},
+		}
+
+		for _, tc := range testCases {
+			if tc.Actual != tc.Expected {
+				t.Errorf("Expect %s, got %s", tc.Expected, tc.Actual)
+			}
+		}
+	})
+
+	t.Run("qualified filenames without name pattern", func(t *testing.T) {
+		qualifiedGen := gen
+		qualifiedGen.QualifiedFilenames = true
+		if err := qualifiedGen.validateOutput(); err != nil {
+			t.Errorf("Expect no errors got %v", err)
+		}
+
+		qualifiedGen.Output.EncryptedFilePattern = "secrets/{key}.enc.yaml"
+		if err := qualifiedGen.validateOutput(); err == nil {
+			t.Errorf("Expect error, got nil")
+		}
+	})
+}
+
+func TestGenerateKustomizationUpdate(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Existing string
+		Expected string
+	}{
+		{
+			Name: "merge into existing",
+			Existing: `# Application kustomization
+apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+metadata:
+  annotations:
+    config.kubernetes.io/path: kustomization.yaml
+namespace: app
+commonLabels:
+  app: test
+resources:
+- deployment.yaml # the application
+patches:
+- path: patch.yaml
+`,
+			Expected: `# Application kustomization
+apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+metadata:
+  annotations:
+    config.kubernetes.io/path: kustomization.yaml
+namespace: app
+commonLabels:
+  app: test
+resources:
+- deployment.yaml # the application
+- secrets.yaml
+patches:
+- path: patch.yaml
+generators:
+- generated/ksops-generator.yaml
+`,
+		},
+		{
+			Name: "entries exist",
+			Existing: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+metadata:
+  annotations:
+    config.kubernetes.io/path: kustomization.yml
+generators:
+- ./generated/ksops-generator.yaml
+resources:
+- secrets.yaml
+- deployment.yaml
+`,
+			Expected: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+metadata:
+  annotations:
+    config.kubernetes.io/path: kustomization.yml
+generators:
+- ./generated/ksops-generator.yaml
+resources:
+- secrets.yaml
+- deployment.yaml
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			existing := yaml.MustParse(tc.Existing)
+			gen := KSopsGenerator{}
+			outputs, results := gen.GenerateKustomization([]*yaml.RNode{existing})
+			if results.ExitCode() != 0 {
+				t.Fatalf("unexpected error:\n %s", results.Error())
+			}
+			if len(outputs) != 1 {
+				t.Fatalf("expect to generate 1 rnode, got %v", len(outputs))
+			}
+
+			actual := outputs[0].MustString()
+			if actual != tc.Expected {
+				t.Fatalf("\n[expect]\n%v\n[got]\n%v", tc.Expected, actual)
+			}
+
+			if existing.MustString() != tc.Existing {
+				t.Errorf("expect the existing kustomization untouched")
+			}
+		})
+	}
+
+	t.Run("kustomization path", func(t *testing.T) {
+		existing := yaml.MustParse(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+metadata:
+  annotations:
+    config.kubernetes.io/path: envs/prod/kustomization.yml
+`)
+		gen := KSopsGenerator{Dir: "envs/prod"}
+		if actual := gen.kustomizationPath([]*yaml.RNode{existing}); actual != "envs/prod/kustomization.yml" {
+			t.Errorf("Expect envs/prod/kustomization.yml, got %s", actual)
+		}
+
+		gen = KSopsGenerator{Dir: "envs/staging"}
+		if actual := gen.kustomizationPath([]*yaml.RNode{existing}); actual != "envs/staging/kustomization.yaml" {
+			t.Errorf("Expect envs/staging/kustomization.yaml, got %s", actual)
+		}
+	})
+}
@@ -1,7 +1,9 @@
 package generator
 
 import (
+	"errors"
 	"fmt"
+	"os"
 
 	"sigs.k8s.io/kustomize/kyaml/fn/framework"
 	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
@@ -9,6 +11,7 @@ import (
 
 	sdk "github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
 	"github.com/neutronth/kpt-update-ksops-secrets/config"
+	"github.com/neutronth/kpt-update-ksops-secrets/exec"
 )
 
 func NewProcessor() *Processor {
@@ -16,49 +19,132 @@ func NewProcessor() *Processor {
 }
 
 type Processor struct {
-	uks config.UpdateKSopsSecrets
+	configs []*config.UpdateKSopsSecrets
 }
 
 func (p *Processor) Process(resourceList *framework.ResourceList) error {
-	if err := cleanupResourceForPath(resourceList, ResultFileKSopsGenerator); err != nil {
-		return err
+	cfg, err := sdk.NewFromTypedObject(resourceList.FunctionConfig)
+	if err != nil {
+		return errorHandler(resourceList, err)
 	}
 
-	cfg, err := sdk.NewFromTypedObject(resourceList.FunctionConfig)
+	p.configs, err = config.LoadUpdateKSopsSecrets(cfg, kubeObjects(resourceList.Items))
 	if err != nil {
 		return errorHandler(resourceList, err)
 	}
 
-	if err := p.uks.Config(cfg); err != nil {
+	// The PGP keys received from the key server are kept in the keyring of
+	// the run only
+	gpg, err := exec.NewGPGKeys()
+	if err != nil {
 		return errorHandler(resourceList, err)
 	}
+	defer gpg.Close()
 
-	gen := &KSopsGenerator{}
-	uksConfig := &p.uks
-	baseSecrets, results := gen.GenerateBaseSecrets(resourceList.Items, uksConfig)
+	// The SecretSource files are read once, the secrets are looked up by the
+	// configs of all directories but never written
+	sourcesGen := &KSopsGenerator{FS: os.DirFS(".")}
+	sources, results := sourcesGen.GenerateSecretSources(resourceList.Items)
 	resourceList.Results = append(resourceList.Results, results...)
 	if results.ExitCode() == 1 {
 		return resourceList.Results
 	}
-	setFilename(baseSecrets, ResultFileBaseSecrets)
 
-	kustomization, results := gen.GenerateKustomization(resourceList.Items)
+	for _, dir := range configDirs(p.configs) {
+		if err := processDir(resourceList, dir, configsInDir(p.configs, dir), sources, gpg); err != nil {
+			return err
+		}
+	}
+
+	sopsConfigs, results := PruneSopsConfig(resourceList.Items, p.configs)
 	resourceList.Results = append(resourceList.Results, results...)
-	if results.ExitCode() == 1 {
-		return resourceList.Results
+	resourceListUpserts(resourceList, sopsConfigs)
+
+	return nil
+}
+
+func processDir(resourceList *framework.ResourceList, dir string,
+	configs []*config.UpdateKSopsSecrets, sources []*yaml.RNode, gpg exec.GPGKeysInterface,
+) error {
+	gen := &KSopsGenerator{
+		Dir:                dir,
+		QualifiedFilenames: len(configs) > 1,
+		Output:             configs[0].Output,
+		FS:                 os.DirFS("."),
+		GPG:                gpg,
+	}
+
+	if err := gen.validateOutput(); err != nil {
+		return errorHandler(resourceList, err)
+	}
+
+	if err := cleanupResourceForPath(resourceList, gen.path(gen.ksopsGeneratorFile())); err != nil {
+		return err
+	}
+
+	// The secrets of the SecretSource files are looked up but not written
+	items := append(append([]*yaml.RNode{}, resourceList.Items...), sources...)
+
+	var baseSecrets, ksopsGenerator, secretEncryptedFiles []*yaml.RNode
+
+	for _, uksConfig := range configs {
+		secretRef := newSecretReference(items, uksConfig)
+		resourceList.Results = append(resourceList.Results, selectSecretItems(uksConfig, secretRef)...)
+
+		// The files named by the other scheme are moved to the names of the
+		// selected items, the fingerprints are looked up by their new names
+		results := gen.MigrateSecretEncryptedFiles(resourceList.Items, uksConfig)
+		resourceList.Results = append(resourceList.Results, results...)
+		if results.ExitCode() == 1 {
+			return resourceList.Results
+		}
+		secretRef = newSecretReference(items, uksConfig)
+
+		nodes, results := gen.GenerateBaseSecrets(resourceList.Items, uksConfig)
+		resourceList.Results = append(resourceList.Results, results...)
+		if results.ExitCode() == 1 {
+			return resourceList.Results
+		}
+		baseSecrets = append(baseSecrets, nodes...)
+
+		nodes, results = gen.GenerateKSopsGenerator(resourceList.Items, uksConfig)
+		resourceList.Results = append(resourceList.Results, results...)
+		if results.ExitCode() == 1 {
+			return resourceList.Results
+		}
+		ksopsGenerator = append(ksopsGenerator, nodes...)
+
+		nodes, results = gen.GenerateSecretEncryptedFiles(
+			resourceList.Items, uksConfig, secretRef)
+		resourceList.Results = append(resourceList.Results, results...)
+		if results.ExitCode() == 1 {
+			return resourceList.Results
+		}
+		secretEncryptedFiles = append(secretEncryptedFiles, nodes...)
+
+		orphanPaths, results := gen.PruneSecretEncryptedFiles(resourceList.Items, uksConfig)
+		resourceList.Results = append(resourceList.Results, results...)
+		if results.ExitCode() == 1 {
+			return resourceList.Results
+		}
+
+		for _, orphanPath := range orphanPaths {
+			if err := cleanupResourceForPath(resourceList, orphanPath); err != nil {
+				return err
+			}
+		}
 	}
-	setFilename(kustomization, ResultFileKustomization)
+	setFilename(baseSecrets, gen.path(gen.baseSecretsFile()))
+	setFilename(ksopsGenerator, gen.path(gen.ksopsGeneratorFile()))
 
-	ksopsGenerator, results := gen.GenerateKSopsGenerator(resourceList.Items, uksConfig)
+	kustomization, results := gen.GenerateKustomization(resourceList.Items)
 	resourceList.Results = append(resourceList.Results, results...)
 	if results.ExitCode() == 1 {
 		return resourceList.Results
 	}
-	setFilename(ksopsGenerator, ResultFileKSopsGenerator)
+	setFilename(kustomization, gen.kustomizationPath(resourceList.Items))
 
-	secretRef := newSecretReference(resourceList.Items, uksConfig)
-	secretEncryptedFiles, results := gen.GenerateSecretEncryptedFiles(
-		resourceList.Items, uksConfig, secretRef)
+	sopsConfig, results := gen.GenerateSopsConfig(resourceList.Items, configs)
 	resourceList.Results = append(resourceList.Results, results...)
 	if results.ExitCode() == 1 {
 		return resourceList.Results
@@ -69,10 +155,50 @@ func (p *Processor) Process(resourceList *framework.ResourceList) error {
 		baseSecrets,
 		ksopsGenerator,
 		secretEncryptedFiles,
+		sopsConfig,
 	)
 	return nil
 }
 
+// configDirs lists the package directories of the configs in order
+func configDirs(configs []*config.UpdateKSopsSecrets) (dirs []string) {
+	for _, uksConfig := range configs {
+		if !sliceContainsString(dirs, uksConfig.GetDir()) {
+			dirs = append(dirs, uksConfig.GetDir())
+		}
+	}
+
+	return dirs
+}
+
+func configsInDir(configs []*config.UpdateKSopsSecrets, dir string) (selected []*config.UpdateKSopsSecrets) {
+	for _, uksConfig := range configs {
+		if uksConfig.GetDir() == dir {
+			selected = append(selected, uksConfig)
+		}
+	}
+
+	return selected
+}
+
+// kubeObjects converts the resources keeping the comments, they could be
+// required by the sops encrypted comment regex
+func kubeObjects(items []*yaml.RNode) (kobjs sdk.KubeObjects) {
+	for _, item := range items {
+		s, err := item.String()
+		if err != nil {
+			continue
+		}
+
+		ko, err := sdk.ParseKubeObject([]byte(s))
+		if err == nil {
+			kobjs = append(kobjs, ko)
+		}
+	}
+
+	return kobjs
+}
+
 func cleanupResourceForPath(resourceList *framework.ResourceList, path string) error {
 	var items []*yaml.RNode
 	for _, resource := range resourceList.Items {
@@ -128,6 +254,13 @@ func nodeUpserts(resourceList *framework.ResourceList, node *yaml.RNode) {
 }
 
 func errorHandler(resourceList *framework.ResourceList, err error) framework.Results {
+	// The config validation reports a result per invalid field
+	var results framework.Results
+	if errors.As(err, &results) {
+		resourceList.Results = results
+		return resourceList.Results
+	}
+
 	resourceList.Results = framework.Results{
 		&framework.Result{
 			Message:  err.Error(),
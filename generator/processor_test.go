@@ -0,0 +1,196 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package generator
+
+import (
+	"testing"
+
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const processorConfig = `
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test
+  annotations:
+    config.kubernetes.io/local-config: "true"
+    internal.config.kubernetes.io/path: update-ksops-secrets.yaml
+secret:
+  references:
+  - unencrypted-secrets
+  items:
+  - test
+recipients:
+- type: age
+  recipient: age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa
+`
+
+const processorOtherConfig = `
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: other
+  annotations:
+    config.kubernetes.io/local-config: "true"
+    internal.config.kubernetes.io/path: update-ksops-secrets-other.yaml
+secret:
+  references:
+  - unencrypted-secrets
+  items:
+  - other
+recipients:
+- type: age
+  recipient: age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa
+`
+
+const processorUnencryptedSecrets = `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: unencrypted-secrets
+  annotations:
+    config.kubernetes.io/local-config: "true"
+    internal.config.kubernetes.io/path: unencrypted-secrets.yaml
+stringData:
+  test: test
+  other: other
+`
+
+func processResourceList(t *testing.T, items []*yaml.RNode) []*yaml.RNode {
+	resourceList := &framework.ResourceList{
+		Items:          items,
+		FunctionConfig: yaml.MustParse(processorConfig),
+	}
+
+	if err := NewProcessor().Process(resourceList); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	return resourceList.Items
+}
+
+func itemPaths(items []*yaml.RNode) map[string]bool {
+	paths := map[string]bool{}
+	for _, item := range items {
+		if itemPath, _, err := kioutil.GetFileAnnotations(item); err == nil {
+			paths[itemPath] = true
+		}
+	}
+
+	return paths
+}
+
+// itemString returns the item of the path without its file annotations
+func itemString(t *testing.T, items []*yaml.RNode, filePath string) string {
+	for _, item := range items {
+		if itemPath, _, err := kioutil.GetFileAnnotations(item); err != nil || itemPath != filePath {
+			continue
+		}
+
+		n := item.Copy()
+		for _, annotation := range []string{kioutil.PathAnnotation, kioutil.LegacyPathAnnotation} {
+			if err := n.PipeE(yaml.ClearAnnotation(annotation)); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+
+		return n.MustString()
+	}
+
+	t.Fatalf("Expect %s generated", filePath)
+	return ""
+}
+
+func TestProcessAddConfig(t *testing.T) {
+	items := processResourceList(t, []*yaml.RNode{
+		yaml.MustParse(processorConfig),
+		yaml.MustParse(processorUnencryptedSecrets),
+	})
+
+	paths := itemPaths(items)
+	for _, expected := range []string{"generated/secrets.test.enc.yaml", "generated/secrets.test.fp.yaml"} {
+		if !paths[expected] {
+			t.Fatalf("Expect %s generated, got %v", expected, paths)
+		}
+	}
+
+	encrypted := itemString(t, items, "generated/secrets.test.enc.yaml")
+
+	// The second config qualifies the file names, the existing files are
+	// moved to the new names as they are
+	items = processResourceList(t, append(items, yaml.MustParse(processorOtherConfig)))
+
+	paths = itemPaths(items)
+	for _, expected := range []string{
+		"generated/secrets.test.test.enc.yaml",
+		"generated/secrets.test.test.fp.yaml",
+		"generated/secrets.other.other.enc.yaml",
+		"generated/secrets.other.other.fp.yaml",
+	} {
+		if !paths[expected] {
+			t.Errorf("Expect %s generated, got %v", expected, paths)
+		}
+	}
+
+	for _, moved := range []string{"generated/secrets.test.enc.yaml", "generated/secrets.test.fp.yaml"} {
+		if paths[moved] {
+			t.Errorf("Expect %s moved", moved)
+		}
+	}
+
+	if moved := itemString(t, items, "generated/secrets.test.test.enc.yaml"); moved != encrypted {
+		t.Errorf("Expect the encrypted file moved as is\n%s\ngot\n%s", encrypted, moved)
+	}
+
+	assertKSopsGeneratorFiles(t, items)
+}
+
+// assertKSopsGeneratorFiles ensures the files of the KSOPS generators exist
+func assertKSopsGeneratorFiles(t *testing.T, items []*yaml.RNode) {
+	paths := itemPaths(items)
+
+	for _, item := range items {
+		if item.GetKind() != "ksops" {
+			continue
+		}
+
+		files, err := item.GetSlice("files")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		for _, file := range files {
+			if !paths[file.(string)] {
+				t.Errorf("Expect KSOPS generator '%s' file %s exists", item.GetName(), file)
+			}
+		}
+	}
+}
+
+func TestProcessAddConfigWithoutUnencryptedSecrets(t *testing.T) {
+	items := processResourceList(t, []*yaml.RNode{
+		yaml.MustParse(processorConfig),
+		yaml.MustParse(processorUnencryptedSecrets),
+	})
+
+	var encryptedItems []*yaml.RNode
+	for _, item := range items {
+		if item.GetName() != "unencrypted-secrets" {
+			encryptedItems = append(encryptedItems, item)
+		}
+	}
+
+	// The skipped items keep their files, only the removed items are pruned
+	items = processResourceList(t, append(encryptedItems, yaml.MustParse(processorOtherConfig)))
+
+	paths := itemPaths(items)
+	for _, expected := range []string{"generated/secrets.test.test.enc.yaml", "generated/secrets.test.test.fp.yaml"} {
+		if !paths[expected] {
+			t.Errorf("Expect %s kept, got %v", expected, paths)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+	"github.com/neutronth/kpt-update-ksops-secrets/sops"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// PublicKeysDir is the package directory of the ASCII-armored public keys,
+// they are loaded for the listed fingerprints without the public key source
+const PublicKeysDir = "keys"
+
+// publicKeyReader reads the public keys data of the recipients from the
+// referenced Secret or ConfigMap, or the package files
+type publicKeyReader struct {
+	secretRef SecretReference
+	nodes     []*yaml.RNode
+
+	// fsys holds the package files, nil if they are not available to the
+	// function, dir is the package directory of the config
+	fsys fs.FS
+	dir  string
+}
+
+func (g *KSopsGenerator) newPublicKeyReader(nodes []*yaml.RNode, secretRef SecretReference) *publicKeyReader {
+	return &publicKeyReader{
+		secretRef: secretRef,
+		nodes:     nodes,
+		fsys:      g.packageFS(nodes),
+		dir:       g.Dir,
+	}
+}
+
+// read returns the public key data of the recipient and its source
+func (r *publicKeyReader) read(recipient config.UpdateKSopsRecipient) (data, source string, err error) {
+	switch {
+	case recipient.PublicKeySecretReference.Name != "":
+		sr := recipient.PublicKeySecretReference
+		data, err = getGPGPublicKeysData(r.secretRef, sr.Name, sr.Key)
+		return data, fmt.Sprintf("the secret '%s' key '%s'", sr.Name, sr.Key), err
+	case recipient.PublicKeyConfigMapReference.Name != "":
+		cr := recipient.PublicKeyConfigMapReference
+		data, err = r.readConfigMap(cr.Name, cr.Key)
+		return data, fmt.Sprintf("the ConfigMap '%s' key '%s'", cr.Name, cr.Key), err
+	case recipient.PublicKeyFile != "":
+		file := path.Join(r.dir, recipient.PublicKeyFile)
+		data, err = r.readFile(file)
+		return data, fmt.Sprintf("the file '%s'", file), err
+	}
+
+	return "", "", fmt.Errorf("the recipient %s has no public key source", recipient.Recipient)
+}
+
+func (r *publicKeyReader) readConfigMap(name, key string) (string, error) {
+	for _, node := range r.nodes {
+		if node.GetApiVersion() != "v1" || node.GetKind() != "ConfigMap" ||
+			node.GetName() != name {
+			continue
+		}
+
+		if data := node.GetDataMap(); data != nil {
+			if value, found := data[key]; found {
+				return value, nil
+			}
+		}
+
+		if data := node.GetBinaryDataMap(); data != nil {
+			if value, found := data[key]; found {
+				decoded, err := decodeValue(value)
+				return string(decoded), err
+			}
+		}
+	}
+
+	return "", fmt.Errorf("the ConfigMap '%s' key '%s' not found", name, key)
+}
+
+// errPackageFilesUnavailable explains the package files could not be read
+var errPackageFilesUnavailable = errors.New("the package files are not available to the function, " +
+	"run it by the kpt fn eval --exec or with the mounted package in the package directory")
+
+func (r *publicKeyReader) readFile(file string) (string, error) {
+	if r.fsys == nil {
+		return "", fmt.Errorf("the file '%s' could not be read, %w", file, errPackageFilesUnavailable)
+	}
+
+	data, err := fs.ReadFile(r.fsys, file)
+	if err != nil {
+		return "", fmt.Errorf("the file '%s' read error: %w", file, err)
+	}
+
+	return string(data), nil
+}
+
+// importFromKeysDir imports the key of the fingerprint from the first
+// public keys file holding it, the file is empty if not found, the error is
+// returned if the keys directory could not be read
+func (r *publicKeyReader) importFromKeysDir(keyRing *sops.PGPKeyRing, fingerprint string) (file string, err error) {
+	pattern := path.Join(r.dir, PublicKeysDir, "*.asc")
+	if r.fsys == nil {
+		return "", fmt.Errorf("the '%s' files could not be read, %w", pattern, errPackageFilesUnavailable)
+	}
+
+	files, err := fs.Glob(r.fsys, pattern)
+	if err != nil {
+		return "", fmt.Errorf("the '%s' files could not be read: %w", pattern, err)
+	}
+
+	for _, file := range files {
+		data, err := r.readFile(file)
+		if err != nil {
+			return "", err
+		}
+
+		if keyRing.Import(fingerprint, data) == nil {
+			return file, nil
+		}
+	}
+
+	return "", nil
+}
+
+// expandAgeRecipients reads the age recipients or the ssh authorized keys
+// files of the recipients with the public key source, all the listed
+// recipients are used if the recipient is not set, otherwise it must be listed
+func (r *publicKeyReader) expandAgeRecipients(recipients ...config.UpdateKSopsRecipient) (expanded []config.UpdateKSopsRecipient, err error) {
+	for _, recipient := range recipients {
+		if (recipient.Type != "age" && recipient.Type != "ssh") || !recipient.HasPublicKeySource() {
+			expanded = append(expanded, recipient)
+			continue
+		}
+
+		data, source, err := r.read(recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		listed := ageRecipientsList(data)
+		if recipient.Recipient != "" {
+			if !sliceContainsString(listed, recipient.Recipient) {
+				return nil, fmt.Errorf("the %s recipient %s not found in %s", recipient.Type, recipient.Recipient, source)
+			}
+
+			expanded = append(expanded, recipient)
+			continue
+		}
+
+		if len(listed) == 0 {
+			return nil, fmt.Errorf("no %s recipients found in %s", recipient.Type, source)
+		}
+
+		for _, ageRecipient := range listed {
+			r := recipient
+			r.Recipient = ageRecipient
+			expanded = append(expanded, r)
+		}
+	}
+
+	return expanded, nil
+}
+
+// ageRecipientsList parses the age recipients file, one recipient per line
+// and the comments are ignored, the same as the ssh public keys comments
+func ageRecipientsList(data string) (recipients []string) {
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if fields := strings.Fields(line); strings.HasPrefix(line, "ssh-") && len(fields) > 2 {
+			line = strings.Join(fields[:2], " ")
+		}
+
+		recipients = append(recipients, line)
+	}
+
+	return recipients
+}
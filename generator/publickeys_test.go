@@ -0,0 +1,278 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package generator
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+	"github.com/neutronth/kpt-update-ksops-secrets/sops"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	testPGPFingerprint = "380024A2AC1D3EBC9402BEE66E38309B4DA30118"
+	testSSHRecipient   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILqk4EhAuCsl8EwxgLLug+O0Eo6GdZnpSCJfU76iFNND"
+)
+
+func testPublicKeyReader(t *testing.T) *publicKeyReader {
+	publicKey, err := os.ReadFile("../example/" + testPGPFingerprint + ".gpg")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	return &publicKeyReader{
+		secretRef: &mockSecretReference{},
+		nodes: []*yaml.RNode{
+			yaml.MustParse(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: public-keys
+data:
+  age.txt: |
+    # ops
+    ` + testSopsAgeRecipient + `
+    ` + testSopsOtherAgeRecipient + `
+binaryData:
+  pgp.gpg: ` + encodeValue(string(publicKey)) + `
+`),
+		},
+		fsys: fstest.MapFS{
+			"envs/prod/keys/" + testPGPFingerprint + ".asc": {Data: publicKey},
+			"envs/prod/keys/other.asc":                      {Data: []byte("not a key")},
+			"envs/prod/age.txt":                             {Data: []byte(testSopsAgeRecipient + "\n")},
+			"envs/prod/ops.keys":                            {Data: []byte(testSSHRecipient + " ops@example.com\n")},
+		},
+		dir: "envs/prod",
+	}
+}
+
+func TestPublicKeyReaderImport(t *testing.T) {
+	testCases := []struct {
+		Name             string
+		Recipient        config.UpdateKSopsRecipient
+		NoPackageFiles   bool
+		ExpectedImported bool
+		ExpectedExitCode int
+	}{
+		{
+			Name: "secret reference",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:                     "pgp",
+				Recipient:                testPGPFingerprint,
+				PublicKeySecretReference: config.UpdateKSopsGPGPublicKeyReference{Name: "gpg-publickeys", Key: testPGPFingerprint + ".gpg"},
+			},
+			ExpectedImported: true,
+		},
+		{
+			Name: "configmap binary data",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:                        "pgp",
+				Recipient:                   testPGPFingerprint,
+				PublicKeyConfigMapReference: config.UpdateKSopsGPGPublicKeyReference{Name: "public-keys", Key: "pgp.gpg"},
+			},
+			ExpectedImported: true,
+		},
+		{
+			Name: "file",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:          "pgp",
+				Recipient:     testPGPFingerprint,
+				PublicKeyFile: "keys/" + testPGPFingerprint + ".asc",
+			},
+			ExpectedImported: true,
+		},
+		{
+			Name: "keys directory",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:      "pgp",
+				Recipient: testPGPFingerprint,
+			},
+			ExpectedImported: true,
+		},
+		{
+			Name: "not in keys directory",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:      "pgp",
+				Recipient: "F532DA10E563EE84440977A19D0470BDA6CDC457",
+			},
+		},
+		{
+			Name: "file without package files",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:          "pgp",
+				Recipient:     testPGPFingerprint,
+				PublicKeyFile: "keys/" + testPGPFingerprint + ".asc",
+			},
+			NoPackageFiles:   true,
+			ExpectedExitCode: 1,
+		},
+		{
+			Name: "keys directory without package files",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:      "pgp",
+				Recipient: testPGPFingerprint,
+			},
+			NoPackageFiles: true,
+		},
+		{
+			Name: "file fingerprint mismatch",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:          "pgp",
+				Recipient:     "F532DA10E563EE84440977A19D0470BDA6CDC457",
+				PublicKeyFile: "keys/" + testPGPFingerprint + ".asc",
+			},
+			ExpectedExitCode: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			keys := testPublicKeyReader(t)
+			if tc.NoPackageFiles {
+				keys.fsys = nil
+			}
+
+			keyRing := sops.NewPGPKeyRing(nil)
+			results, imported := importGPGKeys(keys, keyRing, tc.Recipient)
+			if exitCode := framework.Results(results).ExitCode(); exitCode != tc.ExpectedExitCode {
+				t.Fatalf("Expect exit code %d, got %d\n%s", tc.ExpectedExitCode, exitCode,
+					framework.Results(results).Error())
+			}
+
+			if tc.NoPackageFiles && !strings.Contains(framework.Results(results).Error(), errPackageFilesUnavailable.Error()) {
+				t.Errorf("Expect the package files unavailable result, got\n%s", framework.Results(results).Error())
+			}
+
+			if found := sliceContainsString(imported, tc.Recipient.Recipient); found != tc.ExpectedImported {
+				t.Errorf("Expect imported %v, got %v", tc.ExpectedImported, found)
+			}
+
+			if _, err := keyRing.PublicKey(tc.Recipient.Recipient); (err == nil) != tc.ExpectedImported {
+				t.Errorf("Expect public key available %v, got %v", tc.ExpectedImported, err)
+			}
+		})
+	}
+}
+
+func TestExpandAgeRecipients(t *testing.T) {
+	testCases := []struct {
+		Name               string
+		Recipient          config.UpdateKSopsRecipient
+		ExpectedRecipients []string
+		ExpectsErr         bool
+	}{
+		{
+			Name:               "inline",
+			Recipient:          config.UpdateKSopsRecipient{Type: "age", Recipient: testSopsAgeRecipient},
+			ExpectedRecipients: []string{testSopsAgeRecipient},
+		},
+		{
+			Name: "configmap recipients",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:                        "age",
+				PublicKeyConfigMapReference: config.UpdateKSopsGPGPublicKeyReference{Name: "public-keys", Key: "age.txt"},
+			},
+			ExpectedRecipients: []string{testSopsAgeRecipient, testSopsOtherAgeRecipient},
+		},
+		{
+			Name: "file listed recipient",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:          "age",
+				Recipient:     testSopsAgeRecipient,
+				PublicKeyFile: "age.txt",
+			},
+			ExpectedRecipients: []string{testSopsAgeRecipient},
+		},
+		{
+			Name: "file unlisted recipient",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:          "age",
+				Recipient:     testSopsOtherAgeRecipient,
+				PublicKeyFile: "age.txt",
+			},
+			ExpectsErr: true,
+		},
+		{
+			Name: "ssh authorized keys file",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:          "ssh",
+				PublicKeyFile: "ops.keys",
+			},
+			ExpectedRecipients: []string{testSSHRecipient},
+		},
+		{
+			Name: "file not found",
+			Recipient: config.UpdateKSopsRecipient{
+				Type:          "age",
+				PublicKeyFile: "unknown.txt",
+			},
+			ExpectsErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			recipients, err := testPublicKeyReader(t).expandAgeRecipients(tc.Recipient)
+			if tc.ExpectsErr {
+				if err == nil {
+					t.Errorf("Expect error, got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			var actual []string
+			for _, r := range recipients {
+				actual = append(actual, r.Recipient)
+			}
+
+			if !reflect.DeepEqual(actual, tc.ExpectedRecipients) {
+				t.Errorf("Expect recipients %v, got %v", tc.ExpectedRecipients, actual)
+			}
+		})
+	}
+}
+
+func TestPackageFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"envs/prod/update-ksops-secrets.yaml": {Data: []byte("kind: UpdateKSopsSecrets\n")},
+	}
+
+	testCases := []struct {
+		Name      string
+		Path      string
+		Available bool
+	}{
+		{Name: "package directory", Path: "envs/prod/update-ksops-secrets.yaml", Available: true},
+		{Name: "other directory", Path: "update-ksops-secrets.yaml"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			node := yaml.MustParse(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: UpdateKSopsSecrets
+metadata:
+  name: test
+  annotations:
+    internal.config.kubernetes.io/path: ` + tc.Path + `
+`)
+
+			gen := &KSopsGenerator{FS: fsys}
+			if available := gen.packageFS([]*yaml.RNode{node}) != nil; available != tc.Available {
+				t.Errorf("Expect package files available %v, got %v", tc.Available, available)
+			}
+		})
+	}
+}
@@ -8,9 +8,13 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"sort"
+	"strings"
 
 	sdk "github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
 	"github.com/neutronth/kpt-update-ksops-secrets/config"
+	"github.com/neutronth/kpt-update-ksops-secrets/exec"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
@@ -19,11 +23,27 @@ var ErrSecretNotFound = errors.New("secret was not found in the references")
 type SecretReference interface {
 	Get(key string) (value string, b64encoded bool, err error)
 	GetExact(name, key string) (value string, b64encoded bool, err error)
-	GetEncryptedFP(name, key string) string
+	GetFromProvider(provider, key string) (value string, b64encoded bool, err error)
+	GetEncryptedFP(filename, name, key string) string
+	GetComment(name, key string) string
+	GetSources(key string) []string
+	GetKeys(name string) (keys []string, found bool)
+	GetEncryptedKeys(name string) []string
 }
 
 type secretReference struct {
 	sdk.KubeObjects
+
+	// dir is the package directory of the config, its own encrypted files
+	// are placed relative to it with the output layout
+	dir    string
+	output config.UpdateKSopsOutput
+
+	// refs is the reference list order that the secrets are looked up in
+	refs []string
+
+	// providers run the provider commands by name
+	providers map[string]exec.ValueProviderInterface
 }
 
 func sliceContainsString(slice []string, s string) bool {
@@ -39,7 +59,13 @@ func sliceContainsString(slice []string, s string) bool {
 func listSecretRefsFromConfig(uksConfig *config.UpdateKSopsSecrets) (list []string) {
 	list = append(list, uksConfig.Secret.References...)
 
-	for _, r := range uksConfig.Recipients {
+	for _, name := range uksConfig.GetSecretItemReferences() {
+		if !sliceContainsString(list, name) {
+			list = append(list, name)
+		}
+	}
+
+	for _, r := range uksConfig.GetRecipients() {
 		if r.Type == "pgp" && r.PublicKeySecretReference.Name != "" {
 			list = append(list, r.PublicKeySecretReference.Name)
 		}
@@ -65,8 +91,39 @@ func getSecretRefNodes(items sdk.KubeObjects, secretrefs []string) (results sdk.
 	return
 }
 
-func encryptedSecretPredicate(expected bool) (f func(ko *sdk.KubeObject) bool) {
-	encryptedFilesCheck, err := regexp.Compile(`generated/secrets\..*\.(enc|fp)\.yaml`)
+// encryptedFilesPattern matches the encrypted and fingerprint files in the
+// dir, or the default layout files in any package directories if the dir
+// is empty
+func encryptedFilesPattern(dir string, output config.UpdateKSopsOutput) string {
+	if dir == "" {
+		output = config.UpdateKSopsOutput{}
+	}
+
+	pattern := fmt.Sprintf("(%s|%s)$",
+		filePatternRegexp(encryptedFilePattern(output, false)),
+		filePatternRegexp(fingerprintFilePattern(output, false)))
+
+	switch dir {
+	case "":
+		return `(^|/)` + pattern
+	case ".":
+		return `^` + pattern
+	default:
+		return `^` + regexp.QuoteMeta(dir+"/") + pattern
+	}
+}
+
+func filePatternRegexp(pattern string) string {
+	quoted := regexp.QuoteMeta(pattern)
+	for _, placeholder := range []string{config.OutputPatternName, config.OutputPatternKey} {
+		quoted = strings.ReplaceAll(quoted, regexp.QuoteMeta(placeholder), ".+")
+	}
+
+	return quoted
+}
+
+func encryptedSecretPredicate(dir string, output config.UpdateKSopsOutput, expected bool) (f func(ko *sdk.KubeObject) bool) {
+	encryptedFilesCheck, err := regexp.Compile(encryptedFilesPattern(dir, output))
 	if err != nil {
 		return f
 	}
@@ -76,64 +133,280 @@ func encryptedSecretPredicate(expected bool) (f func(ko *sdk.KubeObject) bool) {
 	}
 }
 
+// isEncryptedResource reports whether the resource holds the encrypted data
+// or fingerprints regardless of its path
+func isEncryptedResource(ko *sdk.KubeObject) bool {
+	if ko.GetKind() == "SecretFingerprint" {
+		return true
+	}
+
+	_, found, _ := ko.NestedSubObject("sops")
+	return found
+}
+
 func (sr *secretReference) onlyEncryptedSecrets() (results sdk.KubeObjects) {
-	return sr.Where(encryptedSecretPredicate(true))
+	return sr.Where(encryptedSecretPredicate(sr.dir, sr.output, true))
 }
 
+// withoutEncryptedSecrets excludes the encrypted files of all package
+// directories, they must never be the source of the unencrypted secrets
 func (sr *secretReference) withoutEncryptedSecrets() (results sdk.KubeObjects) {
-	return sr.Where(encryptedSecretPredicate(false))
+	return sr.Where(encryptedSecretPredicate(sr.dir, sr.output, false)).
+		Where(encryptedSecretPredicate("", sr.output, false)).
+		WhereNot(isEncryptedResource)
 }
 
 func newSecretReference(items []*yaml.RNode,
 	uksConfig *config.UpdateKSopsSecrets) SecretReference {
 
-	var kobjs sdk.KubeObjects
-
-	for _, item := range items {
-		ko, err := sdk.NewFromTypedObject(item)
-		if err == nil {
-			kobjs = append(kobjs, ko)
-		}
+	providers := map[string]exec.ValueProviderInterface{}
+	for _, provider := range uksConfig.Providers {
+		providers[provider.Name] = exec.NewCommandProvider(provider)
 	}
 
+	refs := listSecretRefsFromConfig(uksConfig)
 	return &secretReference{
-		getSecretRefNodes(kobjs, listSecretRefsFromConfig(uksConfig)),
+		KubeObjects: getSecretRefNodes(kubeObjects(items), refs),
+		dir:         uksConfig.GetDir(),
+		output:      uksConfig.Output,
+		refs:        refs,
+		providers:   providers,
 	}
 }
+
+// orderedSecrets returns the unencrypted secrets in the reference list order,
+// the secrets of the same name keep their resource order
+func (sr *secretReference) orderedSecrets() sdk.KubeObjects {
+	secrets := sr.withoutEncryptedSecrets()
+
+	index := func(ko *sdk.KubeObject) int {
+		for i, ref := range sr.refs {
+			if ref == ko.GetName() {
+				return i
+			}
+		}
+
+		return len(sr.refs)
+	}
+
+	sort.SliceStable(secrets, func(i, j int) bool {
+		return index(secrets[i]) < index(secrets[j])
+	})
+
+	return secrets
+}
+
 func (sr *secretReference) Get(key string) (value string, b64encoded bool, err error) {
 	return sr.GetExact("", key)
 }
 
+// GetExact returns the value of the key from the named secret, or from the
+// first secret in the reference list order that has it if the name is empty,
+// the stringData of the secret takes precedence over its data
 func (sr *secretReference) GetExact(name, key string) (value string, b64encoded bool, err error) {
-	if val, found := sr.lookup(name, key, "stringData"); found {
-		return val, false, nil
-	} else if val, found := sr.lookup(name, key, "data"); found {
-		if _, err := base64.StdEncoding.DecodeString(val); err != nil {
-			return "", false, err
+	for _, ko := range sr.orderedSecrets() {
+		if name != "" && ko.GetName() != name {
+			continue
+		}
+
+		if val, found := lookup(ko, key, "stringData"); found {
+			return val, false, nil
+		} else if val, found := lookup(ko, key, "data"); found {
+			if _, err := base64.StdEncoding.DecodeString(val); err != nil {
+				return "", false, err
+			}
+			return val, true, nil
 		}
-		return val, true, nil
 	}
 	return "", false, fmt.Errorf("secret: %s, %w", key, ErrSecretNotFound)
 }
 
-func (sr *secretReference) lookup(name, key, dataField string) (val string, found bool) {
+// GetFromProvider returns the value of the key printed by the provider, it
+// is never base64 encoded
+func (sr *secretReference) GetFromProvider(provider, key string) (value string, b64encoded bool, err error) {
+	p, found := sr.providers[provider]
+	if !found {
+		return "", false, fmt.Errorf("unknown provider '%s'", provider)
+	}
+
+	value, err = p.Get(key)
+	return value, false, err
+}
+
+func lookup(ko *sdk.KubeObject, key, dataField string) (val string, found bool) {
+	if data, found, err := ko.NestedStringMap(dataField); err == nil && found {
+		if val, ok := data[key]; ok {
+			return val, true
+		}
+	}
+	return "", false
+}
+
+// GetSources returns the names of the secrets that have the key in the
+// reference list order, the key is ambiguous if there are more than one
+func (sr *secretReference) GetSources(key string) (sources []string) {
+	for _, ko := range sr.orderedSecrets() {
+		if sliceContainsString(sources, ko.GetName()) {
+			continue
+		}
+
+		for _, dataField := range []string{"stringData", "data"} {
+			if _, found := lookup(ko, key, dataField); found {
+				sources = append(sources, ko.GetName())
+				break
+			}
+		}
+	}
+
+	return sources
+}
+
+// GetKeys returns the sorted keys of the unencrypted secrets of the name,
+// found is false if there is no such secret
+func (sr *secretReference) GetKeys(name string) (keys []string, found bool) {
 	for _, ko := range sr.withoutEncryptedSecrets() {
+		if ko.GetName() != name {
+			continue
+		}
+
+		found = true
+		for _, dataField := range []string{"stringData", "data"} {
+			if data, ok, err := ko.NestedStringMap(dataField); err == nil && ok {
+				for key := range data {
+					if !sliceContainsString(keys, key) {
+						keys = append(keys, key)
+					}
+				}
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, found
+}
+
+// GetEncryptedKeys returns the sorted keys of the encrypted and fingerprint
+// files of the config name
+func (sr *secretReference) GetEncryptedKeys(name string) (keys []string) {
+	for _, ko := range sr.onlyEncryptedSecrets() {
+		if ko.GetName() != name {
+			continue
+		}
+
+		if data, found, err := ko.NestedStringMap("data"); err == nil && found {
+			for key := range data {
+				if !sliceContainsString(keys, key) {
+					keys = append(keys, key)
+				}
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// selectSecretItems resolves the selectors of the config against the
+// referenced secrets, a key selected from more than one secret is taken from
+// the first selector. The encrypted keys of the config are matched instead if
+// the secret is absent to keep them stable, after the present secrets
+func selectSecretItems(uksConfig *config.UpdateKSopsSecrets, secretRef SecretReference) (results framework.Results) {
+	var items []config.UpdateKSopsSecretItem
+	var absent []config.UpdateKSopsSecretSelector
+
+	for _, selector := range uksConfig.Secret.Selectors {
+		keys, found := secretRef.GetKeys(selector.Secret)
+		if !found {
+			absent = append(absent, selector)
+			continue
+		}
+
+		for _, key := range keys {
+			if !selector.Match(key) {
+				continue
+			}
+
+			if selected := findSelectedItem(items, key); selected != nil {
+				if selected.From.Secret != selector.Secret {
+					results = append(results, &framework.Result{
+						Message: fmt.Sprintf("Secret '%s' is selected from '%s' and '%s', the value of '%s' is used",
+							key, selected.From.Secret, selector.Secret, selected.From.Secret),
+						Severity: framework.Warning,
+					})
+				}
+				continue
+			}
+
+			items = append(items, selectedItem(selector, key))
+		}
+	}
+
+	if len(absent) > 0 {
+		encrypted := secretRef.GetEncryptedKeys(uksConfig.GetName())
+		for _, selector := range absent {
+			for _, key := range encrypted {
+				if selector.Match(key) && findSelectedItem(items, key) == nil {
+					items = append(items, selectedItem(selector, key))
+				}
+			}
+		}
+	}
+
+	uksConfig.SetSelectedItems(items)
+	return results
+}
+
+func selectedItem(selector config.UpdateKSopsSecretSelector, key string) config.UpdateKSopsSecretItem {
+	return config.UpdateKSopsSecretItem{
+		Key:  key,
+		From: &config.UpdateKSopsSecretItemSource{Secret: selector.Secret},
+	}
+}
+
+func findSelectedItem(items []config.UpdateKSopsSecretItem, key string) *config.UpdateKSopsSecretItem {
+	for i := range items {
+		if items[i].Key == key {
+			return &items[i]
+		}
+	}
+
+	return nil
+}
+
+// GetComment returns the comment preceding the key in the secret that the
+// value is read from, any secret if the name is empty
+func (sr *secretReference) GetComment(name, key string) string {
+	for _, ko := range sr.orderedSecrets() {
 		if name != "" && ko.GetName() != name {
 			continue
 		}
 
-		if data, found, err := ko.NestedStringMap(dataField); err == nil && found {
-			if val, ok := data[key]; ok {
-				return val, true
+		n, err := yaml.Parse(ko.String())
+		if err != nil {
+			continue
+		}
+
+		for _, dataField := range []string{"stringData", "data"} {
+			data := n.Field(dataField)
+			if data == nil {
+				continue
+			}
+
+			if f := data.Value.Field(key); f != nil {
+				return f.Key.YNode().HeadComment
 			}
 		}
 	}
-	return "", false
+
+	return ""
 }
 
-func (sr *secretReference) GetEncryptedFP(name, key string) string {
+// GetEncryptedFP returns the fingerprint of the secret key, only the
+// fingerprint file at the filename counts, the file names change with the
+// output layout and the files elsewhere are never written again
+func (sr *secretReference) GetEncryptedFP(filename, name, key string) string {
 	for _, ko := range sr.onlyEncryptedSecrets() {
-		if ko.GetKind() != "SecretFingerprint" {
+		if ko.GetKind() != "SecretFingerprint" || ko.PathAnnotation() != filename {
 			continue
 		}
 
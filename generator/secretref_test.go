@@ -5,11 +5,13 @@ package generator
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
 	"testing"
 
 	"github.com/neutronth/kpt-update-ksops-secrets/config"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
@@ -20,7 +22,7 @@ func uksConfigSecretReferenceSimple() *config.UpdateKSopsSecrets {
 		},
 		Secret: config.UpdateKSopsSecretSpec{
 			References: []string{"unencrypted-secrets", "unencrypted-secrets-config-txt"},
-			Items:      []string{"test", "test2", "UPPER_CASE", "config.txt"},
+			Items:      []config.UpdateKSopsSecretItem{{Key: "test"}, {Key: "test2"}, {Key: "UPPER_CASE"}, {Key: "config.txt"}},
 		},
 		Recipients: []config.UpdateKSopsRecipient{
 			{
@@ -46,7 +48,7 @@ func uksConfigSecretReferenceSameName() *config.UpdateKSopsSecrets {
 		},
 		Secret: config.UpdateKSopsSecretSpec{
 			References: []string{"unencrypted-secrets", "samename"},
-			Items:      []string{"unencrypted", "samename"},
+			Items:      []config.UpdateKSopsSecretItem{{Key: "unencrypted"}, {Key: "samename"}},
 		},
 		Recipients: []config.UpdateKSopsRecipient{
 			{
@@ -64,7 +66,7 @@ func uksConfigSecretFingerprint() *config.UpdateKSopsSecrets {
 		},
 		Secret: config.UpdateKSopsSecretSpec{
 			References: []string{"test-update-ksops-secrets"},
-			Items:      []string{"test"},
+			Items:      []config.UpdateKSopsSecretItem{{Key: "test"}},
 		},
 		Recipients: []config.UpdateKSopsRecipient{
 			{
@@ -357,7 +359,7 @@ data:
 	secretlist := []*yaml.RNode{yaml.MustParse(data)}
 	uksConfig := uksConfigSecretReferenceSameName()
 	uksConfig.Secret.References = []string{"unencoded-b64-data"}
-	uksConfig.Secret.Items = []string{"KEY"}
+	uksConfig.Secret.Items = []config.UpdateKSopsSecretItem{{Key: "KEY"}}
 
 	secretRef := newSecretReference(secretlist, uksConfig)
 	v, encoded, err := secretRef.Get("KEY")
@@ -376,6 +378,414 @@ data:
 	}
 }
 
+func TestSecretReferenceComment(t *testing.T) {
+	data := `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: commented
+type: Opaque
+stringData:
+  # sops:enc
+  KEY: value
+  OTHER: value
+`
+	secretlist := []*yaml.RNode{yaml.MustParse(data)}
+	uksConfig := uksConfigSecretReferenceSameName()
+	uksConfig.Secret.References = []string{"commented"}
+
+	secretRef := newSecretReference(secretlist, uksConfig)
+
+	if comment := secretRef.GetComment("", "KEY"); comment != "# sops:enc" {
+		t.Errorf("Expect comment '# sops:enc', got '%s'", comment)
+	}
+
+	if comment := secretRef.GetComment("", "OTHER"); comment != "" {
+		t.Errorf("Expect no comment, got '%s'", comment)
+	}
+}
+
+func TestSecretReferenceItemSources(t *testing.T) {
+	secretlist := []*yaml.RNode{yaml.MustParse(`
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+type: Opaque
+stringData:
+  url: app-url
+`), yaml.MustParse(`
+apiVersion: v1
+kind: Secret
+metadata:
+  name: legacy-db
+type: Opaque
+stringData:
+  # sops:enc
+  url: postgres://legacy
+  DATABASE_URL: legacy-database-url
+`)}
+
+	uksConfig := &config.UpdateKSopsSecrets{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "sources",
+		},
+		Secret: config.UpdateKSopsSecretSpec{
+			References: []string{"app"},
+			Items: []config.UpdateKSopsSecretItem{
+				{Key: "DATABASE_URL", From: &config.UpdateKSopsSecretItemSource{Secret: "legacy-db", Key: "url"}},
+				{Key: "APP_URL", From: &config.UpdateKSopsSecretItemSource{Key: "url"}},
+				{Key: "url"},
+			},
+		},
+	}
+
+	secretRef := newSecretReference(secretlist, uksConfig)
+
+	expectedRefs := []string{"app", "legacy-db", "sources"}
+	if refs := listSecretRefsFromConfig(uksConfig); !reflect.DeepEqual(refs, expectedRefs) {
+		t.Errorf("Expect %#v, got %#v", expectedRefs, refs)
+	}
+
+	testCases := []struct {
+		Key           string
+		ExpectedValue string
+	}{
+		{Key: "DATABASE_URL", ExpectedValue: "postgres://legacy"},
+		{Key: "APP_URL", ExpectedValue: "app-url"},
+		{Key: "url", ExpectedValue: "app-url"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Key, func(t *testing.T) {
+			name, sourceKey := uksConfig.GetSecretItemSource(tc.Key)
+			value, _, err := getSecretItemValue(secretRef, "", name, sourceKey)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if value != tc.ExpectedValue {
+				t.Errorf("Expect %v, got %v", tc.ExpectedValue, value)
+			}
+		})
+	}
+
+	if comment := secretRef.GetComment("legacy-db", "url"); comment != "# sops:enc" {
+		t.Errorf("Expect comment '# sops:enc', got '%s'", comment)
+	}
+
+	if comment := secretRef.GetComment("app", "url"); comment != "" {
+		t.Errorf("Expect no comment, got '%s'", comment)
+	}
+}
+
+// fakeValueProvider is the provider of the values by key, the unknown keys
+// are failed as the provider commands do
+type fakeValueProvider map[string]string
+
+func (p fakeValueProvider) Get(key string) (string, error) {
+	if value, found := p[key]; found {
+		return value, nil
+	}
+
+	return "", fmt.Errorf("the provider 'fake' error: exit status 1")
+}
+
+func TestSecretReferenceProviders(t *testing.T) {
+	secretlist := []*yaml.RNode{yaml.MustParse(`
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+type: Opaque
+stringData:
+  DB_PASSWORD: unencrypted-password
+`)}
+
+	uksConfig := &config.UpdateKSopsSecrets{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "providers",
+		},
+		Secret: config.UpdateKSopsSecretSpec{
+			References: []string{"app"},
+			Items: []config.UpdateKSopsSecretItem{
+				{Key: "DB_PASSWORD", From: &config.UpdateKSopsSecretItemSource{Provider: "pass", Key: "app/db-password"}},
+				{Key: "API_TOKEN", From: &config.UpdateKSopsSecretItemSource{Provider: "pass"}},
+				{Key: "MISSING", From: &config.UpdateKSopsSecretItemSource{Provider: "pass"}},
+				{Key: "UNKNOWN", From: &config.UpdateKSopsSecretItemSource{Provider: "op"}},
+			},
+		},
+		Providers: []config.UpdateKSopsProvider{
+			{Name: "pass", Command: "pass", Args: []string{"show"}},
+		},
+	}
+
+	secretRef := newSecretReference(secretlist, uksConfig)
+	secretRef.(*secretReference).providers["pass"] = fakeValueProvider{
+		"app/db-password": "provided-password",
+		"API_TOKEN":       "provided-token",
+	}
+
+	testCases := []struct {
+		Key           string
+		ExpectedValue string
+		ExpectedError string
+	}{
+		{Key: "DB_PASSWORD", ExpectedValue: "provided-password"},
+		{Key: "API_TOKEN", ExpectedValue: "provided-token"},
+		{Key: "MISSING", ExpectedError: "the provider 'fake' error: exit status 1"},
+		{Key: "UNKNOWN", ExpectedError: "unknown provider 'op'"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Key, func(t *testing.T) {
+			name, sourceKey := uksConfig.GetSecretItemSource(tc.Key)
+			value, b64encoded, err := getSecretItemValue(secretRef, uksConfig.GetSecretItemProvider(tc.Key), name, sourceKey)
+			if tc.ExpectedError != "" {
+				if err == nil || err.Error() != tc.ExpectedError {
+					t.Fatalf("Expect error %q, got %v", tc.ExpectedError, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if value != tc.ExpectedValue || b64encoded {
+				t.Errorf("Expect %v unencoded, got %v (%v)", tc.ExpectedValue, value, b64encoded)
+			}
+		})
+	}
+}
+
+func TestSecretReferenceAmbiguousKeys(t *testing.T) {
+	secretlist := []*yaml.RNode{yaml.MustParse(`
+apiVersion: v1
+kind: Secret
+metadata:
+  name: defaults
+type: Opaque
+stringData:
+  password: default-password
+  username: admin
+`), yaml.MustParse(`
+apiVersion: v1
+kind: Secret
+metadata:
+  name: overrides
+type: Opaque
+data:
+  password: b3ZlcnJpZGU=
+`)}
+
+	testCases := []struct {
+		Name             string
+		Precedence       string
+		Key              string
+		ExpectedValue    string
+		ExpectedSources  []string
+		ExpectedSeverity framework.Severity
+		ExpectedMessage  string
+	}{
+		{
+			Name:             "reference list order",
+			Key:              "password",
+			ExpectedValue:    "b3ZlcnJpZGU=",
+			ExpectedSources:  []string{"overrides", "defaults"},
+			ExpectedSeverity: framework.Warning,
+			ExpectedMessage:  "Secret 'password' is ambiguous, found in the secrets references 'overrides', 'defaults', the value of 'overrides' is used",
+		},
+		{
+			Name:             "error on conflict",
+			Precedence:       config.SecretPrecedenceError,
+			Key:              "password",
+			ExpectedValue:    "b3ZlcnJpZGU=",
+			ExpectedSources:  []string{"overrides", "defaults"},
+			ExpectedSeverity: framework.Error,
+			ExpectedMessage:  "Secret 'password' is ambiguous, found in the secrets references 'overrides', 'defaults', pin the source with the item from.secret",
+		},
+		{
+			Name:            "unambiguous",
+			Precedence:      config.SecretPrecedenceError,
+			Key:             "username",
+			ExpectedValue:   "admin",
+			ExpectedSources: []string{"defaults"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			uksConfig := &config.UpdateKSopsSecrets{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "ambiguous",
+				},
+				Secret: config.UpdateKSopsSecretSpec{
+					References: []string{"overrides", "defaults"},
+					Items:      []config.UpdateKSopsSecretItem{{Key: tc.Key}},
+					Precedence: tc.Precedence,
+				},
+			}
+
+			secretRef := newSecretReference(secretlist, uksConfig)
+
+			value, _, err := secretRef.Get(tc.Key)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if value != tc.ExpectedValue {
+				t.Errorf("Expect value %v, got %v", tc.ExpectedValue, value)
+			}
+
+			if sources := secretRef.GetSources(tc.Key); !reflect.DeepEqual(sources, tc.ExpectedSources) {
+				t.Errorf("Expect sources %v, got %v", tc.ExpectedSources, sources)
+			}
+
+			result := ambiguousSecretResult(secretRef, uksConfig, tc.Key, tc.Key)
+			if tc.ExpectedMessage == "" {
+				if result != nil {
+					t.Errorf("Unexpected result %v", result)
+				}
+				return
+			}
+
+			if result == nil || result.Severity != tc.ExpectedSeverity || result.Message != tc.ExpectedMessage {
+				t.Errorf("Expect %s result %q, got %v", tc.ExpectedSeverity, tc.ExpectedMessage, result)
+			}
+		})
+	}
+}
+
+func TestSelectSecretItems(t *testing.T) {
+	secretlist := []*yaml.RNode{yaml.MustParse(`
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-env
+type: Opaque
+stringData:
+  DB_HOST: db
+  DB_PASSWORD: password
+  DEBUG: "true"
+  API_TOKEN: token
+`), yaml.MustParse(`
+apiVersion: v1
+kind: Secret
+metadata:
+  name: shared-env
+type: Opaque
+stringData:
+  API_TOKEN: shared-token
+  SMTP_PASSWORD: smtp
+`), yaml.MustParse(`
+apiVersion: v1
+kind: Secret
+metadata:
+  name: selectors
+  annotations:
+    internal.config.kubernetes.io/path: generated/secrets.selectors_LEGACY_KEY.enc.yaml
+type: Opaque
+data:
+  LEGACY_KEY: ENC[AES256_GCM,data:IUJvrFsCOzM=,iv:WGt9lQnO1VNbFkMN26EDacHUF0xQNvmDZfzPjzp6S8Q=,tag:Y56ZVMB9MIlxv1B/t2VPVQ==,type:str]
+`), yaml.MustParse(`
+apiVersion: config.kubernetes.io/v1alpha1
+kind: SecretFingerprint
+metadata:
+  name: selectors
+  annotations:
+    internal.config.kubernetes.io/path: generated/secrets.selectors_LEGACY_TOKEN.fp.yaml
+data:
+  LEGACY_TOKEN: fingerprint
+`)}
+
+	testCases := []struct {
+		Name            string
+		Selectors       []config.UpdateKSopsSecretSelector
+		ExpectedItems   []string
+		ExpectedSources map[string]string
+		ExpectedResults int
+	}{
+		{
+			Name: "all keys",
+			Selectors: []config.UpdateKSopsSecretSelector{
+				{Secret: "app-env", All: true, Exclude: []string{"DEBUG"}},
+			},
+			ExpectedItems: []string{"API_TOKEN", "DATABASE_URL", "DB_HOST", "DB_PASSWORD"},
+			ExpectedSources: map[string]string{
+				"API_TOKEN":    "app-env",
+				"DATABASE_URL": "legacy-db",
+			},
+		},
+		{
+			Name: "glob and regex",
+			Selectors: []config.UpdateKSopsSecretSelector{
+				{Secret: "app-env", Include: []string{"DB_*"}, ExcludeRegex: "HOST$"},
+				{Secret: "shared-env", IncludeRegex: "(TOKEN|PASSWORD)$"},
+			},
+			ExpectedItems: []string{"API_TOKEN", "DATABASE_URL", "DB_PASSWORD", "SMTP_PASSWORD"},
+			ExpectedSources: map[string]string{
+				"API_TOKEN":     "shared-env",
+				"SMTP_PASSWORD": "shared-env",
+			},
+		},
+		{
+			Name: "selected from more than one secret",
+			Selectors: []config.UpdateKSopsSecretSelector{
+				{Secret: "app-env", Include: []string{"API_*"}},
+				{Secret: "shared-env", All: true},
+			},
+			ExpectedItems: []string{"API_TOKEN", "DATABASE_URL", "SMTP_PASSWORD"},
+			ExpectedSources: map[string]string{
+				"API_TOKEN": "app-env",
+			},
+			ExpectedResults: 1,
+		},
+		{
+			Name: "absent secret keeps the encrypted keys",
+			Selectors: []config.UpdateKSopsSecretSelector{
+				{Secret: "legacy-env", Include: []string{"LEGACY_*"}},
+			},
+			ExpectedItems: []string{"DATABASE_URL", "LEGACY_KEY", "LEGACY_TOKEN"},
+			ExpectedSources: map[string]string{
+				"LEGACY_KEY":   "legacy-env",
+				"LEGACY_TOKEN": "legacy-env",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			uksConfig := &config.UpdateKSopsSecrets{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "selectors",
+				},
+				Secret: config.UpdateKSopsSecretSpec{
+					Items: []config.UpdateKSopsSecretItem{
+						{Key: "DATABASE_URL", From: &config.UpdateKSopsSecretItemSource{Secret: "legacy-db", Key: "url"}},
+					},
+					Selectors: tc.Selectors,
+				},
+			}
+
+			results := selectSecretItems(uksConfig, newSecretReference(secretlist, uksConfig))
+			if len(results) != tc.ExpectedResults {
+				t.Errorf("Expect %d results, got %v", tc.ExpectedResults, results)
+			}
+
+			if items := uksConfig.GetSecretItems(); !reflect.DeepEqual(items, tc.ExpectedItems) {
+				t.Errorf("Expect items %v, got %v", tc.ExpectedItems, items)
+			}
+
+			for key, expected := range tc.ExpectedSources {
+				if name, _ := uksConfig.GetSecretItemSource(key); name != expected {
+					t.Errorf("Expect %s source %s, got %s", key, expected, name)
+				}
+			}
+		})
+	}
+}
+
 func TestSecretFingerprintRef(t *testing.T) {
 	var secretlist []*yaml.RNode
 
@@ -417,10 +827,105 @@ data:
 	uksConfig := uksConfigSecretFingerprint()
 	secretRef := newSecretReference(secretlist, uksConfig)
 
-	fp := secretRef.GetEncryptedFP("test-update-ksops-secrets", "test")
+	fp := secretRef.GetEncryptedFP("generated/secrets.test-update-ksops-secrets_test.fp.yaml",
+		"test-update-ksops-secrets", "test")
 	expected := "+OSdrYZqZjj3uQ68dhoHpKqAMCe8gMR4PyDtQ5sVdhViHh6rbhd4mwZeZ5uWFQjkY7S+ISp4wq9ioNmwATnI53EtuZajI5C19oUmCj8HEYobVw=="
 
 	if fp != expected {
 		t.Errorf("Expect fingerprint %s, got %s", expected, fp)
 	}
 }
+
+func TestSecretFingerprintRefInDir(t *testing.T) {
+	var secretlist []*yaml.RNode
+
+	secrets := []string{`
+apiVersion: config.kubernetes.io/v1alpha1
+kind: SecretFingerprint
+metadata:
+  name: test-update-ksops-secrets
+  annotations:
+    internal.config.kubernetes.io/path: envs/prod/generated/secrets.test.fp.yaml
+type: Opaque
+data:
+  test: prod
+`, `
+apiVersion: config.kubernetes.io/v1alpha1
+kind: SecretFingerprint
+metadata:
+  name: test-update-ksops-secrets
+  annotations:
+    internal.config.kubernetes.io/path: envs/staging/generated/secrets.test.fp.yaml
+type: Opaque
+data:
+  test: staging
+`, `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: test-update-ksops-secrets
+  annotations:
+    internal.config.kubernetes.io/path: envs/staging/generated/secrets.test.enc.yaml
+type: Opaque
+data:
+  test: ENC[AES256_GCM,data:IUJvrFsCOzM=,iv:WGt9lQnO1VNbFkMN26EDacHUF0xQNvmDZfzPjzp6S8Q=,tag:Y56ZVMB9MIlxv1B/t2VPVQ==,type:str]
+`}
+
+	for _, ref := range secrets {
+		secretlist = append(secretlist, yaml.MustParse(ref))
+	}
+
+	testCases := []struct {
+		Path     string
+		Filename string
+		Expected string
+	}{
+		{Path: "envs/prod/update-ksops-secrets.yaml", Filename: "envs/prod/generated/secrets.test.fp.yaml", Expected: "prod"},
+		{Path: "envs/staging/update-ksops-secrets.yaml", Filename: "envs/staging/generated/secrets.test.fp.yaml", Expected: "staging"},
+		{Path: "envs/staging/update-ksops-secrets.yaml", Filename: "envs/staging/generated/secrets.test-update-ksops-secrets.test.fp.yaml", Expected: ""},
+		{Path: "update-ksops-secrets.yaml", Filename: "generated/secrets.test.fp.yaml", Expected: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Path, func(t *testing.T) {
+			uksConfig := uksConfigSecretFingerprint()
+			uksConfig.Path = tc.Path
+			secretRef := newSecretReference(secretlist, uksConfig)
+
+			fp := secretRef.GetEncryptedFP(tc.Filename, "test-update-ksops-secrets", "test")
+			if fp != tc.Expected {
+				t.Errorf("Expect fingerprint %s, got %s", tc.Expected, fp)
+			}
+
+			if _, _, err := secretRef.Get("test"); !errors.Is(err, ErrSecretNotFound) {
+				t.Errorf("Expect error %v, got %v", ErrSecretNotFound, err)
+			}
+		})
+	}
+}
+
+func TestSecretFingerprintRefOutputLayout(t *testing.T) {
+	secretlist := []*yaml.RNode{yaml.MustParse(`
+apiVersion: config.kubernetes.io/v1alpha1
+kind: SecretFingerprint
+metadata:
+  name: test-update-ksops-secrets
+  annotations:
+    internal.config.kubernetes.io/path: .sops/test.fp.yaml
+type: Opaque
+data:
+  test: fingerprint
+`)}
+
+	uksConfig := uksConfigSecretFingerprint()
+	secretRef := newSecretReference(secretlist, uksConfig)
+	if fp := secretRef.GetEncryptedFP("generated/secrets.test.fp.yaml", "test-update-ksops-secrets", "test"); fp != "" {
+		t.Errorf("Expect no fingerprint with default layout, got %s", fp)
+	}
+
+	uksConfig.Output.FingerprintFilePattern = ".sops/{key}.fp.yaml"
+	secretRef = newSecretReference(secretlist, uksConfig)
+	if fp := secretRef.GetEncryptedFP(".sops/test.fp.yaml", "test-update-ksops-secrets", "test"); fp != "fingerprint" {
+		t.Errorf("Expect fingerprint %s, got %s", "fingerprint", fp)
+	}
+}
@@ -0,0 +1,790 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package generator
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+	"github.com/neutronth/kpt-update-ksops-secrets/sops"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const SopsConfigFile = ".sops.yaml"
+
+// sopsConfigGeneratedComment marks the creation rules maintained by the
+// function, followed by the package path of the UpdateKSopsSecrets name
+const sopsConfigGeneratedComment = "# update-ksops-secrets: "
+
+// sopsKeys is the comma separated keys or the list of keys
+type sopsKeys []string
+
+func (k *sopsKeys) UnmarshalYAML(value *yaml.Node) error {
+	var keys []string
+
+	switch value.Kind {
+	case yaml.ScalarNode:
+		keys = strings.Split(value.Value, ",")
+	case yaml.SequenceNode:
+		if err := value.Decode(&keys); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("the keys must be a string or a list")
+	}
+
+	*k = nil
+	for _, key := range keys {
+		if key = strings.TrimSpace(key); key != "" {
+			*k = append(*k, key)
+		}
+	}
+
+	return nil
+}
+
+type sopsKeyGroup struct {
+	Age sopsKeys `yaml:"age"`
+	PGP sopsKeys `yaml:"pgp"`
+
+	KMS           []sopsKMSKey           `yaml:"kms"`
+	GCPKMS        []sopsGCPKMSKey        `yaml:"gcp_kms"`
+	AzureKeyVault []sopsAzureKeyVaultKey `yaml:"azure_keyvault"`
+	HCVault       sopsKeys               `yaml:"hc_vault"`
+}
+
+// sopsKMSKey is the AWS KMS key of the key group, the encryption context
+// and the AWS profile are not supported by the awskms recipients
+type sopsKMSKey struct {
+	ARN        string            `yaml:"arn"`
+	Role       string            `yaml:"role"`
+	Context    map[string]string `yaml:"context"`
+	AWSProfile string            `yaml:"aws_profile"`
+}
+
+type sopsGCPKMSKey struct {
+	ResourceID string `yaml:"resource_id"`
+}
+
+type sopsAzureKeyVaultKey struct {
+	VaultURL string `yaml:"vaultUrl"`
+	Key      string `yaml:"key"`
+	Version  string `yaml:"version"`
+}
+
+type sopsCreationRule struct {
+	// index is the position in the creation rules for the results
+	index int
+
+	PathRegex       string         `yaml:"path_regex"`
+	KeyGroups       []sopsKeyGroup `yaml:"key_groups"`
+	ShamirThreshold int            `yaml:"shamir_threshold"`
+
+	Age               sopsKeys `yaml:"age"`
+	PGP               sopsKeys `yaml:"pgp"`
+	KMS               sopsKeys `yaml:"kms"`
+	GCPKMS            sopsKeys `yaml:"gcp_kms"`
+	AzureKeyVault     sopsKeys `yaml:"azure_keyvault"`
+	HCVaultTransitURI sopsKeys `yaml:"hc_vault_transit_uri"`
+}
+
+// sopsConfig is the .sops.yaml creation rules
+type sopsConfig struct {
+	// source describes where the content is read from for the results
+	source string
+
+	// dir is the package directory of the .sops.yaml, the path regexes are
+	// matched against the file paths relative to it as SOPS does
+	dir string
+
+	CreationRules []sopsCreationRule
+}
+
+// loadSopsConfig reads the .sops.yaml referenced by the config, or the
+// nearest one in the config directory or its parents, nil is returned if
+// there is none
+func loadSopsConfig(nodes []*yaml.RNode, uksConfig *config.UpdateKSopsSecrets) (*sopsConfig, error) {
+	var node *yaml.RNode
+	var source, dir string
+
+	if ref := uksConfig.SopsConfig; ref.Name != "" {
+		refNode, data, found := findSopsConfigReference(nodes, ref.Name, ref.Key)
+		if !found {
+			return nil, fmt.Errorf("the sopsConfig '%s' key '%s' not found", ref.Name, ref.Key)
+		}
+
+		source = fmt.Sprintf("%s '%s'", refNode.GetKind(), ref.Name)
+
+		var err error
+		if node, err = yaml.Parse(data); err != nil {
+			return nil, fmt.Errorf("the %s parse error: %w", source, err)
+		}
+
+		refPath, _, _ := kioutil.GetFileAnnotations(refNode)
+		dir = path.Dir(refPath)
+	} else {
+		node = findNearestSopsConfig(nodes, uksConfig.GetDir())
+		if node == nil {
+			return nil, nil
+		}
+
+		source, _, _ = kioutil.GetFileAnnotations(node)
+		dir = path.Dir(source)
+	}
+
+	c := &sopsConfig{source: source, dir: dir}
+	if err := c.decode(node); err != nil {
+		return nil, fmt.Errorf("the %s parse error: %w", source, err)
+	}
+
+	return c, nil
+}
+
+// decode reads the creation rules, the rules generated by the function are
+// skipped as they are never the source of the recipients
+func (c *sopsConfig) decode(node *yaml.RNode) error {
+	rules := node.Field("creation_rules")
+	if rules == nil {
+		return nil
+	}
+
+	for i, n := range rules.Value.Content() {
+		if isGeneratedRule(n) {
+			continue
+		}
+
+		rule := sopsCreationRule{index: i}
+		if err := n.Decode(&rule); err != nil {
+			return err
+		}
+
+		c.CreationRules = append(c.CreationRules, rule)
+	}
+
+	return nil
+}
+
+func isGeneratedRule(n *yaml.Node) bool {
+	return generatedRuleMark(n) != ""
+}
+
+// generatedRuleMark returns the comment line marking the generated rule
+func generatedRuleMark(n *yaml.Node) string {
+	for _, line := range strings.Split(n.HeadComment, "\n") {
+		if strings.HasPrefix(line, sopsConfigGeneratedComment) {
+			return line
+		}
+	}
+
+	return ""
+}
+
+// generatedRuleComment identifies the rules of the config, the package
+// directory is included as the names are unique per directory only
+func generatedRuleComment(uksConfig *config.UpdateKSopsSecrets) string {
+	return sopsConfigGeneratedComment + path.Join(uksConfig.GetDir(), uksConfig.GetName())
+}
+
+func findSopsConfigReference(nodes []*yaml.RNode, name, key string) (*yaml.RNode, string, bool) {
+	for _, node := range nodes {
+		if node.GetApiVersion() != "v1" || node.GetName() != name {
+			continue
+		}
+
+		switch node.GetKind() {
+		case "ConfigMap":
+			if data, ok := node.GetDataMap()[key]; ok {
+				return node, data, true
+			}
+		case "Secret":
+			if data, err := node.Pipe(yaml.Lookup("stringData", key)); err == nil && data != nil {
+				return node, data.YNode().Value, true
+			}
+
+			if data, ok := node.GetDataMap()[key]; ok {
+				if decoded, err := decodeValue(data); err == nil {
+					return node, string(decoded), true
+				}
+			}
+		}
+	}
+
+	return nil, "", false
+}
+
+// findNearestSopsConfig finds the .sops.yaml in the directory or the closest
+// parent directory
+func findNearestSopsConfig(nodes []*yaml.RNode, dir string) (nearest *yaml.RNode) {
+	nearestDir := ""
+
+	for _, node := range nodes {
+		nodePath, _, err := kioutil.GetFileAnnotations(node)
+		if err != nil || path.Base(nodePath) != SopsConfigFile {
+			continue
+		}
+
+		nodeDir := path.Dir(nodePath)
+		if !isParentDir(nodeDir, dir) {
+			continue
+		}
+
+		if nearest == nil || len(nodeDir) > len(nearestDir) {
+			nearest, nearestDir = node, nodeDir
+		}
+	}
+
+	return nearest
+}
+
+func isParentDir(parent, dir string) bool {
+	return parent == "." || parent == dir || strings.HasPrefix(dir, parent+"/")
+}
+
+// matchRule returns the first creation rule matching the package file path
+func (c *sopsConfig) matchRule(filePath string) (*sopsCreationRule, error) {
+	if c.dir != "." {
+		filePath = strings.TrimPrefix(filePath, c.dir+"/")
+	}
+
+	for i := range c.CreationRules {
+		r := &c.CreationRules[i]
+		if r.PathRegex == "" {
+			return r, nil
+		}
+
+		pathCheck, err := regexp.Compile(r.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("the %s creation rule %d path_regex error: %w", c.source, r.index, err)
+		}
+
+		if pathCheck.MatchString(filePath) {
+			return r, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// recipients returns the recipients of the rule with their key group index,
+// the keys of the options the recipients could not express are listed as
+// unsupported
+func (r *sopsCreationRule) recipients() (recipients []config.UpdateKSopsRecipient, unsupported []string, err error) {
+	groups := r.KeyGroups
+	if len(groups) == 0 {
+		group := sopsKeyGroup{Age: r.Age, PGP: r.PGP, HCVault: r.HCVaultTransitURI}
+		for _, key := range r.KMS {
+			arn, role, _ := strings.Cut(key, "+")
+			group.KMS = append(group.KMS, sopsKMSKey{ARN: arn, Role: role})
+		}
+
+		for _, key := range r.GCPKMS {
+			group.GCPKMS = append(group.GCPKMS, sopsGCPKMSKey{ResourceID: key})
+		}
+
+		for _, key := range r.AzureKeyVault {
+			vaultURL, name, version, err := config.ParseAzureKeyVaultKey(key)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			group.AzureKeyVault = append(group.AzureKeyVault,
+				sopsAzureKeyVaultKey{VaultURL: vaultURL, Key: name, Version: version})
+		}
+
+		groups = []sopsKeyGroup{group}
+	}
+
+	for i, group := range groups {
+		add := func(keyType string, keys ...string) {
+			for _, key := range keys {
+				recipients = append(recipients, config.UpdateKSopsRecipient{Type: keyType, Recipient: key, KeyGroup: i})
+			}
+		}
+
+		add("age", group.Age...)
+		add("pgp", group.PGP...)
+
+		for _, key := range group.KMS {
+			if len(key.Context) > 0 || key.AWSProfile != "" {
+				if !sliceContainsString(unsupported, "kms context and aws_profile") {
+					unsupported = append(unsupported, "kms context and aws_profile")
+				}
+				continue
+			}
+
+			recipient := key.ARN
+			if key.Role != "" {
+				recipient += "+" + key.Role
+			}
+			add("awskms", recipient)
+		}
+
+		for _, key := range group.GCPKMS {
+			add("gcpkms", key.ResourceID)
+		}
+
+		for _, key := range group.AzureKeyVault {
+			add("azurekv", strings.TrimSuffix(key.VaultURL, "/")+"/keys/"+key.Key+"/"+key.Version)
+		}
+
+		// The vault recipients are encrypted by the Vault of the address
+		// environment, the transit key URIs must be of the same address
+		for _, uri := range group.HCVault {
+			address, recipient, err := config.ParseVaultTransitURI(uri)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if vaultAddress := os.Getenv(config.VaultAddressEnv); strings.TrimSuffix(vaultAddress, "/") != address {
+				return nil, nil, fmt.Errorf("vault transit URI '%s' is not of the %s '%s'",
+					uri, config.VaultAddressEnv, vaultAddress)
+			}
+			add("vault", recipient)
+		}
+	}
+
+	return recipients, unsupported, nil
+}
+
+// resolveRecipients resolves the recipients of the encrypted file by the
+// matching creation rule, they are merged into or override the configured
+// recipients, the key groups are merged by their index, the rule
+// shamir_threshold applies unless the options set their own
+func resolveRecipients(sopsCfg *sopsConfig, uksConfig *config.UpdateKSopsSecrets,
+	configured []config.UpdateKSopsRecipient, options config.UpdateKSopsSopsOptions, filePath string,
+) (recipients []config.UpdateKSopsRecipient, resolved config.UpdateKSopsSopsOptions, results framework.Results) {
+	if sopsCfg == nil {
+		return configured, options, nil
+	}
+
+	rule, err := sopsCfg.matchRule(filePath)
+	if err != nil {
+		results = append(results, &framework.Result{
+			Message:  err.Error(),
+			Severity: framework.Error,
+		})
+		return nil, options, results
+	}
+
+	if rule == nil {
+		return configured, options, nil
+	}
+
+	if options.ShamirThreshold == 0 {
+		options.ShamirThreshold = rule.ShamirThreshold
+	}
+
+	ruleRecipients, unsupported, err := rule.recipients()
+	if err != nil {
+		results = append(results, &framework.Result{
+			Message:  fmt.Sprintf("the %s creation rule %d keys error: %s", sopsCfg.source, rule.index, err.Error()),
+			Severity: framework.Error,
+		})
+		return nil, options, results
+	}
+
+	if len(unsupported) > 0 {
+		results = append(results, &framework.Result{
+			Message: fmt.Sprintf("the %s creation rule %d keys %s are not supported, ignored",
+				sopsCfg.source, rule.index, strings.Join(unsupported, ", ")),
+			Severity: framework.Warning,
+		})
+	}
+
+	if !uksConfig.SopsConfig.IsOverride() {
+		recipients = append(recipients, configured...)
+	}
+
+	for _, r := range ruleRecipients {
+		if !config.ContainsRecipient(recipients, r) {
+			recipients = append(recipients, r)
+		}
+	}
+
+	results = append(results, &framework.Result{
+		Message: fmt.Sprintf("File %s recipients resolved by the %s creation rule %d",
+			filePath, sopsCfg.source, rule.index),
+		Severity: framework.Info,
+	})
+
+	return recipients, options, results
+}
+
+// resolveKeyRecipients resolves the recipients and the sops options of the
+// encrypted file of each secret item
+func (g *KSopsGenerator) resolveKeyRecipients(nodes []*yaml.RNode,
+	uksConfig *config.UpdateKSopsSecrets, keys *publicKeyReader,
+) (keyRecipients map[string][]config.UpdateKSopsRecipient,
+	keyOptions map[string]config.UpdateKSopsSopsOptions, results framework.Results,
+) {
+	sopsCfg, err := loadSopsConfig(nodes, uksConfig)
+	if err != nil {
+		results = append(results, &framework.Result{
+			Message:  err.Error(),
+			Severity: framework.Error,
+		})
+		return nil, nil, results
+	}
+
+	configured, err := keys.expandAgeRecipients(uksConfig.GetRecipients()...)
+	if err != nil {
+		results = append(results, &framework.Result{
+			Message:  err.Error(),
+			Severity: framework.Error,
+		})
+		return nil, nil, results
+	}
+
+	keyRecipients = map[string][]config.UpdateKSopsRecipient{}
+	keyOptions = map[string]config.UpdateKSopsSopsOptions{}
+	for _, key := range uksConfig.GetSecretItems() {
+		filename := g.path(g.encryptedFilename(uksConfig.GetName(), key, "enc"))
+		recipients, options, recipientsResults := resolveRecipients(sopsCfg, uksConfig, configured,
+			uksConfig.GetSopsOptions(key), filename)
+		results = append(results, recipientsResults...)
+		if recipientsResults.ExitCode() == 1 {
+			return nil, nil, results
+		}
+
+		if len(recipients) == 0 {
+			results = append(results, &framework.Result{
+				Message:  fmt.Sprintf("Secret key '%s' => %s has no recipients", key, filename),
+				Severity: framework.Error,
+			})
+			return nil, nil, results
+		}
+
+		// The key groups are final once the creation rule is merged
+		if err := options.ValidateKeyGroups(len(config.KeyGroups(recipients...))); err != nil {
+			results = append(results, &framework.Result{
+				Message:  fmt.Sprintf("Secret key '%s' => %s sops options error, %s", key, filename, err.Error()),
+				Severity: framework.Error,
+			})
+			return nil, nil, results
+		}
+
+		keyRecipients[key] = recipients
+		keyOptions[key] = options
+	}
+
+	return keyRecipients, keyOptions, results
+}
+
+// GenerateSopsConfig maintains the creation rules of the encrypted files in
+// the nearest .sops.yaml, or a new one in the package directory, the other
+// rules are kept as is
+func (g *KSopsGenerator) GenerateSopsConfig(nodes []*yaml.RNode,
+	configs []*config.UpdateKSopsSecrets,
+) (newNodes []*yaml.RNode, results framework.Results) {
+	var generatedConfigs []*config.UpdateKSopsSecrets
+	for _, uksConfig := range configs {
+		if uksConfig.SopsConfig.Generate {
+			generatedConfigs = append(generatedConfigs, uksConfig)
+		}
+	}
+
+	if len(generatedConfigs) == 0 {
+		return nil, nil
+	}
+
+	node := yaml.MustParse("creation_rules: []\n")
+	filePath := g.path(SopsConfigFile)
+	if existing := findNearestSopsConfig(nodes, path.Clean(g.Dir)); existing != nil {
+		node = existing.Copy()
+		filePath, _, _ = kioutil.GetFileAnnotations(existing)
+	}
+
+	var rules, comments []string
+	var ruleNodes []*yaml.Node
+	for _, uksConfig := range generatedConfigs {
+		keys := g.newPublicKeyReader(nodes, newSecretReference(nodes, uksConfig))
+		keyRecipients, keyOptions, recipientsResults := g.resolveKeyRecipients(nodes, uksConfig, keys)
+		if recipientsResults.ExitCode() == 1 {
+			return nil, append(results, recipientsResults...)
+		}
+
+		comments = append(comments, generatedRuleComment(uksConfig))
+		for _, key := range uksConfig.GetSecretItems() {
+			encryptedFile := g.path(g.encryptedFilename(uksConfig.GetName(), key, "enc"))
+			if dir := path.Dir(filePath); dir != "." {
+				encryptedFile = strings.TrimPrefix(encryptedFile, dir+"/")
+			}
+
+			rule, err := NewSopsCreationRuleNode(encryptedFile,
+				keyOptions[key], keyRecipients[key]...)
+			if err != nil {
+				results = append(results, &framework.Result{
+					Message:  fmt.Sprintf("The %s creation rule generation error, %s", filePath, err.Error()),
+					Severity: framework.Error,
+				})
+				return nil, results
+			}
+
+			rule.YNode().HeadComment = generatedRuleComment(uksConfig)
+			ruleNodes = append(ruleNodes, rule.YNode())
+			rules = append(rules, encryptedFile)
+		}
+	}
+
+	creationRules, err := node.Pipe(yaml.LookupCreate(yaml.SequenceNode, "creation_rules"))
+	if err != nil {
+		results = append(results, &framework.Result{
+			Message:  fmt.Sprintf("The %s update error, %s", filePath, err.Error()),
+			Severity: framework.Error,
+		})
+		return nil, results
+	}
+
+	// The generated rules precede the others as the first matching rule wins
+	for _, n := range creationRules.Content() {
+		if !sliceContainsString(comments, generatedRuleMark(n)) {
+			ruleNodes = append(ruleNodes, n)
+		}
+	}
+	creationRules.YNode().Content = ruleNodes
+	creationRules.YNode().Style = 0
+
+	setFilename([]*yaml.RNode{node}, filePath)
+	newNodes = append(newNodes, node)
+	results = append(results, &framework.Result{
+		Message: fmt.Sprintf("The %s creation rules updated for %s",
+			filePath, strings.Join(rules, ", ")),
+		Severity: framework.Info,
+	})
+
+	return newNodes, results
+}
+
+// NewSopsCreationRuleNode creates the creation rule of the encrypted file
+// with the same options and recipients the file is encrypted with
+func NewSopsCreationRuleNode(encryptedFile string, options config.UpdateKSopsSopsOptions,
+	recipients ...config.UpdateKSopsRecipient,
+) (*yaml.RNode, error) {
+	n := yaml.NewMapRNode(nil)
+
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"path_regex", "^" + regexp.QuoteMeta(encryptedFile) + "$"},
+		{"encrypted_regex", options.EncryptedRegex},
+		{"unencrypted_regex", options.UnencryptedRegex()},
+		{"encrypted_comment_regex", options.EncryptedCommentRegex},
+	}
+
+	if options.EncryptedRegex == "" && options.UnencryptedSuffix == "" &&
+		options.EncryptedCommentRegex == "" {
+		fields[1].value = sops.DefaultEncryptedRegex
+	}
+
+	for _, field := range fields {
+		if field.value == "" {
+			continue
+		}
+
+		if err := n.PipeE(yaml.SetField(field.name, yaml.NewStringRNode(field.value))); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.IsMACOnlyEncrypted() {
+		value := yaml.NewScalarRNode("true")
+		value.YNode().Tag = yaml.NodeTagBool
+		if err := n.PipeE(yaml.SetField("mac_only_encrypted", value)); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.ShamirThreshold > 0 {
+		value := yaml.NewScalarRNode(strconv.Itoa(options.ShamirThreshold))
+		value.YNode().Tag = yaml.NodeTagInt
+		if err := n.PipeE(yaml.SetField("shamir_threshold", value)); err != nil {
+			return nil, err
+		}
+	}
+
+	keyGroups := config.KeyGroups(recipients...)
+	if len(keyGroups) <= 1 {
+		return n, setCreationRuleKeys(n, false, recipients...)
+	}
+
+	groups := yaml.NewListRNode()
+	for _, groupRecipients := range keyGroups {
+		group := yaml.NewMapRNode(nil)
+		if err := setCreationRuleKeys(group, true, groupRecipients...); err != nil {
+			return nil, err
+		}
+
+		if err := groups.PipeE(yaml.Append(group.YNode())); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := n.PipeE(yaml.SetField("key_groups", groups)); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// setCreationRuleKeys sets the keys of the rule as the comma-separated
+// strings, or as the lists in the key groups
+func setCreationRuleKeys(n *yaml.RNode, list bool, recipients ...config.UpdateKSopsRecipient) error {
+	keys := map[string][]string{}
+	for _, r := range recipients {
+		keyType, key := r.Type, r.Recipient
+		switch keyType {
+		case "ssh":
+			// The ssh public keys are the age recipients of SOPS
+			keyType = "age"
+		case "vault":
+			address := os.Getenv(config.VaultAddressEnv)
+			if address == "" {
+				return fmt.Errorf("the vault recipient %s requires the %s", r.Recipient, config.VaultAddressEnv)
+			}
+
+			keyType, key = "hc_vault", config.VaultTransitURI(address, r.Recipient)
+		case "awskms":
+			keyType = "kms"
+		case "gcpkms":
+			keyType = "gcp_kms"
+		case "azurekv":
+			keyType = "azure_keyvault"
+		}
+
+		keys[keyType] = append(keys[keyType], key)
+	}
+
+	for _, keyType := range []string{"age", "pgp", "hc_vault", "kms", "gcp_kms", "azure_keyvault"} {
+		if len(keys[keyType]) == 0 {
+			continue
+		}
+
+		field := keyType
+		value := yaml.NewStringRNode(strings.Join(keys[keyType], ","))
+		switch {
+		case list:
+			var err error
+			if value, err = keyGroupKeysNode(keyType, keys[keyType]); err != nil {
+				return err
+			}
+		case keyType == "hc_vault":
+			field = "hc_vault_transit_uri"
+		}
+
+		if err := n.PipeE(yaml.SetField(field, value)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// keyGroupKeysNode returns the keys list of the key group, the cloud KMS keys
+// are the mappings of the SOPS key group
+func keyGroupKeysNode(keyType string, keys []string) (*yaml.RNode, error) {
+	switch keyType {
+	case "kms", "gcp_kms", "azure_keyvault":
+	default:
+		return yaml.NewListRNode(keys...), nil
+	}
+
+	list := yaml.NewListRNode()
+	for _, key := range keys {
+		var fields []string
+		switch keyType {
+		case "kms":
+			arn, role, err := config.ParseAWSKMSKey(key)
+			if err != nil {
+				return nil, err
+			}
+
+			fields = []string{"arn", arn}
+			if role != "" {
+				fields = append(fields, "role", role)
+			}
+		case "gcp_kms":
+			fields = []string{"resource_id", key}
+		case "azure_keyvault":
+			vaultURL, name, version, err := config.ParseAzureKeyVaultKey(key)
+			if err != nil {
+				return nil, err
+			}
+
+			fields = []string{"vaultUrl", vaultURL, "key", name, "version", version}
+		}
+
+		n := yaml.NewMapRNode(nil)
+		for i := 0; i+1 < len(fields); i += 2 {
+			if err := n.PipeE(yaml.SetField(fields[i], yaml.NewStringRNode(fields[i+1]))); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := list.PipeE(yaml.Append(n.YNode())); err != nil {
+			return nil, err
+		}
+	}
+
+	return list, nil
+}
+
+// PruneSopsConfig removes the generated creation rules no config generates
+// anymore, the config could be removed along with its package directory or
+// no longer generate the rules, the other rules are kept as is
+func PruneSopsConfig(nodes []*yaml.RNode, configs []*config.UpdateKSopsSecrets,
+) (newNodes []*yaml.RNode, results framework.Results) {
+	var marks []string
+	for _, uksConfig := range configs {
+		if uksConfig.SopsConfig.Generate {
+			marks = append(marks, generatedRuleComment(uksConfig))
+		}
+	}
+
+	for _, node := range nodes {
+		filePath, _, err := kioutil.GetFileAnnotations(node)
+		if err != nil || path.Base(filePath) != SopsConfigFile {
+			continue
+		}
+
+		updated := node.Copy()
+		creationRules, err := updated.Pipe(yaml.Lookup("creation_rules"))
+		if err != nil || creationRules == nil || creationRules.YNode().Kind != yaml.SequenceNode {
+			continue
+		}
+
+		var ruleNodes []*yaml.Node
+		var pruned []string
+		for _, n := range creationRules.Content() {
+			mark := generatedRuleMark(n)
+			if mark != "" && !sliceContainsString(marks, mark) {
+				pruned = append(pruned, strings.TrimPrefix(mark, sopsConfigGeneratedComment))
+				continue
+			}
+
+			ruleNodes = append(ruleNodes, n)
+		}
+
+		if len(pruned) == 0 {
+			continue
+		}
+
+		creationRules.YNode().Content = ruleNodes
+		newNodes = append(newNodes, updated)
+		results = append(results, &framework.Result{
+			Message: fmt.Sprintf("The %s creation rules of %s removed",
+				filePath, strings.Join(pruned, ", ")),
+			Severity: framework.Info,
+		})
+	}
+
+	return newNodes, results
+}
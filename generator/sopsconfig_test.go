@@ -0,0 +1,748 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package generator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	testSopsAgeRecipient      = "age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa"
+	testSopsOtherAgeRecipient = "age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"
+	testSopsPGPRecipient      = "380024A2AC1D3EBC9402BEE66E38309B4DA30118"
+)
+
+func uksConfigSopsConfig(dir string) *config.UpdateKSopsSecrets {
+	return &config.UpdateKSopsSecrets{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test",
+		},
+		Recipients: []config.UpdateKSopsRecipient{
+			{
+				Type:      "age",
+				Recipient: testSopsAgeRecipient,
+			},
+		},
+		Path: dir + "/update-ksops-secrets.yaml",
+	}
+}
+
+func TestLoadSopsConfig(t *testing.T) {
+	nodes := []*yaml.RNode{
+		yaml.MustParse(`
+creation_rules:
+  - age: root
+metadata:
+  annotations:
+    internal.config.kubernetes.io/path: .sops.yaml
+`),
+		yaml.MustParse(`
+creation_rules:
+  - age: prod
+metadata:
+  annotations:
+    internal.config.kubernetes.io/path: envs/prod/.sops.yaml
+`),
+		yaml.MustParse(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: sops-config
+  annotations:
+    internal.config.kubernetes.io/path: config/sops.yaml
+data:
+  .sops.yaml: |
+    creation_rules:
+      - age: configmap, other
+`),
+	}
+
+	testCases := []struct {
+		Name        string
+		Dir         string
+		Reference   config.UpdateKSopsSopsConfig
+		ExpectedDir string
+		ExpectedAge []string
+		ExpectsErr  bool
+	}{
+		{
+			Name:        "nearest in the same directory",
+			Dir:         "envs/prod",
+			ExpectedDir: "envs/prod",
+			ExpectedAge: []string{"prod"},
+		},
+		{
+			Name:        "nearest in the parent directory",
+			Dir:         "envs/production",
+			ExpectedDir: ".",
+			ExpectedAge: []string{"root"},
+		},
+		{
+			Name:        "referenced",
+			Dir:         "envs/prod",
+			Reference:   config.UpdateKSopsSopsConfig{Name: "sops-config", Key: ".sops.yaml"},
+			ExpectedDir: "config",
+			ExpectedAge: []string{"configmap", "other"},
+		},
+		{
+			Name:       "referenced not found",
+			Dir:        "envs/prod",
+			Reference:  config.UpdateKSopsSopsConfig{Name: "sops-config", Key: "unknown"},
+			ExpectsErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			uksConfig := uksConfigSopsConfig(tc.Dir)
+			uksConfig.SopsConfig = tc.Reference
+
+			sopsCfg, err := loadSopsConfig(nodes, uksConfig)
+			if tc.ExpectsErr {
+				if err == nil {
+					t.Errorf("Expect error, got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if sopsCfg.dir != tc.ExpectedDir {
+				t.Errorf("Expect dir %s, got %s", tc.ExpectedDir, sopsCfg.dir)
+			}
+
+			if len(sopsCfg.CreationRules) != 1 ||
+				!reflect.DeepEqual([]string(sopsCfg.CreationRules[0].Age), tc.ExpectedAge) {
+				t.Errorf("Expect age %v, got %#v", tc.ExpectedAge, sopsCfg.CreationRules)
+			}
+		})
+	}
+
+	t.Run("none", func(t *testing.T) {
+		sopsCfg, err := loadSopsConfig(nodes[1:2], uksConfigSopsConfig("envs/staging"))
+		if err != nil || sopsCfg != nil {
+			t.Errorf("Expect no sops config, got %v, %v", sopsCfg, err)
+		}
+	})
+}
+
+func TestResolveRecipients(t *testing.T) {
+	sopsCfg := &sopsConfig{
+		source: ".sops.yaml",
+		dir:    ".",
+	}
+
+	if err := sopsCfg.decode(yaml.MustParse(`
+creation_rules:
+  - path_regex: ^envs/prod/
+    key_groups:
+      - age:
+          - ` + testSopsOtherAgeRecipient + `
+        pgp:
+          - ` + testSopsPGPRecipient + `
+  - path_regex: ^envs/staging/
+    age: ` + testSopsAgeRecipient + `,` + testSopsOtherAgeRecipient + `
+    kms: arn:aws:kms:us-east-1:000000000000:key/test
+  - path_regex: ^envs/groups/
+    shamir_threshold: 2
+    key_groups:
+      - age: [` + testSopsAgeRecipient + `]
+      - age: [` + testSopsOtherAgeRecipient + `]
+`)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	configured := config.UpdateKSopsRecipient{Type: "age", Recipient: testSopsAgeRecipient}
+	other := config.UpdateKSopsRecipient{Type: "age", Recipient: testSopsOtherAgeRecipient}
+	pgp := config.UpdateKSopsRecipient{Type: "pgp", Recipient: testSopsPGPRecipient}
+	otherGroup := config.UpdateKSopsRecipient{Type: "age", Recipient: testSopsOtherAgeRecipient, KeyGroup: 1}
+	kms := config.UpdateKSopsRecipient{Type: "awskms", Recipient: "arn:aws:kms:us-east-1:000000000000:key/test"}
+
+	testCases := []struct {
+		Name               string
+		FilePath           string
+		Mode               string
+		ShamirThreshold    int
+		ExpectedRecipients []config.UpdateKSopsRecipient
+		ExpectedThreshold  int
+	}{
+		{
+			Name:               "merge key group",
+			FilePath:           "envs/prod/generated/secrets.test.enc.yaml",
+			ExpectedRecipients: []config.UpdateKSopsRecipient{configured, other, pgp},
+		},
+		{
+			Name:               "override key group",
+			FilePath:           "envs/prod/generated/secrets.test.enc.yaml",
+			Mode:               config.SopsConfigRecipientsOverride,
+			ExpectedRecipients: []config.UpdateKSopsRecipient{other, pgp},
+		},
+		{
+			Name:               "merge without duplicates",
+			FilePath:           "envs/staging/generated/secrets.test.enc.yaml",
+			ExpectedRecipients: []config.UpdateKSopsRecipient{configured, other, kms},
+		},
+		{
+			Name:               "no matching rule",
+			FilePath:           "envs/dev/generated/secrets.test.enc.yaml",
+			Mode:               config.SopsConfigRecipientsOverride,
+			ExpectedRecipients: []config.UpdateKSopsRecipient{configured},
+		},
+		{
+			Name:               "merge multiple key groups",
+			FilePath:           "envs/groups/generated/secrets.test.enc.yaml",
+			ExpectedRecipients: []config.UpdateKSopsRecipient{configured, otherGroup},
+			ExpectedThreshold:  2,
+		},
+		{
+			Name:               "override multiple key groups",
+			FilePath:           "envs/groups/generated/secrets.test.enc.yaml",
+			Mode:               config.SopsConfigRecipientsOverride,
+			ExpectedRecipients: []config.UpdateKSopsRecipient{configured, otherGroup},
+			ExpectedThreshold:  2,
+		},
+		{
+			Name:               "configured shamir threshold",
+			FilePath:           "envs/groups/generated/secrets.test.enc.yaml",
+			ShamirThreshold:    1,
+			ExpectedRecipients: []config.UpdateKSopsRecipient{configured, otherGroup},
+			ExpectedThreshold:  1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			uksConfig := uksConfigSopsConfig(".")
+			uksConfig.SopsConfig.Recipients = tc.Mode
+			uksConfig.Sops.ShamirThreshold = tc.ShamirThreshold
+
+			recipients, options, results := resolveRecipients(sopsCfg, uksConfig, uksConfig.GetRecipients(),
+				uksConfig.Sops, tc.FilePath)
+			if results.ExitCode() != 0 {
+				t.Fatalf("Unexpected results: %s", results.Error())
+			}
+
+			if !reflect.DeepEqual(recipients, tc.ExpectedRecipients) {
+				t.Errorf("Expect recipients\n%v,\ngot\n%v", tc.ExpectedRecipients, recipients)
+			}
+
+			if options.ShamirThreshold != tc.ExpectedThreshold {
+				t.Errorf("Expect shamir threshold %d, got %d", tc.ExpectedThreshold, options.ShamirThreshold)
+			}
+		})
+	}
+}
+
+func TestSopsCreationRuleRecipients(t *testing.T) {
+	t.Setenv(config.VaultAddressEnv, "https://vault.example.com:8200/")
+
+	kmsARN := "arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+	kmsRoleARN := "arn:aws:iam::123456789012:role/sops"
+	gcpKMSKey := "projects/test/locations/global/keyRings/sops/cryptoKeys/sops"
+	azureKey := "https://sops.vault.azure.net/keys/sops/0123456789abcdef"
+	vaultURI := "https://vault.example.com:8200/v1/transit/keys/sops"
+
+	expected := []config.UpdateKSopsRecipient{
+		{Type: "awskms", Recipient: kmsARN + "+" + kmsRoleARN},
+		{Type: "gcpkms", Recipient: gcpKMSKey},
+		{Type: "azurekv", Recipient: azureKey},
+		{Type: "vault", Recipient: "transit/keys/sops"},
+	}
+
+	testCases := []struct {
+		Name                string
+		Rule                string
+		ExpectedRecipients  []config.UpdateKSopsRecipient
+		ExpectedUnsupported []string
+		ExpectedError       string
+	}{
+		{
+			Name: "keys",
+			Rule: `
+kms: ` + kmsARN + `+` + kmsRoleARN + `
+gcp_kms: ` + gcpKMSKey + `
+azure_keyvault: ` + azureKey + `
+hc_vault_transit_uri: ` + vaultURI + `
+`,
+			ExpectedRecipients: expected,
+		},
+		{
+			Name: "key groups",
+			Rule: `
+key_groups:
+  - kms:
+      - arn: ` + kmsARN + `
+        role: ` + kmsRoleARN + `
+    gcp_kms:
+      - resource_id: ` + gcpKMSKey + `
+    azure_keyvault:
+      - vaultUrl: https://sops.vault.azure.net
+        key: sops
+        version: 0123456789abcdef
+    hc_vault:
+      - ` + vaultURI + `
+`,
+			ExpectedRecipients: expected,
+		},
+		{
+			Name: "kms context",
+			Rule: `
+key_groups:
+  - kms:
+      - arn: ` + kmsARN + `
+        context:
+          app: test
+    age:
+      - ` + testSopsAgeRecipient + `
+`,
+			ExpectedRecipients:  []config.UpdateKSopsRecipient{{Type: "age", Recipient: testSopsAgeRecipient}},
+			ExpectedUnsupported: []string{"kms context and aws_profile"},
+		},
+		{
+			Name:          "other vault address",
+			Rule:          "hc_vault_transit_uri: https://other.example.com/v1/transit/keys/sops\n",
+			ExpectedError: "vault transit URI 'https://other.example.com/v1/transit/keys/sops' is not of the VAULT_ADDR 'https://vault.example.com:8200/'",
+		},
+		{
+			Name:          "invalid vault transit URI",
+			Rule:          "hc_vault_transit_uri: https://vault.example.com:8200/transit/keys/sops\n",
+			ExpectedError: "vault transit URI 'https://vault.example.com:8200/transit/keys/sops' must be <address>/v1/<engine path>/keys/<key name>",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			rule := sopsCreationRule{}
+			if err := yaml.MustParse(tc.Rule).YNode().Decode(&rule); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			recipients, unsupported, err := rule.recipients()
+			if tc.ExpectedError != "" {
+				if err == nil || err.Error() != tc.ExpectedError {
+					t.Fatalf("Expect error %s, got %v", tc.ExpectedError, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(recipients, tc.ExpectedRecipients) {
+				t.Errorf("Expect recipients\n%v,\ngot\n%v", tc.ExpectedRecipients, recipients)
+			}
+
+			if !reflect.DeepEqual(unsupported, tc.ExpectedUnsupported) {
+				t.Errorf("Expect unsupported %v, got %v", tc.ExpectedUnsupported, unsupported)
+			}
+		})
+	}
+}
+
+func TestResolveKeyRecipientsShamirThreshold(t *testing.T) {
+	sopsConfigNode := yaml.MustParse(`
+creation_rules:
+  - path_regex: ^generated/
+    key_groups:
+      - age: [` + testSopsAgeRecipient + `]
+      - age: [` + testSopsOtherAgeRecipient + `]
+metadata:
+  annotations:
+    internal.config.kubernetes.io/path: .sops.yaml
+`)
+
+	testCases := []struct {
+		Name            string
+		Groups          []config.UpdateKSopsRecipientGroup
+		ShamirThreshold int
+		ExpectedError   string
+	}{
+		{
+			Name:            "threshold of the merged key groups",
+			ShamirThreshold: 2,
+		},
+		{
+			Name:            "threshold over the merged key groups",
+			ShamirThreshold: 3,
+			ExpectedError:   "shamirThreshold 3 must not be greater than the number of key groups",
+		},
+		{
+			Name:            "threshold of one for the merged key groups",
+			ShamirThreshold: 1,
+			ExpectedError:   "shamirThreshold must be at least 2 for 2 key groups",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			uksConfig := uksConfigSopsConfig(".")
+			uksConfig.Secret.Items = []config.UpdateKSopsSecretItem{{Key: "password"}}
+			uksConfig.Sops.ShamirThreshold = tc.ShamirThreshold
+
+			nodes := []*yaml.RNode{sopsConfigNode}
+			gen := &KSopsGenerator{Dir: "."}
+			keys := gen.newPublicKeyReader(nodes, newSecretReference(nodes, uksConfig))
+			keyRecipients, keyOptions, results := gen.resolveKeyRecipients(nodes, uksConfig, keys)
+			if tc.ExpectedError != "" {
+				if results.ExitCode() != 1 || !strings.Contains(results.Error(), tc.ExpectedError) {
+					t.Fatalf("Expect error %s, got %v", tc.ExpectedError, results)
+				}
+				return
+			}
+
+			if results.ExitCode() != 0 {
+				t.Fatalf("Unexpected results: %s", results.Error())
+			}
+
+			if groups := config.KeyGroups(keyRecipients["password"]...); len(groups) != 2 {
+				t.Errorf("Expect 2 key groups, got %v", groups)
+			}
+
+			if keyOptions["password"].ShamirThreshold != tc.ShamirThreshold {
+				t.Errorf("Expect shamir threshold %d, got %d", tc.ShamirThreshold, keyOptions["password"].ShamirThreshold)
+			}
+		})
+	}
+}
+
+func TestGenerateSopsConfig(t *testing.T) {
+	existing := yaml.MustParse(`
+creation_rules:
+  # update-ksops-secrets: envs/prod/test
+  - path_regex: ^envs/prod/secrets\.stale\.enc\.yaml$
+    age: stale
+  - path_regex: ^envs/
+    age: manual
+metadata:
+  annotations:
+    internal.config.kubernetes.io/path: .sops.yaml
+`)
+
+	commented := yaml.MustParse(`
+creation_rules:
+  # The rule of the production secrets
+  # update-ksops-secrets: envs/prod/test
+  - path_regex: ^envs/prod/secrets\.stale\.enc\.yaml$
+    age: stale
+metadata:
+  annotations:
+    internal.config.kubernetes.io/path: .sops.yaml
+`)
+
+	testCases := []struct {
+		Name          string
+		Nodes         []*yaml.RNode
+		Generate      bool
+		Options       config.UpdateKSopsSopsOptions
+		Groups        []config.UpdateKSopsRecipientGroup
+		ExpectedPath  string
+		ExpectedRules string
+	}{
+		{
+			Name:         "not generated",
+			Nodes:        []*yaml.RNode{existing},
+			ExpectedPath: "",
+		},
+		{
+			Name:         "new",
+			Generate:     true,
+			ExpectedPath: "envs/prod/.sops.yaml",
+			ExpectedRules: `# update-ksops-secrets: envs/prod/test
+- path_regex: ^generated/secrets\.password\.enc\.yaml$
+  encrypted_regex: ^(data|stringData)$
+  age: ` + testSopsAgeRecipient + `
+`,
+		},
+		{
+			Name:     "existing",
+			Nodes:    []*yaml.RNode{existing},
+			Generate: true,
+			Options: config.UpdateKSopsSopsOptions{
+				UnencryptedSuffix: "_plain",
+				ShamirThreshold:   1,
+			},
+			ExpectedPath: ".sops.yaml",
+			ExpectedRules: `# update-ksops-secrets: envs/prod/test
+- path_regex: ^envs/prod/generated/secrets\.password\.enc\.yaml$
+  unencrypted_regex: ^(apiVersion|kind|metadata|type)$|_plain$
+  shamir_threshold: 1
+  age: ` + testSopsAgeRecipient + `,manual
+- path_regex: ^envs/
+  age: manual
+`,
+		},
+		{
+			Name:         "commented",
+			Nodes:        []*yaml.RNode{commented},
+			Generate:     true,
+			ExpectedPath: ".sops.yaml",
+			ExpectedRules: `# update-ksops-secrets: envs/prod/test
+- path_regex: ^envs/prod/generated/secrets\.password\.enc\.yaml$
+  encrypted_regex: ^(data|stringData)$
+  age: ` + testSopsAgeRecipient + `
+`,
+		},
+		{
+			Name:     "key groups",
+			Generate: true,
+			Options:  config.UpdateKSopsSopsOptions{ShamirThreshold: 2},
+			Groups: []config.UpdateKSopsRecipientGroup{
+				{Name: "ops", Recipients: []config.UpdateKSopsRecipient{
+					{Type: "age", Recipient: testSopsAgeRecipient},
+				}},
+				{Name: "security", Recipients: []config.UpdateKSopsRecipient{
+					{Type: "age", Recipient: testSopsOtherAgeRecipient},
+					{Type: "pgp", Recipient: testSopsPGPRecipient},
+				}},
+			},
+			ExpectedPath: "envs/prod/.sops.yaml",
+			ExpectedRules: `# update-ksops-secrets: envs/prod/test
+- path_regex: ^generated/secrets\.password\.enc\.yaml$
+  encrypted_regex: ^(data|stringData)$
+  shamir_threshold: 2
+  key_groups:
+  - age:
+    - ` + testSopsAgeRecipient + `
+  - age:
+    - ` + testSopsOtherAgeRecipient + `
+    pgp:
+    - ` + testSopsPGPRecipient + `
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			uksConfig := uksConfigSopsConfig("envs/prod")
+			uksConfig.Secret.Items = []config.UpdateKSopsSecretItem{{Key: "password"}}
+			uksConfig.Sops = tc.Options
+			uksConfig.SopsConfig.Generate = tc.Generate
+			if tc.Groups != nil {
+				uksConfig.Recipients = nil
+				uksConfig.RecipientGroups = tc.Groups
+			}
+
+			gen := &KSopsGenerator{Dir: "envs/prod"}
+			nodes, results := gen.GenerateSopsConfig(tc.Nodes,
+				[]*config.UpdateKSopsSecrets{uksConfig})
+			if results.ExitCode() != 0 {
+				t.Fatalf("Unexpected results: %s", results.Error())
+			}
+
+			if tc.ExpectedPath == "" {
+				if len(nodes) != 0 {
+					t.Errorf("Expect no nodes, got %v", nodes)
+				}
+				return
+			}
+
+			if len(nodes) != 1 {
+				t.Fatalf("Expect 1 node, got %d", len(nodes))
+			}
+
+			nodePath, _, _ := kioutil.GetFileAnnotations(nodes[0])
+			if nodePath != tc.ExpectedPath {
+				t.Errorf("Expect path %s, got %s", tc.ExpectedPath, nodePath)
+			}
+
+			rules, err := nodes[0].Pipe(yaml.Lookup("creation_rules"))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if got := rules.MustString(); got != tc.ExpectedRules {
+				t.Errorf("Expect rules\n%s\ngot\n%s", tc.ExpectedRules, got)
+			}
+		})
+	}
+}
+
+func TestNewSopsCreationRuleNodeSSH(t *testing.T) {
+	sshRecipient := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILqk4EhAuCsl8EwxgLLug+O0Eo6GdZnpSCJfU76iFNND"
+
+	n, err := NewSopsCreationRuleNode("generated/secrets.test.enc.yaml", config.UpdateKSopsSopsOptions{},
+		config.UpdateKSopsRecipient{Type: "age", Recipient: testSopsAgeRecipient},
+		config.UpdateKSopsRecipient{Type: "ssh", Recipient: sshRecipient},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The ssh public keys are the age recipients of SOPS
+	expected := testSopsAgeRecipient + "," + sshRecipient
+	if age := n.Field("age"); age == nil || age.Value.YNode().Value != expected {
+		t.Errorf("Expected age %s, got\n%s", expected, n.MustString())
+	}
+
+	if ssh := n.Field("ssh"); ssh != nil {
+		t.Errorf("Expected no ssh field, got\n%s", n.MustString())
+	}
+}
+
+func TestNewSopsCreationRuleNodeVault(t *testing.T) {
+	recipients := []config.UpdateKSopsRecipient{
+		{Type: "age", Recipient: testSopsAgeRecipient},
+		{Type: "vault", Recipient: "transit/keys/sops"},
+	}
+
+	t.Setenv(config.VaultAddressEnv, "")
+	if _, err := NewSopsCreationRuleNode("generated/secrets.test.enc.yaml", config.UpdateKSopsSopsOptions{},
+		recipients...); err == nil {
+		t.Errorf("Expect error without the %s, got none", config.VaultAddressEnv)
+	}
+
+	t.Setenv(config.VaultAddressEnv, "https://vault.example.com:8200/")
+	n, err := NewSopsCreationRuleNode("generated/secrets.test.enc.yaml", config.UpdateKSopsSopsOptions{},
+		recipients...)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := "https://vault.example.com:8200/v1/transit/keys/sops"
+	if uri := n.Field("hc_vault_transit_uri"); uri == nil || uri.Value.YNode().Value != expected {
+		t.Errorf("Expected hc_vault_transit_uri %s, got\n%s", expected, n.MustString())
+	}
+}
+
+func TestNewSopsCreationRuleNodeKeyService(t *testing.T) {
+	kmsARN := "arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+	kmsRoleARN := "arn:aws:iam::123456789012:role/sops"
+	gcpKMSKey := "projects/test/locations/global/keyRings/sops/cryptoKeys/sops"
+	azureKVKey := "https://sops.vault.azure.net/keys/sops/0123456789abcdef"
+
+	n, err := NewSopsCreationRuleNode("generated/secrets.test.enc.yaml", config.UpdateKSopsSopsOptions{},
+		config.UpdateKSopsRecipient{Type: "awskms", Recipient: kmsARN + "+" + kmsRoleARN},
+		config.UpdateKSopsRecipient{Type: "gcpkms", Recipient: gcpKMSKey},
+		config.UpdateKSopsRecipient{Type: "azurekv", Recipient: azureKVKey, KeyGroup: 1},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The cloud KMS keys of the key groups are the mappings
+	for _, expected := range []struct {
+		path  []string
+		value string
+	}{
+		{[]string{"key_groups", "0", "kms", "0", "arn"}, kmsARN},
+		{[]string{"key_groups", "0", "kms", "0", "role"}, kmsRoleARN},
+		{[]string{"key_groups", "0", "gcp_kms", "0", "resource_id"}, gcpKMSKey},
+		{[]string{"key_groups", "1", "azure_keyvault", "0", "vaultUrl"}, "https://sops.vault.azure.net"},
+		{[]string{"key_groups", "1", "azure_keyvault", "0", "key"}, "sops"},
+		{[]string{"key_groups", "1", "azure_keyvault", "0", "version"}, "0123456789abcdef"},
+	} {
+		if v, err := n.Pipe(yaml.Lookup(expected.path...)); err != nil || v == nil || v.YNode().Value != expected.value {
+			t.Errorf("Expected %s %s, got\n%s", strings.Join(expected.path, "."), expected.value, n.MustString())
+		}
+	}
+
+	n, err = NewSopsCreationRuleNode("generated/secrets.test.enc.yaml", config.UpdateKSopsSopsOptions{},
+		config.UpdateKSopsRecipient{Type: "gcpkms", Recipient: gcpKMSKey},
+		config.UpdateKSopsRecipient{Type: "azurekv", Recipient: azureKVKey},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if v := n.Field("gcp_kms"); v == nil || v.Value.YNode().Value != gcpKMSKey {
+		t.Errorf("Expected gcp_kms %s, got\n%s", gcpKMSKey, n.MustString())
+	}
+
+	if v := n.Field("azure_keyvault"); v == nil || v.Value.YNode().Value != azureKVKey {
+		t.Errorf("Expected azure_keyvault %s, got\n%s", azureKVKey, n.MustString())
+	}
+}
+
+func TestPruneSopsConfig(t *testing.T) {
+	existing := yaml.MustParse(`
+creation_rules:
+  # update-ksops-secrets: envs/prod/test
+  - path_regex: ^envs/prod/generated/secrets\.password\.enc\.yaml$
+    age: ` + testSopsAgeRecipient + `
+  # update-ksops-secrets: envs/prod/removed
+  - path_regex: ^envs/prod/generated/secrets\.removed\.enc\.yaml$
+    age: ` + testSopsAgeRecipient + `
+  # update-ksops-secrets: envs/old/test
+  - path_regex: ^envs/old/generated/secrets\.password\.enc\.yaml$
+    age: ` + testSopsAgeRecipient + `
+  - path_regex: ^envs/
+    age: manual
+metadata:
+  annotations:
+    internal.config.kubernetes.io/path: .sops.yaml
+`)
+
+	testCases := []struct {
+		Name          string
+		Generate      bool
+		ExpectedRules string
+	}{
+		{
+			Name:     "removed configs",
+			Generate: true,
+			ExpectedRules: `# update-ksops-secrets: envs/prod/test
+- path_regex: ^envs/prod/generated/secrets\.password\.enc\.yaml$
+  age: ` + testSopsAgeRecipient + `
+- path_regex: ^envs/
+  age: manual
+`,
+		},
+		{
+			Name: "not generated",
+			ExpectedRules: `- path_regex: ^envs/
+  age: manual
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			uksConfig := uksConfigSopsConfig("envs/prod")
+			uksConfig.SopsConfig.Generate = tc.Generate
+
+			nodes, results := PruneSopsConfig([]*yaml.RNode{existing},
+				[]*config.UpdateKSopsSecrets{uksConfig})
+			if results.ExitCode() != 0 {
+				t.Fatalf("Unexpected results: %s", results.Error())
+			}
+
+			if len(nodes) != 1 {
+				t.Fatalf("Expect 1 node, got %d", len(nodes))
+			}
+
+			rules, err := nodes[0].Pipe(yaml.Lookup("creation_rules"))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if got := rules.MustString(); got != tc.ExpectedRules {
+				t.Errorf("Expect rules\n%s\ngot\n%s", tc.ExpectedRules, got)
+			}
+		})
+	}
+
+	t.Run("up to date", func(t *testing.T) {
+		nodes, _ := PruneSopsConfig([]*yaml.RNode{yaml.MustParse(`
+creation_rules:
+  - path_regex: ^envs/
+    age: manual
+metadata:
+  annotations:
+    internal.config.kubernetes.io/path: .sops.yaml
+`)}, []*config.UpdateKSopsSecrets{uksConfigSopsConfig("envs/prod")})
+		if len(nodes) != 0 {
+			t.Errorf("Expect no nodes, got %v", nodes)
+		}
+	})
+}
@@ -0,0 +1,190 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// dotenvEntry is the KEY=VALUE line of the dotenv file with the comment
+// lines preceding it
+type dotenvEntry struct {
+	key, value, comment string
+}
+
+// GenerateSecretSources reads the files of the SecretSource resources into
+// the Secrets of the same names, they are looked up as the references but
+// never written to the package. The files are read from the package files
+// only if they hold the resources at their package paths
+func (g *KSopsGenerator) GenerateSecretSources(nodes []*yaml.RNode) (secrets []*yaml.RNode, results framework.Results) {
+	fsys := g.packageFS(nodes)
+	for _, ko := range kubeObjects(nodes).Where(config.IsSecretSource) {
+		source, err := config.LoadSecretSource(ko)
+		if err != nil {
+			var loadResults framework.Results
+			if !errors.As(err, &loadResults) {
+				loadResults = framework.Results{{Message: err.Error(), Severity: framework.Error}}
+			}
+			results = append(results, loadResults...)
+			continue
+		}
+
+		dir := path.Dir(ko.PathAnnotation())
+		secret, err := readSecretSource(fsys, ko.GetName(), dir, source)
+		if err != nil {
+			results = append(results, &framework.Result{
+				Message:  fmt.Sprintf("SecretSource '%s' read error, %s", ko.GetName(), err),
+				Severity: framework.Error,
+			})
+			continue
+		}
+
+		if err := secret.PipeE(yaml.SetAnnotation(kioutil.PathAnnotation, ko.PathAnnotation())); err != nil {
+			results = append(results, &framework.Result{
+				Message:  fmt.Sprintf("SecretSource '%s' error, %s", ko.GetName(), err),
+				Severity: framework.Error,
+			})
+			continue
+		}
+
+		secrets = append(secrets, secret)
+	}
+
+	return secrets, results
+}
+
+// readSecretSource reads the dotenv files into the stringData and the plain
+// files into the data of the Secret, the files are relative to the dir
+func readSecretSource(fsys fs.FS, name, dir string, source *config.SecretSource) (*yaml.RNode, error) {
+	if fsys == nil {
+		return nil, fmt.Errorf("the files could not be read, %w", errPackageFilesUnavailable)
+	}
+
+	keys := map[string]string{}
+	addKey := func(key, file string) error {
+		if first, found := keys[key]; found {
+			return fmt.Errorf("the key '%s' of the file '%s' is duplicated in '%s'", key, file, first)
+		}
+
+		keys[key] = file
+		return nil
+	}
+
+	stringData := yaml.NewMapRNode(nil)
+	for _, env := range source.Envs {
+		file := path.Join(dir, env)
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, fmt.Errorf("the file '%s' read error: %w", file, err)
+		}
+
+		entries, err := parseDotenv(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("the file '%s' %w", file, err)
+		}
+
+		for _, entry := range entries {
+			if err := addKey(entry.key, file); err != nil {
+				return nil, err
+			}
+
+			stringData.YNode().Content = append(stringData.YNode().Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Value: entry.key, HeadComment: entry.comment},
+				yaml.NewStringRNode(entry.value).YNode())
+		}
+	}
+
+	data := yaml.NewMapRNode(nil)
+	for _, f := range source.Files {
+		key, filename := config.ParseSecretSourceFile(f)
+		file := path.Join(dir, filename)
+		value, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, fmt.Errorf("the file '%s' read error: %w", file, err)
+		}
+
+		if err := addKey(key, file); err != nil {
+			return nil, err
+		}
+
+		if err := data.PipeE(yaml.SetField(key, yaml.NewStringRNode(encodeValue(string(value))))); err != nil {
+			return nil, err
+		}
+	}
+
+	n := yaml.MustParse(`
+apiVersion: v1
+kind: Secret
+type: Opaque
+`)
+
+	if err := n.SetName(name); err != nil {
+		return nil, err
+	}
+
+	if len(stringData.YNode().Content) > 0 {
+		if err := n.PipeE(yaml.SetField("stringData", stringData)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(data.YNode().Content) > 0 {
+		if err := n.PipeE(yaml.SetField("data", data)); err != nil {
+			return nil, err
+		}
+	}
+
+	return n, nil
+}
+
+// parseDotenv parses the KEY=VALUE lines as the kustomize envs, the value is
+// taken as is without the quotes removal or the variables expansion, and the
+// comment lines preceding the key are kept for the encryptedCommentRegex. The
+// errors refer to the line number only, the line could hold the value
+func parseDotenv(data string) (entries []dotenvEntry, err error) {
+	var comments []string
+	seen := map[string]bool{}
+
+	for i, line := range strings.Split(strings.TrimPrefix(data, "\ufeff"), "\n") {
+		line = strings.TrimLeftFunc(strings.TrimSuffix(line, "\r"), unicode.IsSpace)
+
+		switch {
+		case line == "":
+			comments = nil
+			continue
+		case strings.HasPrefix(line, "#"):
+			comments = append(comments, line)
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("line %d is not KEY=VALUE", i+1)
+		}
+
+		if !config.IsSecretSourceKey(key) {
+			return nil, fmt.Errorf("line %d key is invalid", i+1)
+		}
+
+		if seen[key] {
+			return nil, fmt.Errorf("line %d key '%s' is duplicated", i+1, key)
+		}
+
+		seen[key] = true
+		entries = append(entries, dotenvEntry{key: key, value: value, comment: strings.Join(comments, "\n")})
+		comments = nil
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,256 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package generator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+func TestParseDotenv(t *testing.T) {
+	testCases := []struct {
+		Name            string
+		Data            string
+		ExpectedEntries []dotenvEntry
+		ExpectedError   string
+	}{
+		{
+			Name: "entries with comments",
+			Data: "\ufeff# database\n# sops:enc\nDB_PASSWORD=pa=ss\n\n# unrelated\n\n  DB_HOST=db\r\nEMPTY=\nQUOTED=\"value\"\n",
+			ExpectedEntries: []dotenvEntry{
+				{key: "DB_PASSWORD", value: "pa=ss", comment: "# database\n# sops:enc"},
+				{key: "DB_HOST", value: "db"},
+				{key: "EMPTY", value: ""},
+				{key: "QUOTED", value: `"value"`},
+			},
+		},
+		{
+			Name:          "not key value",
+			Data:          "DB_HOST=db\nsecret-value\n",
+			ExpectedError: "line 2 is not KEY=VALUE",
+		},
+		{
+			Name:          "invalid key",
+			Data:          "DB HOST=db\n",
+			ExpectedError: "line 1 key is invalid",
+		},
+		{
+			Name:          "duplicate key",
+			Data:          "DB_HOST=db\nDB_HOST=other\n",
+			ExpectedError: "line 2 key 'DB_HOST' is duplicated",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			entries, err := parseDotenv(tc.Data)
+			if tc.ExpectedError != "" {
+				if err == nil || err.Error() != tc.ExpectedError {
+					t.Fatalf("Expect error %q, got %v", tc.ExpectedError, err)
+				}
+
+				if strings.Contains(err.Error(), "secret-value") {
+					t.Errorf("Expect the value not in the error, got %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(entries, tc.ExpectedEntries) {
+				t.Errorf("Expect %#v, got %#v", tc.ExpectedEntries, entries)
+			}
+		})
+	}
+}
+
+func TestGenerateSecretSources(t *testing.T) {
+	nodes := []*yaml.RNode{yaml.MustParse(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: SecretSource
+metadata:
+  name: app-env
+  annotations:
+    config.kubernetes.io/local-config: "true"
+    internal.config.kubernetes.io/path: app/sources.yaml
+envs:
+  - .env
+files:
+  - config.txt
+  - tls.crt=certs/server.crt
+`)}
+
+	gen := &KSopsGenerator{
+		FS: fstest.MapFS{
+			"app/sources.yaml":     {Data: []byte("kind: SecretSource\n")},
+			"app/.env":             {Data: []byte("# sops:enc\nDB_PASSWORD=password\nDB_HOST=db\n")},
+			"app/config.txt":       {Data: []byte("config.txt\n")},
+			"app/certs/server.crt": {Data: []byte("certificate")},
+		},
+	}
+
+	secrets, results := gen.GenerateSecretSources(nodes)
+	if results.ExitCode() != 0 {
+		t.Fatalf("Unexpected results: %v", results)
+	}
+
+	uksConfig := &config.UpdateKSopsSecrets{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "sources",
+		},
+		Secret: config.UpdateKSopsSecretSpec{
+			References: []string{"app-env"},
+		},
+	}
+
+	secretRef := newSecretReference(secrets, uksConfig)
+
+	testCases := []struct {
+		Key                string
+		ExpectedValue      string
+		ExpectedB64Encoded bool
+	}{
+		{Key: "DB_PASSWORD", ExpectedValue: "password"},
+		{Key: "DB_HOST", ExpectedValue: "db"},
+		{Key: "config.txt", ExpectedValue: "Y29uZmlnLnR4dAo=", ExpectedB64Encoded: true},
+		{Key: "tls.crt", ExpectedValue: "Y2VydGlmaWNhdGU=", ExpectedB64Encoded: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Key, func(t *testing.T) {
+			value, b64encoded, err := secretRef.Get(tc.Key)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if value != tc.ExpectedValue || b64encoded != tc.ExpectedB64Encoded {
+				t.Errorf("Expect %v (%v), got %v (%v)", tc.ExpectedValue, tc.ExpectedB64Encoded, value, b64encoded)
+			}
+		})
+	}
+
+	if comment := secretRef.GetComment("app-env", "DB_PASSWORD"); comment != "# sops:enc" {
+		t.Errorf("Expect comment '# sops:enc', got '%s'", comment)
+	}
+
+	expectedKeys := []string{"DB_HOST", "DB_PASSWORD", "config.txt", "tls.crt"}
+	if keys, found := secretRef.GetKeys("app-env"); !found || !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("Expect keys %v, got %v", expectedKeys, keys)
+	}
+}
+
+func TestGenerateSecretSourcesErrors(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Source   string
+		Expected string
+	}{
+		{
+			Name: "missing file",
+			Source: `
+envs:
+  - .env.missing
+`,
+			Expected: "SecretSource 'app-env' read error, the file '.env.missing' read error",
+		},
+		{
+			Name: "duplicate keys of the files",
+			Source: `
+envs:
+  - .env
+files:
+  - DB_HOST=config.txt
+`,
+			Expected: "SecretSource 'app-env' read error, the key 'DB_HOST' of the file 'config.txt' is duplicated in '.env'",
+		},
+		{
+			Name: "invalid dotenv",
+			Source: `
+envs:
+  - config.txt
+`,
+			Expected: "SecretSource 'app-env' read error, the file 'config.txt' line 1 is not KEY=VALUE",
+		},
+		{
+			Name:     "no files",
+			Source:   "{}",
+			Expected: "envs or files must be set",
+		},
+		{
+			Name: "file outside the package",
+			Source: `
+envs:
+  - ../.env
+`,
+			Expected: "file '../.env' must be a path in the package",
+		},
+	}
+
+	gen := &KSopsGenerator{
+		FS: fstest.MapFS{
+			"sources.yaml": {Data: []byte("kind: SecretSource\n")},
+			".env":         {Data: []byte("DB_HOST=db\n")},
+			"config.txt":   {Data: []byte("config.txt\n")},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			n := yaml.MustParse(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: SecretSource
+metadata:
+  name: app-env
+  annotations:
+    internal.config.kubernetes.io/path: sources.yaml
+`)
+			source := yaml.MustParse(tc.Source)
+			for _, field := range []string{"envs", "files"} {
+				if value := source.Field(field); value != nil {
+					if err := n.PipeE(yaml.SetField(field, value.Value)); err != nil {
+						t.Fatalf("Unexpected error: %v", err)
+					}
+				}
+			}
+
+			_, results := gen.GenerateSecretSources([]*yaml.RNode{n})
+			if results.ExitCode() != 1 || !strings.Contains(results.Error(), tc.Expected) {
+				t.Errorf("Expect error results %q, got %v", tc.Expected, results)
+			}
+		})
+	}
+}
+
+func TestGenerateSecretSourcesWithoutPackageFiles(t *testing.T) {
+	nodes := []*yaml.RNode{yaml.MustParse(`
+apiVersion: fn.kpt.dev/v1alpha1
+kind: SecretSource
+metadata:
+  name: app-env
+  annotations:
+    internal.config.kubernetes.io/path: app/sources.yaml
+envs:
+  - .env
+`)}
+
+	// The files of another directory than the package are never read
+	gen := &KSopsGenerator{
+		FS: fstest.MapFS{
+			".env": {Data: []byte("DB_PASSWORD=password\n")},
+		},
+	}
+
+	_, results := gen.GenerateSecretSources(nodes)
+	if results.ExitCode() != 1 || !strings.Contains(results.Error(), errPackageFilesUnavailable.Error()) {
+		t.Errorf("Expect the package files unavailable error, got %v", results)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package sops
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+)
+
+// PGPKeyRing holds the PGP public keys parsed in-process without the gpg
+// keyring, the keys not imported are looked up by the fallback
+type PGPKeyRing struct {
+	keys     map[string]string
+	fallback PGPPublicKeyFunc
+}
+
+func NewPGPKeyRing(fallback PGPPublicKeyFunc) *PGPKeyRing {
+	return &PGPKeyRing{
+		keys:     map[string]string{},
+		fallback: fallback,
+	}
+}
+
+// Import parses the armored or binary public keys data of the fingerprint,
+// the data must hold the key of the fingerprint
+func (k *PGPKeyRing) Import(fingerprint, data string) error {
+	if err := verifyPGPKey(fingerprint, data); err != nil {
+		return err
+	}
+
+	k.keys[normalizeFingerprint(fingerprint)] = data
+	return nil
+}
+
+// PublicKey returns the imported public key data of the fingerprint, the
+// PGPPublicKeyFunc of the encryption
+func (k *PGPKeyRing) PublicKey(fingerprint string) (string, error) {
+	if data, found := k.keys[normalizeFingerprint(fingerprint)]; found {
+		return data, nil
+	}
+
+	if k.fallback == nil {
+		return "", fmt.Errorf("the PGP public key %s not imported", fingerprint)
+	}
+
+	return k.fallback(fingerprint)
+}
+
+// ValidatePGPKey confirms the public keys data holds the key of the full
+// fingerprint, neither expired nor revoked at the time, and the key could
+// encrypt by itself or with a subkey
+func ValidatePGPKey(fingerprint, data string, now time.Time) error {
+	if !config.IsPGPFingerprint(fingerprint) {
+		return fmt.Errorf("the PGP recipient %s must be the full 40 hex fingerprint", fingerprint)
+	}
+
+	entities, err := readPGPKeyRing(data)
+	if err != nil {
+		return fmt.Errorf("the PGP public key %s read error: %w", fingerprint, err)
+	}
+
+	id := normalizeFingerprint(fingerprint)
+	for _, entity := range entities {
+		if fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint) == id {
+			return validatePGPEntity(entity, nil, fingerprint, now)
+		}
+
+		for i := range entity.Subkeys {
+			if fmt.Sprintf("%X", entity.Subkeys[i].PublicKey.Fingerprint) == id {
+				return validatePGPEntity(entity, &entity.Subkeys[i], fingerprint, now)
+			}
+		}
+	}
+
+	return fmt.Errorf("the PGP public key %s fingerprint does not match the key data", fingerprint)
+}
+
+// validatePGPEntity checks the primary key, and the subkey of the
+// fingerprint if set, could encrypt at the time
+func validatePGPEntity(entity *openpgp.Entity, subkey *openpgp.Subkey, fingerprint string, now time.Time) error {
+	selfSignature, identity := entity.PrimarySelfSignature()
+	switch {
+	case selfSignature == nil:
+		return fmt.Errorf("the PGP public key %s has no valid self-signature", fingerprint)
+	case entity.Revoked(now) || (identity != nil && identity.Revoked(now)):
+		return fmt.Errorf("the PGP public key %s is revoked", fingerprint)
+	case entity.PrimaryKey.KeyExpired(selfSignature, now) || selfSignature.SigExpired(now):
+		return fmt.Errorf("the PGP public key %s is expired", fingerprint)
+	}
+
+	if subkey == nil {
+		if _, ok := entity.EncryptionKey(now); !ok {
+			return fmt.Errorf("the PGP public key %s has no valid encryption-capable key", fingerprint)
+		}
+
+		return nil
+	}
+
+	switch {
+	case subkey.Revoked(now):
+		return fmt.Errorf("the PGP public subkey %s is revoked", fingerprint)
+	case subkey.PublicKey.KeyExpired(subkey.Sig, now) || subkey.Sig.SigExpired(now):
+		return fmt.Errorf("the PGP public subkey %s is expired", fingerprint)
+	case !subkey.Sig.FlagsValid || !subkey.Sig.FlagEncryptCommunications ||
+		!subkey.PublicKey.PubKeyAlgo.CanEncrypt():
+		return fmt.Errorf("the PGP public subkey %s is not encryption-capable", fingerprint)
+	}
+
+	return nil
+}
+
+// readPGPKeyRing reads the ASCII-armored or the binary public keys
+func readPGPKeyRing(data string) (openpgp.EntityList, error) {
+	if strings.Contains(data, "-----BEGIN PGP") {
+		return openpgp.ReadArmoredKeyRing(strings.NewReader(data))
+	}
+
+	return openpgp.ReadKeyRing(strings.NewReader(data))
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToUpper(strings.ReplaceAll(fingerprint, " ", ""))
+}
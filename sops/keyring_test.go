@@ -0,0 +1,205 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package sops
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+)
+
+func TestPGPKeyRing(t *testing.T) {
+	entity, err := openpgp.NewEntity("test", "", "test@example.com",
+		&packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	fingerprint := fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+
+	var binary bytes.Buffer
+	if err := entity.Serialize(&binary); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	fallback := func(fp string) (string, error) {
+		return "", fmt.Errorf("the GPG public key %s not found", fp)
+	}
+
+	testCases := []struct {
+		Name         string
+		Fingerprint  string
+		Data         string
+		ExpectsError bool
+	}{
+		{
+			Name:        "armored",
+			Fingerprint: fingerprint,
+			Data:        armoredPublicKey(t, entity),
+		},
+		{
+			Name:        "binary",
+			Fingerprint: fingerprint,
+			Data:        binary.String(),
+		},
+		{
+			Name:         "fingerprint mismatch",
+			Fingerprint:  "380024A2AC1D3EBC9402BEE66E38309B4DA30118",
+			Data:         armoredPublicKey(t, entity),
+			ExpectsError: true,
+		},
+		{
+			Name:         "invalid data",
+			Fingerprint:  fingerprint,
+			Data:         "OK",
+			ExpectsError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			keyRing := NewPGPKeyRing(fallback)
+			err := keyRing.Import(tc.Fingerprint, tc.Data)
+			if tc.ExpectsError {
+				if err == nil {
+					t.Errorf("Expect error, got none")
+				}
+
+				if _, err := keyRing.PublicKey(tc.Fingerprint); err == nil {
+					t.Errorf("Expect the fallback error, got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			encryptor := NewSopsEncryption(keyRing.PublicKey)
+			if _, err := encryptor.Encrypt(testSecret, config.UpdateKSopsSopsOptions{}, config.UpdateKSopsRecipient{
+				Type:      "pgp",
+				Recipient: tc.Fingerprint,
+			}); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidatePGPKey(t *testing.T) {
+	now := time.Now()
+
+	valid, fingerprint := testPGPEntity(t, "valid@example.com")
+	subkeyFingerprint := fmt.Sprintf("%X", valid.Subkeys[0].PublicKey.Fingerprint)
+
+	expiring, err := openpgp.NewEntity("test", "", "expired@example.com",
+		&packet.Config{Algorithm: packet.PubKeyAlgoEdDSA, KeyLifetimeSecs: 3600})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	revoked, revokedFingerprint := testPGPEntity(t, "revoked@example.com")
+	if err := revoked.RevokeKey(packet.KeyCompromised, "", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	revokedSubkey, _ := testPGPEntity(t, "revoked-subkey@example.com")
+	if err := revokedSubkey.RevokeSubkey(&revokedSubkey.Subkeys[0], packet.KeyCompromised, "", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	signOnly, signOnlyFingerprint := testPGPEntity(t, "sign-only@example.com")
+	signOnly.Subkeys = nil
+
+	testCases := []struct {
+		Name          string
+		Fingerprint   string
+		Data          string
+		Now           time.Time
+		ExpectedError string
+	}{
+		{
+			Name:        "primary key",
+			Fingerprint: fingerprint,
+			Data:        armoredPublicKey(t, valid),
+			Now:         now,
+		},
+		{
+			Name:        "lower case fingerprint",
+			Fingerprint: strings.ToLower(fingerprint),
+			Data:        armoredPublicKey(t, valid),
+			Now:         now,
+		},
+		{
+			Name:        "encryption subkey",
+			Fingerprint: subkeyFingerprint,
+			Data:        armoredPublicKey(t, valid),
+			Now:         now,
+		},
+		{
+			Name:          "long key id",
+			Fingerprint:   fingerprint[24:],
+			Data:          armoredPublicKey(t, valid),
+			Now:           now,
+			ExpectedError: fmt.Sprintf("the PGP recipient %s must be the full 40 hex fingerprint", fingerprint[24:]),
+		},
+		{
+			Name:          "fingerprint mismatch",
+			Fingerprint:   revokedFingerprint,
+			Data:          armoredPublicKey(t, valid),
+			Now:           now,
+			ExpectedError: fmt.Sprintf("the PGP public key %s fingerprint does not match the key data", revokedFingerprint),
+		},
+		{
+			Name:          "expired",
+			Fingerprint:   fmt.Sprintf("%X", expiring.PrimaryKey.Fingerprint),
+			Data:          armoredPublicKey(t, expiring),
+			Now:           now.Add(2 * time.Hour),
+			ExpectedError: fmt.Sprintf("the PGP public key %X is expired", expiring.PrimaryKey.Fingerprint),
+		},
+		{
+			Name:          "revoked",
+			Fingerprint:   revokedFingerprint,
+			Data:          armoredPublicKey(t, revoked),
+			Now:           now,
+			ExpectedError: fmt.Sprintf("the PGP public key %s is revoked", revokedFingerprint),
+		},
+		{
+			Name:          "revoked subkey",
+			Fingerprint:   fmt.Sprintf("%X", revokedSubkey.Subkeys[0].PublicKey.Fingerprint),
+			Data:          armoredPublicKey(t, revokedSubkey),
+			Now:           now,
+			ExpectedError: fmt.Sprintf("the PGP public subkey %X is revoked", revokedSubkey.Subkeys[0].PublicKey.Fingerprint),
+		},
+		{
+			Name:          "no encryption-capable key",
+			Fingerprint:   signOnlyFingerprint,
+			Data:          armoredPublicKey(t, signOnly),
+			Now:           now,
+			ExpectedError: fmt.Sprintf("the PGP public key %s has no valid encryption-capable key", signOnlyFingerprint),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := ValidatePGPKey(tc.Fingerprint, tc.Data, tc.Now)
+			if tc.ExpectedError == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || err.Error() != tc.ExpectedError {
+				t.Errorf("Expected error %s, got %v", tc.ExpectedError, err)
+			}
+		})
+	}
+}
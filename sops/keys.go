@@ -0,0 +1,135 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package sops
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	ageArmor "filippo.io/age/armor"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgpArmor "github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// encryptAge encrypts the data key to the age or the ssh recipient as the
+// armored file
+func encryptAge(dataKey []byte, recipient string) (string, error) {
+	ageRecipient, err := parseAgeRecipient(recipient)
+	if err != nil {
+		return "", err
+	}
+
+	var buffer bytes.Buffer
+
+	armorWriter := ageArmor.NewWriter(&buffer)
+	w, err := age.Encrypt(armorWriter, ageRecipient)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := w.Write(dataKey); err != nil {
+		return "", err
+	}
+
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	if err := armorWriter.Close(); err != nil {
+		return "", err
+	}
+
+	return withTrailingNewline(buffer.String()), nil
+}
+
+// parseAgeRecipient parses the age X25519 or the ssh-ed25519 and ssh-rsa
+// public key recipients, the same as SOPS does
+func parseAgeRecipient(recipient string) (age.Recipient, error) {
+	if strings.HasPrefix(recipient, "ssh-") {
+		return agessh.ParseRecipient(recipient)
+	}
+
+	return age.ParseX25519Recipient(recipient)
+}
+
+// encryptPGP encrypts the data key to the PGP recipient as the armored message
+func (s *sops) encryptPGP(dataKey []byte, fingerprint string) (string, error) {
+	if s.pgpPublicKey == nil {
+		return "", fmt.Errorf("no PGP public keys available")
+	}
+
+	data, err := s.pgpPublicKey(fingerprint)
+	if err != nil {
+		return "", err
+	}
+
+	entities, err := readPGPKeyRing(data)
+	if err != nil {
+		return "", fmt.Errorf("the PGP public key read error: %w", err)
+	}
+
+	entity := findPGPEntity(entities, fingerprint)
+	if entity == nil {
+		return "", fmt.Errorf("the PGP public key %s not found", fingerprint)
+	}
+
+	var buffer bytes.Buffer
+
+	armorWriter, err := pgpArmor.Encode(&buffer, "PGP MESSAGE", nil)
+	if err != nil {
+		return "", err
+	}
+
+	w, err := openpgp.Encrypt(armorWriter, []*openpgp.Entity{entity}, nil,
+		&openpgp.FileHints{IsBinary: true}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := w.Write(dataKey); err != nil {
+		return "", err
+	}
+
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	if err := armorWriter.Close(); err != nil {
+		return "", err
+	}
+
+	return withTrailingNewline(buffer.String()), nil
+}
+
+// withTrailingNewline terminates the armored block with a single newline
+func withTrailingNewline(armored string) string {
+	return strings.TrimRight(armored, "\n") + "\n"
+}
+
+// findPGPEntity finds the key by the fingerprint or the key id of the
+// primary key or its subkeys
+func findPGPEntity(entities openpgp.EntityList, fingerprint string) *openpgp.Entity {
+	id := normalizeFingerprint(fingerprint)
+
+	for _, entity := range entities {
+		if matchPGPFingerprint(entity.PrimaryKey.Fingerprint, id) {
+			return entity
+		}
+
+		for _, subkey := range entity.Subkeys {
+			if matchPGPFingerprint(subkey.PublicKey.Fingerprint, id) {
+				return entity
+			}
+		}
+	}
+
+	return nil
+}
+
+func matchPGPFingerprint(fingerprint []byte, id string) bool {
+	return id != "" && strings.HasSuffix(fmt.Sprintf("%X", fingerprint), id)
+}
@@ -0,0 +1,190 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package sops
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	hkpDefaultPort        = "11371"
+	pgpKeyFetchTimeout    = 30 * time.Second
+	maxPGPKeyDataSize     = 1 << 20
+	zbase32Alphabet       = "ybndrfg8ejkmcpqxot1uwisza345h769"
+	wkdWellKnownDirectory = ".well-known/openpgpkey"
+)
+
+// PGPKeyFetcher fetches the PGP public keys from the HKP/HKPS keyservers and
+// the Web Key Directory, the fetched keys are pinned to the fingerprint
+type PGPKeyFetcher struct {
+	client *http.Client
+}
+
+// NewPGPKeyFetcher creates the fetcher of the HTTP client, a client with the
+// default timeout is used if nil
+func NewPGPKeyFetcher(client *http.Client) *PGPKeyFetcher {
+	if client == nil {
+		client = &http.Client{Timeout: pgpKeyFetchTimeout}
+	}
+
+	return &PGPKeyFetcher{client: client}
+}
+
+// FetchHKP fetches the key of the fingerprint from the keyserver, the hkp and
+// hkps schemes are mapped to the http and https ones
+func (f *PGPKeyFetcher) FetchHKP(keyserver, fingerprint string) (string, error) {
+	lookup, err := hkpLookupURL(keyserver, fingerprint)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := f.get(lookup)
+	if err != nil {
+		return "", fmt.Errorf("the PGP public key %s fetch error from the keyserver %s: %w",
+			fingerprint, keyserver, err)
+	}
+
+	if err := verifyPGPKey(fingerprint, data); err != nil {
+		return "", fmt.Errorf("%w, the keyserver %s", err, keyserver)
+	}
+
+	return data, nil
+}
+
+// FetchWKD fetches the key of the fingerprint from the Web Key Directory of
+// the email, the advanced method is tried before the direct one
+func (f *PGPKeyFetcher) FetchWKD(email, fingerprint string) (string, error) {
+	lookups, err := wkdLookupURLs(email)
+	if err != nil {
+		return "", err
+	}
+
+	var errs []string
+	for _, lookup := range lookups {
+		data, err := f.get(lookup)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		if err := verifyPGPKey(fingerprint, data); err != nil {
+			return "", fmt.Errorf("%w, the WKD of %s", err, email)
+		}
+
+		return data, nil
+	}
+
+	return "", fmt.Errorf("the PGP public key %s fetch error from the WKD of %s: %s",
+		fingerprint, email, strings.Join(errs, "; "))
+}
+
+func (f *PGPKeyFetcher) get(lookup string) (string, error) {
+	resp, err := f.client.Get(lookup)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", lookup, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPGPKeyDataSize))
+	if err != nil {
+		return "", fmt.Errorf("%s read error: %w", lookup, err)
+	}
+
+	return string(data), nil
+}
+
+// verifyPGPKey pins the public keys data to the fingerprint, the data must
+// hold the key of the fingerprint
+func verifyPGPKey(fingerprint, data string) error {
+	entities, err := readPGPKeyRing(data)
+	if err != nil {
+		return fmt.Errorf("the PGP public key %s read error: %w", fingerprint, err)
+	}
+
+	if findPGPEntity(entities, fingerprint) == nil {
+		return fmt.Errorf("the PGP public key %s not found in the key data", fingerprint)
+	}
+
+	return nil
+}
+
+func hkpLookupURL(keyserver, fingerprint string) (string, error) {
+	u, err := url.Parse(keyserver)
+	if err != nil {
+		return "", fmt.Errorf("the keyserver %s is invalid: %w", keyserver, err)
+	}
+
+	switch u.Scheme {
+	case "hkp":
+		u.Scheme = "http"
+		if u.Port() == "" {
+			u.Host = u.Host + ":" + hkpDefaultPort
+		}
+	case "hkps":
+		u.Scheme = "https"
+	case "http", "https":
+	default:
+		return "", fmt.Errorf("the keyserver %s scheme must be one of hkp, hkps, http and https", keyserver)
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/pks/lookup"
+	u.RawQuery = url.Values{
+		"op":      {"get"},
+		"options": {"mr"},
+		"search":  {"0x" + normalizeFingerprint(fingerprint)},
+	}.Encode()
+
+	return u.String(), nil
+}
+
+// wkdLookupURLs returns the advanced and the direct method URLs of the email
+func wkdLookupURLs(email string) ([]string, error) {
+	local, domain, found := strings.Cut(email, "@")
+	if !found || local == "" || domain == "" || strings.Contains(domain, "@") {
+		return nil, fmt.Errorf("the WKD email %s is invalid", email)
+	}
+
+	domain = strings.ToLower(domain)
+	// The WKD hashed user part is defined as the SHA-1 of the local part
+	hash := sha1.Sum([]byte(strings.ToLower(local)))
+	hu := zbase32Encode(hash[:])
+	query := url.Values{"l": {local}}.Encode()
+
+	return []string{
+		fmt.Sprintf("https://openpgpkey.%s/%s/%s/hu/%s?%s", domain, wkdWellKnownDirectory, domain, hu, query),
+		fmt.Sprintf("https://%s/%s/hu/%s?%s", domain, wkdWellKnownDirectory, hu, query),
+	}, nil
+}
+
+// zbase32Encode encodes the data with the z-base-32 human-oriented alphabet
+func zbase32Encode(data []byte) string {
+	var sb strings.Builder
+
+	buffer, bits := 0, 0
+	for _, b := range data {
+		buffer = buffer<<8 | int(b)
+		bits += 8
+
+		for bits >= 5 {
+			bits -= 5
+			sb.WriteByte(zbase32Alphabet[(buffer>>bits)&0x1f])
+		}
+	}
+
+	if bits > 0 {
+		sb.WriteByte(zbase32Alphabet[(buffer<<(5-bits))&0x1f])
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,222 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package sops
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+func testPGPEntity(t *testing.T, email string) (*openpgp.Entity, string) {
+	t.Helper()
+
+	entity, err := openpgp.NewEntity("test", "", email,
+		&packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	return entity, fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+}
+
+func TestWKDLookupURLs(t *testing.T) {
+	// The example of the OpenPGP Web Key Directory draft
+	lookups, err := wkdLookupURLs("Joe.Doe@Example.ORG")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"https://openpgpkey.example.org/.well-known/openpgpkey/example.org/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe",
+		"https://example.org/.well-known/openpgpkey/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe",
+	}
+
+	for i := range expected {
+		if lookups[i] != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], lookups[i])
+		}
+	}
+
+	if _, err := wkdLookupURLs("example.org"); err == nil {
+		t.Errorf("Expect error, got none")
+	}
+}
+
+func TestFetchHKP(t *testing.T) {
+	entity, fingerprint := testPGPEntity(t, "alice@example.com")
+	_, otherFingerprint := testPGPEntity(t, "bob@example.com")
+	armored := armoredPublicKey(t, entity)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pks/lookup" || r.URL.Query().Get("op") != "get" {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.URL.Query().Get("search") {
+		case "0x" + fingerprint:
+			fmt.Fprint(w, armored)
+		case "0x" + otherFingerprint:
+			// A compromised keyserver serves the other key
+			fmt.Fprint(w, armored)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		Name         string
+		Keyserver    string
+		Fingerprint  string
+		ExpectsError bool
+	}{
+		{
+			Name:        "key found",
+			Keyserver:   server.URL,
+			Fingerprint: fingerprint,
+		},
+		{
+			Name:         "fingerprint mismatch",
+			Keyserver:    server.URL,
+			Fingerprint:  otherFingerprint,
+			ExpectsError: true,
+		},
+		{
+			Name:         "key not found",
+			Keyserver:    server.URL,
+			Fingerprint:  "380024A2AC1D3EBC9402BEE66E38309B4DA30118",
+			ExpectsError: true,
+		},
+		{
+			Name:         "invalid scheme",
+			Keyserver:    "ldap://keys.example.com",
+			Fingerprint:  fingerprint,
+			ExpectsError: true,
+		},
+	}
+
+	fetcher := NewPGPKeyFetcher(server.Client())
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			data, err := fetcher.FetchHKP(tc.Keyserver, tc.Fingerprint)
+			if tc.ExpectsError {
+				if err == nil {
+					t.Errorf("Expect error, got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if data != armored {
+				t.Errorf("Expected the armored key, got %s", data)
+			}
+		})
+	}
+}
+
+func TestFetchWKD(t *testing.T) {
+	alice, aliceFingerprint := testPGPEntity(t, "alice@example.com")
+	bob, bobFingerprint := testPGPEntity(t, "bob@example.com")
+
+	var aliceKey, bobKey bytes.Buffer
+	if err := alice.Serialize(&aliceKey); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := bob.Serialize(&bobKey); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	aliceLookups, _ := wkdLookupURLs("alice@example.com")
+	bobLookups, _ := wkdLookupURLs("bob@example.com")
+
+	keys := map[string][]byte{
+		// The advanced method of the example.com
+		aliceLookups[0]: aliceKey.Bytes(),
+		// The direct method, the advanced one is not found
+		bobLookups[1]: bobKey.Bytes(),
+	}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, found := keys["https://"+r.Host+r.URL.RequestURI()]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	// All the WKD hosts are resolved to the stand-in server
+	client := server.Client()
+	transport := client.Transport.(*http.Transport)
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	}
+
+	testCases := []struct {
+		Name         string
+		Email        string
+		Fingerprint  string
+		ExpectsError bool
+	}{
+		{
+			Name:        "advanced method",
+			Email:       "alice@example.com",
+			Fingerprint: aliceFingerprint,
+		},
+		{
+			Name:        "direct method",
+			Email:       "bob@example.com",
+			Fingerprint: bobFingerprint,
+		},
+		{
+			Name:         "fingerprint mismatch",
+			Email:        "alice@example.com",
+			Fingerprint:  bobFingerprint,
+			ExpectsError: true,
+		},
+		{
+			Name:         "key not found",
+			Email:        "carol@example.com",
+			Fingerprint:  aliceFingerprint,
+			ExpectsError: true,
+		},
+	}
+
+	fetcher := NewPGPKeyFetcher(client)
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			data, err := fetcher.FetchWKD(tc.Email, tc.Fingerprint)
+			if tc.ExpectsError {
+				if err == nil {
+					t.Errorf("Expect error, got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			keyRing := NewPGPKeyRing(nil)
+			if err := keyRing.Import(tc.Fingerprint, data); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package sops
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	keyServiceRequestTimeout = 30 * time.Second
+	keyServiceEncryptMethod  = "/KeyService/Encrypt"
+	maxKeyServiceMessageSize = 1 << 20
+
+	// grpcMessageHeaderSize is the compressed flag and the message length
+	// prefix of the gRPC message
+	grpcMessageHeaderSize = 5
+)
+
+// The field numbers of the SOPS keyservice.proto Key message
+const (
+	keyServiceKMSKey           protowire.Number = 1
+	keyServiceGCPKMSKey        protowire.Number = 3
+	keyServiceAzureKeyVaultKey protowire.Number = 4
+)
+
+// keyService encrypts the data keys of the cloud KMS recipients with the SOPS
+// keyservices, the gRPC KeyService of the sops keyservice command is called
+// over the cleartext HTTP/2 as sops does
+type keyService struct {
+	endpoints []string
+	timeout   time.Duration
+}
+
+func newKeyService(endpoints []string) *keyService {
+	return &keyService{endpoints: endpoints, timeout: keyServiceRequestTimeout}
+}
+
+// encrypt wraps the data key by the first keyservice that succeeds, the
+// ciphertext is the encrypted data key of the metadata
+func (k *keyService) encrypt(dataKey []byte, recipient config.UpdateKSopsRecipient) (string, error) {
+	if len(k.endpoints) == 0 {
+		return "", fmt.Errorf("no keyservices to encrypt the %s recipient", recipient.Type)
+	}
+
+	key, err := keyServiceKey(recipient)
+	if err != nil {
+		return "", err
+	}
+
+	// EncryptRequest{key = 1, plaintext = 2}
+	var request []byte
+	request = protowire.AppendTag(request, 1, protowire.BytesType)
+	request = protowire.AppendBytes(request, key)
+	request = protowire.AppendTag(request, 2, protowire.BytesType)
+	request = protowire.AppendBytes(request, dataKey)
+
+	var errs []string
+	for _, endpoint := range k.endpoints {
+		response, err := k.call(endpoint, keyServiceEncryptMethod, request)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s %s", endpoint, err))
+			continue
+		}
+
+		// EncryptResponse{ciphertext = 1}
+		ciphertext, err := protoBytesField(response, 1)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s response error: %s", endpoint, err))
+			continue
+		}
+
+		return string(ciphertext), nil
+	}
+
+	return "", fmt.Errorf("the keyservices error: %s", strings.Join(errs, "; "))
+}
+
+// call invokes the unary gRPC method of the keyservice endpoint
+func (k *keyService) call(endpoint, method string, message []byte) ([]byte, error) {
+	network, address, err := config.ParseKeyservice(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, _, _ string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	authority := address
+	if network == "unix" {
+		authority = "localhost"
+	}
+
+	body := make([]byte, grpcMessageHeaderSize, grpcMessageHeaderSize+len(message))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(message)))
+	body = append(body, message...)
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+authority+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("request error: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	client := &http.Client{Transport: transport, Timeout: k.timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("returned %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxKeyServiceMessageSize))
+	if err != nil {
+		return nil, fmt.Errorf("response read error: %w", err)
+	}
+
+	// The status is in the headers of the trailers-only response
+	status, statusMessage := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, statusMessage = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+
+	if status != "0" {
+		if unescaped, err := url.PathUnescape(statusMessage); err == nil {
+			statusMessage = unescaped
+		}
+
+		return nil, fmt.Errorf("returned the gRPC status %s: %s", status, statusMessage)
+	}
+
+	if len(data) < grpcMessageHeaderSize || data[0] != 0 {
+		return nil, fmt.Errorf("returned an invalid gRPC message")
+	}
+
+	size := binary.BigEndian.Uint32(data[1:grpcMessageHeaderSize])
+	if int(size) != len(data)-grpcMessageHeaderSize {
+		return nil, fmt.Errorf("returned an invalid gRPC message length")
+	}
+
+	return data[grpcMessageHeaderSize:], nil
+}
+
+// keyServiceKey marshals the keyservice.proto Key message of the recipient
+func keyServiceKey(recipient config.UpdateKSopsRecipient) ([]byte, error) {
+	var number protowire.Number
+	var fields []string
+
+	switch recipient.Type {
+	case "awskms":
+		// KmsKey{arn = 1, role = 2}
+		arn, role, err := config.ParseAWSKMSKey(recipient.Recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		number, fields = keyServiceKMSKey, []string{arn, role}
+	case "gcpkms":
+		// GcpKmsKey{resource_id = 1}
+		resourceID, err := config.ParseGCPKMSKey(recipient.Recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		number, fields = keyServiceGCPKMSKey, []string{resourceID}
+	case "azurekv":
+		// AzureKeyVaultKey{vault_url = 1, name = 2, version = 3}
+		vaultURL, name, version, err := config.ParseAzureKeyVaultKey(recipient.Recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		number, fields = keyServiceAzureKeyVaultKey, []string{vaultURL, name, version}
+	default:
+		return nil, fmt.Errorf("the %s recipient is not encrypted by the keyservices", recipient.Type)
+	}
+
+	var message []byte
+	for i, field := range fields {
+		if field == "" {
+			continue
+		}
+
+		message = protowire.AppendTag(message, protowire.Number(i+1), protowire.BytesType)
+		message = protowire.AppendString(message, field)
+	}
+
+	key := protowire.AppendTag(nil, number, protowire.BytesType)
+	return protowire.AppendBytes(key, message), nil
+}
+
+// protoBytesField returns the bytes field of the message, empty if unset
+func protoBytesField(message []byte, number protowire.Number) ([]byte, error) {
+	var value []byte
+
+	for len(message) > 0 {
+		n, wireType, size := protowire.ConsumeTag(message)
+		if size < 0 {
+			return nil, protowire.ParseError(size)
+		}
+		message = message[size:]
+
+		if n == number && wireType == protowire.BytesType {
+			v, size := protowire.ConsumeBytes(message)
+			if size < 0 {
+				return nil, protowire.ParseError(size)
+			}
+
+			value, message = v, message[size:]
+			continue
+		}
+
+		size = protowire.ConsumeFieldValue(n, wireType, message)
+		if size < 0 {
+			return nil, protowire.ParseError(size)
+		}
+		message = message[size:]
+	}
+
+	return value, nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package sops
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	testKMSARN     = "arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+	testKMSRoleARN = "arn:aws:iam::123456789012:role/sops"
+	testGCPKMSKey  = "projects/test/locations/global/keyRings/sops/cryptoKeys/sops"
+	testAzureKVKey = "https://sops.vault.azure.net/keys/sops/0123456789abcdef"
+)
+
+// newTestKeyService is the stand-in of the sops keyservice, the ciphertext is
+// the key message type and the base64 plaintext to be reversible, the
+// requests of the denied key types are rejected with the permission denied
+func newTestKeyService(t *testing.T, network string, denied ...protowire.Number) string {
+	t.Helper()
+
+	address := "127.0.0.1:0"
+	if network == "unix" {
+		address = filepath.Join(t.TempDir(), "keyservice.sock")
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+		data, _ := io.ReadAll(r.Body)
+		if r.URL.Path != keyServiceEncryptMethod || len(data) < grpcMessageHeaderSize {
+			w.Header().Set("Grpc-Status", "12")
+			w.Header().Set("Grpc-Message", "unimplemented")
+			return
+		}
+
+		request := data[grpcMessageHeaderSize:]
+		key, _ := protoBytesField(request, 1)
+		plaintext, _ := protoBytesField(request, 2)
+
+		keyType, _, _ := protowire.ConsumeTag(key)
+		for _, number := range denied {
+			if keyType == number {
+				w.Header().Set("Grpc-Status", "7")
+				w.Header().Set("Grpc-Message", "permission%20denied")
+				return
+			}
+		}
+
+		ciphertext := fmt.Sprintf("%d:%s", keyType, base64.StdEncoding.EncodeToString(plaintext))
+		response := protowire.AppendTag(nil, 1, protowire.BytesType)
+		response = protowire.AppendString(response, ciphertext)
+
+		header := make([]byte, grpcMessageHeaderSize)
+		binary.BigEndian.PutUint32(header[1:], uint32(len(response)))
+		_, _ = w.Write(append(header, response...))
+
+		w.Header().Set("Grpc-Status", "0")
+	})
+
+	server := &http.Server{Handler: h2c.NewHandler(handler, &http2.Server{})}
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	if network == "unix" {
+		return "unix://" + address
+	}
+
+	return "tcp://" + listener.Addr().String()
+}
+
+func TestEncryptKeyService(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			keyservice := newTestKeyService(t, network)
+
+			encryptor := NewSopsEncryption(nil, keyservice)
+			output, err := encryptor.Encrypt(testSecret, config.UpdateKSopsSopsOptions{},
+				config.UpdateKSopsRecipient{Type: "awskms", Recipient: testKMSARN + "+" + testKMSRoleARN},
+				config.UpdateKSopsRecipient{Type: "gcpkms", Recipient: testGCPKMSKey},
+				config.UpdateKSopsRecipient{Type: "azurekv", Recipient: testAzureKVKey},
+			)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			n := yaml.MustParse(output)
+
+			for _, expected := range []struct {
+				path  []string
+				value string
+			}{
+				{[]string{"sops", "kms", "0", "arn"}, testKMSARN},
+				{[]string{"sops", "kms", "0", "role"}, testKMSRoleARN},
+				{[]string{"sops", "gcp_kms", "0", "resource_id"}, testGCPKMSKey},
+				{[]string{"sops", "azure_kv", "0", "vault_url"}, "https://sops.vault.azure.net"},
+				{[]string{"sops", "azure_kv", "0", "name"}, "sops"},
+				{[]string{"sops", "azure_kv", "0", "version"}, "0123456789abcdef"},
+			} {
+				if v, err := n.Pipe(yaml.Lookup(expected.path...)); err != nil || v == nil || v.YNode().Value != expected.value {
+					t.Errorf("Expect %s %s, got\n%s", strings.Join(expected.path, "."), expected.value, output)
+				}
+			}
+
+			for keyType, number := range map[string]protowire.Number{
+				"kms":      keyServiceKMSKey,
+				"gcp_kms":  keyServiceGCPKMSKey,
+				"azure_kv": keyServiceAzureKeyVaultKey,
+			} {
+				enc, err := n.Pipe(yaml.Lookup("sops", keyType, "0", "enc"))
+				if err != nil || enc == nil {
+					t.Fatalf("Expect %s encrypted data key, got none\n%s", keyType, output)
+				}
+
+				prefix := fmt.Sprintf("%d:", number)
+				if !strings.HasPrefix(enc.YNode().Value, prefix) {
+					t.Fatalf("Expect %s encrypted by its key message, got %s", keyType, enc.YNode().Value)
+				}
+
+				dataKey, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(enc.YNode().Value, prefix))
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+
+				assertDecrypted(t, n, dataKey, map[string]string{
+					"test":  "dGVzdA==",
+					"empty": "",
+				})
+			}
+		})
+	}
+}
+
+func TestEncryptKeyServiceErrors(t *testing.T) {
+	keyservice := newTestKeyService(t, "tcp")
+	deniedKeyservice := newTestKeyService(t, "tcp", keyServiceKMSKey)
+
+	// The port of the closed listener is unreachable
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	unreachable := "tcp://" + listener.Addr().String()
+	listener.Close()
+
+	testCases := []struct {
+		Name        string
+		Keyservices []string
+		Expected    string
+	}{
+		{
+			Name:     "no keyservices",
+			Expected: "no keyservices to encrypt the awskms recipient",
+		},
+		{
+			Name:        "permission denied",
+			Keyservices: []string{deniedKeyservice},
+			Expected:    "returned the gRPC status 7: permission denied",
+		},
+		{
+			Name:        "unreachable",
+			Keyservices: []string{unreachable},
+			Expected:    unreachable + " request error",
+		},
+		{
+			Name:        "fallback to the next keyservice",
+			Keyservices: []string{unreachable, deniedKeyservice, keyservice},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			encryptor := NewSopsEncryption(nil, tc.Keyservices...)
+			_, err := encryptor.Encrypt(testSecret, config.UpdateKSopsSopsOptions{},
+				config.UpdateKSopsRecipient{Type: "awskms", Recipient: testKMSARN})
+			if tc.Expected == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.Expected) {
+				t.Errorf("Expect error contains %q, got %v", tc.Expected, err)
+			}
+		})
+	}
+}
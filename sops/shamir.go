@@ -0,0 +1,66 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package sops
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// splitSecret splits the secret into the parts of which any threshold of
+// them recover it, the parts are the same format as the SOPS Shamir's secret
+// sharing does, each part is the y coordinates followed by the x coordinate
+func splitSecret(secret []byte, parts, threshold int) ([][]byte, error) {
+	switch {
+	case parts < threshold:
+		return nil, fmt.Errorf("the parts %d must not be less than the threshold %d", parts, threshold)
+	case parts > 255:
+		return nil, fmt.Errorf("the parts %d must not be greater than 255", parts)
+	case threshold < 2:
+		return nil, fmt.Errorf("the threshold %d must be at least 2", threshold)
+	case len(secret) == 0:
+		return nil, fmt.Errorf("the secret must not be empty")
+	}
+
+	out := make([][]byte, parts)
+	for i := range out {
+		out[i] = make([]byte, len(secret)+1)
+		out[i][len(secret)] = uint8(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+	for idx, value := range secret {
+		coefficients[0] = value
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+
+		for i := range out {
+			out[i][idx] = evaluatePolynomial(coefficients, out[i][len(secret)])
+		}
+	}
+
+	return out, nil
+}
+
+// evaluatePolynomial evaluates the polynomial at x by the Horner's method
+func evaluatePolynomial(coefficients []byte, x uint8) uint8 {
+	degree := len(coefficients) - 1
+	out := coefficients[degree]
+	for i := degree - 1; i >= 0; i-- {
+		out = gfMult(out, x) ^ coefficients[i]
+	}
+
+	return out
+}
+
+// gfMult multiplies in the GF(2^8) of the AES polynomial in constant time
+func gfMult(a, b uint8) uint8 {
+	var r uint8
+	for i := 7; i >= 0; i-- {
+		r = (-(b >> uint(i) & 1) & a) ^ (-(r >> 7) & 0x1b) ^ (r + r)
+	}
+
+	return r
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package sops
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitSecret(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	testCases := []struct {
+		Name       string
+		Parts      int
+		Threshold  int
+		Combined   []int
+		ExpectsErr bool
+	}{
+		{Name: "2 of 3", Parts: 3, Threshold: 2, Combined: []int{0, 2}},
+		{Name: "3 of 3", Parts: 3, Threshold: 3, Combined: []int{2, 1, 0}},
+		{Name: "threshold over parts", Parts: 2, Threshold: 3, ExpectsErr: true},
+		{Name: "threshold of one", Parts: 2, Threshold: 1, ExpectsErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			parts, err := splitSecret(secret, tc.Parts, tc.Threshold)
+			if tc.ExpectsErr {
+				if err == nil {
+					t.Errorf("Expect error, got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			var selected [][]byte
+			for _, i := range tc.Combined {
+				selected = append(selected, parts[i])
+			}
+
+			if combined := combineSecret(selected); !bytes.Equal(combined, secret) {
+				t.Errorf("Expect secret %x, got %x", secret, combined)
+			}
+
+			if combined := combineSecret(selected[:1]); bytes.Equal(combined, secret) {
+				t.Errorf("Expect secret not recovered from a single part")
+			}
+		})
+	}
+}
+
+func TestGFMult(t *testing.T) {
+	// The FIPS-197 example of the AES field multiplication
+	if product := gfMult(0x57, 0x83); product != 0xc1 {
+		t.Errorf("Expect product c1, got %x", product)
+	}
+}
+
+// combineSecret recovers the secret by the Lagrange interpolation at zero, the
+// same as the SOPS Shamir's secret sharing combines the key group shares
+func combineSecret(parts [][]byte) []byte {
+	size := len(parts[0]) - 1
+	secret := make([]byte, size)
+
+	for idx := 0; idx < size; idx++ {
+		var value uint8
+		for i, pi := range parts {
+			basis := uint8(1)
+			for j, pj := range parts {
+				if i == j {
+					continue
+				}
+
+				xj := pj[size]
+				basis = gfMult(basis, gfDiv(xj, xj^pi[size]))
+			}
+
+			value ^= gfMult(pi[idx], basis)
+		}
+
+		secret[idx] = value
+	}
+
+	return secret
+}
+
+func gfDiv(a, b uint8) uint8 {
+	// b^254 is the multiplicative inverse of b
+	inverse := uint8(1)
+	for i := 0; i < 254; i++ {
+		inverse = gfMult(inverse, b)
+	}
+
+	return gfMult(a, inverse)
+}
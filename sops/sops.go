@@ -0,0 +1,390 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+// Package sops encrypts the YAML resources in-process, the encrypted output
+// is the SOPS file format that could be decrypted by the upstream sops and KSOPS
+package sops
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	// Version is the SOPS file format version of the encrypted output
+	Version = "3.9.0"
+	// DefaultEncryptedRegex selects the secret data if no other rule is set
+	DefaultEncryptedRegex = "^(data|stringData)$"
+
+	dataKeySize = 32
+)
+
+// PGPPublicKeyFunc returns the ASCII-armored or binary public key of the PGP
+// fingerprint
+type PGPPublicKeyFunc func(fingerprint string) (data string, err error)
+
+type SopsEncryptionInterface interface {
+	Encrypt(input string, options config.UpdateKSopsSopsOptions,
+		recipients ...config.UpdateKSopsRecipient) (output string, err error)
+}
+
+// metadataField is the sops metadata field, the fields are written in the
+// same order as SOPS does
+type metadataField struct {
+	name  string
+	value *yaml.RNode
+}
+
+// masterKeys are the encrypted data keys of the recipients by the metadata
+// key type
+type masterKeys struct {
+	kms     *yaml.RNode
+	gcpKMS  *yaml.RNode
+	azureKV *yaml.RNode
+	hcVault *yaml.RNode
+	age     *yaml.RNode
+	pgp     *yaml.RNode
+}
+
+type sops struct {
+	pgpPublicKey PGPPublicKeyFunc
+	vault        *vaultTransit
+	keyService   *keyService
+}
+
+// NewSopsEncryption encrypts in-process, the cloud KMS recipients are
+// encrypted by the keyservices endpoints
+func NewSopsEncryption(pgpPublicKey PGPPublicKeyFunc, keyservices ...string) SopsEncryptionInterface {
+	return &sops{
+		pgpPublicKey: pgpPublicKey,
+		vault:        newVaultTransit(),
+		keyService:   newKeyService(keyservices),
+	}
+}
+
+func (s *sops) Encrypt(input string, options config.UpdateKSopsSopsOptions,
+	recipients ...config.UpdateKSopsRecipient,
+) (output string, err error) {
+	if len(recipients) == 0 {
+		return "", fmt.Errorf("the Sops encryption requires at least one recipient")
+	}
+
+	node, err := yaml.Parse(input)
+	if err != nil {
+		return "", fmt.Errorf("the Sops encryption error: %w", err)
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", fmt.Errorf("the Sops data key error: %w", err)
+	}
+
+	mac, err := encryptTree(node, dataKey, options)
+	if err != nil {
+		return "", fmt.Errorf("the Sops encryption error: %w", err)
+	}
+
+	lastModified := time.Now().UTC().Format(time.RFC3339)
+	encryptedMac, err := encryptScalar(mac, "str", dataKey, lastModified)
+	if err != nil {
+		return "", fmt.Errorf("the Sops MAC encryption error: %w", err)
+	}
+
+	metadata, err := s.metadata(dataKey, lastModified, encryptedMac, options, recipients...)
+	if err != nil {
+		return "", err
+	}
+
+	if err := node.PipeE(yaml.SetField("sops", metadata)); err != nil {
+		return "", fmt.Errorf("the Sops metadata error: %w", err)
+	}
+
+	return node.String()
+}
+
+func (s *sops) metadata(dataKey []byte, lastModified, mac string,
+	options config.UpdateKSopsSopsOptions,
+	recipients ...config.UpdateKSopsRecipient,
+) (*yaml.RNode, error) {
+	var fields []metadataField
+
+	keys := newMasterKeys()
+
+	keyGroups := config.KeyGroups(recipients...)
+	if len(keyGroups) > 1 {
+		groups, threshold, err := s.keyGroups(dataKey, options, keyGroups)
+		if err != nil {
+			return nil, err
+		}
+
+		fields = append(fields,
+			metadataField{"shamir_threshold", newTaggedScalarRNode(strconv.Itoa(threshold), yaml.NodeTagInt)},
+			metadataField{"key_groups", groups},
+		)
+	} else {
+		var err error
+		if keys, err = s.encryptDataKey(dataKey, recipients...); err != nil {
+			return nil, err
+		}
+
+		if options.ShamirThreshold > 0 {
+			fields = append(fields, metadataField{"shamir_threshold",
+				newTaggedScalarRNode(strconv.Itoa(options.ShamirThreshold), yaml.NodeTagInt)})
+		}
+	}
+
+	fields = append(fields,
+		metadataField{"kms", keys.kms},
+		metadataField{"gcp_kms", keys.gcpKMS},
+		metadataField{"azure_kv", keys.azureKV},
+		metadataField{"hc_vault", keys.hcVault},
+		metadataField{"age", keys.age},
+		metadataField{"lastmodified", yaml.NewStringRNode(lastModified)},
+		metadataField{"mac", yaml.NewStringRNode(mac)},
+		metadataField{"pgp", keys.pgp},
+	)
+
+	for _, rule := range []struct {
+		name  string
+		value string
+	}{
+		{"unencrypted_regex", options.UnencryptedRegex()},
+		{"encrypted_regex", encryptedRegex(options)},
+		{"encrypted_comment_regex", options.EncryptedCommentRegex},
+	} {
+		if rule.value != "" {
+			fields = append(fields, metadataField{rule.name, yaml.NewStringRNode(rule.value)})
+		}
+	}
+
+	if options.IsMACOnlyEncrypted() {
+		fields = append(fields, metadataField{"mac_only_encrypted",
+			newTaggedScalarRNode("true", yaml.NodeTagBool)})
+	}
+
+	fields = append(fields, metadataField{"version", yaml.NewStringRNode(Version)})
+
+	return metadataNode(fields)
+}
+
+// keyGroups splits the data key into a share per key group, the default
+// threshold requires all the groups as SOPS does
+func (s *sops) keyGroups(dataKey []byte, options config.UpdateKSopsSopsOptions,
+	keyGroups [][]config.UpdateKSopsRecipient,
+) (groups *yaml.RNode, threshold int, err error) {
+	threshold = options.ShamirThreshold
+	if threshold == 0 {
+		threshold = len(keyGroups)
+	}
+
+	shares, err := splitSecret(dataKey, len(keyGroups), threshold)
+	if err != nil {
+		return nil, 0, fmt.Errorf("the Sops key groups error: %w", err)
+	}
+
+	groups = yaml.NewListRNode()
+	for i, recipients := range keyGroups {
+		keys, err := s.encryptDataKey(shares[i], recipients...)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// The key group fields are in the same order as SOPS writes them
+		var fields []metadataField
+		for _, field := range []metadataField{
+			{"pgp", keys.pgp},
+			{"kms", keys.kms},
+			{"gcp_kms", keys.gcpKMS},
+			{"azure_kv", keys.azureKV},
+			{"hc_vault", keys.hcVault},
+			{"age", keys.age},
+		} {
+			if len(field.value.Content()) > 0 {
+				fields = append(fields, field)
+			}
+		}
+
+		group, err := metadataNode(fields)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if err := groups.PipeE(yaml.Append(group.YNode())); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return groups, threshold, nil
+}
+
+func newMasterKeys() *masterKeys {
+	return &masterKeys{
+		kms:     yaml.NewListRNode(),
+		gcpKMS:  yaml.NewListRNode(),
+		azureKV: yaml.NewListRNode(),
+		hcVault: yaml.NewListRNode(),
+		age:     yaml.NewListRNode(),
+		pgp:     yaml.NewListRNode(),
+	}
+}
+
+// encryptDataKey encrypts the data key, or its share, to each recipient
+func (s *sops) encryptDataKey(dataKey []byte,
+	recipients ...config.UpdateKSopsRecipient,
+) (*masterKeys, error) {
+	keys := newMasterKeys()
+
+	for _, r := range recipients {
+		switch r.Type {
+		case "age", "ssh":
+			// The ssh recipients are age recipients in the metadata
+			enc, err := encryptAge(dataKey, r.Recipient)
+			if err != nil {
+				return nil, fmt.Errorf("the Sops %s recipient %s error: %w", r.Type, r.Recipient, err)
+			}
+
+			if err := appendKeyNode(keys.age,
+				"recipient", r.Recipient,
+				"enc", enc,
+			); err != nil {
+				return nil, err
+			}
+		case "pgp":
+			enc, err := s.encryptPGP(dataKey, r.Recipient)
+			if err != nil {
+				return nil, fmt.Errorf("the Sops pgp recipient %s error: %w", r.Recipient, err)
+			}
+
+			if err := appendKeyNode(keys.pgp,
+				"created_at", time.Now().UTC().Format(time.RFC3339),
+				"enc", enc,
+				"fp", r.Recipient,
+			); err != nil {
+				return nil, err
+			}
+		case "vault":
+			key, err := s.vault.encrypt(dataKey, r.Recipient)
+			if err != nil {
+				return nil, fmt.Errorf("the Sops vault recipient %s error: %w", r.Recipient, err)
+			}
+
+			if err := appendKeyNode(keys.hcVault,
+				"vault_address", key.address,
+				"engine_path", key.enginePath,
+				"key_name", key.keyName,
+				"created_at", time.Now().UTC().Format(time.RFC3339),
+				"enc", key.enc,
+			); err != nil {
+				return nil, err
+			}
+		case "awskms", "gcpkms", "azurekv":
+			enc, err := s.keyService.encrypt(dataKey, r)
+			if err != nil {
+				return nil, fmt.Errorf("the Sops %s recipient %s error: %w", r.Type, r.Recipient, err)
+			}
+
+			if err := appendKeyServiceKeyNode(keys, r, enc); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// metadataNode creates the mapping of the fields in order, the empty lists
+// are written in the flow style
+func metadataNode(fields []metadataField) (*yaml.RNode, error) {
+	metadata := yaml.NewMapRNode(nil)
+	for _, field := range fields {
+		if len(field.value.Content()) == 0 && field.value.YNode().Kind == yaml.SequenceNode {
+			field.value.YNode().Style = yaml.FlowStyle
+		}
+
+		if err := metadata.PipeE(yaml.SetField(field.name, field.value)); err != nil {
+			return nil, err
+		}
+	}
+
+	return metadata, nil
+}
+
+// newTaggedScalarRNode creates the scalar with the explicit tag, the untagged
+// scalars are quoted as the strings on output
+func newTaggedScalarRNode(value, tag string) *yaml.RNode {
+	n := yaml.NewScalarRNode(value)
+	n.YNode().Tag = tag
+
+	return n
+}
+
+// appendKeyServiceKeyNode appends the cloud KMS key with the same fields as
+// SOPS writes them
+func appendKeyServiceKeyNode(keys *masterKeys, r config.UpdateKSopsRecipient, enc string) error {
+	createdAt := time.Now().UTC().Format(time.RFC3339)
+
+	switch r.Type {
+	case "awskms":
+		arn, role, err := config.ParseAWSKMSKey(r.Recipient)
+		if err != nil {
+			return err
+		}
+
+		fieldValues := []string{"arn", arn}
+		if role != "" {
+			fieldValues = append(fieldValues, "role", role)
+		}
+
+		return appendKeyNode(keys.kms, append(fieldValues,
+			"created_at", createdAt,
+			"enc", enc,
+			"aws_profile", "",
+		)...)
+	case "gcpkms":
+		return appendKeyNode(keys.gcpKMS,
+			"resource_id", r.Recipient,
+			"created_at", createdAt,
+			"enc", enc,
+		)
+	case "azurekv":
+		vaultURL, name, version, err := config.ParseAzureKeyVaultKey(r.Recipient)
+		if err != nil {
+			return err
+		}
+
+		return appendKeyNode(keys.azureKV,
+			"vault_url", vaultURL,
+			"name", name,
+			"version", version,
+			"created_at", createdAt,
+			"enc", enc,
+		)
+	}
+
+	return nil
+}
+
+// appendKeyNode appends the key metadata mapping from the field name and
+// value pairs, the multi-line values are rendered as the literal blocks
+func appendKeyNode(list *yaml.RNode, fieldValues ...string) error {
+	n := yaml.NewMapRNode(nil)
+
+	for i := 0; i+1 < len(fieldValues); i += 2 {
+		value := yaml.NewStringRNode(fieldValues[i+1])
+		if strings.HasSuffix(fieldValues[i+1], "\n") {
+			value.YNode().Style = yaml.LiteralStyle
+		}
+
+		if err := n.PipeE(yaml.SetField(fieldValues[i], value)); err != nil {
+			return err
+		}
+	}
+
+	return list.PipeE(yaml.Append(n.YNode()))
+}
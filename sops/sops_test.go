@@ -0,0 +1,579 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package sops
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	ageArmor "filippo.io/age/armor"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgpArmor "github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+	"golang.org/x/crypto/ssh"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	testAgeRecipient = "age1x7pzjx4r05ar95pulf20knx0mkscaxa0zhtqr948wza3863fvees8tzaaa"
+	testAgeKeyFile   = "../example/age.key.txt"
+
+	testSecret = `apiVersion: v1
+kind: Secret
+metadata:
+  name: test
+  annotations:
+    kustomize.config.k8s.io/behavior: merge
+type: Opaque
+data:
+  test: dGVzdA==
+  empty: ""
+`
+)
+
+var encryptedValueRegexp = regexp.MustCompile(
+	`^ENC\[AES256_GCM,data:(.*),iv:(.*),tag:(.*),type:(.*)\]$`)
+
+func TestEncryptAge(t *testing.T) {
+	encryptor := NewSopsEncryption(nil)
+	output, err := encryptor.Encrypt(testSecret, config.UpdateKSopsSopsOptions{}, config.UpdateKSopsRecipient{
+		Type:      "age",
+		Recipient: testAgeRecipient,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	n := yaml.MustParse(output)
+
+	enc, err := n.Pipe(yaml.Lookup("sops", "age", "0", "enc"))
+	if err != nil || enc == nil {
+		t.Fatalf("Expect age encrypted data key, got none\n%s", output)
+	}
+
+	dataKey, err := decryptAge(enc.YNode().Value)
+	if err != nil {
+		t.Fatalf("Unexpected data key decryption error: %v", err)
+	}
+
+	assertDecrypted(t, n, dataKey, map[string]string{
+		"test":  "dGVzdA==",
+		"empty": "",
+	})
+
+	if name := n.GetName(); name != "test" {
+		t.Errorf("Expect unencrypted name test, got %s", name)
+	}
+}
+
+func TestEncryptSSH(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	identity, err := agessh.NewEd25519Identity(privateKey)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	recipient := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublicKey)))
+
+	encryptor := NewSopsEncryption(nil)
+	output, err := encryptor.Encrypt(testSecret, config.UpdateKSopsSopsOptions{}, config.UpdateKSopsRecipient{
+		Type:      "ssh",
+		Recipient: recipient,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	n := yaml.MustParse(output)
+
+	// The ssh recipients are the age recipients of SOPS
+	if r, err := n.Pipe(yaml.Lookup("sops", "age", "0", "recipient")); err != nil || r == nil || r.YNode().Value != recipient {
+		t.Fatalf("Expect the ssh age recipient %s, got\n%s", recipient, output)
+	}
+
+	enc, err := n.Pipe(yaml.Lookup("sops", "age", "0", "enc"))
+	if err != nil || enc == nil {
+		t.Fatalf("Expect age encrypted data key, got none\n%s", output)
+	}
+
+	r, err := age.Decrypt(ageArmor.NewReader(strings.NewReader(enc.YNode().Value)), identity)
+	if err != nil {
+		t.Fatalf("Unexpected data key decryption error: %v", err)
+	}
+
+	dataKey, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	assertDecrypted(t, n, dataKey, map[string]string{
+		"test":  "dGVzdA==",
+		"empty": "",
+	})
+}
+
+func TestEncryptPGP(t *testing.T) {
+	entity, err := openpgp.NewEntity("test", "", "test@example.com",
+		&packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	fingerprint := fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+	publicKey := armoredPublicKey(t, entity)
+
+	testCases := []struct {
+		Name         string
+		PublicKey    PGPPublicKeyFunc
+		ExpectsError bool
+	}{
+		{
+			Name: "public key available",
+			PublicKey: func(fp string) (string, error) {
+				return publicKey, nil
+			},
+		},
+		{
+			Name: "public key not found",
+			PublicKey: func(fp string) (string, error) {
+				return "", fmt.Errorf("the GPG public key %s not found", fp)
+			},
+			ExpectsError: true,
+		},
+		{
+			Name:         "no public key source",
+			ExpectsError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			encryptor := NewSopsEncryption(tc.PublicKey)
+			output, err := encryptor.Encrypt(testSecret, config.UpdateKSopsSopsOptions{}, config.UpdateKSopsRecipient{
+				Type:      "pgp",
+				Recipient: fingerprint,
+			})
+
+			if tc.ExpectsError {
+				if err == nil {
+					t.Errorf("Expect error, got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			n := yaml.MustParse(output)
+
+			fp, err := n.Pipe(yaml.Lookup("sops", "pgp", "0", "fp"))
+			if err != nil || fp == nil || fp.YNode().Value != fingerprint {
+				t.Errorf("Expect pgp fingerprint %s, got none\n%s", fingerprint, output)
+			}
+
+			enc, err := n.Pipe(yaml.Lookup("sops", "pgp", "0", "enc"))
+			if err != nil || enc == nil {
+				t.Fatalf("Expect pgp encrypted data key, got none\n%s", output)
+			}
+
+			dataKey, err := decryptPGP(enc.YNode().Value, entity)
+			if err != nil {
+				t.Fatalf("Unexpected data key decryption error: %v", err)
+			}
+
+			assertDecrypted(t, n, dataKey, map[string]string{
+				"test":  "dGVzdA==",
+				"empty": "",
+			})
+		})
+	}
+}
+
+func TestEncryptMetadata(t *testing.T) {
+	encryptor := NewSopsEncryption(nil)
+	output, err := encryptor.Encrypt(testSecret, config.UpdateKSopsSopsOptions{}, config.UpdateKSopsRecipient{
+		Type:      "age",
+		Recipient: testAgeRecipient,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	n := yaml.MustParse(output)
+	metadata, err := n.Pipe(yaml.Lookup("sops"))
+	if err != nil || metadata == nil {
+		t.Fatalf("Expect sops metadata, got none\n%s", output)
+	}
+
+	fields, err := metadata.Fields()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"kms", "gcp_kms", "azure_kv", "hc_vault", "age",
+		"lastmodified", "mac", "pgp", "encrypted_regex", "version",
+	}
+	if strings.Join(fields, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expect metadata fields %v, got %v", expected, fields)
+	}
+
+	if v := yaml.GetValue(metadata.Field("version").Value); v != Version {
+		t.Errorf("Expect version %s, got %s", Version, v)
+	}
+}
+
+func TestEncryptKeyGroups(t *testing.T) {
+	var identities []*age.X25519Identity
+	var recipients []config.UpdateKSopsRecipient
+
+	for i := 0; i < 3; i++ {
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		identities = append(identities, identity)
+		recipients = append(recipients, config.UpdateKSopsRecipient{
+			Type:      "age",
+			Recipient: identity.Recipient().String(),
+			KeyGroup:  i,
+		})
+	}
+
+	encryptor := NewSopsEncryption(nil)
+	output, err := encryptor.Encrypt(testSecret, config.UpdateKSopsSopsOptions{ShamirThreshold: 2}, recipients...)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	n := yaml.MustParse(output)
+	if v, err := n.Pipe(yaml.Lookup("sops", "shamir_threshold")); err != nil || v == nil ||
+		v.YNode().Value != "2" || v.YNode().ShortTag() != yaml.NodeTagInt {
+		t.Errorf("Expect shamir_threshold 2, got\n%s", output)
+	}
+
+	var shares [][]byte
+	for _, i := range []int{0, 2} {
+		enc, err := n.Pipe(yaml.Lookup("sops", "key_groups", fmt.Sprintf("%d", i), "age", "0", "enc"))
+		if err != nil || enc == nil {
+			t.Fatalf("Expect key group %d age encrypted share, got none\n%s", i, output)
+		}
+
+		r, err := age.Decrypt(ageArmor.NewReader(strings.NewReader(enc.YNode().Value)), identities[i])
+		if err != nil {
+			t.Fatalf("Unexpected share decryption error: %v", err)
+		}
+
+		share, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		shares = append(shares, share)
+	}
+
+	assertDecrypted(t, n, combineSecret(shares), map[string]string{
+		"test":  "dGVzdA==",
+		"empty": "",
+	})
+
+	t.Run("default threshold", func(t *testing.T) {
+		output, err := encryptor.Encrypt(testSecret, config.UpdateKSopsSopsOptions{}, recipients...)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		v, err := yaml.MustParse(output).Pipe(yaml.Lookup("sops", "shamir_threshold"))
+		if err != nil || v == nil || v.YNode().Value != "3" {
+			t.Errorf("Expect shamir_threshold 3, got\n%s", output)
+		}
+	})
+
+	t.Run("threshold over key groups", func(t *testing.T) {
+		_, err := encryptor.Encrypt(testSecret, config.UpdateKSopsSopsOptions{ShamirThreshold: 4}, recipients...)
+		if err == nil {
+			t.Errorf("Expect error, got none")
+		}
+	})
+}
+
+func TestEncryptOptions(t *testing.T) {
+	macOnlyEncrypted := true
+
+	input := `apiVersion: v1
+kind: Secret
+metadata:
+  name: test
+data:
+  # sops:enc
+  test: dGVzdA==
+  test_unencrypted: dGVzdA==
+`
+
+	testCases := []struct {
+		Name              string
+		Options           config.UpdateKSopsSopsOptions
+		ExpectedEncrypted []string
+		ExpectedMetadata  map[string]string
+	}{
+		{
+			Name:              "default",
+			ExpectedEncrypted: []string{"test", "test_unencrypted"},
+			ExpectedMetadata: map[string]string{
+				"encrypted_regex": DefaultEncryptedRegex,
+			},
+		},
+		{
+			Name:              "encrypted regex",
+			Options:           config.UpdateKSopsSopsOptions{EncryptedRegex: "^test$"},
+			ExpectedEncrypted: []string{"test"},
+			ExpectedMetadata: map[string]string{
+				"encrypted_regex": "^test$",
+			},
+		},
+		{
+			Name:              "unencrypted suffix",
+			Options:           config.UpdateKSopsSopsOptions{UnencryptedSuffix: "_unencrypted"},
+			ExpectedEncrypted: []string{"test"},
+			ExpectedMetadata: map[string]string{
+				"unencrypted_regex": "^(apiVersion|kind|metadata|type)$|_unencrypted$",
+			},
+		},
+		{
+			Name:              "encrypted comment regex",
+			Options:           config.UpdateKSopsSopsOptions{EncryptedCommentRegex: "sops:enc"},
+			ExpectedEncrypted: []string{"test"},
+			ExpectedMetadata: map[string]string{
+				"encrypted_comment_regex": "sops:enc",
+			},
+		},
+		{
+			Name: "mac only encrypted and shamir threshold",
+			Options: config.UpdateKSopsSopsOptions{
+				MACOnlyEncrypted: &macOnlyEncrypted,
+				ShamirThreshold:  1,
+			},
+			ExpectedEncrypted: []string{"test", "test_unencrypted"},
+			ExpectedMetadata: map[string]string{
+				"mac_only_encrypted": "true",
+				"shamir_threshold":   "1",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			encryptor := NewSopsEncryption(nil)
+			output, err := encryptor.Encrypt(input, tc.Options, config.UpdateKSopsRecipient{
+				Type:      "age",
+				Recipient: testAgeRecipient,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			n := yaml.MustParse(output)
+			if n.GetApiVersion() != "v1" || n.GetKind() != "Secret" || n.GetName() != "test" {
+				t.Errorf("Expect the Secret identity fields unencrypted, got\n%s", output)
+			}
+
+			for key, value := range n.GetDataMap() {
+				expected := false
+				for _, k := range tc.ExpectedEncrypted {
+					expected = expected || k == key
+				}
+
+				if encrypted := encryptedValueRegexp.MatchString(value); encrypted != expected {
+					t.Errorf("Expect %s encrypted %v, got %s", key, expected, value)
+				}
+			}
+
+			for field, expected := range tc.ExpectedMetadata {
+				v, err := n.Pipe(yaml.Lookup("sops", field))
+				if err != nil || v == nil || v.YNode().Value != expected ||
+					(field == "mac_only_encrypted" || field == "shamir_threshold") &&
+						v.YNode().ShortTag() == yaml.NodeTagString {
+					t.Errorf("Expect metadata %s: %s, got\n%s", field, expected, output)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptInvalidRecipient(t *testing.T) {
+	encryptor := NewSopsEncryption(nil)
+	_, err := encryptor.Encrypt(testSecret, config.UpdateKSopsSopsOptions{}, config.UpdateKSopsRecipient{
+		Type:      "age",
+		Recipient: "age1invalid",
+	})
+	if err == nil {
+		t.Errorf("Expect error, got none")
+	}
+}
+
+func assertDecrypted(t *testing.T, n *yaml.RNode, dataKey []byte, expected map[string]string) {
+	t.Helper()
+
+	hash := sha512.New()
+	if err := walkNode(n.YNode(), func(leaf *yaml.Node, path []string, _ [][]string) error {
+		if len(path) > 0 && path[0] == "sops" {
+			return nil
+		}
+
+		value := leaf.Value
+		if len(path) > 0 && path[0] == "data" {
+			decrypted, err := decryptScalar(leaf.Value, dataKey, strings.Join(path, ":")+":")
+			if err != nil {
+				return fmt.Errorf("%s: %w", strings.Join(path, "."), err)
+			}
+
+			if expected[path[1]] != decrypted {
+				t.Errorf("Expect %s=%s, got %s", path[1], expected[path[1]], decrypted)
+			}
+
+			value = decrypted
+		}
+
+		hash.Write([]byte(value))
+		return nil
+	}, nil); err != nil {
+		t.Fatalf("Unexpected decryption error: %v", err)
+	}
+
+	lastModified, err := n.Pipe(yaml.Lookup("sops", "lastmodified"))
+	if err != nil || lastModified == nil {
+		t.Fatalf("Expect lastmodified, got none")
+	}
+
+	mac, err := n.Pipe(yaml.Lookup("sops", "mac"))
+	if err != nil || mac == nil {
+		t.Fatalf("Expect mac, got none")
+	}
+
+	decryptedMac, err := decryptScalar(mac.YNode().Value, dataKey, lastModified.YNode().Value)
+	if err != nil {
+		t.Fatalf("Unexpected MAC decryption error: %v", err)
+	}
+
+	if actual := fmt.Sprintf("%X", hash.Sum(nil)); actual != decryptedMac {
+		t.Errorf("Expect MAC %s, got %s", decryptedMac, actual)
+	}
+}
+
+func decryptScalar(value string, dataKey []byte, additionalData string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	matches := encryptedValueRegexp.FindStringSubmatch(value)
+	if matches == nil {
+		return "", fmt.Errorf("not encrypted value %s", value)
+	}
+
+	var parts [][]byte
+	for _, m := range matches[1:4] {
+		b, err := base64.StdEncoding.DecodeString(m)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, b)
+	}
+
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	aesgcm, err := cipher.NewGCMWithNonceSize(block, len(parts[1]))
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := aesgcm.Open(nil, parts[1], append(parts[0], parts[2]...), []byte(additionalData))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+func decryptAge(enc string) ([]byte, error) {
+	keys, err := os.Open(testAgeKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer keys.Close()
+
+	identities, err := age.ParseIdentities(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := age.Decrypt(ageArmor.NewReader(strings.NewReader(enc)), identities...)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
+
+func decryptPGP(enc string, entity *openpgp.Entity) ([]byte, error) {
+	block, err := pgpArmor.Decode(strings.NewReader(enc))
+	if err != nil {
+		return nil, err
+	}
+
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(md.UnverifiedBody)
+}
+
+func armoredPublicKey(t *testing.T, entity *openpgp.Entity) string {
+	t.Helper()
+
+	var buffer bytes.Buffer
+
+	w, err := pgpArmor.Encode(&buffer, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := entity.Serialize(w); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	return buffer.String()
+}
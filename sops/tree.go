@@ -0,0 +1,370 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package sops
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	nonceSize = 32
+)
+
+// macOnlyEncryptedInitialization seeds the MAC of the encrypted values only,
+// the MAC always differs from the one of all the values as SOPS does
+var macOnlyEncryptedInitialization = []byte{
+	0x8a, 0x3f, 0xd2, 0xad, 0x54, 0xce, 0x66, 0x52, 0x7b, 0x10, 0x34, 0xf3, 0xd1, 0x47, 0xbe, 0x0b,
+	0x0b, 0x97, 0x5b, 0x3b, 0xf4, 0x4f, 0x72, 0xc6, 0xfd, 0xad, 0xec, 0x81, 0x76, 0xf2, 0x7d, 0x69,
+}
+
+// encryptTree encrypts the scalar values selected by the options in place,
+// the MAC of the values is returned as SOPS does
+func encryptTree(node *yaml.RNode, dataKey []byte, options config.UpdateKSopsSopsOptions) (mac string, err error) {
+	isEncrypted, err := encryptionRule(options)
+	if err != nil {
+		return "", err
+	}
+
+	if node.YNode().Kind != yaml.MappingNode {
+		return "", fmt.Errorf("the document must be a mapping")
+	}
+
+	hash := sha512.New()
+	if options.IsMACOnlyEncrypted() {
+		hash.Write(macOnlyEncryptedInitialization)
+	}
+
+	onValue := func(n *yaml.Node, path []string, comments [][]string) error {
+		encrypted := isEncrypted(path, comments, false)
+
+		valueType, plaintext, macBytes, err := scalarValue(n)
+		if err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(path, "."), err)
+		}
+
+		if !options.IsMACOnlyEncrypted() || encrypted {
+			hash.Write(macBytes)
+		}
+
+		if !encrypted {
+			return nil
+		}
+
+		value, err := encryptScalar(plaintext, valueType, dataKey, strings.Join(path, ":")+":")
+		if err != nil {
+			return err
+		}
+
+		n.Value = value
+		n.Tag = yaml.NodeTagString
+		n.Style = 0
+
+		return nil
+	}
+
+	// The comments are encrypted under the encrypted paths but never counted
+	// in the MAC as SOPS does
+	onComment := func(comment string, path []string, comments [][]string) (string, error) {
+		if !isEncrypted(path, comments, true) {
+			return comment, nil
+		}
+
+		return encryptScalar(comment, "comment", dataKey, strings.Join(path, ":")+":")
+	}
+
+	if err := walkNode(node.YNode(), onValue, onComment); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%X", hash.Sum(nil)), nil
+}
+
+// encryptionRule returns the check whether the value or the comment is
+// encrypted by its keys path and the comments preceding it, the default
+// encrypted regex is used when no rule is set
+func encryptionRule(options config.UpdateKSopsSopsOptions) (func(path []string, comments [][]string, isComment bool) bool, error) {
+	switch {
+	case options.UnencryptedSuffix != "":
+		unencryptedCheck, err := regexp.Compile(options.UnencryptedRegex())
+		if err != nil {
+			return nil, fmt.Errorf("invalid unencrypted suffix: %w", err)
+		}
+
+		return func(path []string, _ [][]string, _ bool) bool {
+			return !anyMatch(unencryptedCheck, path)
+		}, nil
+	case options.EncryptedCommentRegex != "":
+		encryptedCheck, err := regexp.Compile(options.EncryptedCommentRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encrypted comment regex: %w", err)
+		}
+
+		return func(_ []string, comments [][]string, isComment bool) bool {
+			for i, lines := range comments {
+				for j, line := range lines {
+					// The matching comment line itself is left unencrypted
+					if isComment && i == len(comments)-1 && j == len(lines)-1 {
+						continue
+					}
+
+					if encryptedCheck.MatchString(line) {
+						return true
+					}
+				}
+			}
+
+			return false
+		}, nil
+	}
+
+	encryptedCheck, err := regexp.Compile(encryptedRegex(options))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted regex: %w", err)
+	}
+
+	return func(path []string, _ [][]string, _ bool) bool {
+		return anyMatch(encryptedCheck, path)
+	}, nil
+}
+
+// encryptedRegex returns the encrypted regex of the options, or the default
+// one if no other rule is set
+func encryptedRegex(options config.UpdateKSopsSopsOptions) string {
+	if options.EncryptedRegex == "" && options.UnencryptedSuffix == "" &&
+		options.EncryptedCommentRegex == "" {
+		return DefaultEncryptedRegex
+	}
+
+	return options.EncryptedRegex
+}
+
+func anyMatch(check *regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		if check.MatchString(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// walkNode visits the scalar values and the comment lines of the mapping in
+// the order the SOPS YAML store loads them, the sequence items share the path
+// of their parent key, the comments are the lines preceding the value per
+// mapping and sequence level, the comment lines are replaced by the onComment
+// results if set
+func walkNode(n *yaml.Node,
+	onValue func(n *yaml.Node, path []string, comments [][]string) error,
+	onComment func(comment string, path []string, comments [][]string) (string, error),
+) error {
+	w := &treeWalker{onValue: onValue, onComment: onComment}
+	return w.mapping(n, nil, nil, false)
+}
+
+type treeWalker struct {
+	onValue   func(n *yaml.Node, path []string, comments [][]string) error
+	onComment func(comment string, path []string, comments [][]string) (string, error)
+}
+
+func (w *treeWalker) value(n *yaml.Node, path []string, comments [][]string, commentsHandled bool) error {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return w.mapping(n, path, comments, commentsHandled)
+	case yaml.SequenceNode:
+		return w.sequence(n, path, comments, commentsHandled)
+	case yaml.ScalarNode:
+		return w.onValue(n, path, comments)
+	}
+
+	return fmt.Errorf("unsupported YAML node at %s", strings.Join(path, "."))
+}
+
+func (w *treeWalker) mapping(n *yaml.Node, path []string, comments [][]string, commentsHandled bool) error {
+	comments = append(append([][]string{}, comments...), nil)
+
+	if !commentsHandled {
+		if err := w.comments(path, comments, &n.HeadComment, &n.LineComment); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		scalar := value.Kind == yaml.ScalarNode
+
+		if err := w.comments(path, comments, &key.HeadComment, &key.LineComment); err != nil {
+			return err
+		}
+
+		if scalar {
+			if err := w.comments(path, comments, &value.HeadComment, &value.LineComment); err != nil {
+				return err
+			}
+		}
+
+		keyPath := append(append([]string{}, path...), key.Value)
+		if err := w.value(value, keyPath, comments, scalar); err != nil {
+			return err
+		}
+		comments[len(comments)-1] = nil
+
+		if scalar {
+			if err := w.comments(path, comments, &value.FootComment); err != nil {
+				return err
+			}
+		}
+
+		if err := w.comments(path, comments, &key.FootComment); err != nil {
+			return err
+		}
+	}
+
+	if !commentsHandled {
+		return w.comments(path, comments, &n.FootComment)
+	}
+
+	return nil
+}
+
+func (w *treeWalker) sequence(n *yaml.Node, path []string, comments [][]string, commentsHandled bool) error {
+	comments = append(append([][]string{}, comments...), nil)
+
+	if !commentsHandled {
+		if err := w.comments(path, comments, &n.HeadComment, &n.LineComment); err != nil {
+			return err
+		}
+	}
+
+	for _, item := range n.Content {
+		if err := w.comments(path, comments, &item.HeadComment, &item.LineComment); err != nil {
+			return err
+		}
+
+		if err := w.value(item, path, comments, true); err != nil {
+			return err
+		}
+		comments[len(comments)-1] = nil
+
+		if err := w.comments(path, comments, &item.FootComment); err != nil {
+			return err
+		}
+	}
+
+	if !commentsHandled {
+		return w.comments(path, comments, &n.FootComment)
+	}
+
+	return nil
+}
+
+// comments visits the comment lines without the markers, each line is added
+// to the comments of the current level before it is visited
+func (w *treeWalker) comments(path []string, comments [][]string, fields ...*string) error {
+	for _, field := range fields {
+		if *field == "" {
+			continue
+		}
+
+		var lines []string
+		for _, line := range strings.Split(*field, "\n") {
+			if line == "" {
+				continue
+			}
+
+			comment := line[1:]
+			comments[len(comments)-1] = append(comments[len(comments)-1], comment)
+
+			if w.onComment != nil {
+				var err error
+				if comment, err = w.onComment(comment, path, comments); err != nil {
+					return err
+				}
+			}
+
+			lines = append(lines, "#"+comment)
+		}
+
+		*field = strings.Join(lines, "\n")
+	}
+
+	return nil
+}
+
+// scalarValue returns the SOPS type, the plaintext and the MAC bytes of the
+// scalar, the typed values are represented the same way as SOPS does
+func scalarValue(n *yaml.Node) (valueType, plaintext string, macBytes []byte, err error) {
+	switch n.ShortTag() {
+	case yaml.NodeTagString:
+		return "str", n.Value, []byte(n.Value), nil
+	case yaml.NodeTagInt:
+		i, err := strconv.ParseInt(n.Value, 0, 64)
+		if err != nil {
+			return "", "", nil, err
+		}
+		s := strconv.FormatInt(i, 10)
+		return "int", s, []byte(s), nil
+	case yaml.NodeTagFloat:
+		f, err := strconv.ParseFloat(n.Value, 64)
+		if err != nil {
+			return "", "", nil, err
+		}
+		s := strconv.FormatFloat(f, 'f', -1, 64)
+		return "float", s, []byte(s), nil
+	case yaml.NodeTagBool:
+		b, err := strconv.ParseBool(strings.ToLower(n.Value))
+		if err != nil {
+			return "", "", nil, err
+		}
+		macValue := "False"
+		if b {
+			macValue = "True"
+		}
+		return "bool", strconv.FormatBool(b), []byte(macValue), nil
+	}
+
+	return "", "", nil, fmt.Errorf("unsupported value type %s", n.ShortTag())
+}
+
+// encryptScalar encrypts the value with AES256-GCM, the empty value is not
+// encrypted as SOPS does
+func encryptScalar(plaintext, valueType string, key []byte, additionalData string) (string, error) {
+	if valueType == "str" && plaintext == "" {
+		return "", nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", fmt.Errorf("AES cipher error: %w", err)
+	}
+
+	aesgcm, err := cipher.NewGCMWithNonceSize(block, nonceSize)
+	if err != nil {
+		return "", fmt.Errorf("GCM cipher error: %w", err)
+	}
+
+	iv := make([]byte, nonceSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", fmt.Errorf("Random IV error: %w", err)
+	}
+
+	out := aesgcm.Seal(nil, iv, []byte(plaintext), []byte(additionalData))
+	ciphertext, tag := out[:len(out)-aesgcm.Overhead()], out[len(out)-aesgcm.Overhead():]
+
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]",
+		base64.StdEncoding.EncodeToString(ciphertext),
+		base64.StdEncoding.EncodeToString(iv),
+		base64.StdEncoding.EncodeToString(tag),
+		valueType), nil
+}
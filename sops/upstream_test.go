@@ -0,0 +1,288 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package sops
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	upstream "github.com/getsops/sops/v3"
+	upstreamAES "github.com/getsops/sops/v3/aes"
+	upstreamAge "github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/keyservice"
+	"github.com/getsops/sops/v3/stores"
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+func TestEncryptUpstreamDecrypt(t *testing.T) {
+	t.Setenv(upstreamAge.SopsAgeKeyFileEnv, testAgeKeyFile)
+
+	macOnlyEncrypted := true
+
+	input := `apiVersion: v1
+kind: Secret
+metadata:
+  name: test
+type: Opaque
+data:
+  # sops:enc
+  test: dGVzdA==
+  test_unencrypted: dGVzdA==
+  empty: ""
+`
+
+	testCases := []struct {
+		Name             string
+		Options          config.UpdateKSopsSopsOptions
+		PlaintextComment bool
+	}{
+		{Name: "default"},
+		{Name: "encrypted regex", Options: config.UpdateKSopsSopsOptions{EncryptedRegex: "^test$"}, PlaintextComment: true},
+		{Name: "unencrypted suffix", Options: config.UpdateKSopsSopsOptions{UnencryptedSuffix: "_unencrypted"}},
+		{Name: "encrypted comment regex", Options: config.UpdateKSopsSopsOptions{EncryptedCommentRegex: "sops:enc"}, PlaintextComment: true},
+		{Name: "mac only encrypted", Options: config.UpdateKSopsSopsOptions{MACOnlyEncrypted: &macOnlyEncrypted}},
+		{
+			Name: "mac only encrypted with encrypted regex",
+			Options: config.UpdateKSopsSopsOptions{
+				EncryptedRegex:   "^test$",
+				MACOnlyEncrypted: &macOnlyEncrypted,
+			},
+			PlaintextComment: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			encryptor := NewSopsEncryption(nil)
+			output, err := encryptor.Encrypt(input, tc.Options, config.UpdateKSopsRecipient{
+				Type:      "age",
+				Recipient: testAgeRecipient,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if plaintext := strings.Contains(output, "# sops:enc"); plaintext != tc.PlaintextComment {
+				t.Errorf("Expect plaintext comment %v, got\n%s", tc.PlaintextComment, output)
+			}
+
+			data, comments, err := upstreamDecrypt(output)
+			if err != nil {
+				t.Fatalf("Unexpected upstream decryption error: %v\n%s", err, output)
+			}
+
+			if len(comments) != 1 || comments[0] != " sops:enc" {
+				t.Errorf("Expect decrypted comment ' sops:enc', got %#v", comments)
+			}
+
+			expected := map[string]interface{}{
+				"test":             "dGVzdA==",
+				"test_unencrypted": "dGVzdA==",
+				"empty":            "",
+			}
+			for key, value := range expected {
+				if data[key] != value {
+					t.Errorf("Expect %s=%v, got %v", key, value, data[key])
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptKeyGroupsUpstreamDecrypt(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	var identities []string
+	var recipients []config.UpdateKSopsRecipient
+
+	for i := 0; i < 3; i++ {
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		identities = append(identities, identity.String())
+		recipients = append(recipients, config.UpdateKSopsRecipient{
+			Type:      "age",
+			Recipient: identity.Recipient().String(),
+			KeyGroup:  i,
+		})
+	}
+
+	testCases := []struct {
+		Name       string
+		Threshold  int
+		Identities []string
+		Error      bool
+	}{
+		{Name: "threshold", Threshold: 2, Identities: []string{identities[0], identities[2]}},
+		{Name: "threshold not met", Threshold: 2, Identities: []string{identities[1]}, Error: true},
+		{Name: "default threshold", Identities: identities},
+		{Name: "default threshold not met", Identities: []string{identities[0], identities[2]}, Error: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			keyFile := filepath.Join(t.TempDir(), "keys.txt")
+			if err := os.WriteFile(keyFile, []byte(strings.Join(tc.Identities, "\n")+"\n"), 0o600); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			t.Setenv(upstreamAge.SopsAgeKeyFileEnv, keyFile)
+
+			encryptor := NewSopsEncryption(nil)
+			output, err := encryptor.Encrypt(testSecret,
+				config.UpdateKSopsSopsOptions{ShamirThreshold: tc.Threshold}, recipients...)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			data, _, err := upstreamDecrypt(output)
+			if tc.Error {
+				if err == nil {
+					t.Errorf("Expect upstream decryption error, got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected upstream decryption error: %v\n%s", err, output)
+			}
+
+			if data["test"] != "dGVzdA==" || data["empty"] != "" {
+				t.Errorf("Expect the decrypted data, got %#v", data)
+			}
+		})
+	}
+}
+
+// upstreamDecrypt decrypts the output by the upstream sops library the same
+// way as the sops decrypt command does, the MAC is verified, the data values
+// and comments are returned
+func upstreamDecrypt(output string) (data map[string]interface{}, comments []string, err error) {
+	file := stores.SopsFile{}
+	if err := yaml.Unmarshal([]byte(output), &file); err != nil {
+		return nil, nil, err
+	}
+
+	if file.Metadata == nil {
+		return nil, nil, fmt.Errorf("no sops metadata")
+	}
+
+	metadata, err := file.Metadata.ToInternal()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	n, err := yaml.Parse(output)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := n.Pipe(yaml.Clear("sops")); err != nil {
+		return nil, nil, err
+	}
+
+	branch, err := upstreamTreeBranch(n.YNode())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tree := upstream.Tree{
+		Branches: upstream.TreeBranches{branch},
+		Metadata: metadata,
+	}
+
+	dataKey, err := metadata.GetDataKeyWithKeyServices(
+		[]keyservice.KeyServiceClient{keyservice.NewLocalClient()}, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cipher := upstreamAES.NewCipher()
+	computedMac, err := tree.Decrypt(dataKey, cipher)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fileMac, err := cipher.Decrypt(metadata.MessageAuthenticationCode, dataKey,
+		metadata.LastModified.Format(time.RFC3339))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if fileMac != computedMac {
+		return nil, nil, fmt.Errorf("MAC mismatch, file has %s, computed %s", fileMac, computedMac)
+	}
+
+	data = map[string]interface{}{}
+	for _, item := range branch {
+		if item.Key != "data" {
+			continue
+		}
+
+		if values, ok := item.Value.(upstream.TreeBranch); ok {
+			for _, value := range values {
+				switch key := value.Key.(type) {
+				case string:
+					data[key] = value.Value
+				case upstream.Comment:
+					comments = append(comments, key.Value)
+				}
+			}
+		}
+	}
+
+	return data, comments, nil
+}
+
+// upstreamTreeBranch loads the mapping into the upstream tree, the comments
+// are the tree items the same as the upstream YAML store loads them
+func upstreamTreeBranch(n *yaml.Node) (branch upstream.TreeBranch, err error) {
+	branch = appendUpstreamComments(branch, n.HeadComment, n.LineComment)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		branch = appendUpstreamComments(branch, key.HeadComment, key.LineComment)
+
+		var treeValue interface{}
+		switch value.Kind {
+		case yaml.MappingNode:
+			if treeValue, err = upstreamTreeBranch(value); err != nil {
+				return nil, err
+			}
+		case yaml.ScalarNode:
+			branch = appendUpstreamComments(branch, value.HeadComment, value.LineComment)
+			if err := value.Decode(&treeValue); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported YAML node %s", key.Value)
+		}
+
+		branch = append(branch, upstream.TreeItem{Key: key.Value, Value: treeValue})
+		if value.Kind == yaml.ScalarNode {
+			branch = appendUpstreamComments(branch, value.FootComment)
+		}
+		branch = appendUpstreamComments(branch, key.FootComment)
+	}
+
+	return appendUpstreamComments(branch, n.FootComment), nil
+}
+
+func appendUpstreamComments(branch upstream.TreeBranch, comments ...string) upstream.TreeBranch {
+	for _, comment := range comments {
+		for _, line := range strings.Split(comment, "\n") {
+			if line != "" {
+				branch = append(branch, upstream.TreeItem{Key: upstream.Comment{Value: line[1:]}})
+			}
+		}
+	}
+
+	return branch
+}
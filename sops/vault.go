@@ -0,0 +1,114 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package sops
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+)
+
+const vaultRequestTimeout = 30 * time.Second
+
+// vaultTransit encrypts the data keys with the Vault transit engine, the
+// address and the token are read from the environment as sops does
+type vaultTransit struct {
+	client *http.Client
+}
+
+// vaultKey is the data key encrypted by the transit key of the vault
+type vaultKey struct {
+	address    string
+	enginePath string
+	keyName    string
+	enc        string
+}
+
+func newVaultTransit() *vaultTransit {
+	return &vaultTransit{client: &http.Client{Timeout: vaultRequestTimeout}}
+}
+
+// encrypt wraps the data key by the transit key of the vault recipient
+func (v *vaultTransit) encrypt(dataKey []byte, recipient string) (*vaultKey, error) {
+	enginePath, keyName, err := config.ParseVaultTransitKey(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	address := os.Getenv(config.VaultAddressEnv)
+	if address == "" {
+		return nil, fmt.Errorf("the Vault address is not set, the %s is required", config.VaultAddressEnv)
+	}
+
+	token := os.Getenv(config.VaultTokenEnv)
+	if token == "" {
+		return nil, fmt.Errorf("the Vault token is not set, the %s is required", config.VaultTokenEnv)
+	}
+
+	// The data key is base64 encoded as the transit plaintext, the same as sops
+	body, err := json.Marshal(map[string]string{
+		"plaintext": base64.StdEncoding.EncodeToString(dataKey),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/%s/encrypt/%s", strings.TrimSuffix(address, "/"), enginePath, keyName)
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("the Vault request error: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv(config.VaultNamespaceEnv); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("the Vault request error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("the Vault response read error: %w", err)
+	}
+
+	var result struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+		Errors []string `json:"errors"`
+	}
+
+	if err := json.Unmarshal(data, &result); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("the Vault response parse error: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the Vault transit encrypt returned %s: %s",
+			resp.Status, strings.Join(result.Errors, ", "))
+	}
+
+	if result.Data.Ciphertext == "" {
+		return nil, fmt.Errorf("the Vault transit encrypt returned no ciphertext")
+	}
+
+	return &vaultKey{
+		address:    address,
+		enginePath: enginePath,
+		keyName:    keyName,
+		enc:        result.Data.Ciphertext,
+	}, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2022 Neutron Soutmun <neutron@neutron.in.th>
+// SPDX-License-Identifier: Apache-2.0
+
+package sops
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/neutronth/kpt-update-ksops-secrets/config"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	testVaultToken            = "s.test-token"
+	testVaultCiphertextPrefix = "vault:v1:"
+)
+
+// newTestVaultServer is the stand-in of the Vault transit engine, the
+// ciphertext is the plaintext with the version prefix to be reversible
+func newTestVaultServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Header.Get("X-Vault-Token") != testVaultToken {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/transit/encrypt/sops" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+
+		var request struct {
+			Plaintext string `json:"plaintext"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]string{
+				"ciphertext": testVaultCiphertextPrefix + request.Plaintext,
+			},
+		})
+	}))
+}
+
+func TestEncryptVault(t *testing.T) {
+	server := newTestVaultServer(t)
+	defer server.Close()
+
+	t.Setenv(config.VaultAddressEnv, server.URL)
+	t.Setenv(config.VaultTokenEnv, testVaultToken)
+
+	encryptor := NewSopsEncryption(nil)
+	output, err := encryptor.Encrypt(testSecret, config.UpdateKSopsSopsOptions{}, config.UpdateKSopsRecipient{
+		Type:      "vault",
+		Recipient: "transit/keys/sops",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	n := yaml.MustParse(output)
+
+	for field, expected := range map[string]string{
+		"vault_address": server.URL,
+		"engine_path":   "transit",
+		"key_name":      "sops",
+	} {
+		if v, err := n.Pipe(yaml.Lookup("sops", "hc_vault", "0", field)); err != nil || v == nil || v.YNode().Value != expected {
+			t.Errorf("Expect the hc_vault %s %s, got\n%s", field, expected, output)
+		}
+	}
+
+	enc, err := n.Pipe(yaml.Lookup("sops", "hc_vault", "0", "enc"))
+	if err != nil || enc == nil || !strings.HasPrefix(enc.YNode().Value, testVaultCiphertextPrefix) {
+		t.Fatalf("Expect vault encrypted data key, got none\n%s", output)
+	}
+
+	dataKey, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(enc.YNode().Value, testVaultCiphertextPrefix))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	assertDecrypted(t, n, dataKey, map[string]string{
+		"test":  "dGVzdA==",
+		"empty": "",
+	})
+}
+
+func TestEncryptVaultErrors(t *testing.T) {
+	server := newTestVaultServer(t)
+	defer server.Close()
+
+	testCases := []struct {
+		Name      string
+		Address   string
+		Token     string
+		Recipient string
+		Expected  string
+	}{
+		{
+			Name:      "no address",
+			Token:     testVaultToken,
+			Recipient: "transit/keys/sops",
+			Expected:  "the VAULT_ADDR is required",
+		},
+		{
+			Name:      "no token",
+			Address:   server.URL,
+			Recipient: "transit/keys/sops",
+			Expected:  "the VAULT_TOKEN is required",
+		},
+		{
+			Name:      "permission denied",
+			Address:   server.URL,
+			Token:     "s.invalid",
+			Recipient: "transit/keys/sops",
+			Expected:  "403 Forbidden: permission denied",
+		},
+		{
+			Name:      "key not found",
+			Address:   server.URL,
+			Token:     testVaultToken,
+			Recipient: "transit/keys/unknown",
+			Expected:  "404 Not Found",
+		},
+	}
+
+	encryptor := NewSopsEncryption(nil)
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Setenv(config.VaultAddressEnv, tc.Address)
+			t.Setenv(config.VaultTokenEnv, tc.Token)
+
+			_, err := encryptor.Encrypt(testSecret, config.UpdateKSopsSopsOptions{}, config.UpdateKSopsRecipient{
+				Type:      "vault",
+				Recipient: tc.Recipient,
+			})
+			if err == nil {
+				t.Fatalf("Expect error, got none")
+			}
+
+			if !strings.Contains(err.Error(), tc.Expected) {
+				t.Errorf("Expect error contains %q, got %v", tc.Expected, err)
+			}
+
+			if strings.Contains(err.Error(), tc.Token) && tc.Token != "" {
+				t.Errorf("Expect the token not in the error, got %v", err)
+			}
+		})
+	}
+}